@@ -0,0 +1,220 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// candidate is a possible completion for a word.
+type candidate struct {
+	// insert is the shell text which replaces the word being completed.
+	insert string
+	// display is how the candidate is shown when listing ambiguous ones.
+	display string
+}
+
+// completeKeywords are the reserved words after which a command name follows.
+var completeKeywords = map[string]bool{
+	"!": true, "{": true, "do": true, "elif": true, "else": true,
+	"if": true, "then": true, "time": true, "until": true, "while": true,
+}
+
+// complete finds the candidates to complete the last word in a line of input,
+// returning the offset at which that word starts.
+//
+// A word in a command name position is completed with the names of aliases,
+// functions, builtins, keywords, and programs in $PATH. A word following a '$'
+// is completed with variable names. Any other word is completed with file
+// names, where directories are followed by a slash.
+func complete(r *interp.Runner, line string) (start int, cands []candidate) {
+	cmdPos, redir := true, false
+	wordStart := 0
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+			continue
+		case c == '\\':
+			i++
+			continue
+		case c == '\'' || c == '"':
+			quote = c
+			continue
+		case strings.IndexByte(" \t\n;&|()<>", c) < 0:
+			continue
+		}
+		// A separator, which ends the current word.
+		if word := line[wordStart:i]; word != "" && !redir {
+			cmdPos = cmdPos && (completeKeywords[word] || isAssign(word))
+		}
+		switch c {
+		case ' ', '\t':
+			if wordStart < i {
+				redir = false
+			}
+		case '<', '>':
+			redir = true
+		default:
+			cmdPos, redir = true, false
+		}
+		wordStart = i + 1
+	}
+	raw := line[wordStart:]
+	if i := strings.LastIndexByte(raw, '$'); i >= 0 && quote != '\'' {
+		if prefix, name, ok := varPrefix(raw[i+1:]); ok {
+			return wordStart + i, completeVars(r, prefix, name)
+		}
+	}
+	word := unquote(raw)
+	if cmdPos && !redir && !strings.Contains(word, "/") {
+		return wordStart, completeCmds(r, word)
+	}
+	return wordStart, completeFiles(r, word)
+}
+
+// isAssign reports whether a word is a variable assignment, like "foo=bar".
+func isAssign(word string) bool {
+	i := strings.IndexByte(word, '=')
+	return i > 0 && syntax.ValidName(strings.TrimSuffix(word[:i], "+"))
+}
+
+// varPrefix splits the text following a '$' into the opening of the parameter,
+// either "${" or "$", and the start of a variable name.
+func varPrefix(s string) (prefix, name string, ok bool) {
+	prefix = "$"
+	if strings.HasPrefix(s, "{") {
+		prefix, s = "${", s[1:]
+	}
+	if s != "" && !syntax.ValidName(s) {
+		return "", "", false
+	}
+	return prefix, s, true
+}
+
+// unquote removes the quotes and backslashes from a word being typed.
+func unquote(raw string) string {
+	var sb strings.Builder
+	var quote byte
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		switch {
+		case quote == '\'' && c == '\'', quote == '"' && c == '"':
+			quote = 0
+			continue
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+			continue
+		case c == '\\' && quote != '\'' && i+1 < len(raw):
+			i++
+			c = raw[i]
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// escape backslash-quotes the characters in s which the shell would interpret.
+func escape(s string) string {
+	var sb strings.Builder
+	for i, r := range s {
+		if strings.ContainsRune(" \t\n\\'\"$`&;|()<>*?[]!{}", r) || (r == '#' && i == 0) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// compgen runs the compgen builtin in a subshell, returning the names it
+// prints, sorted and without duplicates.
+func compgen(r *interp.Runner, flag, word string) []string {
+	prog, err := syntax.NewParser().Parse(strings.NewReader(
+		"compgen "+flag+" -- "+syntax.Quote(word)), "")
+	if err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	sub := r.Subshell()
+	interp.StdIO(nil, &buf, ioutil.Discard)(sub)
+	sub.Run(context.Background(), prog)
+	seen := make(map[string]bool)
+	var names []string
+	for _, name := range strings.Split(buf.String(), "\n") {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func completeCmds(r *interp.Runner, word string) []candidate {
+	var cands []candidate
+	for _, name := range compgen(r, "-c", word) {
+		cands = append(cands, candidate{insert: escape(name), display: name})
+	}
+	return cands
+}
+
+func completeVars(r *interp.Runner, prefix, word string) []candidate {
+	suffix := ""
+	if prefix == "${" {
+		suffix = "}"
+	}
+	var cands []candidate
+	for _, name := range compgen(r, "-v", word) {
+		cands = append(cands, candidate{insert: prefix + name + suffix, display: name})
+	}
+	return cands
+}
+
+func completeFiles(r *interp.Runner, word string) []candidate {
+	var cands []candidate
+	for _, name := range compgen(r, "-f", word) {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(r.Dir, path)
+		}
+		display := name[strings.LastIndexByte(name, '/')+1:]
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			name += "/"
+			display += "/"
+		}
+		cands = append(cands, candidate{insert: escape(name), display: display})
+	}
+	return cands
+}
+
+// commonPrefix returns the longest prefix shared by the text of all candidates.
+func commonPrefix(cands []candidate) string {
+	if len(cands) == 0 {
+		return ""
+	}
+	prefix := cands[0].insert
+	for _, cand := range cands[1:] {
+		i := 0
+		for i < len(prefix) && i < len(cand.insert) && prefix[i] == cand.insert[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	return prefix
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+// lineEditor reads lines of input typed at a terminal, one key at a time. It
+// echoes the typed characters itself, which allows erasing them and completing
+// words with the tab key.
+type lineEditor struct {
+	r   *interp.Runner
+	in  io.Reader
+	out io.Writer
+
+	// cbreak, if not nil, sets up the terminal to read keys one at a time
+	// without echoing them. It returns a func to restore the previous mode.
+	cbreak func() (restore func(), err error)
+
+	// plain, if not nil, reads whole lines without editing them, as typed
+	// and echoed by the terminal itself. It's used when cbreak fails, such
+	// as on platforms where it isn't supported.
+	plain *bufio.Reader
+
+	// prompt is the prompt printed before the line being edited, so that
+	// it can be printed again after listing completion candidates.
+	prompt string
+
+	buf []byte // line which wasn't read yet
+	err error  // read error to return once buf is empty
+}
+
+// errInterrupted is returned when Ctrl-C is pressed while editing a line.
+var errInterrupted = errors.New("interrupted")
+
+// The keys handled by lineEditor, besides printable characters.
+const (
+	keyInterrupt = 0x03 // Ctrl-C
+	keyEOF       = 0x04 // Ctrl-D
+	keyBackspace = 0x08 // Ctrl-H
+	keyTab       = '\t'
+	keyKill      = 0x15 // Ctrl-U
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+func (ed *lineEditor) Read(p []byte) (int, error) {
+	if len(ed.buf) == 0 {
+		if ed.err != nil {
+			return 0, ed.err
+		}
+		line, err := ed.readLine()
+		if line == "" {
+			// Don't keep errInterrupted, so that reading can continue.
+			return 0, err
+		}
+		ed.buf, ed.err = []byte(line), err
+	}
+	n := copy(p, ed.buf)
+	ed.buf = ed.buf[n:]
+	return n, nil
+}
+
+// readLine reads and edits a line until the enter key is pressed, returning
+// the line with its trailing newline. If Ctrl-C is pressed, the line is
+// discarded and errInterrupted is returned.
+func (ed *lineEditor) readLine() (string, error) {
+	if ed.plain == nil && ed.cbreak != nil {
+		restore, err := ed.cbreak()
+		if err != nil {
+			ed.plain = bufio.NewReader(ed.in)
+		} else {
+			defer restore()
+		}
+	}
+	if ed.plain != nil {
+		return ed.plain.ReadString('\n')
+	}
+	var line []byte
+	key := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(ed.in, key); err != nil {
+			return string(line), err
+		}
+		switch c := key[0]; c {
+		case '\r', '\n':
+			fmt.Fprint(ed.out, "\n")
+			return string(line) + "\n", nil
+		case keyInterrupt:
+			fmt.Fprint(ed.out, "^C\n")
+			return "", errInterrupted
+		case keyEOF:
+			if len(line) == 0 {
+				fmt.Fprint(ed.out, "\n")
+				return "", io.EOF
+			}
+		case keyBackspace, keyDelete:
+			line = ed.erase(line, 1)
+		case keyKill:
+			line = ed.erase(line, len(line))
+		case keyTab:
+			line = ed.complete(line)
+		case keyEscape:
+			// Ignore escape sequences, such as arrow keys.
+			if err := ed.skipEscape(); err != nil {
+				return string(line), err
+			}
+		default:
+			if c < ' ' {
+				break // other control characters
+			}
+			line = append(line, c)
+			ed.out.Write(key)
+		}
+	}
+}
+
+// erase removes up to n characters from the end of the line, both from the
+// screen and from the line itself.
+func (ed *lineEditor) erase(line []byte, n int) []byte {
+	for ; n > 0 && len(line) > 0; n-- {
+		_, size := utf8.DecodeLastRune(line)
+		line = line[:len(line)-size]
+		fmt.Fprint(ed.out, "\b \b")
+	}
+	return line
+}
+
+// skipEscape consumes the rest of an escape sequence such as "\x1b[A", which
+// ends with a byte in the range from '@' to '~'.
+func (ed *lineEditor) skipEscape() error {
+	key := make([]byte, 1)
+	if _, err := io.ReadFull(ed.in, key); err != nil {
+		return err
+	}
+	if key[0] != '[' && key[0] != 'O' {
+		return nil
+	}
+	for {
+		if _, err := io.ReadFull(ed.in, key); err != nil {
+			return err
+		}
+		if key[0] >= '@' && key[0] <= '~' {
+			return nil
+		}
+	}
+}
+
+// complete completes the last word in the line. A single candidate replaces
+// the word, followed by a space unless it's a directory. With many candidates,
+// the word is extended to their common prefix; if that's not possible, they
+// are listed.
+func (ed *lineEditor) complete(line []byte) []byte {
+	start, cands := complete(ed.r, string(line))
+	word := string(line[start:])
+	var insert string
+	switch len(cands) {
+	case 0:
+		fmt.Fprint(ed.out, "\a")
+		return line
+	case 1:
+		insert = cands[0].insert
+		if !strings.HasSuffix(insert, "/") {
+			insert += " "
+		}
+	default:
+		insert = commonPrefix(cands)
+		if len(unquote(insert)) <= len(unquote(word)) {
+			ed.list(cands)
+			fmt.Fprintf(ed.out, "%s%s", ed.prompt, line)
+			return line
+		}
+	}
+	if strings.HasPrefix(insert, word) {
+		insert = insert[len(word):]
+	} else {
+		line = ed.erase(line, utf8.RuneCountInString(word))
+	}
+	fmt.Fprint(ed.out, insert)
+	return append(line, insert...)
+}
+
+// list prints completion candidates on the lines below the one being edited,
+// in as many columns as fit in a terminal 80 characters wide.
+func (ed *lineEditor) list(cands []candidate) {
+	width := 0
+	for _, cand := range cands {
+		if n := utf8.RuneCountInString(cand.display); n > width {
+			width = n
+		}
+	}
+	width += 2
+	columns := 80 / width
+	if columns < 1 {
+		columns = 1
+	}
+	fmt.Fprint(ed.out, "\n")
+	for i, cand := range cands {
+		if i%columns == columns-1 || i == len(cands)-1 {
+			fmt.Fprintf(ed.out, "%s\n", cand.display)
+		} else {
+			fmt.Fprintf(ed.out, "%-*s", width, cand.display)
+		}
+	}
+}
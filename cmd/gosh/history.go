@@ -0,0 +1,396 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+// history holds the commands entered in an interactive shell. It implements
+// history expansion, such as "!!", and the fc builtin on top of them.
+type history struct {
+	entries []string
+
+	// pending holds the lines of the command being entered, which is
+	// added to the entries once complete.
+	pending strings.Builder
+
+	// rerun holds the commands queued by fc, to be run once the statement
+	// which ran fc is done.
+	rerun []string
+}
+
+// commit adds the command entered so far to the history, unless it's empty.
+func (h *history) commit() {
+	cmd := strings.TrimRight(h.pending.String(), "\n")
+	h.pending.Reset()
+	if strings.TrimSpace(cmd) != "" {
+		h.entries = append(h.entries, cmd)
+	}
+}
+
+// event returns the history entry matching an event designator, without its
+// leading '!'. It can be "!" for the last entry, a number for an absolute
+// entry, a negative number for a relative entry, "?str?" for the last entry
+// containing a string, or any other string for the last entry starting with it.
+func (h *history) event(spec string) (string, bool) {
+	if spec == "!" {
+		spec = "-1"
+	}
+	if strings.HasPrefix(spec, "?") {
+		sub := strings.TrimSuffix(spec[1:], "?")
+		for i := len(h.entries) - 1; i >= 0; i-- {
+			if strings.Contains(h.entries[i], sub) {
+				return h.entries[i], true
+			}
+		}
+		return "", false
+	}
+	i, ok := historyIndex(h.entries, spec)
+	if !ok {
+		return "", false
+	}
+	return h.entries[i], true
+}
+
+// expand performs history expansion on a line of input, reporting whether any
+// expansion happened. Like in Bash, there is no expansion within single
+// quotes, after a backslash, or when '!' is followed by a blank, '=', or '('.
+func (h *history) expand(line string) (string, bool, error) {
+	var sb strings.Builder
+	expanded := false
+	inSingle, inDouble := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && !inSingle && i+1 < len(line):
+			sb.WriteByte(c)
+			i++
+			sb.WriteByte(line[i])
+			continue
+		case c == '\'' && !inDouble:
+			inSingle = !inSingle
+		case c == '"' && !inSingle:
+			inDouble = !inDouble
+		case c == '!' && !inSingle:
+			spec := eventSpec(line[i+1:])
+			// Leave "$!" and "${!name}" alone.
+			after := strings.HasSuffix(line[:i], "$") || strings.HasSuffix(line[:i], "${")
+			if spec == "" || after {
+				break
+			}
+			entry, ok := h.event(spec)
+			if !ok {
+				return "", false, fmt.Errorf("!%s: event not found", spec)
+			}
+			sb.WriteString(entry)
+			i += len(spec)
+			expanded = true
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String(), expanded, nil
+}
+
+// eventSpec returns the event designator at the start of s, which follows a
+// '!'. It returns an empty string if there is none.
+func eventSpec(s string) string {
+	if s == "" {
+		return ""
+	}
+	switch c := s[0]; {
+	case c == '!':
+		return "!"
+	case c == '?':
+		if i := strings.IndexAny(s[1:], "?\n"); i >= 0 {
+			if s[1+i] == '?' {
+				return s[:i+2]
+			}
+			return s[:i+1]
+		}
+		return s
+	case c == '-' || (c >= '0' && c <= '9'):
+		i := 1
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if c == '-' && i == 1 {
+			break // just "!-"
+		}
+		return s[:i]
+	case strings.IndexByte(" \t\n=(", c) >= 0:
+		return ""
+	}
+	if i := strings.IndexAny(s, " \t\n;&|()<>\"'`"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// historyReader reads input one line at a time, performing history expansion
+// on each line and recording it as part of the pending command.
+type historyReader struct {
+	h      *history
+	r      *bufio.Reader
+	stderr io.Writer
+
+	buf []byte // expanded input which wasn't read yet
+	err error  // read error to return once buf is empty
+}
+
+func newHistoryReader(h *history, r io.Reader, stderr io.Writer) *historyReader {
+	return &historyReader{h: h, r: bufio.NewReader(r), stderr: stderr}
+}
+
+func (hr *historyReader) Read(p []byte) (int, error) {
+	if len(hr.buf) == 0 {
+		if hr.err != nil {
+			return 0, hr.err
+		}
+		line, err := hr.r.ReadString('\n')
+		if line == "" {
+			return 0, err
+		}
+		hr.err = err
+		expanded, changed, expErr := hr.h.expand(line)
+		switch {
+		case expErr != nil:
+			// Like Bash, discard the line.
+			fmt.Fprintln(hr.stderr, expErr)
+			expanded = "\n"
+		case changed:
+			// Like Bash, show the line that will be run.
+			fmt.Fprint(hr.stderr, expanded)
+			if !strings.HasSuffix(expanded, "\n") {
+				fmt.Fprintln(hr.stderr)
+			}
+			fallthrough
+		default:
+			hr.h.pending.WriteString(expanded)
+		}
+		hr.buf = []byte(expanded)
+	}
+	n := copy(p, hr.buf)
+	hr.buf = hr.buf[n:]
+	return n, nil
+}
+
+// execHandler returns an ExecHandlerFunc which implements the fc builtin,
+// running any other program via next.
+func (h *history) execHandler(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	return func(ctx context.Context, args []string) error {
+		if args[0] != "fc" {
+			return next(ctx, args)
+		}
+		return h.fc(ctx, next, args[1:])
+	}
+}
+
+const fcUsage = "fc: usage: fc [-e ename] [-lnr] [first] [last] or fc -s [pat=rep] [command]"
+
+// fc implements the fc builtin, which lists, edits, or re-runs commands from
+// the history.
+func (h *history) fc(ctx context.Context, next interp.ExecHandlerFunc, args []string) error {
+	hc := interp.HandlerCtx(ctx)
+	list, numbers, reverse, rerun := false, true, false, false
+	editor := ""
+opts:
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		flags := args[0][1:]
+		if _, err := strconv.Atoi(flags); err == nil {
+			break // a negative number, such as "fc -l -2"
+		}
+		args = args[1:]
+		if flags == "-" {
+			break
+		}
+		for i, c := range flags {
+			switch c {
+			case 'l':
+				list = true
+			case 'n':
+				numbers = false
+			case 'r':
+				reverse = true
+			case 's':
+				rerun = true
+			case 'e':
+				if rest := flags[i+1:]; rest != "" {
+					editor = rest
+				} else if len(args) > 0 {
+					editor, args = args[0], args[1:]
+				} else {
+					fmt.Fprintln(hc.Stderr, "fc: -e: option requires an argument")
+					fmt.Fprintln(hc.Stderr, fcUsage)
+					return interp.NewExitStatus(2)
+				}
+				continue opts
+			default:
+				fmt.Fprintf(hc.Stderr, "fc: -%c: invalid option\n", c)
+				fmt.Fprintln(hc.Stderr, fcUsage)
+				return interp.NewExitStatus(2)
+			}
+		}
+	}
+	if editor == "-" {
+		rerun = true
+	}
+
+	// The command running fc is already in the history, but it's not one
+	// of the commands that fc can refer to.
+	past := h.entries
+	if len(past) > 0 {
+		past = past[:len(past)-1]
+	}
+	if rerun {
+		var old, new string
+		if len(args) > 0 {
+			if i := strings.IndexByte(args[0], '='); i >= 0 {
+				old, new = args[0][:i], args[0][i+1:]
+				args = args[1:]
+			}
+		}
+		spec := "-1"
+		if len(args) > 0 {
+			spec = args[0]
+		}
+		i, ok := historyIndex(past, spec)
+		if !ok {
+			fmt.Fprintln(hc.Stderr, "fc: no command found")
+			return interp.NewExitStatus(1)
+		}
+		cmd := past[i]
+		if old != "" {
+			cmd = strings.Replace(cmd, old, new, -1)
+		}
+		h.queue(hc.Stderr, cmd)
+		return nil
+	}
+
+	if len(past) == 0 {
+		if list {
+			return nil
+		}
+		fmt.Fprintln(hc.Stderr, "fc: no command found")
+		return interp.NewExitStatus(1)
+	}
+	// By default, list the last 16 commands, or edit the last one.
+	start, end := len(past)-1, len(past)-1
+	if list {
+		if start = len(past) - 16; start < 0 {
+			start = 0
+		}
+	}
+	if len(args) > 0 {
+		var ok bool
+		if start, ok = historyIndex(past, args[0]); !ok {
+			fmt.Fprintln(hc.Stderr, "fc: history specification out of range")
+			return interp.NewExitStatus(1)
+		}
+		if !list {
+			end = start
+		}
+	}
+	if len(args) > 1 {
+		var ok bool
+		if end, ok = historyIndex(past, args[1]); !ok {
+			fmt.Fprintln(hc.Stderr, "fc: history specification out of range")
+			return interp.NewExitStatus(1)
+		}
+	}
+	if start > end {
+		start, end = end, start
+		reverse = !reverse
+	}
+	indexes := make([]int, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		if reverse {
+			indexes = append(indexes, start+end-i)
+		} else {
+			indexes = append(indexes, i)
+		}
+	}
+
+	if list {
+		for _, i := range indexes {
+			if numbers {
+				fmt.Fprintf(hc.Stdout, "%d", i+1)
+			}
+			fmt.Fprintf(hc.Stdout, "\t %s\n", past[i])
+		}
+		return nil
+	}
+
+	if editor == "" {
+		editor = hc.Env.Get("FCEDIT").String()
+	}
+	if editor == "" {
+		editor = hc.Env.Get("EDITOR").String()
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	f, err := ioutil.TempFile("", "gosh-fc-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	for _, i := range indexes {
+		fmt.Fprintln(f, past[i])
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := next(ctx, append(strings.Fields(editor), f.Name())); err != nil {
+		return err
+	}
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if cmd := strings.TrimRight(string(edited), "\n"); strings.TrimSpace(cmd) != "" {
+		h.queue(hc.Stderr, cmd)
+	}
+	return nil
+}
+
+// historyIndex returns the index of the entry matching a fc argument, which
+// can be a positive or negative number, or the prefix of a command.
+func historyIndex(entries []string, spec string) (int, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 0 {
+			n += len(entries) + 1
+		}
+		if n < 1 || n > len(entries) {
+			return 0, false
+		}
+		return n - 1, true
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if strings.HasPrefix(entries[i], spec) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// queue makes a command run once the running statement is done. Like in Bash,
+// the command is printed, and it replaces fc in the history.
+func (h *history) queue(stderr io.Writer, cmd string) {
+	fmt.Fprintln(stderr, cmd)
+	h.rerun = append(h.rerun, cmd)
+	if len(h.entries) > 0 {
+		h.entries[len(h.entries)-1] = cmd
+	}
+}
@@ -9,7 +9,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/term"
 
@@ -17,10 +22,42 @@ import (
 	"mvdan.cc/sh/v3/syntax"
 )
 
-var command = flag.String("c", "", "command to be executed")
+var (
+	command     = flag.String("c", "", "command to be executed")
+	interactive = flag.Bool("i", false, "run an interactive shell even if stdin isn't a terminal")
+
+	xtrace  = flag.Bool("x", false, "print commands as they are run, like set -x")
+	errexit = flag.Bool("e", false, "exit if a command fails, like set -e")
+	nounset = flag.Bool("u", false, "fail on unset variables, like set -u")
+
+	dumpAST = flag.Bool("ast", false, "print the syntax tree instead of running the program")
+	options optionList
+
+	showVersion = flag.Bool("version", false, "show version and exit")
+
+	version = "(devel)" // to match the default from runtime/debug
+)
+
+func init() {
+	flag.Var(&options, "o", "enable a shell option by name, like set -o")
+}
+
+// optionList collects the values of a flag which can be given multiple times.
+type optionList []string
+
+func (l *optionList) String() string { return strings.Join(*l, ",") }
+
+func (l *optionList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
 
 func main() {
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
 	err := runAll()
 	if e, ok := interp.IsExitStatus(err); ok {
 		os.Exit(int(e))
@@ -31,8 +68,41 @@ func main() {
 	}
 }
 
+// versionString returns the version of gosh, followed by the version of Go it
+// was built with.
+func versionString() string {
+	v := version
+	// don't overwrite the version if it was set by -ldflags=-X
+	if info, ok := debug.ReadBuildInfo(); ok && v == "(devel)" {
+		mod := &info.Main
+		if mod.Replace != nil {
+			mod = mod.Replace
+		}
+		if mod.Version != "" {
+			v = mod.Version
+		}
+	}
+	return v + " " + runtime.Version()
+}
+
 func runAll() error {
-	r, err := interp.New(interp.StdIO(os.Stdin, os.Stdout, os.Stderr))
+	var params []string
+	if *xtrace {
+		params = append(params, "-x")
+	}
+	if *errexit {
+		params = append(params, "-e")
+	}
+	if *nounset {
+		params = append(params, "-u")
+	}
+	for _, name := range options {
+		params = append(params, "-o", name)
+	}
+	r, err := interp.New(
+		interp.StdIO(os.Stdin, os.Stdout, os.Stderr),
+		interp.Params(params...),
+	)
 	if err != nil {
 		return err
 	}
@@ -41,7 +111,7 @@ func runAll() error {
 		return run(r, strings.NewReader(*command), "")
 	}
 	if flag.NArg() == 0 {
-		if term.IsTerminal(int(os.Stdin.Fd())) {
+		if !*dumpAST && (*interactive || term.IsTerminal(int(os.Stdin.Fd()))) {
 			return runInteractive(r, os.Stdin, os.Stdout, os.Stderr)
 		}
 		return run(r, os.Stdin, "")
@@ -55,10 +125,17 @@ func runAll() error {
 }
 
 func run(r *interp.Runner, reader io.Reader, name string) error {
-	prog, err := syntax.NewParser().Parse(reader, name)
+	prog, err := syntax.NewParser(syntax.Variant(syntax.LangAuto)).Parse(reader, name)
 	if err != nil {
 		return err
 	}
+	if *dumpAST {
+		if err := syntax.DebugPrint(os.Stdout, prog); err != nil {
+			return err
+		}
+		_, err := fmt.Println()
+		return err
+	}
 	r.Reset()
 	ctx := context.Background()
 	return r.Run(ctx, prog)
@@ -75,25 +152,133 @@ func runPath(r *interp.Runner, path string) error {
 
 func runInteractive(r *interp.Runner, stdin io.Reader, stdout, stderr io.Writer) error {
 	parser := syntax.NewParser()
-	fmt.Fprintf(stdout, "$ ")
-	var runErr error
-	fn := func(stmts []*syntax.Stmt) bool {
-		if parser.Incomplete() {
-			fmt.Fprintf(stdout, "> ")
-			return true
+	// Like Bash, expand aliases in interactive shells.
+	if prog, err := parser.Parse(strings.NewReader("shopt -s expand_aliases"), ""); err == nil {
+		r.Run(context.Background(), prog)
+	}
+	interp.Interactive(true)(r)
+	hist := &history{}
+	interp.ExecHandler(hist.execHandler(interp.DefaultExecHandler(2 * time.Second)))(r)
+	var input io.Reader = stdin
+	var editor *lineEditor
+	if f, ok := stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		editor = &lineEditor{r: r, in: f, out: stdout}
+		editor.cbreak = func() (func(), error) { return cbreak(int(f.Fd())) }
+		input = editor
+	}
+	prompt := func(s string) {
+		fmt.Fprint(stdout, s)
+		if editor != nil {
+			editor.prompt = s
 		}
-		ctx := context.Background()
+	}
+	// Like other shells, Ctrl-C interrupts the running command, or discards
+	// the input typed so far, instead of stopping the shell.
+	var intr interrupter
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt)
+	done := make(chan struct{})
+	defer func() {
+		signal.Stop(sigc)
+		close(done)
+	}()
+	go func() {
+		for {
+			select {
+			case <-sigc:
+				intr.interrupt()
+			case <-done:
+				return
+			}
+		}
+	}()
+	prompt("$ ")
+	var runErr error
+	var runStmts func(ctx context.Context, stmts []*syntax.Stmt) bool
+	runStmts = func(ctx context.Context, stmts []*syntax.Stmt) bool {
 		for _, stmt := range stmts {
 			runErr = r.Run(ctx, stmt)
 			if r.Exited() {
 				return false
 			}
+			// Run any commands queued by fc.
+			for len(hist.rerun) > 0 {
+				cmd := hist.rerun[0]
+				hist.rerun = hist.rerun[1:]
+				prog, err := syntax.NewParser().Parse(strings.NewReader(cmd), "")
+				if err != nil {
+					fmt.Fprintln(stderr, err)
+					continue
+				}
+				if !runStmts(ctx, prog.Stmts) {
+					return false
+				}
+			}
 		}
-		fmt.Fprintf(stdout, "$ ")
 		return true
 	}
-	if err := parser.Interactive(stdin, fn); err != nil {
-		return err
+	fn := func(stmts []*syntax.Stmt) bool {
+		if parser.Incomplete() {
+			prompt("> ")
+			return true
+		}
+		hist.commit()
+		ok := runStmts(intr.start(), stmts)
+		intr.stop()
+		if status, _ := interp.IsExitStatus(runErr); status == 130 {
+			// Like Bash, end the line where "^C" was echoed.
+			fmt.Fprintln(stdout)
+		}
+		if !ok {
+			return false
+		}
+		prompt("$ ")
+		return true
+	}
+	input = newHistoryReader(hist, input, stderr)
+	for {
+		err := parser.Interactive(input, fn)
+		if err != errInterrupted {
+			if err != nil {
+				return err
+			}
+			return runErr
+		}
+		// Start over with a fresh parser state and prompt.
+		hist.pending.Reset()
+		prompt("$ ")
+	}
+}
+
+// interrupter cancels the context of the command being run by an interactive
+// shell once SIGINT is received.
+type interrupter struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// start returns the context to run a command with.
+func (in *interrupter) start() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	in.mu.Lock()
+	in.cancel = cancel
+	in.mu.Unlock()
+	return ctx
+}
+
+// stop releases the context returned by start.
+func (in *interrupter) stop() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.cancel()
+	in.cancel = nil
+}
+
+// interrupt cancels the running command, if any. Otherwise, it does nothing.
+func (in *interrupter) interrupt() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.cancel != nil {
+		in.cancel()
 	}
-	return runErr
 }
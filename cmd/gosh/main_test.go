@@ -7,8 +7,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 
+	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/interp"
 )
 
@@ -104,7 +109,7 @@ var interactiveTests = []struct {
 	},
 	{
 		pairs: []string{
-			"echo foo |\n",
+			"shopt -s lastpipe; echo foo |\n",
 			"> ",
 			"read var; echo $var\n",
 			"foo\n",
@@ -164,6 +169,74 @@ var interactiveTests = []struct {
 		},
 		wantErr: "1:1: reached EOF without matching ( with )",
 	},
+	{
+		pairs: []string{
+			"echo foo\n",
+			"foo\n$ ",
+			"echo !!\n",
+			"echo echo foo\necho foo\n$ ",
+			"echo !-2 !ec '!!' \\!!\n",
+			"echo echo foo echo echo foo '!!' \\!!\necho foo echo echo foo !! !!\n$ ",
+			"fc -l\n",
+			"1\t echo foo\n2\t echo echo foo\n3\t echo echo foo echo echo foo '!!' \\!!\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo !nope\n",
+			"!nope: event not found\n$ ",
+			"a=b; b=c; echo ${!a} !\n",
+			"c !\n$ ",
+			"fc -l\n",
+			"1\t a=b; b=c; echo ${!a} !\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo foo; echo bar\n",
+			"foo\nbar\n$ ",
+			"fc -s bar=baz\n",
+			"echo foo; echo baz\nfoo\nbaz\n$ ",
+			// Don't let the editor read the shell's input.
+			"fc -e true </dev/null\n",
+			"echo foo; echo baz\nfoo\nbaz\n$ ",
+			"fc -ln 1 -1\n",
+			"\t echo foo; echo bar\n\t echo foo; echo baz\n\t echo foo; echo baz\n$ ",
+			"fc -lr 2 1\n",
+			"1\t echo foo; echo bar\n2\t echo foo; echo baz\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"if true; then\n",
+			"> ",
+			"echo foo; fi\n",
+			"foo\n$ ",
+			"fc -l\n",
+			"1\t if true; then\necho foo; fi\n$ ",
+			"fc -x\n",
+			"fc: -x: invalid option\n" + fcUsage + "\n$ ",
+		},
+		wantErr: "exit status 2",
+	},
+	{
+		pairs: []string{
+			"alias ll='echo ls -l '; alias dir=/tmp\n",
+			"$ ",
+			"ll dir\n",
+			"ls -l /tmp\n$ ",
+		},
+	},
+	{
+		pairs: []string{
+			"echo ${a:?msg}; echo next\n",
+			"a: msg\nnext\n$ ",
+			"set -u; echo $nope\n",
+			"nope: unbound variable\n$ ",
+			"echo after $?\n",
+			"after 1\n$ ",
+		},
+	},
 }
 
 func TestInteractive(t *testing.T) {
@@ -214,6 +287,16 @@ func TestInteractive(t *testing.T) {
 	}
 }
 
+func TestVersion(t *testing.T) {
+	t.Parallel()
+	// Test binaries have no module version, and the version isn't set via
+	// -ldflags either.
+	got := versionString()
+	if want := "(devel) " + runtime.Version(); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
 func TestInteractiveExit(t *testing.T) {
 	inReader, inWriter := io.Pipe()
 	defer inReader.Close()
@@ -225,6 +308,44 @@ func TestInteractiveExit(t *testing.T) {
 	}
 }
 
+func TestInteractiveInterrupt(t *testing.T) {
+	// Not parallel, as SIGINT is sent to the whole test process.
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	inReader, inWriter := io.Pipe()
+	outReader, outWriter := io.Pipe()
+	runner, _ := interp.New(interp.StdIO(inReader, outWriter, outWriter))
+	errc := make(chan error, 1)
+	go func() {
+		errc <- runInteractive(runner, inReader, outWriter, outWriter)
+	}()
+	if err := readString(outReader, "$ "); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(inWriter, "echo start; while true; do :; done\n")
+	if err := readString(outReader, "start\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(os.Interrupt); err != nil {
+		t.Skipf("cannot send SIGINT: %v", err)
+	}
+	if err := readString(outReader, "\n$ "); err != nil {
+		t.Fatal(err)
+	}
+	// Like Bash, the interrupted command's status is 130.
+	io.WriteString(inWriter, "echo $?\n")
+	if err := readString(outReader, "130\n$ "); err != nil {
+		t.Fatal(err)
+	}
+	inWriter.Close()
+	outReader.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 // readString will keep reading from a reader until all bytes from the supplied
 // string are read.
 func readString(r io.Reader, want string) error {
@@ -239,3 +360,124 @@ func readString(r io.Reader, want string) error {
 	}
 	return nil
 }
+
+func TestComplete(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "gosh-complete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"bin/", "sub/", "sub/deep/", "alpha1", "alpha2", "be ta"} {
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, "/") {
+			err = os.MkdirAll(path, 0o777)
+		} else {
+			err = ioutil.WriteFile(path, nil, 0o666)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "goshtestprog"), nil, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	runner, _ := interp.New(
+		interp.Dir(dir),
+		interp.Env(expand.ListEnviron("PATH="+filepath.Join(dir, "bin"), "GOSHVAR1=x", "GOSHVAR2=y")),
+	)
+
+	tests := []struct {
+		line  string
+		start int
+		want  []string
+	}{
+		{"ech", 0, []string{"echo"}},
+		{"goshtest", 0, []string{"goshtestprog"}},
+		{"echo foo; goshtest", 10, []string{"goshtestprog"}},
+		{"if goshtest", 3, []string{"goshtestprog"}},
+		{"A=b goshtest", 4, []string{"goshtestprog"}},
+		{"echo goshtest", 5, nil},
+		{"cat al", 4, []string{"alpha1", "alpha2"}},
+		{"cat b", 4, []string{"be\\ ta", "bin/"}},
+		{"cat 'be", 4, []string{"be\\ ta"}},
+		{"cat be\\ ", 4, []string{"be\\ ta"}},
+		{"ls su", 3, []string{"sub/"}},
+		{"ls sub/", 3, []string{"sub/deep/"}},
+		{"./su", 0, []string{"./sub/"}},
+		{"echo >al", 6, []string{"alpha1", "alpha2"}},
+		{"echo $GOSHV", 5, []string{"$GOSHVAR1", "$GOSHVAR2"}},
+		{"echo foo${GOSHVAR", 8, []string{"${GOSHVAR1}", "${GOSHVAR2}"}},
+		{"echo 'a $GOSHV", 5, nil},
+		{"cat nosuch", 4, nil},
+	}
+	for _, tc := range tests {
+		start, cands := complete(runner, tc.line)
+		var got []string
+		for _, cand := range cands {
+			got = append(got, cand.insert)
+		}
+		if start != tc.start || fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+			t.Errorf("complete(%q) got %d %q, want %d %q",
+				tc.line, start, got, tc.start, tc.want)
+		}
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	t.Parallel()
+	runner, _ := interp.New(interp.Env(expand.ListEnviron("PATH=", "GOSHVAR=x")))
+	tests := []struct {
+		keys, line, out string
+	}{
+		{"echo foo\r", "echo foo\n", "echo foo\n"},
+		{"echo fooo\x7f\r", "echo foo\n", "echo fooo\b \b\n"},
+		{"foo\x15bar\n", "bar\n", "foo\b \b\b \b\b \bbar\n"},
+		{"ech\tfoo\r", "echo foo\n", "echo foo\n"},
+		{"x $GOSHV\t\r", "x $GOSHVAR \n", "x $GOSHVAR \n"},
+		{"x\x1b[Dy\r", "xy\n", "xy\n"},
+		{"nosuchcmd\t\r", "nosuchcmd\n", "nosuchcmd\a\n"},
+		{"tr\t\r", "tr\n", "tr\ntrap  true\n$ tr\n"},
+		{"echo fo\x03", "", "echo fo^C\n"},
+	}
+	for _, tc := range tests {
+		var out strings.Builder
+		editor := &lineEditor{r: runner, in: strings.NewReader(tc.keys), out: &out, prompt: "$ "}
+		line, err := editor.readLine()
+		if line == "" && err == errInterrupted {
+			err = nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != tc.line || out.String() != tc.out {
+			t.Errorf("keys %q got line %q and output %q, want %q and %q",
+				tc.keys, line, out.String(), tc.line, tc.out)
+		}
+	}
+}
+
+func TestLineEditorNoCbreak(t *testing.T) {
+	t.Parallel()
+	var out strings.Builder
+	editor := &lineEditor{in: strings.NewReader("echo fooo\x7f\nexit\n"), out: &out}
+	editor.cbreak = func() (func(), error) {
+		return nil, fmt.Errorf("line editing is not supported on this platform")
+	}
+	// Without line editing, the lines are read as typed.
+	for _, want := range []string{"echo fooo\x7f\n", "exit\n"} {
+		line, err := editor.readLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Fatalf("want line %q, got %q", want, line)
+		}
+	}
+	if _, err := editor.readLine(); err != io.EOF {
+		t.Fatalf("want io.EOF, got %v", err)
+	}
+	if out.Len() > 0 {
+		t.Fatalf("want no output, got %q", out.String())
+	}
+}
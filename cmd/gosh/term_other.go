@@ -0,0 +1,12 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import "fmt"
+
+func cbreak(fd int) (restore func(), err error) {
+	return nil, fmt.Errorf("line editing is not supported on this platform")
+}
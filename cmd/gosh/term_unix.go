@@ -0,0 +1,26 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// cbreak puts a terminal in a mode where keys can be read one at a time, and
+// where they aren't echoed. Keys like Ctrl-C are read as well, instead of
+// sending signals. Unlike raw mode, output processing stays enabled.
+func cbreak(fd int) (restore func(), err error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	mode := *old
+	mode.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG
+	mode.Cc[unix.VMIN] = 1
+	mode.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &mode); err != nil {
+		return nil, err
+	}
+	return func() { unix.IoctlSetTermios(fd, ioctlSetTermios, old) }, nil
+}
@@ -14,7 +14,7 @@ import (
 
 func writeJSON(w io.Writer, node syntax.Node, pretty bool) error {
 	val := reflect.ValueOf(node)
-	v, _ := encode(val)
+	v := encode(val)
 	enc := json.NewEncoder(w)
 	if pretty {
 		enc.SetIndent("", "\t")
@@ -22,22 +22,21 @@ func writeJSON(w io.Writer, node syntax.Node, pretty bool) error {
 	return enc.Encode(v)
 }
 
-func encode(val reflect.Value) (interface{}, string) {
+func encode(val reflect.Value) interface{} {
 	switch val.Kind() {
 	case reflect.Ptr:
 		elem := val.Elem()
 		if !elem.IsValid() {
-			return nil, ""
+			return nil
 		}
 		return encode(elem)
 	case reflect.Interface:
 		if val.IsNil() {
-			return nil, ""
+			return nil
 		}
-		v, tname := encode(val.Elem())
-		m := v.(map[string]interface{})
-		m["Type"] = tname
-		return m, ""
+		m := encode(val.Elem()).(map[string]interface{})
+		m["Type"] = syntax.NodeType(val.Interface().(syntax.Node))
+		return m
 	case reflect.Struct:
 		m := make(map[string]interface{}, val.NumField()+1)
 		typ := val.Type()
@@ -50,8 +49,7 @@ func encode(val reflect.Value) (interface{}, string) {
 				continue
 			}
 			fval := val.Field(i)
-			v, _ := encode(fval)
-			m[ftyp.Name] = v
+			m[ftyp.Name] = encode(fval)
 		}
 		// Pos methods are defined on struct pointer receivers.
 		for _, name := range [...]string{"Pos", "End"} {
@@ -59,16 +57,16 @@ func encode(val reflect.Value) (interface{}, string) {
 				m[name] = translatePos(fn.Call(nil)[0])
 			}
 		}
-		return m, typ.Name()
+		return m
 	case reflect.Slice:
 		l := make([]interface{}, val.Len())
 		for i := 0; i < val.Len(); i++ {
 			elem := val.Index(i)
-			l[i], _ = encode(elem)
+			l[i] = encode(elem)
 		}
-		return l, ""
+		return l
 	default:
-		return val.Interface(), ""
+		return val.Interface()
 	}
 }
 
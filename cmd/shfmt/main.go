@@ -86,7 +86,7 @@ for shell files - both by filename extension and by shebang.
 
 Parser options:
 
-  -ln str        language variant to parse (bash/posix/mksh, default "bash")
+  -ln str        language variant to parse (bash/posix/mksh/auto, default "bash")
   -p             shorthand for -ln=posix
   -filename str  provide a name for the standard input file
 
@@ -142,6 +142,8 @@ Utilities:
 	if !useEditorConfig {
 		switch *langStr {
 		case "bash", "":
+		case "auto":
+			lang = syntax.LangAuto
 		case "posix":
 			lang = syntax.LangPOSIX
 		case "mksh":
@@ -280,6 +282,8 @@ var ecQuery = editorconfig.Query{
 func propsOptions(props editorconfig.Section) {
 	lang := syntax.LangBash
 	switch props.Get("shell_variant") {
+	case "auto":
+		lang = syntax.LangAuto
 	case "posix":
 		lang = syntax.LangPOSIX
 	case "mksh":
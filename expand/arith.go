@@ -20,7 +20,10 @@ func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 		// recursively fetch vars
 		i := 0
 		for syntax.ValidName(str) {
-			val := cfg.envGet(str)
+			val, err := cfg.arithmVar(str)
+			if err != nil {
+				return 0, err
+			}
 			if val == "" {
 				break
 			}
@@ -37,7 +40,11 @@ func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 		switch x.Op {
 		case syntax.Inc, syntax.Dec:
 			name := x.X.(*syntax.Word).Lit()
-			old := atoi(cfg.envGet(name))
+			str, err := cfg.arithmVar(name)
+			if err != nil {
+				return 0, err
+			}
+			old := atoi(str)
 			val := old
 			if x.Op == syntax.Inc {
 				val++
@@ -105,6 +112,16 @@ func oneIf(b bool) int {
 	return 0
 }
 
+// arithmVar returns the value of a variable used in an arithmetic expression,
+// which is an error if it's unset and Config.NoUnset is enabled.
+func (cfg *Config) arithmVar(name string) (string, error) {
+	vr := cfg.Env.Get(name)
+	if cfg.NoUnset && !vr.IsSet() {
+		return "", fmt.Errorf("%s: unbound variable", name)
+	}
+	return vr.String(), nil
+}
+
 // atoi is just a shorthand for strconv.Atoi that ignores the error,
 // just like shells do.
 func atoi(s string) int {
@@ -114,7 +131,14 @@ func atoi(s string) int {
 
 func (cfg *Config) assgnArit(b *syntax.BinaryArithm) (int, error) {
 	name := b.X.(*syntax.Word).Lit()
-	val := atoi(cfg.envGet(name))
+	val := 0
+	if b.Op != syntax.Assgn {
+		str, err := cfg.arithmVar(name)
+		if err != nil {
+			return 0, err
+		}
+		val = atoi(str)
+	}
 	arg, err := Arithm(cfg, b.Y)
 	if err != nil {
 		return 0, err
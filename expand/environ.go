@@ -69,6 +69,7 @@ type Variable struct {
 	Local    bool
 	Exported bool
 	ReadOnly bool
+	Integer  bool // assigned values are evaluated as arithmetic expressions
 
 	Kind ValueKind
 
@@ -5,8 +5,10 @@ package expand
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -14,6 +16,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"mvdan.cc/sh/v3/pattern"
 	"mvdan.cc/sh/v3/syntax"
@@ -30,6 +34,9 @@ type Config struct {
 	//   * "?", "$", "PPID" for the shell's status and process
 	//   * "HOME foo" to retrieve user foo's home directory (if unset,
 	//     os/user.Lookup will be used)
+	//   * "START TIME" for the Unix time in seconds at which the shell
+	//     started, used by Format with "%(fmt)T" and -2 (if unset, the
+	//     current time will be used)
 	//
 	// If nil, there are no environment variables set. Use
 	// ListEnviron(os.Environ()...) to use the system's environment
@@ -50,13 +57,32 @@ type Config struct {
 	ProcSubst func(*syntax.ProcSubst) (string, error)
 
 	// ReadDir is used for file path globbing. If nil, globbing is disabled.
-	// Use ioutil.ReadDir to use the filesystem directly.
+	// Use ioutil.ReadDir to use the filesystem directly. Matches are
+	// filtered by the patterns in $GLOBIGNORE, if set.
 	ReadDir func(string) ([]os.FileInfo, error)
 
 	// GlobStar corresponds to the shell option that allows globbing with
 	// "**".
 	GlobStar bool
 
+	// ExtGlob corresponds to the shell option that allows extended globs
+	// like "@(a|b)" when globbing, including in $GLOBIGNORE.
+	ExtGlob bool
+
+	// NullGlob corresponds to the shell option that removes the fields
+	// whose globs match no files, instead of keeping them as-is.
+	NullGlob bool
+
+	// FailGlob corresponds to the shell option that makes a glob which
+	// matches no files an error. It takes precedence over NullGlob.
+	FailGlob bool
+
+	// NoUnset corresponds to the shell option that makes expanding an unset
+	// parameter an error, except with operators which deal with unset
+	// parameters, such as ${name-word}. Lookups which aren't expansions,
+	// such as $GLOBIGNORE, are not affected.
+	NoUnset bool
+
 	bufferAlloc bytes.Buffer
 	fieldAlloc  [4]fieldPart
 	fieldsAlloc [4][]fieldPart
@@ -165,7 +191,18 @@ func Document(cfg *Config, word *syntax.Word) (string, error) {
 	return cfg.fieldJoin(field), nil
 }
 
-const patMode = pattern.Filenames | pattern.Braces
+// patMode is used to quote the parts of a pattern. It includes ExtendedGlob, as
+// escaping extended globs is harmless even if they are not enabled.
+const patMode = pattern.Filenames | pattern.Braces | pattern.ExtendedGlob
+
+// globMode is the mode of the patterns used for globbing.
+func (cfg *Config) globMode() pattern.Mode {
+	mode := pattern.Filenames
+	if cfg.ExtGlob {
+		mode |= pattern.ExtendedGlob
+	}
+	return mode
+}
 
 // Pattern expands a single shell word as a pattern, using syntax.QuotePattern
 // on any non-quoted parts of the input word. The result can be used on
@@ -190,10 +227,46 @@ func Pattern(cfg *Config, word *syntax.Word) (string, error) {
 	return buf.String(), nil
 }
 
+// Regexp expands a single shell word as an extended regular expression, like
+// the right hand side of a [[ str =~ regex ]] test. Any quoted parts of the
+// input word, including characters escaped with a backslash, match literally
+// via regexp.QuoteMeta. The result can be used on regexp.Compile directly.
+//
+// The config specifies shell expansion options; nil behaves the same as an
+// empty config.
+func Regexp(cfg *Config, word *syntax.Word) (string, error) {
+	cfg = prepareConfig(cfg)
+	field, err := cfg.wordField(quoteEscaped(word).Parts, quoteNone)
+	if err != nil {
+		return "", err
+	}
+	buf := cfg.strBuilder()
+	for _, part := range field {
+		if part.quote > quoteNone {
+			buf.WriteString(regexp.QuoteMeta(part.val))
+		} else {
+			buf.WriteString(part.val)
+		}
+	}
+	return buf.String(), nil
+}
+
 // Format expands a format string with a number of arguments, following the
 // shell's format specifications. These include printf(1), among others.
 //
 // The resulting string is returned, along with the number of arguments used.
+// Directives without an argument left behave as if it was an empty string,
+// which means zero for numeric directives. Callers like printf(1) may call
+// Format again with the remaining arguments until all are used.
+//
+// A directive like "%2$s" uses the argument at the given position, and so does
+// a width or precision like "*1$". Directives without a position keep taking
+// the arguments in order, independently of the positional ones, and the
+// number of arguments used counts up to the highest position referenced.
+//
+// Floating point directives like "%.2f" round to the nearest value, with ties
+// to even like C's printf, and always use "." as the decimal separator. Unlike
+// Bash, which uses long doubles, the arguments are parsed as float64 values.
 //
 // The config specifies shell expansion options; nil behaves the same as an
 // empty config.
@@ -203,78 +276,36 @@ func Format(cfg *Config, format string, args []string) (string, int, error) {
 	var fmts []byte
 	initialArgs := len(args)
 
-	for i := 0; i < len(format); i++ {
-		// readDigits reads from 0 to max digits, either octal or
-		// hexadecimal.
-		readDigits := func(max int, hex bool) string {
-			j := 0
-			for ; j < max; j++ {
-				c := format[i+j]
-				if (c >= '0' && c <= '9') ||
-					(hex && c >= 'a' && c <= 'f') ||
-					(hex && c >= 'A' && c <= 'F') {
-					// valid octal or hex char
-				} else {
-					break
-				}
-			}
-			digits := format[i : i+j]
-			i += j - 1 // -1 since the outer loop does i++
-			return digits
+	allArgs, maxPos := args, 0
+	argPos := 0 // position of the current directive's argument, if any
+	posArg := func(n int) string {
+		if n > maxPos {
+			maxPos = n
+		}
+		if n <= len(allArgs) {
+			return allArgs[n-1]
+		}
+		return ""
+	}
+	nextArg := func() string {
+		if argPos > 0 {
+			n := argPos
+			argPos = 0
+			return posArg(n)
 		}
+		arg := ""
+		if len(args) > 0 {
+			arg, args = args[0], args[1:]
+		}
+		return arg
+	}
+
+	for i := 0; i < len(format); i++ {
 		c := format[i]
 		switch {
-		case c == '\\': // escaped
-			i++
-			switch c = format[i]; c {
-			case 'a': // bell
-				buf.WriteByte('\a')
-			case 'b': // backspace
-				buf.WriteByte('\b')
-			case 'e', 'E': // escape
-				buf.WriteByte('\x1b')
-			case 'f': // form feed
-				buf.WriteByte('\f')
-			case 'n': // new line
-				buf.WriteByte('\n')
-			case 'r': // carriage return
-				buf.WriteByte('\r')
-			case 't': // horizontal tab
-				buf.WriteByte('\t')
-			case 'v': // vertical tab
-				buf.WriteByte('\v')
-			case '\\', '\'', '"', '?': // just the character
-				buf.WriteByte(c)
-			case '0', '1', '2', '3', '4', '5', '6', '7':
-				digits := readDigits(3, false)
-				// if digits don't fit in 8 bits, 0xff via strconv
-				n, _ := strconv.ParseUint(digits, 8, 8)
-				buf.WriteByte(byte(n))
-			case 'x', 'u', 'U':
-				i++
-				max := 2
-				if c == 'u' {
-					max = 4
-				} else if c == 'U' {
-					max = 8
-				}
-				digits := readDigits(max, true)
-				if len(digits) > 0 {
-					// can't error
-					n, _ := strconv.ParseUint(digits, 16, 32)
-					if c == 'x' {
-						// always as a single byte
-						buf.WriteByte(byte(n))
-					} else {
-						buf.WriteRune(rune(n))
-					}
-					break
-				}
-				fallthrough
-			default: // no escape sequence
-				buf.WriteByte('\\')
-				buf.WriteByte(c)
-			}
+		case c == '\\' && i+1 < len(format): // escaped
+			n, _ := writeEscape(buf, format[i:], escapeFormat)
+			i += n - 1 // -1 since the outer loop does i++
 		case len(fmts) > 0:
 			switch c {
 			case '%':
@@ -282,42 +313,120 @@ func Format(cfg *Config, format string, args []string) (string, int, error) {
 				fmts = nil
 			case 'c':
 				var b byte
-				if len(args) > 0 {
-					arg := ""
-					arg, args = args[0], args[1:]
-					if len(arg) > 0 {
-						b = arg[0]
-					}
+				if arg := nextArg(); len(arg) > 0 {
+					b = arg[0]
 				}
-				buf.WriteByte(b)
+				fmts = append(fmts, 's')
+				fmt.Fprintf(buf, string(fmts), []byte{b})
 				fmts = nil
-			case '+', '-', ' ':
-				if len(fmts) > 1 {
+			case '(':
+				end := strings.Index(format[i:], ")")
+				if end < 0 || i+end+1 >= len(format) || format[i+end+1] != 'T' {
+					return "", 0, fmt.Errorf("invalid time format specification")
+				}
+				layout := format[i+1 : i+end]
+				if layout == "" {
+					layout = "%X" // the default, like in Bash
+				}
+				i += end + 1
+				t, err := cfg.formatTime(nextArg())
+				if err != nil {
+					return "", 0, err
+				}
+				fmts = append(fmts, 's')
+				fmt.Fprintf(buf, string(fmts), strftime(layout, t))
+				fmts = nil
+			case '+', '-', ' ', '#':
+				if !onlyFormatFlags(fmts) {
 					return "", 0, fmt.Errorf("invalid format char: %c", c)
 				}
 				fmts = append(fmts, c)
-			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+			case '.':
+				if bytes.IndexByte(fmts, '.') >= 0 {
+					return "", 0, fmt.Errorf("invalid format char: %c", c)
+				}
 				fmts = append(fmts, c)
-			case 's', 'd', 'i', 'u', 'o', 'x':
-				arg := ""
-				if len(args) > 0 {
-					arg, args = args[0], args[1:]
+			case '*':
+				// The width or precision is taken from an argument.
+				precision := fmts[len(fmts)-1] == '.'
+				if !precision && !onlyFormatFlags(fmts) {
+					return "", 0, fmt.Errorf("invalid format char: %c", c)
 				}
-				var farg interface{} = arg
-				if c != 's' {
-					n, _ := strconv.ParseInt(arg, 0, 0)
-					if c == 'i' || c == 'd' {
-						farg = int(n)
-					} else {
-						farg = uint(n)
-					}
-					if c == 'i' || c == 'u' {
-						c = 'd'
+				var n int64
+				if pos, size := formatArgPos(format[i+1:]); size > 0 {
+					if pos <= 0 {
+						return "", 0, fmt.Errorf("invalid format argument position: %s", format[i+1:i+size])
 					}
+					n = formatInt(posArg(pos))
+					i += size
+				} else if len(args) > 0 {
+					n, args = formatInt(args[0]), args[1:]
+				}
+				if precision && n < 0 {
+					// A negative precision is as if it was omitted.
+					fmts = fmts[:len(fmts)-1]
+				} else {
+					// A negative width adds the "-" flag.
+					fmts = strconv.AppendInt(fmts, n, 10)
+				}
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				fmts = append(fmts, c)
+			case '$':
+				// A position like "%2$s", which must come first.
+				digits := string(fmts[1:])
+				if argPos > 0 || digits == "" || strings.Trim(digits, "0123456789") != "" {
+					return "", 0, fmt.Errorf("invalid format char: %c", c)
+				}
+				n, _ := strconv.Atoi(digits)
+				if n <= 0 {
+					return "", 0, fmt.Errorf("invalid format argument position: %s", digits)
+				}
+				argPos = n
+				fmts = fmts[:1]
+			case 's', 'q', 'b':
+				arg := nextArg()
+				stop := false
+				if c == 'q' {
+					arg = backslashQuote(arg)
+				} else if c == 'b' {
+					arg, stop = formatEscapes(arg)
+				}
+				fmts = append(fmts, 's')
+				fmt.Fprintf(buf, string(fmts), arg)
+				fmts = nil
+				if stop {
+					// "\c" stops all output, using up every argument.
+					return buf.String(), initialArgs, nil
+				}
+			case 'd', 'i', 'u', 'o', 'x', 'X':
+				arg := nextArg()
+				var farg interface{}
+				n := formatInt(arg)
+				if c == 'i' || c == 'd' {
+					farg = int(n)
+				} else {
+					farg = uint(n)
+				}
+				if c == 'i' || c == 'u' {
+					c = 'd'
 				}
 				fmts = append(fmts, c)
 				fmt.Fprintf(buf, string(fmts), farg)
 				fmts = nil
+			case 'e', 'E', 'f', 'F', 'g', 'G':
+				arg := nextArg()
+				if (c == 'g' || c == 'G') && bytes.IndexByte(fmts, '.') < 0 {
+					// Unlike Go, C defaults to six significant digits.
+					fmts = append(fmts, ".6"...)
+				}
+				f := formatFloat(arg)
+				if math.IsInf(f, 0) || math.IsNaN(f) {
+					buf.WriteString(formatNonFinite(fmts, c, f))
+				} else {
+					fmts = append(fmts, c)
+					fmt.Fprintf(buf, string(fmts), f)
+				}
+				fmts = nil
 			default:
 				return "", 0, fmt.Errorf("invalid format char: %c", c)
 			}
@@ -332,7 +441,436 @@ func Format(cfg *Config, format string, args []string) (string, int, error) {
 	if len(fmts) > 0 {
 		return "", 0, fmt.Errorf("missing format char")
 	}
-	return buf.String(), initialArgs - len(args), nil
+	used := initialArgs - len(args)
+	if maxPos > used {
+		used = maxPos
+		if used > initialArgs {
+			used = initialArgs
+		}
+	}
+	return buf.String(), used, nil
+}
+
+// formatArgPos parses a position like "1$" at the start of s, following a "*"
+// in a format directive. It returns the position, which is zero if invalid,
+// and the number of bytes it takes up, which is zero if there is none.
+func formatArgPos(s string) (pos, size int) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	if i == 0 || i == len(s) || s[i] != '$' {
+		return 0, 0
+	}
+	n, _ := strconv.Atoi(s[:i])
+	return n, i + 1
+}
+
+// onlyFormatFlags reports whether a format directive being read, starting with
+// "%", consists of nothing but flags so far.
+func onlyFormatFlags(fmts []byte) bool {
+	for _, c := range fmts[1:] {
+		if !strings.ContainsRune("+- #0", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatInt parses a numeric argument to a format directive such as "%d".
+// Leading whitespace is skipped, and an argument starting with a single or
+// double quote gives the value of the character following it. Like in Bash,
+// a missing or invalid number is zero.
+func formatInt(arg string) int64 {
+	arg = strings.TrimLeft(arg, " \t\n")
+	if arg != "" && (arg[0] == '\'' || arg[0] == '"') {
+		if len(arg) == 1 {
+			return 0
+		}
+		r, _ := utf8.DecodeRuneInString(arg[1:])
+		return int64(r)
+	}
+	n, _ := strconv.ParseInt(arg, 0, 64)
+	return n
+}
+
+// formatFloat is like formatInt, for floating point directives such as "%f".
+// Like C's strtod, it accepts hexadecimal numbers without an exponent, as well
+// as signed infinities and NaNs. Numbers too large for a float64 are infinite.
+func formatFloat(arg string) float64 {
+	trimmed := strings.TrimLeft(arg, " \t\n")
+	if trimmed == "" || trimmed[0] == '\'' || trimmed[0] == '"' {
+		return float64(formatInt(arg))
+	}
+	unsigned := strings.TrimLeft(trimmed, "+-")
+	if strings.EqualFold(unsigned, "nan") {
+		if trimmed[0] == '-' {
+			return math.Copysign(math.NaN(), -1)
+		}
+		return math.NaN()
+	}
+	if len(unsigned) > 2 && unsigned[0] == '0' && (unsigned[1] == 'x' || unsigned[1] == 'X') &&
+		!strings.ContainsAny(unsigned, "pP") {
+		trimmed += "p0"
+	}
+	f, err := strconv.ParseFloat(trimmed, 64)
+	if err == nil || errors.Is(err, strconv.ErrRange) {
+		return f
+	}
+	return float64(formatInt(arg))
+}
+
+// formatNonFinite formats an infinity or NaN like C's printf, which gives
+// "inf" and "nan", or "INF" and "NAN" for the uppercase directives. The flags
+// and the width apply, except for "0" and "#", but the precision doesn't.
+func formatNonFinite(fmts []byte, c byte, f float64) string {
+	s := "inf"
+	if math.IsNaN(f) {
+		s = "nan"
+	}
+	if c >= 'A' && c <= 'Z' {
+		s = strings.ToUpper(s)
+	}
+	spec := fmts[1:]
+	if i := bytes.IndexByte(spec, '.'); i >= 0 {
+		spec = spec[:i]
+	}
+	width := bytes.TrimLeft(spec, "+- #0")
+	flags := spec[:len(spec)-len(width)]
+	switch {
+	case math.Signbit(f):
+		s = "-" + s
+	case bytes.IndexByte(flags, '+') >= 0:
+		s = "+" + s
+	case bytes.IndexByte(flags, ' ') >= 0:
+		s = " " + s
+	}
+	sfmt := []byte{'%'}
+	if bytes.IndexByte(flags, '-') >= 0 {
+		sfmt = append(sfmt, '-')
+	}
+	sfmt = append(sfmt, width...)
+	sfmt = append(sfmt, 's')
+	return fmt.Sprintf(string(sfmt), s)
+}
+
+// backslashQuote quotes an argument to the "%q" directive like Bash, escaping
+// each character which the shell would interpret with a backslash. The empty
+// string and strings with non-printable characters are quoted by syntax.Quote,
+// which use a pair of single quotes and $'...' respectively.
+func backslashQuote(s string) string {
+	if q := syntax.Quote(s); q == s || s == "" || strings.HasPrefix(q, "$'") {
+		return q
+	}
+	var sb strings.Builder
+	for i, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		case r >= utf8.RuneSelf, strings.ContainsRune("%+-./:=@_", r):
+		case (r == '~' || r == '#') && i > 0:
+		default:
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// formatEscapes expands the escape sequences in an argument to the "%b"
+// directive, in the same way that echo -e does. If "\c" ends the output, stop
+// is true.
+func formatEscapes(arg string) (_ string, stop bool) {
+	var buf bytes.Buffer
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '\\' {
+			buf.WriteByte(arg[i])
+			continue
+		}
+		n, stop := writeEscape(&buf, arg[i:], escapeEcho)
+		if stop {
+			return buf.String(), true
+		}
+		i += n - 1
+	}
+	return buf.String(), false
+}
+
+// ansiEscapes expands the escape sequences in a $'...' string. Like in Bash,
+// a null character ends the string.
+func ansiEscapes(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		n, _ := writeEscape(&buf, s[i:], escapeANSI)
+		i += n - 1
+	}
+	s = buf.String()
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return s
+}
+
+// escapeMode is a set of backslash escape sequences supported by the shell.
+// They are mostly the same everywhere, with a few differences.
+type escapeMode uint8
+
+const (
+	// escapeFormat is used in printf format strings.
+	escapeFormat escapeMode = iota
+
+	// escapeANSI is used in $'...' strings. Unlike in format strings,
+	// "\cX" is the control character for X, such as "\cA" for "\x01".
+	escapeANSI
+
+	// escapeEcho is used by echo -e and the "%b" directive. Unlike in
+	// format strings, "\c" stops the output, octal escapes may also be
+	// written as "\0nnn", and "\'", "\"" and "\?" are kept as-is.
+	escapeEcho
+)
+
+// writeEscape expands the escape sequence at the start of s, which begins
+// with a backslash, writing the result to buf. It returns the number of bytes
+// of s which were used, and whether the sequence was a "\c" which stops the
+// output. Unknown or incomplete sequences such as "\q" and "\x" are written
+// as-is.
+func writeEscape(buf *bytes.Buffer, s string, mode escapeMode) (n int, stop bool) {
+	if len(s) < 2 {
+		buf.WriteString(s)
+		return len(s), false
+	}
+	switch c := s[1]; c {
+	case 'a': // bell
+		buf.WriteByte('\a')
+	case 'b': // backspace
+		buf.WriteByte('\b')
+	case 'e', 'E': // escape
+		buf.WriteByte('\x1b')
+	case 'f': // form feed
+		buf.WriteByte('\f')
+	case 'n': // new line
+		buf.WriteByte('\n')
+	case 'r': // carriage return
+		buf.WriteByte('\r')
+	case 't': // horizontal tab
+		buf.WriteByte('\t')
+	case 'v': // vertical tab
+		buf.WriteByte('\v')
+	case '\\':
+		buf.WriteByte('\\')
+	case '\'', '"', '?':
+		if mode == escapeEcho {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	case 'c':
+		switch {
+		case mode == escapeEcho:
+			return 2, true
+		case mode == escapeANSI && len(s) > 2:
+			n := 3
+			x := s[2]
+			if x == '\\' && len(s) > 3 && s[3] == '\\' {
+				n = 4 // "\c\\" is the same as "\c\"
+			}
+			if x == '?' {
+				buf.WriteByte(0x7f)
+			} else {
+				buf.WriteByte(x & 0x1f) // the same for upper and lower case
+			}
+			return n, false
+		}
+		buf.WriteString(s[:2])
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		start := 1
+		if mode == escapeEcho && c == '0' {
+			start = 2 // "\0nnn"
+		}
+		end := start + countDigits(s[start:], 3, false)
+		// if digits don't fit in 8 bits, 0xff via strconv
+		n, _ := strconv.ParseUint(s[start:end], 8, 8)
+		buf.WriteByte(byte(n))
+		return end, false
+	case 'x', 'u', 'U':
+		max := 2
+		if c == 'u' {
+			max = 4
+		} else if c == 'U' {
+			max = 8
+		}
+		end := 2 + countDigits(s[2:], max, true)
+		if end == 2 {
+			buf.WriteString(s[:2])
+			break
+		}
+		// can't error
+		n, _ := strconv.ParseUint(s[2:end], 16, 32)
+		if c == 'x' {
+			// always as a single byte
+			buf.WriteByte(byte(n))
+		} else {
+			buf.WriteRune(rune(n))
+		}
+		return end, false
+	default: // no escape sequence
+		buf.WriteString(s[:2])
+	}
+	return 2, false
+}
+
+// countDigits returns how many of the first max bytes of s are octal digits,
+// or hexadecimal digits if hex is true.
+func countDigits(s string, max int, hex bool) int {
+	n := 0
+	for ; n < max && n < len(s); n++ {
+		c := s[n]
+		if (c >= '0' && c <= '7') ||
+			(c >= '8' && c <= '9' && hex) ||
+			(hex && c >= 'a' && c <= 'f') ||
+			(hex && c >= 'A' && c <= 'F') {
+			// valid octal or hex char
+		} else {
+			break
+		}
+	}
+	return n
+}
+
+// formatTime parses the argument to printf's "%(fmt)T" directive, a number of
+// seconds since the Unix epoch. Like in Bash, an empty argument or -1 means the
+// current time, and -2 means the time at which the shell was started.
+func (cfg *Config) formatTime(arg string) (time.Time, error) {
+	n := int64(-1)
+	if arg != "" {
+		var err error
+		n, err = strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid number: %q", arg)
+		}
+	}
+	var t time.Time
+	switch n {
+	case -1:
+		t = time.Now()
+	case -2:
+		t = time.Now()
+		if vr := cfg.Env.Get("START TIME"); vr.IsSet() {
+			if n, err := strconv.ParseInt(vr.String(), 10, 64); err == nil {
+				t = time.Unix(n, 0)
+			}
+		}
+	default:
+		t = time.Unix(n, 0)
+	}
+	loc := time.Local
+	if tz := cfg.envGet("TZ"); tz != "" {
+		if l, err := time.LoadLocation(tz); err == nil {
+			loc = l
+		}
+	}
+	return t.In(loc), nil
+}
+
+// strftime formats a time following a strftime(3) layout, using the C locale.
+// Unknown conversion specifications are kept as-is.
+func strftime(layout string, t time.Time) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(layout); i++ {
+		c := layout[i]
+		if c != '%' || i+1 >= len(layout) {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = layout[i]; c {
+		case 'a':
+			buf.WriteString(t.Format("Mon"))
+		case 'A':
+			buf.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			buf.WriteString(t.Format("Jan"))
+		case 'B':
+			buf.WriteString(t.Format("January"))
+		case 'c':
+			buf.WriteString(strftime("%a %b %e %H:%M:%S %Y", t))
+		case 'C':
+			fmt.Fprintf(&buf, "%02d", t.Year()/100)
+		case 'd':
+			fmt.Fprintf(&buf, "%02d", t.Day())
+		case 'D', 'x':
+			buf.WriteString(strftime("%m/%d/%y", t))
+		case 'e':
+			fmt.Fprintf(&buf, "%2d", t.Day())
+		case 'F':
+			buf.WriteString(strftime("%Y-%m-%d", t))
+		case 'g':
+			year, _ := t.ISOWeek()
+			fmt.Fprintf(&buf, "%02d", year%100)
+		case 'G':
+			year, _ := t.ISOWeek()
+			fmt.Fprintf(&buf, "%d", year)
+		case 'H':
+			fmt.Fprintf(&buf, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&buf, "%02d", (t.Hour()+11)%12+1)
+		case 'j':
+			fmt.Fprintf(&buf, "%03d", t.YearDay())
+		case 'k':
+			fmt.Fprintf(&buf, "%2d", t.Hour())
+		case 'l':
+			fmt.Fprintf(&buf, "%2d", (t.Hour()+11)%12+1)
+		case 'm':
+			fmt.Fprintf(&buf, "%02d", int(t.Month()))
+		case 'M':
+			fmt.Fprintf(&buf, "%02d", t.Minute())
+		case 'n':
+			buf.WriteByte('\n')
+		case 'p':
+			buf.WriteString(t.Format("PM"))
+		case 'P':
+			buf.WriteString(t.Format("pm"))
+		case 'r':
+			buf.WriteString(strftime("%I:%M:%S %p", t))
+		case 'R':
+			buf.WriteString(strftime("%H:%M", t))
+		case 's':
+			fmt.Fprintf(&buf, "%d", t.Unix())
+		case 'S':
+			fmt.Fprintf(&buf, "%02d", t.Second())
+		case 't':
+			buf.WriteByte('\t')
+		case 'T', 'X':
+			buf.WriteString(strftime("%H:%M:%S", t))
+		case 'u':
+			fmt.Fprintf(&buf, "%d", (int(t.Weekday())+6)%7+1)
+		case 'U':
+			fmt.Fprintf(&buf, "%02d", (t.YearDay()+6-int(t.Weekday()))/7)
+		case 'V':
+			_, week := t.ISOWeek()
+			fmt.Fprintf(&buf, "%02d", week)
+		case 'w':
+			fmt.Fprintf(&buf, "%d", int(t.Weekday()))
+		case 'W':
+			fmt.Fprintf(&buf, "%02d", (t.YearDay()+6-(int(t.Weekday())+6)%7)/7)
+		case 'y':
+			fmt.Fprintf(&buf, "%02d", t.Year()%100)
+		case 'Y':
+			fmt.Fprintf(&buf, "%d", t.Year())
+		case 'z':
+			buf.WriteString(t.Format("-0700"))
+		case 'Z':
+			buf.WriteString(t.Format("MST"))
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
 }
 
 func (cfg *Config) fieldJoin(parts []fieldPart) string {
@@ -357,7 +895,7 @@ func (cfg *Config) escapedGlobField(parts []fieldPart) (escaped string, glob boo
 			continue
 		}
 		buf.WriteString(part.val)
-		if pattern.HasMeta(part.val, patMode) {
+		if pattern.HasMeta(part.val, cfg.globMode()|pattern.Braces) {
 			glob = true
 		}
 	}
@@ -389,7 +927,8 @@ func Fields(cfg *Config, words ...*syntax.Word) ([]string, error) {
 				path, doGlob := cfg.escapedGlobField(field)
 				var matches []string
 				if doGlob && cfg.ReadDir != nil {
-					matches, err = cfg.glob(dir, path)
+					var valid bool
+					matches, valid, err = cfg.glob(dir, path)
 					if err != nil {
 						return nil, err
 					}
@@ -397,6 +936,13 @@ func Fields(cfg *Config, words ...*syntax.Word) ([]string, error) {
 						fields = append(fields, matches...)
 						continue
 					}
+					switch {
+					case !valid:
+					case cfg.FailGlob:
+						return nil, fmt.Errorf("no match: %s", cfg.fieldJoin(field))
+					case cfg.NullGlob:
+						continue
+					}
 				}
 				fields = append(fields, cfg.fieldJoin(field))
 			}
@@ -449,7 +995,7 @@ func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel) ([]fieldPart,
 		case *syntax.SglQuoted:
 			fp := fieldPart{quote: quoteSingle, val: x.Value}
 			if x.Dollar {
-				fp.val, _, _ = Format(cfg, fp.val, nil)
+				fp.val = ansiEscapes(fp.val)
 			}
 			field = append(field, fp)
 		case *syntax.DblQuoted:
@@ -485,6 +1031,8 @@ func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel) ([]fieldPart,
 				return nil, err
 			}
 			field = append(field, fieldPart{val: path})
+		case *syntax.ExtGlob:
+			field = append(field, fieldPart{val: extGlob(x)})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
 		}
@@ -492,6 +1040,12 @@ func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel) ([]fieldPart,
 	return field, nil
 }
 
+// extGlob returns the source of an extended glob, such as "@(a|b)", which is
+// left as-is for pattern matching.
+func extGlob(eg *syntax.ExtGlob) string {
+	return eg.Op.String() + eg.Pattern.Value + ")"
+}
+
 func (cfg *Config) cmdSubst(cs *syntax.CmdSubst) (string, error) {
 	if cfg.CmdSubst == nil {
 		return "", UnexpectedCommandError{Node: cs}
@@ -551,13 +1105,35 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 			allowEmpty = true
 			fp := fieldPart{quote: quoteSingle, val: x.Value}
 			if x.Dollar {
-				fp.val, _, _ = Format(cfg, fp.val, nil)
+				fp.val = ansiEscapes(fp.val)
 			}
 			curField = append(curField, fp)
 		case *syntax.DblQuoted:
-			if len(x.Parts) == 1 {
-				pe, _ := x.Parts[0].(*syntax.ParamExp)
-				if elems := cfg.quotedElemFields(pe); elems != nil {
+			if len(x.Parts) == 0 {
+				allowEmpty = true
+			}
+			for _, qp := range x.Parts {
+				pe, ok := qp.(*syntax.ParamExp)
+				if !ok {
+					allowEmpty = true
+					wfield, err := cfg.wordField([]syntax.WordPart{qp}, quoteDouble)
+					if err != nil {
+						return nil, err
+					}
+					for _, part := range wfield {
+						part.quote = quoteDouble
+						curField = append(curField, part)
+					}
+					continue
+				}
+				elems, indexAll, err := cfg.paramExpElems(pe)
+				if err != nil {
+					return nil, err
+				}
+				switch indexAll {
+				case "@":
+					// One field per element, which means no
+					// fields at all if there are no elements.
 					for i, elem := range elems {
 						if i > 0 {
 							flush()
@@ -567,24 +1143,36 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 							val:   elem,
 						})
 					}
-					continue
+				case "*":
+					allowEmpty = true
+					curField = append(curField, fieldPart{
+						quote: quoteDouble,
+						val:   cfg.ifsJoin(elems),
+					})
+				default:
+					allowEmpty = true
+					curField = append(curField, fieldPart{
+						quote: quoteDouble,
+						val:   elems[0],
+					})
 				}
 			}
-			allowEmpty = true
-			wfield, err := cfg.wordField(x.Parts, quoteDouble)
+		case *syntax.ParamExp:
+			elems, indexAll, err := cfg.paramExpElems(x)
 			if err != nil {
 				return nil, err
 			}
-			for _, part := range wfield {
-				part.quote = quoteDouble
-				curField = append(curField, part)
+			if indexAll == "" {
+				splitAdd(elems[0])
+				break
 			}
-		case *syntax.ParamExp:
-			val, err := cfg.paramExp(x)
-			if err != nil {
-				return nil, err
+			// Each element is split separately.
+			for i, elem := range elems {
+				if i > 0 {
+					flush()
+				}
+				splitAdd(elem)
 			}
-			splitAdd(val)
 		case *syntax.CmdSubst:
 			val, err := cfg.cmdSubst(x)
 			if err != nil {
@@ -603,6 +1191,8 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 				return nil, err
 			}
 			splitAdd(path)
+		case *syntax.ExtGlob:
+			curField = append(curField, fieldPart{val: extGlob(x)})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
 		}
@@ -614,39 +1204,6 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 	return fields, nil
 }
 
-// quotedElemFields returns the list of elements resulting from a quoted
-// parameter expansion if it was in the form of ${*}, ${@}, ${foo[*], ${foo[@]},
-// or ${!foo@}.
-func (cfg *Config) quotedElemFields(pe *syntax.ParamExp) []string {
-	if pe == nil || pe.Length || pe.Width {
-		return nil
-	}
-	if pe.Excl {
-		if pe.Names == syntax.NamesPrefixWords {
-			return cfg.namesByPrefix(pe.Param.Value)
-		}
-		return nil
-	}
-	name := pe.Param.Value
-	switch name {
-	case "*":
-		return []string{cfg.ifsJoin(cfg.Env.Get(name).List)}
-	case "@":
-		return cfg.Env.Get(name).List
-	}
-	switch nodeLit(pe.Index) {
-	case "@":
-		if vr := cfg.Env.Get(name); vr.Kind == Indexed {
-			return vr.List
-		}
-	case "*":
-		if vr := cfg.Env.Get(name); vr.Kind == Indexed {
-			return []string{cfg.ifsJoin(vr.List)}
-		}
-	}
-	return nil
-}
-
 func (cfg *Config) expandUser(field string) (prefix, rest string) {
 	if len(field) == 0 || field[0] != '~' {
 		return "", field
@@ -688,11 +1245,20 @@ func (cfg *Config) expandUser(field string) (prefix, rest string) {
 	return u.HomeDir, rest
 }
 
-func findAllIndex(pat, name string, n int) [][]int {
+// findAllIndex returns the locations of up to n matches of a pattern in name,
+// or all of them if n is negative. An anchor of '#' or '%' means that a match
+// must be at the start or end of name, respectively.
+func findAllIndex(pat, name string, n int, anchor byte) [][]int {
 	expr, err := pattern.Regexp(pat, 0)
 	if err != nil {
 		return nil
 	}
+	switch anchor {
+	case '#':
+		expr = "^(?:" + expr + ")"
+	case '%':
+		expr = "(?:" + expr + ")$"
+	}
 	rx := regexp.MustCompile(expr)
 	return rx.FindAllStringIndex(name, n)
 }
@@ -719,9 +1285,16 @@ func pathSplit(path string) []string {
 	return strings.Split(path, string(filepath.Separator))
 }
 
-func (cfg *Config) glob(base, pat string) ([]string, error) {
+// glob returns the paths matching a glob pattern, relative to base unless the
+// pattern is absolute. It also reports whether the pattern is valid; if it
+// isn't, its word is kept as-is.
+func (cfg *Config) glob(base, pat string) (matches []string, valid bool, err error) {
+	// Like in Bash, setting $GLOBIGNORE also lets globbing match names
+	// starting with a dot.
+	ignore := cfg.envGet("GLOBIGNORE")
+	dotFiles := ignore != ""
 	parts := pathSplit(pat)
-	matches := []string{""}
+	matches = []string{""}
 	if filepath.IsAbs(pat) {
 		if parts[0] == "" {
 			// unix-like
@@ -743,7 +1316,7 @@ func (cfg *Config) glob(base, pat string) ([]string, error) {
 				matches[i] = pathJoin2(dir, part)
 			}
 			continue
-		case !pattern.HasMeta(part, patMode):
+		case !pattern.HasMeta(part, cfg.globMode()|pattern.Braces):
 			var newMatches []string
 			for _, dir := range matches {
 				match := dir
@@ -775,9 +1348,9 @@ func (cfg *Config) glob(base, pat string) ([]string, error) {
 				var newMatches []string
 				for _, dir := range latest {
 					var err error
-					newMatches, err = cfg.globDir(base, dir, rxGlobStar, wantDir, newMatches)
+					newMatches, err = cfg.globDir(base, dir, rxGlobStar, wantDir, dotFiles, newMatches)
 					if err != nil {
-						return nil, err
+						return nil, false, err
 					}
 				}
 				if len(newMatches) == 0 {
@@ -790,25 +1363,59 @@ func (cfg *Config) glob(base, pat string) ([]string, error) {
 			}
 			continue
 		}
-		expr, err := pattern.Regexp(part, pattern.Filenames)
+		expr, err := pattern.Regexp(part, cfg.globMode())
 		if err != nil {
 			// If any glob part is not a valid pattern, don't glob.
-			return nil, nil
+			return nil, false, nil
 		}
 		rx := regexp.MustCompile("^" + expr + "$")
 		var newMatches []string
 		for _, dir := range matches {
-			newMatches, err = cfg.globDir(base, dir, rx, wantDir, newMatches)
+			newMatches, err = cfg.globDir(base, dir, rx, wantDir, dotFiles, newMatches)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
 		}
 		matches = newMatches
 	}
-	return matches, nil
+	if ignore != "" {
+		matches = globIgnore(matches, ignore, cfg.globMode())
+	}
+	return matches, true, nil
+}
+
+// globIgnore removes the matches of a glob which match any of the patterns in
+// $GLOBIGNORE, a colon-separated list. As with globbing itself, a pattern must
+// match an entire path, and "*" does not match slashes.
+func globIgnore(matches []string, ignore string, mode pattern.Mode) []string {
+	var rxs []*regexp.Regexp
+	for _, pat := range strings.Split(ignore, ":") {
+		if pat == "" {
+			continue
+		}
+		expr, err := pattern.Regexp(pat, mode)
+		if err != nil {
+			continue
+		}
+		rxs = append(rxs, regexp.MustCompile("^"+expr+"$"))
+	}
+	kept := matches[:0]
+	for _, match := range matches {
+		ignored := false
+		for _, rx := range rxs {
+			if rx.MatchString(filepath.ToSlash(match)) {
+				ignored = true
+				break
+			}
+		}
+		if !ignored {
+			kept = append(kept, match)
+		}
+	}
+	return kept
 }
 
-func (cfg *Config) globDir(base, dir string, rx *regexp.Regexp, wantDir bool, matches []string) ([]string, error) {
+func (cfg *Config) globDir(base, dir string, rx *regexp.Regexp, wantDir, dotFiles bool, matches []string) ([]string, error) {
 	fullDir := dir
 	if !filepath.IsAbs(dir) {
 		fullDir = filepath.Join(base, dir)
@@ -832,7 +1439,7 @@ func (cfg *Config) globDir(base, dir string, rx *regexp.Regexp, wantDir bool, ma
 			// definitely not a directory
 			continue
 		}
-		if !strings.HasPrefix(rx.String(), `^\.`) && name[0] == '.' {
+		if !dotFiles && !strings.HasPrefix(rx.String(), `^\.`) && name[0] == '.' {
 			continue
 		}
 		if rx.MatchString(name) {
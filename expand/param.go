@@ -4,6 +4,7 @@
 package expand
 
 import (
+	"bytes"
 	"fmt"
 	"regexp"
 	"sort"
@@ -23,16 +24,61 @@ func nodeLit(node syntax.Node) string {
 	return ""
 }
 
+// UnsetParameterError is returned by an expansion like ${name:?word} when the
+// parameter is unset or null, or by expanding an unset parameter with
+// Config.NoUnset. Message is the expanded word, or a default message if the
+// word is empty.
 type UnsetParameterError struct {
 	Node    *syntax.ParamExp
 	Message string
 }
 
+// Error returns the message prefixed by the parameter's name, like Bash.
 func (u UnsetParameterError) Error() string {
-	return u.Message
+	name := u.Node.Param.Value
+	if u.Node.Index != nil {
+		// Print ${name[index]} and remove the braces.
+		pe := *u.Node
+		pe.Exp = nil
+		var buf bytes.Buffer
+		syntax.NewPrinter().Print(&buf, &pe)
+		name = buf.String()[2 : buf.Len()-1]
+	}
+	return name + ": " + u.Message
+}
+
+// unsetOp reports whether a parameter expansion uses an operator which deals
+// with unset parameters, such as ${name-word}.
+func unsetOp(pe *syntax.ParamExp) bool {
+	if pe.Exp == nil {
+		return false
+	}
+	switch pe.Exp.Op {
+	case syntax.AlternateUnset, syntax.AlternateUnsetOrNull,
+		syntax.DefaultUnset, syntax.DefaultUnsetOrNull,
+		syntax.ErrorUnset, syntax.ErrorUnsetOrNull,
+		syntax.AssignUnset, syntax.AssignUnsetOrNull:
+		return true
+	}
+	return false
 }
 
 func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
+	elems, indexAll, err := cfg.paramExpElems(pe)
+	if err != nil {
+		return "", err
+	}
+	if indexAll == "*" {
+		return cfg.ifsJoin(elems), nil
+	}
+	return strings.Join(elems, " "), nil
+}
+
+// paramExpElems expands a parameter expansion into a list of elements. There is
+// exactly one element, unless the expansion is in a form like ${foo[@]} or $*;
+// in that case, there is one element per array element or parameter, and the
+// "@" or "*" index is returned too.
+func (cfg *Config) paramExpElems(pe *syntax.ParamExp) ([]string, string, error) {
 	oldParam := cfg.curParam
 	cfg.curParam = pe
 	defer func() { cfg.curParam = oldParam }()
@@ -57,107 +103,185 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 	}
 	orig := vr
 	_, vr = vr.Resolve(cfg.Env)
-	str, err := cfg.varInd(vr, index)
-	if err != nil {
-		return "", err
-	}
-	slicePos := func(n int) int {
-		if n < 0 {
-			n = len(str) + n
-			if n < 0 {
-				n = len(str)
+	if cfg.NoUnset && !vr.IsSet() && pe.Names == 0 && !unsetOp(pe) {
+		switch name {
+		case "@", "*":
+		default:
+			return nil, "", UnsetParameterError{
+				Node:    pe,
+				Message: "unbound variable",
 			}
-		} else if n > len(str) {
-			n = len(str)
 		}
-		return n
 	}
-	elems := []string{str}
-	switch nodeLit(index) {
+
+	var elems []string
+	indexAll := nodeLit(index)
+	switch indexAll {
 	case "@", "*":
+		// Make a copy, as the elements may be modified below.
 		switch vr.Kind {
 		case Unset:
-			elems = nil
 		case Indexed:
-			elems = vr.List
-		}
-	}
-	switch {
-	case pe.Length:
-		n := len(elems)
-		switch nodeLit(index) {
-		case "@", "*":
+			elems = append([]string(nil), vr.List...)
+		case Associative:
+			for _, val := range vr.Map {
+				elems = append(elems, val)
+			}
+			sort.Strings(elems)
 		default:
-			n = utf8.RuneCountInString(str)
+			elems = []string{vr.Str}
 		}
-		str = strconv.Itoa(n)
-	case pe.Excl:
+	default:
+		indexAll = ""
+		str, err := cfg.varInd(vr, index)
+		if err != nil {
+			return nil, "", err
+		}
+		elems = []string{str}
+	}
+	str := strings.Join(elems, " ")
+	if pe.Excl {
 		var strs []string
 		switch {
 		case pe.Names != 0:
 			strs = cfg.namesByPrefix(pe.Param.Value)
-		case orig.Kind == NameRef:
-			strs = append(strs, orig.Str)
-		case vr.Kind == Indexed:
-			for i, e := range vr.List {
-				if e != "" {
-					strs = append(strs, strconv.Itoa(i))
+			if pe.Names == syntax.NamesPrefixWords {
+				return strs, "@", nil
+			}
+			return strs, "*", nil
+		case indexAll != "":
+			switch vr.Kind {
+			case Indexed:
+				for i, e := range vr.List {
+					if e != "" {
+						strs = append(strs, strconv.Itoa(i))
+					}
 				}
+			case Associative:
+				for k := range vr.Map {
+					strs = append(strs, k)
+				}
+				sort.Strings(strs)
+			case String:
+				strs = append(strs, "0")
 			}
-		case vr.Kind == Associative:
-			for k := range vr.Map {
-				strs = append(strs, k)
+			// Like "${foo[@]}" and "${foo[*]}", the keys are
+			// separate fields or joined by IFS, respectively.
+			return strs, indexAll, nil
+		case orig.Kind == NameRef && index == nil:
+			return []string{orig.Str}, "", nil
+		}
+		// Indirect expansion; the value is the parameter to expand,
+		// and any operators apply to the result.
+		pe2, err := indirectParam(str)
+		if err != nil {
+			return nil, "", err
+		}
+		pe2.Length = pe.Length
+		pe2.Slice = pe.Slice
+		pe2.Repl = pe.Repl
+		pe2.Exp = pe.Exp
+		return cfg.paramExpElems(pe2)
+	}
+	slicePos := func(n, length int) int {
+		if n < 0 {
+			n = length + n
+			if n < 0 {
+				n = length
 			}
-		case !syntax.ValidName(str):
-			return "", fmt.Errorf("invalid indirect expansion")
-		default:
-			vr = cfg.Env.Get(str)
-			strs = append(strs, vr.String())
+		} else if n > length {
+			n = length
 		}
-		sort.Strings(strs)
-		str = strings.Join(strs, " ")
+		return n
+	}
+	switch {
+	case pe.Length:
+		n := len(elems)
+		if indexAll == "" {
+			n = utf8.RuneCountInString(str)
+		}
+		return []string{strconv.Itoa(n)}, "", nil
 	case pe.Slice != nil:
+		if indexAll != "" {
+			// Slicing an array or the parameters selects elements.
+			// Like in Bash, $0 is the first of the parameters.
+			if name == "@" || name == "*" {
+				elems = append([]string{cfg.envGet("0")}, elems...)
+			}
+			if pe.Slice.Offset != nil {
+				n, err := Arithm(cfg, pe.Slice.Offset)
+				if err != nil {
+					return nil, "", err
+				}
+				elems = elems[slicePos(n, len(elems)):]
+			}
+			if pe.Slice.Length != nil {
+				n, err := Arithm(cfg, pe.Slice.Length)
+				if err != nil {
+					return nil, "", err
+				}
+				if n < 0 {
+					return nil, "", fmt.Errorf("%d: substring expression < 0", n)
+				}
+				elems = elems[:slicePos(n, len(elems))]
+			}
+			break
+		}
+		// Like ${#str}, offsets and lengths count characters, not bytes.
+		count := utf8.RuneCountInString(str)
+		start, end := 0, count
 		if pe.Slice.Offset != nil {
 			n, err := Arithm(cfg, pe.Slice.Offset)
 			if err != nil {
-				return "", err
+				return nil, "", err
 			}
-			str = str[slicePos(n):]
+			start = slicePos(n, count)
 		}
 		if pe.Slice.Length != nil {
 			n, err := Arithm(cfg, pe.Slice.Length)
 			if err != nil {
-				return "", err
+				return nil, "", err
+			}
+			if n < 0 {
+				// A negative length is an offset from the end.
+				if end = count + n; end < start {
+					return nil, "", fmt.Errorf("%d: substring expression < 0", n)
+				}
+			} else if n < count-start {
+				end = start + n
 			}
-			str = str[:slicePos(n)]
 		}
+		elems[0] = str[runeOffset(str, start):runeOffset(str, end)]
 	case pe.Repl != nil:
-		orig, err := Pattern(cfg, pe.Repl.Orig)
+		origWord, anchor := replAnchor(pe.Repl)
+		orig, err := Pattern(cfg, origWord)
 		if err != nil {
-			return "", err
+			return nil, "", err
 		}
-		with, err := Literal(cfg, pe.Repl.With)
+		with, err := Literal(cfg, quoteEscaped(pe.Repl.With))
 		if err != nil {
-			return "", err
+			return nil, "", err
 		}
 		n := 1
 		if pe.Repl.All {
 			n = -1
 		}
-		locs := findAllIndex(orig, str, n)
-		buf := cfg.strBuilder()
-		last := 0
-		for _, loc := range locs {
-			buf.WriteString(str[last:loc[0]])
-			buf.WriteString(with)
-			last = loc[1]
+		for i, elem := range elems {
+			locs := findAllIndex(orig, elem, n, anchor)
+			buf := cfg.strBuilder()
+			last := 0
+			for _, loc := range locs {
+				buf.WriteString(elem[last:loc[0]])
+				buf.WriteString(with)
+				last = loc[1]
+			}
+			buf.WriteString(elem[last:])
+			elems[i] = buf.String()
 		}
-		buf.WriteString(str[last:])
-		str = buf.String()
 	case pe.Exp != nil:
 		arg, err := Literal(cfg, pe.Exp.Word)
 		if err != nil {
-			return "", err
+			return nil, "", err
 		}
 		switch op := pe.Exp.Op; op {
 		case syntax.AlternateUnsetOrNull:
@@ -167,7 +291,7 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 			fallthrough
 		case syntax.AlternateUnset:
 			if vr.IsSet() {
-				str = arg
+				return []string{arg}, "", nil
 			}
 		case syntax.DefaultUnset:
 			if vr.IsSet() {
@@ -176,16 +300,22 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 			fallthrough
 		case syntax.DefaultUnsetOrNull:
 			if str == "" {
-				str = arg
+				return []string{arg}, "", nil
 			}
 		case syntax.ErrorUnset:
 			if vr.IsSet() {
 				break
 			}
+			if arg == "" {
+				arg = "parameter not set"
+			}
 			fallthrough
 		case syntax.ErrorUnsetOrNull:
 			if str == "" {
-				return "", UnsetParameterError{
+				if arg == "" {
+					arg = "parameter null or not set"
+				}
+				return nil, "", UnsetParameterError{
 					Node:    pe,
 					Message: arg,
 				}
@@ -198,9 +328,9 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		case syntax.AssignUnsetOrNull:
 			if str == "" {
 				if err := cfg.envSet(name, arg); err != nil {
-					return "", err
+					return nil, "", err
 				}
-				str = arg
+				return []string{arg}, "", nil
 			}
 		case syntax.RemSmallPrefix, syntax.RemLargePrefix,
 			syntax.RemSmallSuffix, syntax.RemLargeSuffix:
@@ -209,7 +339,6 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 			for i, elem := range elems {
 				elems[i] = removePattern(elem, arg, suffix, small)
 			}
-			str = strings.Join(elems, " ")
 		case syntax.UpperFirst, syntax.UpperAll,
 			syntax.LowerFirst, syntax.LowerAll:
 
@@ -222,7 +351,7 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 			// empty string means '?'; nothing to do there
 			expr, err := pattern.Regexp(arg, 0)
 			if err != nil {
-				return str, nil
+				break
 			}
 			rx := regexp.MustCompile(expr)
 
@@ -231,35 +360,132 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 				for ri, r := range rs {
 					if rx.MatchString(string(r)) {
 						rs[ri] = caseFunc(r)
-						if !all {
-							break
-						}
+					}
+					if !all {
+						// Only the first character may change.
+						break
 					}
 				}
 				elems[i] = string(rs)
 			}
-			str = strings.Join(elems, " ")
 		case syntax.OtherParamOps:
-			switch arg {
-			case "Q":
-				str = strconv.Quote(str)
-			case "E":
-				tail := str
-				var rns []rune
-				for tail != "" {
-					var rn rune
-					rn, _, tail, _ = strconv.UnquoteChar(tail, 0)
-					rns = append(rns, rn)
+			for i, elem := range elems {
+				switch arg {
+				case "Q":
+					elems[i] = syntax.Quote(elem)
+				case "E":
+					tail := elem
+					var rns []rune
+					for tail != "" {
+						var rn rune
+						rn, _, tail, _ = strconv.UnquoteChar(tail, 0)
+						rns = append(rns, rn)
+					}
+					elems[i] = string(rns)
+				case "P", "A", "a":
+					panic(fmt.Sprintf("unhandled @%s param expansion", arg))
+				default:
+					panic(fmt.Sprintf("unexpected @%s param expansion", arg))
 				}
-				str = string(rns)
-			case "P", "A", "a":
-				panic(fmt.Sprintf("unhandled @%s param expansion", arg))
-			default:
-				panic(fmt.Sprintf("unexpected @%s param expansion", arg))
 			}
 		}
 	}
-	return str, nil
+	return elems, indexAll, nil
+}
+
+// indirectParam returns the parameter that an indirect expansion like ${!ref}
+// refers to. The reference may be a variable name like "foo", a positional or
+// special parameter like "1" or "@", or an array element like "foo[1]" or
+// "foo[@]".
+func indirectParam(ref string) (*syntax.ParamExp, error) {
+	name, index := ref, ""
+	if i := strings.IndexByte(ref, '['); i > 0 && strings.HasSuffix(ref, "]") {
+		name, index = ref[:i], ref[i+1:len(ref)-1]
+	}
+	pe := &syntax.ParamExp{Param: &syntax.Lit{Value: name}}
+	switch {
+	case syntax.ValidName(name):
+	case index != "":
+		return nil, fmt.Errorf("invalid indirect expansion")
+	case len(name) == 1 && strings.ContainsAny(name, "@*#?-$!"):
+	case name != "" && strings.Trim(name, "0123456789") == "":
+	default:
+		return nil, fmt.Errorf("invalid indirect expansion")
+	}
+	switch index {
+	case "":
+	case "@", "*":
+		pe.Index = &syntax.Word{Parts: []syntax.WordPart{
+			&syntax.Lit{Value: index},
+		}}
+	default:
+		expr, err := syntax.NewParser().Arithmetic(strings.NewReader(index))
+		if err != nil {
+			return nil, fmt.Errorf("invalid indirect expansion")
+		}
+		pe.Index = expr
+	}
+	return pe, nil
+}
+
+// replAnchor returns the pattern to search for in a search and replace
+// expression, and the anchor at its start, if any. Like in Bash, an unquoted
+// '#' or '%' at the start of the pattern, as in ${a/#x/y} or ${a/%x/y}, means
+// that it must match at the start or end of the value, respectively.
+func replAnchor(repl *syntax.Replace) (*syntax.Word, byte) {
+	word := repl.Orig
+	if word == nil {
+		word = &syntax.Word{}
+	}
+	if repl.All || len(word.Parts) == 0 {
+		return word, 0
+	}
+	lit, ok := word.Parts[0].(*syntax.Lit)
+	if !ok || lit.Value == "" || (lit.Value[0] != '#' && lit.Value[0] != '%') {
+		return word, 0
+	}
+	lit2 := *lit
+	lit2.Value = lit.Value[1:]
+	word2 := *word
+	word2.Parts = append([]syntax.WordPart{&lit2}, word.Parts[1:]...)
+	return &word2, lit.Value[0]
+}
+
+// quoteEscaped returns a copy of a word where the characters escaped with a
+// backslash in its literal parts are single-quoted instead, so that they are
+// kept verbatim and not subject to tilde expansion. Bash does this for the
+// replacement string of a search and replace expression even within double
+// quotes, and for regular expressions.
+func quoteEscaped(word *syntax.Word) *syntax.Word {
+	if word == nil {
+		return nil
+	}
+	word2 := *word
+	word2.Parts = nil
+	for _, part := range word.Parts {
+		lit, ok := part.(*syntax.Lit)
+		if !ok {
+			word2.Parts = append(word2.Parts, part)
+			continue
+		}
+		s := lit.Value
+		for {
+			i := strings.IndexByte(s, '\\')
+			if i < 0 || i+1 >= len(s) {
+				break
+			}
+			_, size := utf8.DecodeRuneInString(s[i+1:])
+			word2.Parts = append(word2.Parts,
+				&syntax.Lit{ValuePos: lit.ValuePos, ValueEnd: lit.ValueEnd, Value: s[:i]},
+				&syntax.SglQuoted{Left: lit.ValuePos, Right: lit.ValueEnd, Value: s[i+1 : i+1+size]},
+			)
+			s = s[i+1+size:]
+		}
+		lit2 := *lit
+		lit2.Value = s
+		word2.Parts = append(word2.Parts, &lit2)
+	}
+	return &word2
 }
 
 func removePattern(str, pat string, fromEnd, shortest bool) string {
@@ -313,7 +539,7 @@ func (cfg *Config) varInd(vr Variable, idx syntax.ArithmExpr) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		if len(vr.List) > 0 {
+		if i >= 0 && i < len(vr.List) {
 			return vr.List[i], nil
 		}
 	case Associative:
@@ -338,13 +564,35 @@ func (cfg *Config) varInd(vr Variable, idx syntax.ArithmExpr) (string, error) {
 	return "", nil
 }
 
+// namesByPrefix returns the sorted names of the set variables starting with the
+// given prefix.
 func (cfg *Config) namesByPrefix(prefix string) []string {
-	var names []string
+	// Names may appear more than once, the latest taking priority.
+	set := make(map[string]bool)
 	cfg.Env.Each(func(name string, vr Variable) bool {
 		if strings.HasPrefix(name, prefix) {
-			names = append(names, name)
+			set[name] = vr.IsSet()
 		}
 		return true
 	})
+	var names []string
+	for name, isSet := range set {
+		if isSet {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
 	return names
 }
+
+// runeOffset returns the byte offset of the character at index n in s, or the
+// length of s if there are fewer characters.
+func runeOffset(s string, n int) int {
+	for i := range s {
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(s)
+}
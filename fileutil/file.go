@@ -12,11 +12,11 @@ import (
 )
 
 var (
-	shebangRe = regexp.MustCompile(`^#!\s?/(usr/)?bin/(env\s+)?(sh|bash)\s`)
+	shebangRe = regexp.MustCompile(`^#!\s?/(usr/)?bin/(env\s+)?(sh|bash|mksh)\s`)
 	extRe     = regexp.MustCompile(`\.(sh|bash)$`)
 )
 
-// HasShebang reports whether bs begins with a valid sh or bash shebang.
+// HasShebang reports whether bs begins with a valid sh, bash, or mksh shebang.
 // It supports variations with /usr and env.
 func HasShebang(bs []byte) bool {
 	return shebangRe.Match(bs)
@@ -20,14 +20,15 @@ import (
 	"sync"
 	"time"
 
-	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
 )
 
 // A Runner interprets shell programs. It can be reused, but it is not safe for
-// concurrent use. You should typically use New to build a new Runner.
+// concurrent use. You should typically use New to build a new Runner. To run
+// many programs concurrently, such as in a server, configure one Runner and
+// give each goroutine its own via Clone.
 //
 // Note that writes to Stdout and Stderr may be concurrent if background
 // commands are used. If you plan on using an io.Writer implementation that
@@ -58,16 +59,70 @@ type Runner struct {
 
 	alias map[string]alias
 
+	// readOnlyFuncs holds the names of the functions which were made
+	// read-only, for example via "readonly -f".
+	readOnlyFuncs map[string]bool
+
+	// disabledBuiltins holds the names of the builtins disabled via
+	// "enable -n", which are then looked up as programs instead.
+	disabledBuiltins map[string]bool
+
+	// compSpecs holds the programmable completion specifications registered
+	// via the "complete" builtin, by command name.
+	compSpecs map[string]compSpec
+
+	// hash remembers the paths of the programs executed so far, to avoid
+	// searching $PATH again for each execution.
+	hash map[string]hashEntry
+
 	// execHandler is a function responsible for executing programs. It must be non-nil.
 	execHandler ExecHandlerFunc
 
 	// openHandler is a function responsible for opening files. It must be non-nil.
 	openHandler OpenHandlerFunc
 
+	// commandHook is called after each builtin or program is run, if non-nil.
+	commandHook func(CommandEvent)
+
+	// notFoundHandler runs the programs not found in $PATH, if set via
+	// CommandNotFoundHandler.
+	notFoundHandler ExecHandlerFunc
+
+	// builtins holds the builtins registered via Builtin and
+	// OverrideBuiltin, by name.
+	builtins map[string]BuiltinHandlerFunc
+
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
 
+	// teeOut and teeErr receive a copy of what's written to stdout and
+	// stderr, if non-nil. See TeeStdIO.
+	teeOut io.Writer
+	teeErr io.Writer
+
+	// limits holds the limits set via OutputLimit and TimeLimit, if any.
+	limits *limits
+
+	// noCmdSubst and noProcSubst are set via DisableCmdSubst and
+	// DisableProcSubst.
+	noCmdSubst  bool
+	noProcSubst bool
+
+	// interactive is set via Interactive.
+	interactive bool
+
+	// termSize returns the size of the terminal for $COLUMNS and $LINES, if
+	// set via TermSize.
+	termSize func() (cols, rows int)
+
+	// xtraceWriter receives the output of the xtrace option, if set via
+	// XTraceWriter. Otherwise, it goes to stderr.
+	xtraceWriter io.Writer
+
+	// maxCallDepth is the nesting limit set via MaxCallDepth.
+	maxCallDepth int
+
 	ecfg *expand.Config
 	ectx context.Context // just so that Runner.Subshell can use it again
 
@@ -87,9 +142,22 @@ type Runner struct {
 
 	filename string // only if Node was a File
 
-	// like Vars, but local to a func i.e. "local foo=bar"
+	// like Vars, but local to a func i.e. "local foo=bar"; since scoping
+	// is dynamic, these are shared with nested function calls
 	funcVars map[string]expand.Variable
 
+	// funcShadowed holds the variables shadowed by the locals of the
+	// running function, to be restored once it returns. A nil value means
+	// that there was no local variable to restore.
+	funcShadowed map[string]*expand.Variable
+
+	// callStack holds a frame for each function being run and each file
+	// being sourced, the innermost last. It backs the "caller" builtin.
+	callStack []callFrame
+
+	// sourceFile is the name of the file being sourced, if any.
+	sourceFile string
+
 	// like Vars, but local to a cmd i.e. "foo=bar prog args..."
 	cmdVars map[string]string
 
@@ -104,9 +172,21 @@ type Runner struct {
 	// track if a sourced script set positional parameters
 	sourceSetParams bool
 
+	// pipeStatus holds the exit status of each command in the last
+	// pipeline, for $PIPESTATUS.
+	pipeStatus []int
+
 	err       error // current shell exit code or fatal error
 	exitShell bool  // whether the shell needs to exit
 
+	// ranExitTrap is set once the EXIT trap runs, for Runner.RanExitTrap.
+	ranExitTrap bool
+
+	// aborting is set along with exitShell when a fatal error, such as
+	// ${name:?word} on an unset parameter, should only stop the Run call
+	// of an interactive shell.
+	aborting bool
+
 	// The current and last exit status code. They can only be different if
 	// the interpreter is in the middle of running a statement. In that
 	// scenario, 'exit' is the status code for the statement being run, and
@@ -114,7 +194,16 @@ type Runner struct {
 	exit     int
 	lastExit int
 
-	bgShells errgroup.Group
+	// bgProcs holds all background shells spawned by this runner, in order.
+	bgProcs []*bgProc
+
+	// fds holds the file descriptors other than the standard ones, such as
+	// the pipes to coprocesses, keyed by their number.
+	fds map[int]io.ReadWriteCloser
+
+	// coprocs holds the coprocesses started by this shell which haven't
+	// been cleaned up yet.
+	coprocs []*coprocState
 
 	opts runnerOpts
 
@@ -135,6 +224,66 @@ type Runner struct {
 	// keepRedirs is used so that "exec" can make any redirections
 	// apply to the current shell, and not just the command.
 	keepRedirs bool
+
+	// traps holds the commands set via the trap builtin, keyed by the name
+	// of the condition such as "EXIT" or "ERR".
+	traps map[string]string
+
+	// parentTraps holds the traps of the parent shell, which a subshell
+	// lists via the trap builtin until it changes any trap of its own.
+	parentTraps map[string]string
+
+	// handlingTrap is used so that traps don't trigger themselves.
+	handlingTrap bool
+
+	// bashCommand is the simple command being run, for $BASH_COMMAND. It is
+	// only printed when the variable is used, as that's rare.
+	bashCommand syntax.Command
+
+	// startTime is when the shell was started, for printf's "%(fmt)T" with
+	// -2. It is set by Reset and kept by subshells.
+	startTime time.Time
+
+	// substDepth is how many command substitutions we're nested in, so that
+	// the xtrace option can repeat the first character of $PS4 accordingly.
+	substDepth int
+
+	// callDepth is how many function calls, sourced files, and evals we're
+	// nested in, to enforce MaxCallDepth and $FUNCNEST.
+	callDepth int
+}
+
+type bgProc struct {
+	// done is closed when the background shell finishes, after which the
+	// fields below are set.
+	done chan struct{}
+	exit int
+	err  error
+
+	// cancel stops the background shell, such as when the kill builtin
+	// sends it a signal.
+	cancel context.CancelFunc
+	// signal is the signal which the background shell was killed with, if
+	// any. It must be accessed atomically.
+	signal int32
+
+	// disowned is set once the background shell is removed from the job
+	// table via the disown builtin, so that it's no longer waited for.
+	disowned bool
+	// reaped is set once the wait builtin with no arguments has waited for
+	// the background shell, after which its exit status is forgotten.
+	reaped bool
+}
+
+// inJobTable reports whether a background shell can still be referred to by
+// builtins like wait and disown.
+func (bg *bgProc) inJobTable() bool {
+	return !bg.disowned && !bg.reaped
+}
+
+type hashEntry struct {
+	path string
+	hits int
 }
 
 type alias struct {
@@ -159,9 +308,10 @@ func (r *Runner) optByFlag(flag string) *bool {
 // standard output writer means that the output will be discarded.
 func New(opts ...RunnerOption) (*Runner, error) {
 	r := &Runner{
-		usedNew:     true,
-		execHandler: DefaultExecHandler(2 * time.Second),
-		openHandler: DefaultOpenHandler(),
+		usedNew:      true,
+		execHandler:  DefaultExecHandler(2 * time.Second),
+		openHandler:  DefaultOpenHandler(),
+		maxCallDepth: defaultMaxCallDepth,
 	}
 	r.dirStack = r.dirBootstrap[:0]
 	for _, opt := range opts {
@@ -203,6 +353,10 @@ func Env(env expand.Environ) RunnerOption {
 
 // Dir sets the interpreter's working directory. If empty, the process's current
 // directory is used.
+//
+// The directory is only tracked by the Runner, and is used for $PWD, relative
+// paths, globbing, and running programs. The process's current directory is
+// never changed, not even by cd.
 func Dir(path string) RunnerOption {
 	return func(r *Runner) error {
 		if path == "" {
@@ -232,6 +386,8 @@ func Dir(path string) RunnerOption {
 // Params populates the shell options and parameters. For example, Params("-e",
 // "--", "foo") will set the "-e" option and the parameters ["foo"], and
 // Params("+e") will unset the "-e" option and leave the parameters untouched.
+// A single "-" ends the options like "--", but it also unsets the "-x" option,
+// and it only sets the parameters if any follow.
 //
 // This is similar to what the interpreter's "set" builtin does.
 func Params(args ...string) RunnerOption {
@@ -248,6 +404,14 @@ func Params(args ...string) RunnerOption {
 				args = args[1:]
 				break
 			}
+			if arg == "-" {
+				// Like "--", but it also disables xtrace, and
+				// the parameters are only set if any follow.
+				r.opts[optXTrace] = false
+				args = args[1:]
+				onlyFlags = len(args) == 0
+				break
+			}
 			enable := arg[0] == '-'
 			var opt *bool
 			if flag := arg[1:]; flag == "o" {
@@ -308,6 +472,144 @@ func OpenHandler(f OpenHandlerFunc) RunnerOption {
 	}
 }
 
+// CommandHook sets a function to be called after each simple command is run,
+// be it a builtin or a program, with the details in a CommandEvent. Calls to
+// functions are not reported, but the commands they run are.
+//
+// The hook is called from the goroutine running the command, so it may be
+// called concurrently for background jobs, pipelines, and the like.
+func CommandHook(f func(CommandEvent)) RunnerOption {
+	return func(r *Runner) error {
+		r.commandHook = f
+		return nil
+	}
+}
+
+// CommandNotFoundHandler sets a handler to run the programs which aren't found
+// in $PATH, instead of the exec handler. Like with Bash, a shell function named
+// command_not_found_handle takes precedence, and is called in a subshell with
+// the program's name and arguments as its parameters.
+//
+// Without either, the exec handler is run as usual, which for the default one
+// means an error and an exit status of 127.
+func CommandNotFoundHandler(f ExecHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		r.notFoundHandler = f
+		return nil
+	}
+}
+
+// Builtin adds a builtin command to the interpreter, which runs f. Like other
+// builtins, it's found before programs in $PATH and can be shadowed by
+// functions, and it can be used anywhere a command can, such as in pipelines.
+//
+// It's an error to use the name of a builtin provided by the interpreter; see
+// OverrideBuiltin to replace those.
+func Builtin(name string, f BuiltinHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		if isBuiltin(name) {
+			return fmt.Errorf("%s is already a builtin", name)
+		}
+		return OverrideBuiltin(name, f)(r)
+	}
+}
+
+// OverrideBuiltin is like Builtin, but it can also replace any of the builtins
+// provided by the interpreter, such as "echo" or "cd".
+func OverrideBuiltin(name string, f BuiltinHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		if name == "" {
+			return fmt.Errorf("builtin name cannot be empty")
+		}
+		if r.builtins == nil {
+			r.builtins = make(map[string]BuiltinHandlerFunc)
+		}
+		r.builtins[name] = f
+		return nil
+	}
+}
+
+// DisableCmdSubst makes command substitutions like $(cmd) and `cmd` fail with
+// an expansion error instead of running any commands. Together with
+// DisableProcSubst, it allows using the interpreter to expand untrusted input,
+// such as templates. The parser still accepts the syntax.
+func DisableCmdSubst() RunnerOption {
+	return func(r *Runner) error {
+		r.noCmdSubst = true
+		return nil
+	}
+}
+
+// DisableProcSubst makes process substitutions like <(cmd) and >(cmd) fail with
+// an expansion error instead of running any commands. See DisableCmdSubst.
+func DisableProcSubst() RunnerOption {
+	return func(r *Runner) error {
+		r.noProcSubst = true
+		return nil
+	}
+}
+
+// Interactive makes the runner behave like an interactive shell. Fatal
+// expansion errors, such as ${name:?word} on an unset or null parameter or an
+// unset variable with "set -u", then abort the command being run instead of
+// exiting the shell. Subshells are never interactive.
+//
+// Cancelling the context given to Run, such as when the user presses Ctrl-C,
+// also sets the exit status to 130, like a command interrupted by SIGINT.
+func Interactive(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.interactive = enabled
+		return nil
+	}
+}
+
+// TermSize sets the function used to get the size of the terminal in columns
+// and rows, which backs the $COLUMNS and $LINES variables unless they are
+// assigned to. It's called each time either variable is used, so that resizing
+// the terminal is taken into account. A size of zero means that it's unknown.
+//
+// By default, the size of the terminal on the standard output, error, or input
+// is used. If the size is unknown, the variables are taken from the
+// environment, or otherwise default to 80 columns and 24 lines.
+func TermSize(f func() (cols, rows int)) RunnerOption {
+	return func(r *Runner) error {
+		r.termSize = f
+		return nil
+	}
+}
+
+// XTraceWriter sets the writer which receives the output of the xtrace option,
+// as enabled by "set -x". Each traced command is written on a line of its own,
+// prefixed by the expansion of $PS4, whose first character is repeated for each
+// level of nested command substitutions. A nil writer restores the default,
+// which is to write to the interpreter's standard error.
+//
+// Unlike standard error, the writer isn't affected by redirections. It may be
+// written to concurrently by background commands and pipelines.
+func XTraceWriter(w io.Writer) RunnerOption {
+	return func(r *Runner) error {
+		r.xtraceWriter = w
+		return nil
+	}
+}
+
+// defaultMaxCallDepth is the nesting limit used unless MaxCallDepth is given.
+const defaultMaxCallDepth = 1000
+
+// MaxCallDepth sets how deeply function calls, sourced files, and evals may be
+// nested. Exceeding the limit, such as with endless recursion, is reported as
+// an error which stops the shell with exit status 1. If the $FUNCNEST variable
+// is set to a number greater than zero, it is used as the limit instead.
+//
+// The default limit is 1000. A limit of zero or less disables it, which can
+// cause a Go stack overflow in scripts that recurse without end.
+func MaxCallDepth(n int) RunnerOption {
+	return func(r *Runner) error {
+		r.maxCallDepth = n
+		return nil
+	}
+}
+
 // StdIO configures an interpreter's standard input, standard output, and
 // standard error. If out or err are nil, they default to a writer that discards
 // the output.
@@ -317,13 +619,209 @@ func StdIO(in io.Reader, out, err io.Writer) RunnerOption {
 		if out == nil {
 			out = ioutil.Discard
 		}
-		r.stdout = out
+		r.stdout = r.wrapOutput(out, r.teeOut)
 		if err == nil {
 			err = ioutil.Discard
 		}
-		r.stderr = err
+		r.stderr = r.wrapOutput(err, r.teeErr)
+		return nil
+	}
+}
+
+// TeeStdIO configures additional writers to receive a copy of everything
+// written to the interpreter's standard output and standard error, much like
+// io.MultiWriter. Unlike wrapping the writers given to StdIO, the copies are
+// kept if StdIO is used again, such as on a Runner returned by Subshell.
+//
+// Output which doesn't reach the configured writers, such as the output of a
+// command substitution or of a command redirected to a file, isn't copied
+// either. If either writer is nil, the corresponding stream isn't copied.
+func TeeStdIO(out, err io.Writer) RunnerOption {
+	return func(r *Runner) error {
+		r.teeOut, r.teeErr = out, err
+		if r.stdout != nil {
+			r.stdout = r.wrapOutput(r.stdout, out)
+		}
+		if r.stderr != nil {
+			r.stderr = r.wrapOutput(r.stderr, err)
+		}
+		return nil
+	}
+}
+
+// teeWriter writes to a writer, and copies what was written to another.
+type teeWriter struct {
+	io.Writer
+	tee io.Writer
+}
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	n, err := t.Writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := t.tee.Write(p[:n]); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// withTee returns w, replacing any previous tee with the given one.
+func withTee(w, tee io.Writer) io.Writer {
+	if t, ok := w.(teeWriter); ok {
+		w = t.Writer
+	}
+	if tee == nil {
+		return w
+	}
+	return teeWriter{w, tee}
+}
+
+// wrapOutput returns w to be used as the standard output or error, copying to
+// tee and enforcing the output limit if any.
+func (r *Runner) wrapOutput(w, tee io.Writer) io.Writer {
+	if lw, ok := w.(limitWriter); ok {
+		w = lw.Writer
+	}
+	w = withTee(w, tee)
+	if r.limits == nil || r.limits.output <= 0 {
+		return w
+	}
+	return limitWriter{w, r.limits}
+}
+
+// OutputLimit sets the maximum number of bytes that each call to Run may write
+// to the standard output and standard error combined. Once the limit is
+// exceeded, the write fails, and Run stops and returns a *LimitError. A limit
+// of zero or less means no limit.
+//
+// Like with TeeStdIO, output which doesn't reach the writers configured via
+// StdIO, such as the output of a command redirected to a file, isn't counted.
+//
+// Background commands started by a call to Run are stopped once it returns, as
+// their later output would otherwise not count towards any limit.
+func OutputLimit(n int64) RunnerOption {
+	return func(r *Runner) error {
+		r.ensureLimits().output = n
+		if r.stdout != nil {
+			r.stdout = r.wrapOutput(r.stdout, r.teeOut)
+		}
+		if r.stderr != nil {
+			r.stderr = r.wrapOutput(r.stderr, r.teeErr)
+		}
+		return nil
+	}
+}
+
+// TimeLimit sets the maximum duration of each call to Run. Once it's exceeded,
+// Run stops as if its context was cancelled, and returns a *LimitError. Unlike
+// a context deadline, the limit applies to each call to Run without the caller
+// having to set it up. A limit of zero or less means no limit.
+//
+// Background commands started by a call to Run are stopped once it returns.
+func TimeLimit(d time.Duration) RunnerOption {
+	return func(r *Runner) error {
+		r.ensureLimits().time = d
+		return nil
+	}
+}
+
+// LimitError is returned by Runner.Run when a limit set via OutputLimit or
+// TimeLimit was exceeded. Only one of its fields is set.
+type LimitError struct {
+	// Output is the output limit in bytes, if it was exceeded.
+	Output int64
+	// Time is the time limit, if it was exceeded.
+	Time time.Duration
+}
+
+func (e *LimitError) Error() string {
+	if e.Output > 0 {
+		return fmt.Sprintf("output limit of %d bytes exceeded", e.Output)
+	}
+	return fmt.Sprintf("time limit of %v exceeded", e.Time)
+}
+
+// limits holds the limits set on a Runner, and the state needed to enforce
+// them while Run is running. The output state is shared by the writers in
+// subshells, which may write concurrently.
+type limits struct {
+	output int64
+	time   time.Duration
+
+	mu      sync.Mutex
+	written int64
+	err     *LimitError // the first limit exceeded in the current Run
+	cancel  context.CancelFunc
+}
+
+func (r *Runner) ensureLimits() *limits {
+	if r.limits == nil {
+		r.limits = &limits{}
+	}
+	return r.limits
+}
+
+// start resets the state of the limits for a call to Run, which will be
+// stopped via cancel once a limit is exceeded.
+func (l *limits) start(cancel context.CancelFunc) {
+	l.mu.Lock()
+	l.written = 0
+	l.err = nil
+	l.cancel = cancel
+	l.mu.Unlock()
+}
+
+// exceed records that a limit was exceeded and stops the running program,
+// unless a limit was exceeded already. It returns the first error recorded.
+func (l *limits) exceed(err *LimitError) *LimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
+		l.err = err
+		if l.cancel != nil {
+			l.cancel()
+		}
+	}
+	return l.err
+}
+
+// exceeded returns the limit exceeded during the current Run, if any.
+func (l *limits) exceeded() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err == nil {
 		return nil
 	}
+	return l.err
+}
+
+// limitWriter writes to a writer within the output limit.
+type limitWriter struct {
+	io.Writer
+	l *limits
+}
+
+func (w limitWriter) Write(p []byte) (int, error) {
+	l := w.l
+	l.mu.Lock()
+	if l.err != nil {
+		l.mu.Unlock()
+		return 0, l.err
+	}
+	allowed := l.output - l.written
+	if int64(len(p)) <= allowed {
+		l.written += int64(len(p))
+		l.mu.Unlock()
+		return w.Writer.Write(p)
+	}
+	l.written = l.output
+	l.mu.Unlock()
+	n, err := w.Writer.Write(p[:allowed])
+	if err != nil {
+		return n, err
+	}
+	return n, l.exceed(&LimitError{Output: l.output})
 }
 
 func (r *Runner) optByName(name string, bash bool) *bool {
@@ -351,16 +849,25 @@ var shellOptsTable = [...]struct {
 	// that have no flag form
 	{"a", "allexport"},
 	{"e", "errexit"},
+	{"E", "errtrace"},
+	{"T", "functrace"},
+	{"C", "noclobber"},
 	{"n", "noexec"},
 	{"f", "noglob"},
 	{"u", "nounset"},
+	{"P", "physical"},
 	{" ", "pipefail"},
+	{"x", "xtrace"},
 }
 
 var bashOptsTable = [...]string{
 	// sorted alphabetically by name
 	"expand_aliases",
+	"extglob",
+	"failglob",
 	"globstar",
+	"lastpipe",
+	"nullglob",
 }
 
 // To access the shell options arrays without a linear search when we
@@ -369,13 +876,22 @@ var bashOptsTable = [...]string{
 const (
 	optAllExport = iota
 	optErrExit
+	optErrTrace
+	optFuncTrace
+	optNoClobber
 	optNoExec
 	optNoGlob
 	optNoUnset
+	optPhysical
 	optPipeFail
+	optXTrace
 
 	optExpandAliases
+	optExtGlob
+	optFailGlob
 	optGlobStar
+	optLastPipe
+	optNullGlob
 )
 
 // Reset returns a runner to its initial state, right before the first call to
@@ -389,6 +905,9 @@ func (r *Runner) Reset() {
 	if !r.usedNew {
 		panic("use interp.New to construct a Runner")
 	}
+	for _, f := range r.fds {
+		f.Close()
+	}
 	if !r.didReset {
 		r.origDir = r.Dir
 		r.origParams = r.Params
@@ -402,6 +921,20 @@ func (r *Runner) Reset() {
 		Env:         r.Env,
 		execHandler: r.execHandler,
 		openHandler: r.openHandler,
+		commandHook: r.commandHook,
+		builtins:    r.builtins,
+		teeOut:      r.teeOut,
+		teeErr:      r.teeErr,
+		limits:      r.limits,
+		noCmdSubst:  r.noCmdSubst,
+		noProcSubst: r.noProcSubst,
+		interactive: r.interactive,
+		termSize:    r.termSize,
+
+		xtraceWriter: r.xtraceWriter,
+		maxCallDepth: r.maxCallDepth,
+
+		notFoundHandler: r.notFoundHandler,
 
 		// These can be set by functions like Dir or Params, but
 		// builtins can overwrite them; reset the fields to whatever the
@@ -461,9 +994,75 @@ func (r *Runner) Reset() {
 	}
 
 	r.dirStack = append(r.dirStack, r.Dir)
+	r.startTime = time.Now()
 	r.didReset = true
 }
 
+// Clone returns a new Runner with the same configuration as r, but none of its
+// state, as if New had been called again with the same options. This includes
+// the environment, handlers, limits, and the directory, parameters, options,
+// and standard input and outputs set up before r first ran. Variables,
+// functions, and other changes made by running programs are not kept.
+//
+// Clone is much cheaper than New, as the options aren't applied again and the
+// environment isn't copied. Clones can run concurrently with each other as long
+// as the shared configuration, such as the Env field and the handlers, is safe
+// for concurrent use. The same goes for the standard input and outputs; use
+// StdIO on each clone to give it its own.
+//
+// Like Subshell, Clone is not safe to use concurrently with Run on r.
+func (r *Runner) Clone() *Runner {
+	if !r.usedNew {
+		panic("use interp.New to construct a Runner")
+	}
+	dir, params, opts := r.Dir, r.Params, r.opts
+	stdin, stdout, stderr := r.stdin, r.stdout, r.stderr
+	if r.didReset {
+		dir, params, opts = r.origDir, r.origParams, r.origOpts
+		stdin, stdout, stderr = r.origStdin, r.origStdout, r.origStderr
+	}
+	// Keep in sync with the fields kept by Reset.
+	r2 := &Runner{
+		Env:         r.Env,
+		Dir:         dir,
+		Params:      params,
+		execHandler: r.execHandler,
+		openHandler: r.openHandler,
+		commandHook: r.commandHook,
+		stdin:       stdin,
+		stdout:      stdout,
+		stderr:      stderr,
+		teeOut:      r.teeOut,
+		teeErr:      r.teeErr,
+		noCmdSubst:  r.noCmdSubst,
+		noProcSubst: r.noProcSubst,
+		interactive: r.interactive,
+		termSize:    r.termSize,
+		opts:        opts,
+		usedNew:     true,
+
+		xtraceWriter: r.xtraceWriter,
+		maxCallDepth: r.maxCallDepth,
+
+		notFoundHandler: r.notFoundHandler,
+	}
+	r2.dirStack = r2.dirBootstrap[:0]
+	// Options like Builtin may still be applied to either runner.
+	if len(r.builtins) > 0 {
+		r2.builtins = make(map[string]BuiltinHandlerFunc, len(r.builtins))
+		for name, f := range r.builtins {
+			r2.builtins[name] = f
+		}
+	}
+	// The limits also hold the state of each call to Run.
+	if l := r.limits; l != nil {
+		r2.limits = &limits{output: l.output, time: l.time}
+		r2.stdout = r2.wrapOutput(r2.stdout, r2.teeOut)
+		r2.stderr = r2.wrapOutput(r2.stderr, r2.teeErr)
+	}
+	return r2
+}
+
 // exitStatus is a non-zero status code resulting from running a shell node.
 type exitStatus uint8
 
@@ -490,25 +1089,72 @@ func IsExitStatus(err error) (status uint8, ok bool) {
 // Run can be called multiple times synchronously to interpret programs
 // incrementally. To reuse a Runner without keeping the internal shell state,
 // call Reset.
-func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
+//
+// For example, an interactive shell can parse and run one statement at a time,
+// keeping variables, functions, the current directory, and $? between calls.
+// An error only affects the Run call which returned it; the loop should stop
+// once Exited reports true, such as after the exit builtin. The EXIT trap runs
+// at the end of a *File, or once a *Stmt or Command exits the shell.
+func (r *Runner) Run(ctx context.Context, node syntax.Node) (retErr error) {
 	if !r.didReset {
 		r.Reset()
 	}
+	origCtx := ctx
+	if l := r.limits; l != nil {
+		parent := ctx
+		var cancel context.CancelFunc
+		if l.time > 0 {
+			ctx, cancel = context.WithTimeout(ctx, l.time)
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
+		l.start(cancel)
+		defer func() {
+			if ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+				l.exceed(&LimitError{Time: l.time})
+			}
+			// Stop any background commands, so that they can't
+			// keep running or writing once Run returns.
+			cancel()
+			for _, bg := range r.bgProcs {
+				<-bg.done
+			}
+			if err := l.exceeded(); err != nil {
+				retErr = err
+			}
+		}()
+	}
 	r.fillExpandConfig(ctx)
 	r.err = nil
-	r.exitShell = false
+	r.exitShell, r.aborting = false, false
+	r.ranExitTrap = false
 	r.filename = ""
 	switch x := node.(type) {
 	case *syntax.File:
 		r.filename = x.Name
 		r.stmts(ctx, x.Stmts)
+		r.exitTrap(ctx)
 	case *syntax.Stmt:
 		r.stmt(ctx, x)
+		if r.exitShell && !r.aborting {
+			r.exitTrap(ctx)
+		}
 	case syntax.Command:
 		r.cmd(ctx, x)
+		if r.exitShell && !r.aborting {
+			r.exitTrap(ctx)
+		}
 	default:
 		return fmt.Errorf("node can only be File, Stmt, or Command: %T", x)
 	}
+	if r.aborting {
+		r.exitShell, r.aborting = false, false
+	}
+	if r.interactive && origCtx.Err() == context.Canceled && r.err == context.Canceled {
+		// Like a command interrupted by SIGINT.
+		r.err = nil
+		r.exit, r.lastExit = 130, 130
+	}
 	if r.exit != 0 {
 		r.setErr(NewExitStatus(uint8(r.exit)))
 	}
@@ -516,7 +1162,8 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 }
 
 // Exited reports whether the last Run call should exit an entire shell. This
-// can be triggered by the "exit" built-in command, for example.
+// can be triggered by the "exit" built-in command, for example. Reaching the
+// end of a *syntax.File does not count as exiting.
 //
 // Note that this state is overwritten at every Run call, so it should be
 // checked immediately after each Run call.
@@ -524,11 +1171,64 @@ func (r *Runner) Exited() bool {
 	return r.exitShell
 }
 
+// ExitStatus returns the exit status of the last Run call, which is what $?
+// expands to in the next one. Unlike the error returned by Run, it is also
+// available when the status is zero. Like Exited, it includes the effect of
+// an EXIT trap.
+func (r *Runner) ExitStatus() uint8 {
+	return uint8(r.exit)
+}
+
+// RanExitTrap reports whether the last Run call ran the EXIT trap, such as at
+// the end of a *syntax.File or when a statement called "exit".
+func (r *Runner) RanExitTrap() bool {
+	return r.ranExitTrap
+}
+
+// ExpandWord parses s as a single shell word and expands it like the
+// interpreter expands the arguments of a command, returning the resulting
+// fields. This includes tilde, parameter, arithmetic, and brace expansions,
+// command substitutions, field splitting, and globbing, all using the runner's
+// current state such as its variables, options, and directory.
+//
+// An empty or blank string results in no fields. An error is returned if s is
+// made up of more than one word, or if either parsing or expanding fails.
+//
+// This can be useful to expand values like "~/foo" or "$HOME/*.conf" in
+// configuration files without running a whole program.
+func (r *Runner) ExpandWord(ctx context.Context, s string) ([]string, error) {
+	var words []*syntax.Word
+	err := syntax.NewParser().Words(strings.NewReader(s), func(w *syntax.Word) bool {
+		words = append(words, w)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	switch len(words) {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("%q is more than one word", s)
+	}
+	if !r.didReset {
+		r.Reset()
+	}
+	r.fillExpandConfig(ctx)
+	return expand.Fields(r.ecfg, words[0])
+}
+
 // Subshell makes a copy of the given Runner, suitable for use concurrently
 // with the original.  The copy will have the same environment, including
 // variables and functions, but they can all be modified without affecting the
 // original.
 //
+// Like in Bash, traps are reset in the copy, with a few exceptions: ignored
+// conditions stay ignored, and the ERR and DEBUG traps are kept if the errtrace
+// and functrace options are set. Still, the trap builtin lists the original's
+// traps until the copy sets or resets one.
+//
 // Subshell is not safe to use concurrently with Run.  Orchestrating this is
 // left up to the caller; no locking is performed.
 //
@@ -536,24 +1236,43 @@ func (r *Runner) Exited() bool {
 // the copy.
 func (r *Runner) Subshell() *Runner {
 	// Keep in sync with the Runner type. Manually copy fields, to not copy
-	// sensitive ones like errgroup.Group, and to do deep copies of slices.
+	// sensitive ones like bgProcs, and to do deep copies of slices.
 	r2 := &Runner{
 		Env:         r.Env,
 		Dir:         r.Dir,
 		Params:      r.Params,
 		execHandler: r.execHandler,
 		openHandler: r.openHandler,
+		commandHook: r.commandHook,
+		builtins:    r.builtins,
 		stdin:       r.stdin,
 		stdout:      r.stdout,
 		stderr:      r.stderr,
+		teeOut:      r.teeOut,
+		teeErr:      r.teeErr,
+		noCmdSubst:  r.noCmdSubst,
+		noProcSubst: r.noProcSubst,
+		termSize:    r.termSize,
 		filename:    r.filename,
 		opts:        r.opts,
 		usedNew:     r.usedNew,
 		exit:        r.exit,
 		lastExit:    r.lastExit,
+		pipeStatus:  r.pipeStatus,
+		bashCommand: r.bashCommand,
+		startTime:   r.startTime,
+		substDepth:  r.substDepth,
+
+		xtraceWriter: r.xtraceWriter,
+		maxCallDepth: r.maxCallDepth,
+		callDepth:    r.callDepth,
+
+		notFoundHandler: r.notFoundHandler,
 
 		origStdout: r.origStdout, // used for process substitutions
 	}
+	r2.callStack = append([]callFrame(nil), r.callStack...)
+	r2.sourceFile = r.sourceFile
 	r2.Vars = make(map[string]expand.Variable, len(r.Vars))
 	for k, v := range r.Vars {
 		v2 := v
@@ -580,12 +1299,58 @@ func (r *Runner) Subshell() *Runner {
 	for k, v := range r.Funcs {
 		r2.Funcs[k] = v
 	}
+	if l := len(r.readOnlyFuncs); l > 0 {
+		r2.readOnlyFuncs = make(map[string]bool, l)
+		for k, v := range r.readOnlyFuncs {
+			r2.readOnlyFuncs[k] = v
+		}
+	}
+	if l := len(r.disabledBuiltins); l > 0 {
+		r2.disabledBuiltins = make(map[string]bool, l)
+		for k, v := range r.disabledBuiltins {
+			r2.disabledBuiltins[k] = v
+		}
+	}
+	if l := len(r.fds); l > 0 {
+		// The file descriptors are still the parent's, so the
+		// subshell must not close them.
+		r2.fds = make(map[int]io.ReadWriteCloser, l)
+		for k, v := range r.fds {
+			r2.fds[k] = streamFd{v}
+		}
+	}
+	if l := len(r.hash); l > 0 {
+		r2.hash = make(map[string]hashEntry, l)
+		for k, v := range r.hash {
+			r2.hash[k] = v
+		}
+	}
+	// Traps aren't inherited by subshells, except for ERR and DEBUG when
+	// errtrace and functrace are set, respectively. Ignored conditions,
+	// set via an empty command, stay ignored. Like in Bash, the trap
+	// builtin lists the parent's traps until the subshell sets its own, so
+	// that "$(trap -p)" can be used to save and restore them.
+	for name, cmd := range r.traps {
+		switch {
+		case cmd == "",
+			name == "ERR" && r.opts[optErrTrace],
+			name == "DEBUG" && r.opts[optFuncTrace]:
+			r2.setTrap(name, cmd)
+		}
+	}
+	r2.parentTraps = r.listedTraps()
 	if l := len(r.alias); l > 0 {
 		r2.alias = make(map[string]alias, l)
 		for k, v := range r.alias {
 			r2.alias[k] = v
 		}
 	}
+	if l := len(r.compSpecs); l > 0 {
+		r2.compSpecs = make(map[string]compSpec, l)
+		for k, v := range r.compSpecs {
+			r2.compSpecs[k] = v
+		}
+	}
 
 	r2.dirStack = append(r2.dirBootstrap[:0], r.dirStack...)
 	r2.fillExpandConfig(r.ectx)
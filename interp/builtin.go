@@ -6,29 +6,72 @@ package interp
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
 )
 
+// builtinNames lists the names of all builtins, sorted.
+var builtinNames = [...]string{
+	".", ":", "[", "alias", "bg", "break", "builtin", "caller", "cd",
+	"command", "compgen", "complete", "continue", "dirs", "disown", "echo",
+	"enable", "eval", "exec", "exit", "false", "fg", "getopts", "hash", "kill",
+	"popd", "printf", "pushd", "pwd", "read", "return", "set", "shift",
+	"shopt", "source", "test", "trap", "true", "type", "ulimit", "umask",
+	"unalias", "unset", "wait",
+}
+
 func isBuiltin(name string) bool {
-	switch name {
-	case "true", ":", "false", "exit", "set", "shift", "unset",
-		"echo", "printf", "break", "continue", "pwd", "cd",
-		"wait", "builtin", "trap", "type", "source", ".", "command",
-		"dirs", "pushd", "popd", "umask", "alias", "unalias",
-		"fg", "bg", "getopts", "eval", "test", "[", "exec",
-		"return", "read", "shopt":
-		return true
+	i := sort.SearchStrings(builtinNames[:], name)
+	return i < len(builtinNames) && builtinNames[i] == name
+}
+
+// isBuiltin is like the isBuiltin func, but it also includes the builtins
+// registered via Builtin, and excludes the builtins disabled via "enable -n".
+func (r *Runner) isBuiltin(name string) bool {
+	return r.knownBuiltin(name) && !r.disabledBuiltins[name]
+}
+
+// knownBuiltin is like isBuiltin, but it also includes disabled builtins.
+func (r *Runner) knownBuiltin(name string) bool {
+	return isBuiltin(name) || r.builtins[name] != nil
+}
+
+// allBuiltins returns the names of all builtins, including the builtins
+// registered via Builtin, sorted.
+func (r *Runner) allBuiltins() []string {
+	names := append([]string(nil), builtinNames[:]...)
+	for name := range r.builtins {
+		if !isBuiltin(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sourceName returns how "caller" shows a file name, where an empty name means
+// that the program wasn't read from a file.
+func sourceName(name string) string {
+	if name == "" {
+		return "NULL"
 	}
-	return false
+	return name
 }
 
 func oneIf(b bool) int {
@@ -46,6 +89,10 @@ func atoi(s string) int {
 }
 
 func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, args []string) int {
+	if f := r.builtins[name]; f != nil {
+		hc := r.handlerContext()
+		return f(context.WithValue(ctx, handlerCtxKey{}, hc), append([]string{name}, args...))
+	}
 	switch name {
 	case "true", ":":
 	case "false":
@@ -61,7 +108,8 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				r.errf("invalid exit status code: %q\n", args[0])
 				return 2
 			}
-			return n
+			// Like $?, only keep the lowest eight bits.
+			return int(uint8(n))
 		default:
 			r.errf("exit cannot take multiple arguments\n")
 			return 1
@@ -107,15 +155,27 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			}
 		}
 
+		exit := 0
 		for _, arg := range args {
 			if vr := r.lookupVar(arg); vr.IsSet() && vars {
+				if vr.ReadOnly {
+					r.errf("unset: %s: cannot unset: readonly variable\n", arg)
+					exit = 1
+					continue
+				}
 				r.delVar(arg)
 				continue
 			}
 			if _, ok := r.Funcs[arg]; ok && funcs {
+				if r.readOnlyFuncs[arg] {
+					r.errf("unset: %s: cannot unset: readonly function\n", arg)
+					exit = 1
+					continue
+				}
 				delete(r.Funcs, arg)
 			}
 		}
+		return exit
 	case "echo":
 		newline, doExpand := true, false
 	echoOpts:
@@ -131,19 +191,25 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			}
 			args = args[1:]
 		}
-		for i, arg := range args {
-			if i > 0 {
-				r.out(" ")
-			}
-			if doExpand {
-				arg, _, _ = expand.Format(r.ecfg, arg, nil)
-			}
-			r.out(arg)
-		}
+		line := strings.Join(args, " ")
 		if newline {
-			r.out("\n")
+			line += "\n"
+		}
+		if doExpand {
+			// Like printf's "%b", where "\c" stops all output,
+			// including the remaining arguments and the newline.
+			line, _, _ = expand.Format(r.ecfg, "%b", []string{line})
+		}
+		// Only report writes to a closed stream, like Bash. It's
+		// killed by SIGPIPE when writing to a broken pipe.
+		if _, err := io.WriteString(r.stdout, line); errors.Is(err, syscall.EBADF) {
+			r.errf("echo: write error: %v\n", err)
+			return 1
 		}
 	case "printf":
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
 		if len(args) == 0 {
 			r.errf("usage: printf format [arguments]\n")
 			return 2
@@ -155,7 +221,10 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				r.errf("%v\n", err)
 				return 1
 			}
-			r.out(s)
+			if _, err := io.WriteString(r.stdout, s); errors.Is(err, syscall.EBADF) {
+				r.errf("printf: write error: %v\n", err)
+				return 1
+			}
 			args = args[n:]
 			if n == 0 || len(args) == 0 {
 				break
@@ -184,8 +253,48 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			return 2
 		}
 	case "pwd":
-		r.outf("%s\n", r.envGet("PWD"))
+		physical := r.opts[optPhysical]
+	pwdFlags:
+		for _, arg := range args {
+			switch arg {
+			case "-L":
+				physical = false
+			case "-P":
+				physical = true
+			case "--":
+				break pwdFlags
+			default:
+				if strings.HasPrefix(arg, "-") {
+					r.errf("pwd: invalid option %q\n", arg)
+					return 2
+				}
+				break pwdFlags
+			}
+		}
+		dir := r.envGet("PWD")
+		if physical {
+			if phys, err := filepath.EvalSymlinks(r.Dir); err == nil {
+				dir = phys
+			}
+		}
+		r.outf("%s\n", dir)
 	case "cd":
+		physical := r.opts[optPhysical]
+	cdFlags:
+		for len(args) > 0 {
+			switch args[0] {
+			case "-L":
+				physical = false
+			case "-P":
+				physical = true
+			case "--":
+				args = args[1:]
+				break cdFlags
+			default:
+				break cdFlags
+			}
+			args = args[1:]
+		}
 		var path string
 		switch len(args) {
 		case 0:
@@ -193,26 +302,191 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		case 1:
 			path = args[0]
 		default:
-			r.errf("usage: cd [dir]\n")
+			r.errf("usage: cd [-L|-P] [dir]\n")
 			return 2
 		}
-		return r.changeDir(path)
+		if cdpath := r.envGet("CDPATH"); cdpath != "" && !filepath.IsAbs(path) && !dotPrefixed(path) {
+			// An empty element means the current directory. Like bash, we
+			// print the new directory if it was found elsewhere.
+			for _, dir := range splitList(cdpath) {
+				if dir == "" {
+					if r.changeDir(path, physical) == 0 {
+						return 0
+					}
+				} else if r.changeDir(filepath.Join(dir, path), physical) == 0 {
+					r.outf("%s\n", r.envGet("PWD"))
+					return 0
+				}
+			}
+		}
+		return r.changeDir(path, physical)
 	case "wait":
+		if len(args) > 0 && args[0] == "-n" {
+			args = args[1:]
+			if len(args) > 0 && args[0] == "--" {
+				args = args[1:]
+			}
+			return r.waitAny(ctx, args)
+		}
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
 		if len(args) > 0 {
-			panic("wait with args not handled yet")
+			exit := 0
+			for _, arg := range args {
+				bg, code := r.waitTarget(arg)
+				if bg == nil {
+					exit = code
+					continue
+				}
+				select {
+				case <-bg.done:
+				case <-ctx.Done():
+					r.setErr(ctx.Err())
+					return 1
+				}
+				if _, ok := IsExitStatus(bg.err); bg.err != nil && !ok {
+					r.setErr(bg.err)
+				}
+				exit = bg.exit
+			}
+			return exit
+		}
+		// Wait for all background shells, including those which
+		// already finished, so that none of them are left unreaped.
+		// Like in Bash, the exit status is always zero, and their exit
+		// statuses are forgotten.
+		for _, bg := range r.bgProcs {
+			if !bg.inJobTable() {
+				continue
+			}
+			select {
+			case <-bg.done:
+			case <-ctx.Done():
+				r.setErr(ctx.Err())
+				return 1
+			}
+			if _, ok := IsExitStatus(bg.err); bg.err != nil && !ok {
+				r.setErr(bg.err)
+			}
+			bg.reaped = true
+		}
+	case "kill":
+		const usage = "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\n"
+		sig := syscall.SIGTERM
+		if len(args) > 0 && args[0] != "--" && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+			spec := args[0][1:]
+			switch args[0] {
+			case "-l", "-L":
+				return r.killList(args[1:])
+			case "-s", "-n":
+				if len(args) == 1 {
+					r.errf("kill: %s: option requires an argument\n", args[0])
+					return 1
+				}
+				spec, args = args[1], args[1:]
+			}
+			args = args[1:]
+			n, err := ParseSignal(spec)
+			if err != nil {
+				r.errf("kill: %v\n", err)
+				return 1
+			}
+			sig = n
+		}
+		if len(args) > 0 && args[0] == "--" {
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			r.errf(usage)
+			return 2
+		}
+		exit := 0
+		for _, arg := range args {
+			if !r.killTarget(arg, sig) {
+				exit = 1
+			}
 		}
-		err := r.bgShells.Wait()
-		if _, ok := IsExitStatus(err); err != nil && !ok {
-			r.setErr(err)
+		return exit
+	case "disown":
+		all, running, keep := false, false, false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+			if args[0] == "--" {
+				args = args[1:]
+				break
+			}
+			for _, c := range args[0][1:] {
+				switch c {
+				case 'a':
+					all = true
+				case 'r':
+					running = true
+				case 'h':
+					keep = true
+				default:
+					r.errf("disown: -%c: invalid option\n", c)
+					r.errf("disown: usage: disown [-h] [-ar] [jobspec ... | pid ...]\n")
+					return 2
+				}
+			}
+			args = args[1:]
 		}
+		return r.disown(args, all, running, keep)
 	case "builtin":
 		if len(args) < 1 {
 			break
 		}
-		if !isBuiltin(args[0]) {
+		if !r.isBuiltin(args[0]) {
 			return 1
 		}
 		return r.builtinCode(ctx, pos, args[0], args[1:])
+	case "enable":
+		all, disable := false, false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+			for _, c := range args[0][1:] {
+				switch c {
+				case 'a':
+					all = true
+				case 'n':
+					disable = true
+				case 'p':
+					// printing is the default with no names
+				default:
+					r.errf("enable: -%c: invalid option\n", c)
+					r.errf("enable: usage: enable [-a] [-np] [name ...]\n")
+					return 2
+				}
+			}
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			for _, name := range r.allBuiltins() {
+				switch enabled := !r.disabledBuiltins[name]; {
+				case enabled && (all || !disable):
+					r.outf("enable %s\n", name)
+				case !enabled && (all || disable):
+					r.outf("enable -n %s\n", name)
+				}
+			}
+			break
+		}
+		exit := 0
+		for _, name := range args {
+			if !r.knownBuiltin(name) {
+				r.errf("enable: %s: not a shell builtin\n", name)
+				exit = 1
+				continue
+			}
+			if !disable {
+				delete(r.disabledBuiltins, name)
+				continue
+			}
+			if r.disabledBuiltins == nil {
+				r.disabledBuiltins = make(map[string]bool)
+			}
+			r.disabledBuiltins[name] = true
+		}
+		return exit
 	case "type":
 		anyNotFound := false
 		for _, arg := range args {
@@ -234,7 +508,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				r.outf("%s is a function\n", arg)
 				continue
 			}
-			if isBuiltin(arg) {
+			if r.isBuiltin(arg) {
 				r.outf("%s is a shell builtin\n", arg)
 				continue
 			}
@@ -256,7 +530,11 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("eval: %v\n", err)
 			return 1
 		}
+		if !r.enterCall("eval") {
+			return 1
+		}
 		r.stmts(ctx, file.Stmts)
+		r.leaveCall()
 		return r.exit
 	case "source", ".":
 		if len(args) < 1 {
@@ -275,11 +553,16 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("source: %v\n", err)
 			return 1
 		}
+		if !r.enterCall(name) {
+			return 1
+		}
+		defer r.leaveCall()
 
 		// Keep the current versions of some fields we might modify.
 		oldParams := r.Params
 		oldSourceSetParams := r.sourceSetParams
 		oldInSource := r.inSource
+		oldSourceFile := r.sourceFile
 
 		// If we run "source file args...", set said args as parameters.
 		// Otherwise, keep the current parameters.
@@ -292,7 +575,11 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		// parameters.
 		r.sourceSetParams = false
 		r.inSource = true // know that we're inside a sourced script.
+		r.pushFrame("source", pos)
+		r.sourceFile = args[0]
 		r.stmts(ctx, file.Stmts)
+		r.callStack = r.callStack[:len(r.callStack)-1]
+		r.sourceFile = oldSourceFile
 
 		// If we modified the parameters and the sourced file didn't
 		// explicitly set them, we restore the old ones.
@@ -339,7 +626,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			break
 		}
 		r.exitShell = true
-		r.exec(ctx, args)
+		r.exec(ctx, r.execHandler, args)
 		return r.exit
 	case "command":
 		show := false
@@ -357,16 +644,16 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			break
 		}
 		if !show {
-			if isBuiltin(args[0]) {
+			if r.isBuiltin(args[0]) {
 				return r.builtinCode(ctx, pos, args[0], args[1:])
 			}
-			r.exec(ctx, args)
+			r.execOrNotFound(ctx, pos, args)
 			return r.exit
 		}
 		last := 0
 		for _, arg := range args {
 			last = 0
-			if r.Funcs[arg] != nil || isBuiltin(arg) {
+			if r.Funcs[arg] != nil || r.isBuiltin(arg) {
 				r.outf("%s\n", arg)
 			} else if path, err := exec.LookPath(arg); err == nil {
 				r.outf("%s\n", path)
@@ -406,13 +693,13 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				return 1
 			}
 			newtop := swap()
-			if code := r.changeDir(newtop); code != 0 {
+			if code := r.changeDir(newtop, r.opts[optPhysical]); code != 0 {
 				return code
 			}
 			r.builtinCode(ctx, syntax.Pos{}, "dirs", nil)
 		case 1:
 			if change {
-				if code := r.changeDir(args[0]); code != 0 {
+				if code := r.changeDir(args[0], r.opts[optPhysical]); code != 0 {
 					return code
 				}
 				r.dirStack = append(r.dirStack, r.Dir)
@@ -441,7 +728,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.dirStack = r.dirStack[:len(r.dirStack)-1]
 			if change {
 				newtop := r.dirStack[len(r.dirStack)-1]
-				if code := r.changeDir(newtop); code != 0 {
+				if code := r.changeDir(newtop, r.opts[optPhysical]); code != 0 {
 					return code
 				}
 			} else {
@@ -452,16 +739,52 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("popd: invalid argument\n")
 			return 2
 		}
+	case "caller":
+		const usage = "caller: usage: caller [expr]\n"
+		if len(args) == 0 {
+			if len(r.callStack) == 0 {
+				return 1
+			}
+			frame := r.callStack[len(r.callStack)-1]
+			r.outf("%d %s\n", frame.line, sourceName(frame.source))
+			break
+		}
+		if len(args[0]) > 1 && args[0][0] == '-' {
+			r.errf("caller: %s: invalid option\n", args[0])
+			r.errf(usage)
+			return 2
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			r.errf("caller: %s: invalid number\n", args[0])
+			r.errf(usage)
+			return 2
+		}
+		i := len(r.callStack) - 1 - n
+		if i < 0 || (i == 0 && r.filename == "") {
+			// Like Bash, only name the "main" caller for files.
+			return 1
+		}
+		frame, callerName := r.callStack[i], "main"
+		if i > 0 {
+			callerName = r.callStack[i-1].name
+		}
+		r.outf("%d %s %s\n", frame.line, callerName, sourceName(frame.source))
 	case "return":
-		if !r.inFunc && !r.inSource {
+		if len(r.callStack) == 0 {
 			r.errf("return: can only be done from a func or sourced script\n")
 			return 1
 		}
-		code := 0
+		code := r.lastExit
 		switch len(args) {
 		case 0:
 		case 1:
-			code = atoi(args[0])
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				r.errf("return: %s: numeric argument required\n", args[0])
+				n = 2
+			}
+			code = n
 		default:
 			r.errf("return: too many arguments\n")
 			return 2
@@ -528,22 +851,35 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		if len(args) == 0 {
 			args = r.Params
 		}
-		diagnostics := !strings.HasPrefix(optstr, ":")
+		// In silent mode, errors are reported via $OPTARG instead of
+		// being printed. Like in Bash, OPTERR=0 also stops the printing.
+		silent := strings.HasPrefix(optstr, ":")
+		diagnostics := !silent && r.envGet("OPTERR") != "0"
 
 		opt, optarg, done := r.optState.Next(optstr, args)
 
-		r.setVarString(name, string(opt))
 		r.delVar("OPTARG")
 		switch {
-		case opt == '?' && diagnostics && !done:
-			r.errf("getopts: illegal option -- %q\n", optarg)
-		case opt == ':' && diagnostics:
-			r.errf("getopts: option requires an argument -- %q\n", optarg)
-		default:
-			if optarg != "" {
+		case done:
+		case opt == '?': // invalid option
+			if silent {
 				r.setVarString("OPTARG", optarg)
+			} else if diagnostics {
+				r.errf("%s: illegal option -- %s\n", r.envGet("0"), optarg)
 			}
+		case opt == ':': // missing argument
+			if silent {
+				r.setVarString("OPTARG", optarg)
+				break
+			}
+			opt = '?'
+			if diagnostics {
+				r.errf("%s: option requires an argument -- %s\n", r.envGet("0"), optarg)
+			}
+		case optarg != "":
+			r.setVarString("OPTARG", optarg)
 		}
+		r.setVarString(name, string(opt))
 		if optind-1 != r.optState.argidx {
 			r.setVarString("OPTIND", strconv.FormatInt(int64(r.optState.argidx+1), 10))
 		}
@@ -594,6 +930,333 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		r.updateExpandOpts()
 
+	case "ulimit":
+		hard, soft := false, false
+		all := false
+		var flags []byte
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+			for _, c := range []byte(args[0][1:]) {
+				switch c {
+				case 'H':
+					hard = true
+				case 'S':
+					soft = true
+				case 'a':
+					all = true
+				default:
+					if ulimitByFlag(c) == nil {
+						r.errf("ulimit: invalid option -%c\n", c)
+						return 2
+					}
+					flags = append(flags, c)
+				}
+			}
+			args = args[1:]
+		}
+		if all {
+			flags = flags[:0]
+			for _, lim := range &ulimitTable {
+				flags = append(flags, lim.flag)
+			}
+		}
+		if len(flags) == 0 {
+			flags = append(flags, 'f') // the default, like in Bash
+		}
+		switch {
+		case len(args) > 1:
+			r.errf("ulimit: too many arguments\n")
+			return 2
+		case len(args) == 1 && !all:
+			// The value applies to every resource given, so check it
+			// against all of them before setting any limits.
+			values := make([]uint64, len(flags))
+			for i, flag := range flags {
+				lim := ulimitByFlag(flag)
+				values[i] = rlimInfinity
+				if args[0] == "unlimited" {
+					continue
+				}
+				n, err := strconv.ParseUint(args[0], 10, 64)
+				if err != nil && !errors.Is(err, strconv.ErrRange) {
+					r.errf("ulimit: invalid number: %q\n", args[0])
+					return 1
+				}
+				if err != nil || n > math.MaxUint64/lim.unit {
+					r.errf("ulimit: %s: limit out of range\n", args[0])
+					return 1
+				}
+				values[i] = n * lim.unit
+			}
+			if !hard && !soft {
+				hard, soft = true, true
+			}
+			for i, flag := range flags {
+				lim := ulimitByFlag(flag)
+				if err := setRlimit(lim.flag, values[i], soft, hard); err != nil {
+					r.errf("ulimit: %s: %v\n", lim.name, err)
+					return 1
+				}
+			}
+			return 0
+		}
+		for _, flag := range flags {
+			lim := ulimitByFlag(flag)
+			cur, max, err := getRlimit(lim.flag)
+			if err != nil {
+				r.errf("ulimit: %s: %v\n", lim.name, err)
+				return 1
+			}
+			value := cur
+			if hard && !soft {
+				value = max
+			}
+			str := "unlimited"
+			if value != rlimInfinity {
+				str = strconv.FormatUint(value/lim.unit, 10)
+			}
+			if len(flags) > 1 {
+				r.outf("%-20s (-%c) %s\n", lim.name, lim.flag, str)
+			} else {
+				r.outf("%s\n", str)
+			}
+		}
+
+	case "trap":
+		print := false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+			if args[0] == "--" {
+				args = args[1:]
+				break
+			}
+			switch args[0] {
+			case "-p":
+				print = true
+			case "-l":
+				// Like Bash, ignore any other arguments.
+				r.signalList()
+				return 0
+			default:
+				r.errf("trap: %s: invalid option\n", args[0])
+				r.errf("trap: usage: trap [-lp] [[arg] signal_spec ...]\n")
+				return 2
+			}
+			args = args[1:]
+		}
+		if print || len(args) == 0 {
+			names := args
+			if len(names) == 0 {
+				names = trapConds()
+			}
+			traps := r.listedTraps()
+			exit := 0
+			for _, name := range names {
+				cond := trapName(name)
+				if cond == "" {
+					r.errf("trap: %s: invalid signal specification\n", name)
+					exit = 1
+					continue
+				}
+				if cmd, ok := traps[cond]; ok {
+					r.outf("trap -- %s %s\n", singleQuote(cmd), cond)
+				}
+			}
+			return exit
+		}
+		cmd, reset := args[0], false
+		if len(args) == 1 || cmd == "-" {
+			// "trap COND" resets the condition, just like "trap - COND".
+			reset = true
+		}
+		if cmd == "-" || len(args) > 1 {
+			args = args[1:]
+		}
+		exit := 0
+		for _, name := range args {
+			cond := trapName(name)
+			switch {
+			case cond == "":
+				r.errf("trap: %s: invalid signal specification\n", name)
+				exit = 1
+			case reset:
+				delete(r.traps, cond)
+				r.parentTraps = nil
+			default:
+				r.setTrap(cond, cmd)
+				r.parentTraps = nil
+			}
+		}
+		return exit
+	case "compgen":
+		spec, _, args, code := r.compOpts("compgen", args, "")
+		if code != 0 {
+			return code
+		}
+		word := ""
+		switch len(args) {
+		case 0:
+		case 1:
+			word = args[0]
+		default:
+			r.errf("compgen: too many arguments\n")
+			return 2
+		}
+		cands := r.compgen(ctx, pos, spec, word)
+		for _, cand := range cands {
+			r.outf("%s\n", cand)
+		}
+		if len(cands) == 0 && spec != (compSpec{}) {
+			return 1
+		}
+	case "complete":
+		spec, flags, args, code := r.compOpts("complete", args, "pr")
+		if code != 0 {
+			return code
+		}
+		switch {
+		case strings.Contains(flags, "r"):
+			if len(args) == 0 {
+				r.compSpecs = nil
+			}
+			for _, name := range args {
+				if _, ok := r.compSpecs[name]; !ok {
+					r.errf("complete: %s: no completion specification\n", name)
+					code = 1
+				}
+				delete(r.compSpecs, name)
+			}
+			return code
+		case strings.Contains(flags, "p"), len(args) == 0:
+			if len(args) == 0 {
+				for name := range r.compSpecs {
+					args = append(args, name)
+				}
+				sort.Strings(args)
+			}
+			for _, name := range args {
+				spec, ok := r.compSpecs[name]
+				if !ok {
+					r.errf("complete: %s: no completion specification\n", name)
+					code = 1
+					continue
+				}
+				r.outf("complete %s%s\n", spec, name)
+			}
+			return code
+		}
+		if r.compSpecs == nil {
+			r.compSpecs = make(map[string]compSpec)
+		}
+		for _, name := range args {
+			r.compSpecs[name] = spec
+		}
+	case "hash":
+		list, del, print, reset := false, false, false, false
+		pinned := ""
+	hashOpts:
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+			flags := args[0][1:]
+			args = args[1:]
+			if flags == "-" {
+				break
+			}
+			for i, c := range flags {
+				switch c {
+				case 'r':
+					r.hash = nil
+					reset = true
+				case 'l':
+					list = true
+				case 'd':
+					del = true
+				case 't':
+					print = true
+				case 'p':
+					if rest := flags[i+1:]; rest != "" {
+						pinned = rest
+					} else if len(args) > 0 {
+						pinned, args = args[0], args[1:]
+					} else {
+						r.errf("hash: -p: option requires an argument\n")
+						r.errf("hash: usage: hash [-lr] [-p pathname] [-dt] [name ...]\n")
+						return 2
+					}
+					continue hashOpts
+				default:
+					r.errf("hash: -%c: invalid option\n", c)
+					r.errf("hash: usage: hash [-lr] [-p pathname] [-dt] [name ...]\n")
+					return 2
+				}
+			}
+		}
+		if len(args) == 0 {
+			switch {
+			case pinned != "", del, print:
+				r.errf("hash: missing name argument\n")
+				return 2
+			case reset:
+				return 0
+			}
+			if len(r.hash) == 0 {
+				r.outf("hash: hash table empty\n")
+				return 0
+			}
+			names := make([]string, 0, len(r.hash))
+			for name := range r.hash {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if !list {
+				r.outf("hits\tcommand\n")
+			}
+			for _, name := range names {
+				entry := r.hash[name]
+				if list {
+					r.outf("builtin hash -p %s %s\n", entry.path, name)
+				} else {
+					r.outf("%4d\t%s\n", entry.hits, entry.path)
+				}
+			}
+			return 0
+		}
+		exit := 0
+		for _, name := range args {
+			entry, ok := r.hash[name]
+			switch {
+			case pinned != "":
+				if r.hash == nil {
+					r.hash = make(map[string]hashEntry)
+				}
+				r.hash[name] = hashEntry{path: pinned}
+			case del:
+				if !ok {
+					r.errf("hash: %s: not found\n", name)
+					exit = 1
+				}
+				delete(r.hash, name)
+			case print:
+				if !ok {
+					r.errf("hash: %s: not found\n", name)
+					exit = 1
+				} else if len(args) > 1 {
+					r.outf("%s\t%s\n", name, entry.path)
+				} else {
+					r.outf("%s\n", entry.path)
+				}
+			case r.isBuiltin(name) || r.Funcs[name] != nil:
+				// nothing to remember
+			default:
+				if r.hashPath(name) == "" {
+					r.errf("hash: %s: not found\n", name)
+					exit = 1
+					break
+				}
+				entry = r.hash[name]
+				entry.hits = 0
+				r.hash[name] = entry
+			}
+		}
+		return exit
+
 	case "alias":
 		show := func(name string, als alias) {
 			var buf bytes.Buffer
@@ -610,8 +1273,13 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 
 		if len(args) == 0 {
-			for name, als := range r.alias {
-				show(name, als)
+			names := make([]string, 0, len(r.alias))
+			for name := range r.alias {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				show(name, r.alias[name])
 			}
 		}
 		for _, name := range args {
@@ -653,7 +1321,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 
 	default:
-		// "trap", "umask", "fg", "bg",
+		// "umask", "fg", "bg",
 		panic(fmt.Sprintf("unhandled builtin: %s", name))
 	}
 	return 0
@@ -664,7 +1332,8 @@ func (r *Runner) printOptLine(name string, enabled bool) {
 	if enabled {
 		status = "on"
 	}
-	r.outf("%s\t%s\n", name, status)
+	// Like Bash, pad the names so that most statuses line up.
+	r.outf("%-15s\t%s\n", name, status)
 }
 
 func (r *Runner) readLine(raw bool) ([]byte, error) {
@@ -700,7 +1369,20 @@ func (r *Runner) readLine(raw bool) ([]byte, error) {
 	}
 }
 
-func (r *Runner) changeDir(path string) int {
+// changeDir changes the current directory. A logical change keeps any symlinks
+// in the new path and resolves ".." by dropping the last element of the path,
+// while a physical change resolves all symlinks first.
+func (r *Runner) changeDir(path string, physical bool) int {
+	if physical {
+		if !filepath.IsAbs(path) {
+			path = r.Dir + string(filepath.Separator) + path
+		}
+		phys, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return 1
+		}
+		path = phys
+	}
 	path = r.absPath(path)
 	info, err := r.stat(path)
 	if err != nil || !info.IsDir() {
@@ -715,6 +1397,44 @@ func (r *Runner) changeDir(path string) int {
 	return 0
 }
 
+// expandAliases expands the aliases at the start of a command's words. The
+// first word of an alias's value is expanded again, unless it names an alias
+// which is already being expanded, so that recursive aliases terminate. A value
+// ending with a blank makes the word following the alias subject to expansion
+// too.
+func (r *Runner) expandAliases(words []*syntax.Word, expanding map[string]bool) []*syntax.Word {
+	// Use a new slice, to not modify the slices in the alias map.
+	var args []*syntax.Word
+	for len(words) > 0 {
+		name := words[0].Lit()
+		als, ok := r.alias[name]
+		if !ok || expanding[name] {
+			break
+		}
+		expanding[name] = true
+		args = append(args, r.expandAliases(als.args, expanding)...)
+		delete(expanding, name)
+		words = words[1:]
+		if !als.blank {
+			break
+		}
+	}
+	if args == nil {
+		return words
+	}
+	return append(args, words...)
+}
+
+// dotPrefixed reports whether a path starts with a "." or ".." element, in
+// which case cd doesn't search CDPATH.
+func dotPrefixed(path string) bool {
+	elem := path
+	if i := strings.IndexAny(path, "/"+string(filepath.Separator)); i >= 0 {
+		elem = path[:i]
+	}
+	return elem == "." || elem == ".."
+}
+
 func (r *Runner) absPath(path string) string {
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(r.Dir, path)
@@ -722,6 +1442,660 @@ func (r *Runner) absPath(path string) string {
 	return filepath.Clean(path)
 }
 
+// trapNames holds the conditions supported by the trap builtin other than
+// signals.
+var trapNames = [...]string{"EXIT", "DEBUG", "ERR"}
+
+// trapName returns the canonical name of a trap condition such as "exit", "0",
+// or "term", or an empty string if the condition isn't supported. Signals are
+// named like "SIGTERM".
+func trapName(name string) string {
+	upper := strings.ToUpper(name)
+	if upper == "0" || upper == "SIGEXIT" {
+		return "EXIT"
+	}
+	for _, cond := range &trapNames {
+		if upper == cond {
+			return cond
+		}
+	}
+	if sig, err := ParseSignal(name); err == nil && sig != 0 {
+		return signalName(sig)
+	}
+	return ""
+}
+
+// trapConds returns all the conditions supported by the trap builtin, in the
+// order in which they are listed: EXIT, then the signals by number, then the
+// rest.
+func trapConds() []string {
+	conds := []string{"EXIT"}
+	for sig := syscall.Signal(1); sig <= maxSignal; sig++ {
+		if name := signalName(sig); name != "" {
+			conds = append(conds, name)
+		}
+	}
+	return append(conds, trapNames[1:]...)
+}
+
+// listedTraps returns the traps shown by the trap builtin, which are those of
+// the parent shell if this subshell hasn't changed any trap yet.
+func (r *Runner) listedTraps() map[string]string {
+	if r.parentTraps != nil {
+		return r.parentTraps
+	}
+	return r.traps
+}
+
+func (r *Runner) setTrap(name, cmd string) {
+	if r.traps == nil {
+		r.traps = make(map[string]string)
+	}
+	r.traps[name] = cmd
+}
+
+// maxSignal is the highest signal number that the kill builtin lists.
+const maxSignal = 64
+
+// ParseSignal parses a signal specification as understood by the kill and trap
+// builtins. It may be a number such as "15", or a name such as "TERM" or
+// "SIGTERM" in any case. The number zero is valid, as it's used to check
+// whether a process exists without sending it a signal.
+func ParseSignal(spec string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 0 || n > maxSignal {
+			return 0, fmt.Errorf("%s: invalid signal specification", spec)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(spec)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := signalNumber(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("%s: invalid signal specification", spec)
+}
+
+// SignalName returns the name of a signal as listed by "kill -l" and
+// "trap -l", such as "SIGTERM", or an empty string if the signal is unknown.
+func SignalName(sig syscall.Signal) string {
+	return signalName(sig)
+}
+
+// signalList prints all known signals with their numbers, in rows of five, as
+// done by "kill -l" and "trap -l".
+func (r *Runner) signalList() {
+	var names []string
+	for sig := syscall.Signal(1); sig <= maxSignal; sig++ {
+		if name := signalName(sig); name != "" {
+			names = append(names, fmt.Sprintf("%2d) %s", sig, name))
+		}
+	}
+	for i, name := range names {
+		r.out(name)
+		if i%5 == 4 || i == len(names)-1 {
+			r.out("\n")
+		} else {
+			r.out("\t")
+		}
+	}
+}
+
+// killList implements "kill -l". Without arguments, all known signals are
+// listed. Otherwise, signal numbers are translated to names, and names to
+// numbers. Exit statuses above 128 are treated as the signal that caused them.
+func (r *Runner) killList(args []string) int {
+	if len(args) == 0 {
+		r.signalList()
+		return 0
+	}
+	exit := 0
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			if n > 128 {
+				n -= 128
+			}
+			if name := signalName(syscall.Signal(n)); name != "" {
+				r.outf("%s\n", strings.TrimPrefix(name, "SIG"))
+				continue
+			}
+		} else if sig, err := ParseSignal(arg); err == nil {
+			r.outf("%d\n", sig)
+			continue
+		}
+		r.errf("kill: %s: invalid signal specification\n", arg)
+		exit = 1
+	}
+	return exit
+}
+
+// killTarget sends a signal to a single argument of the kill builtin, which
+// may be a job spec such as "%1", a background shell ID such as "g1", or a
+// process ID. It reports whether the signal could be sent.
+//
+// Background shells aren't real processes, so any signal other than zero
+// stops them by cancelling their context, which interrupts any program they
+// are running.
+func (r *Runner) killTarget(arg string, sig syscall.Signal) bool {
+	var bg *bgProc
+	switch {
+	case strings.HasPrefix(arg, "%"):
+		if bg = r.jobSpec(arg[1:]); bg == nil {
+			r.errf("kill: %s: no such job\n", arg)
+			return false
+		}
+	case strings.HasPrefix(arg, "g"):
+		if bg = r.bgProcByID(arg); bg == nil {
+			r.errf("kill: %s: arguments must be process or job IDs\n", arg)
+			return false
+		}
+	default:
+		pid, err := strconv.Atoi(arg)
+		if err != nil {
+			r.errf("kill: %s: arguments must be process or job IDs\n", arg)
+			return false
+		}
+		proc, err := os.FindProcess(pid)
+		if err == nil {
+			err = proc.Signal(sig)
+		}
+		if err != nil {
+			r.errf("kill: (%d) - No such process\n", pid)
+			return false
+		}
+		return true
+	}
+	select {
+	case <-bg.done:
+		if strings.HasPrefix(arg, "%") {
+			r.errf("kill: %s: no such job\n", arg)
+		} else {
+			r.errf("kill: (%s) - No such process\n", arg)
+		}
+		return false
+	default:
+	}
+	if sig != 0 {
+		atomic.CompareAndSwapInt32(&bg.signal, 0, int32(sig))
+		bg.cancel()
+	}
+	return true
+}
+
+// jobSpec returns the background shell referred to by a job spec without its
+// leading "%", such as "1" or "+", or nil if there is no such job.
+//
+// Jobs keep their numbers once disowned or reaped, but they can no longer be
+// referred to.
+func (r *Runner) jobSpec(spec string) *bgProc {
+	switch spec {
+	case "%", "+", "", "-":
+		// the current job is the latest one, and the previous job is
+		// the one before that
+		skip := 0
+		if spec == "-" {
+			skip = 1
+		}
+		for i := len(r.bgProcs) - 1; i >= 0; i-- {
+			if bg := r.bgProcs[i]; bg.inJobTable() {
+				if skip == 0 {
+					return bg
+				}
+				skip--
+			}
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 1 || n > len(r.bgProcs) || !r.bgProcs[n-1].inJobTable() {
+		return nil
+	}
+	return r.bgProcs[n-1]
+}
+
+// waitTarget returns the background shell to wait for given an argument to
+// the wait builtin, which may be a job spec or a background shell ID. If there
+// is no such background shell, an error is printed and a non-zero exit status
+// is returned.
+func (r *Runner) waitTarget(arg string) (*bgProc, int) {
+	if strings.HasPrefix(arg, "%") {
+		if bg := r.jobSpec(arg[1:]); bg != nil {
+			return bg, 0
+		}
+		r.errf("wait: %s: no such job\n", arg)
+		return nil, 127
+	}
+	if bg := r.bgProcByID(arg); bg != nil && bg.inJobTable() {
+		return bg, 0
+	} else if bg == nil {
+		if _, err := strconv.Atoi(arg); err != nil {
+			r.errf("wait: `%s': not a pid or valid job spec\n", arg)
+			return nil, 1
+		}
+	}
+	r.errf("wait: pid %s is not a child of this shell\n", arg)
+	return nil, 127
+}
+
+// waitAny implements "wait -n", waiting for any one of the jobs given as
+// arguments, or any job in the table if none are given. The first job to
+// finish is removed from the table and its exit status is returned. Jobs which
+// had already finished are picked first, in the order they were started.
+func (r *Runner) waitAny(ctx context.Context, args []string) int {
+	var bgs []*bgProc
+	exit := 127
+	if len(args) == 0 {
+		for _, bg := range r.bgProcs {
+			if bg.inJobTable() {
+				bgs = append(bgs, bg)
+			}
+		}
+	}
+	for _, arg := range args {
+		bg, code := r.waitTarget(arg)
+		if bg == nil {
+			exit = code
+			continue
+		}
+		bgs = append(bgs, bg)
+	}
+	if len(bgs) == 0 {
+		return exit
+	}
+	var bg *bgProc
+	for _, bg2 := range bgs {
+		select {
+		case <-bg2.done:
+			bg = bg2
+		default:
+			continue
+		}
+		break
+	}
+	if bg == nil {
+		// None have finished yet, so wait until the first one does.
+		cases := make([]reflect.SelectCase, len(bgs)+1)
+		for i, bg := range bgs {
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(bg.done)}
+		}
+		cases[len(bgs)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+		i, _, _ := reflect.Select(cases)
+		if i == len(bgs) {
+			r.setErr(ctx.Err())
+			return 1
+		}
+		bg = bgs[i]
+	}
+	if _, ok := IsExitStatus(bg.err); bg.err != nil && !ok {
+		r.setErr(bg.err)
+	}
+	bg.reaped = true
+	return bg.exit
+}
+
+// disown implements the disown builtin, removing jobs from the job table so
+// that they are no longer waited for. With all, every job is removed, or just
+// those which are still running if running is also set.
+//
+// If keep is set, as with "disown -h", the jobs are left in the table. It would
+// otherwise stop the jobs from getting SIGHUP when the shell exits, but
+// background shells never get that signal.
+func (r *Runner) disown(args []string, all, running, keep bool) int {
+	if len(args) == 0 && (all || running) {
+		for _, bg := range r.bgProcs {
+			if running {
+				select {
+				case <-bg.done:
+					continue
+				default:
+				}
+			}
+			if !keep {
+				bg.disowned = true
+			}
+		}
+		return 0
+	}
+	if len(args) == 0 {
+		bg := r.jobSpec("+")
+		if bg == nil {
+			r.errf("disown: current: no such job\n")
+			return 1
+		}
+		bg.disowned = bg.disowned || !keep
+		return 0
+	}
+	exit := 0
+	for _, arg := range args {
+		var bg *bgProc
+		if strings.HasPrefix(arg, "%") {
+			bg = r.jobSpec(arg[1:])
+		} else if bg = r.bgProcByID(arg); bg != nil && !bg.inJobTable() {
+			bg = nil
+		}
+		if bg == nil {
+			r.errf("disown: %s: no such job\n", arg)
+			exit = 1
+			continue
+		}
+		bg.disowned = bg.disowned || !keep
+	}
+	return exit
+}
+
+// bgProcByID returns the background shell with an ID as used in $!, such as
+// "g1", or nil if there is no such background shell.
+func (r *Runner) bgProcByID(id string) *bgProc {
+	if !strings.HasPrefix(id, "g") {
+		return nil
+	}
+	n, err := strconv.Atoi(id[1:])
+	if err != nil || n < 1 || n > len(r.bgProcs) {
+		return nil
+	}
+	return r.bgProcs[n-1]
+}
+
+// compActions lists the kinds of completions that the compgen and complete
+// builtins support, in the order in which they are generated and printed.
+// Those without a short flag must be given via "-A name".
+var compActions = [...]struct {
+	flag byte
+	name string
+}{
+	{'a', "alias"},
+	{'b', "builtin"},
+	{'c', "command"},
+	{'d', "directory"},
+	{'f', "file"},
+	{'k', "keyword"},
+	{'v', "variable"},
+	{0, "function"},
+}
+
+// keywords lists the shell's reserved words.
+var keywords = [...]string{
+	"!", "[[", "]]", "case", "coproc", "do", "done", "elif", "else", "esac",
+	"fi", "for", "function", "if", "in", "select", "then", "time", "until",
+	"while", "{", "}",
+}
+
+// compSpec is a programmable completion specification, as used by the complete
+// and compgen builtins.
+type compSpec struct {
+	actions  [len(compActions)]bool
+	wordList string // -W
+	funcName string // -F
+	prefix   string // -P
+	suffix   string // -S
+}
+
+// String returns the spec's options as printed by "complete -p", including a
+// trailing space if there are any options.
+func (s compSpec) String() string {
+	var sb strings.Builder
+	for i, act := range compActions {
+		if !s.actions[i] {
+			continue
+		}
+		if act.flag != 0 {
+			fmt.Fprintf(&sb, "-%c ", act.flag)
+		} else {
+			fmt.Fprintf(&sb, "-A %s ", act.name)
+		}
+	}
+	if s.prefix != "" {
+		fmt.Fprintf(&sb, "-P %s ", singleQuote(s.prefix))
+	}
+	if s.suffix != "" {
+		fmt.Fprintf(&sb, "-S %s ", singleQuote(s.suffix))
+	}
+	if s.wordList != "" {
+		fmt.Fprintf(&sb, "-W %s ", singleQuote(s.wordList))
+	}
+	if s.funcName != "" {
+		fmt.Fprintf(&sb, "-F %s ", s.funcName)
+	}
+	return sb.String()
+}
+
+// compOpts parses the options shared by the compgen and complete builtins.
+// Any of the flags in extra are accepted too, and returned in flags. A
+// non-zero code is returned if the options were invalid.
+func (r *Runner) compOpts(builtin string, args []string, extra string) (spec compSpec, flags string, rest []string, code int) {
+	usage := func() int {
+		if builtin == "compgen" {
+			r.errf("compgen: usage: compgen [-abcdfkv] [-A action] [-W wordlist] [-F function] [-P prefix] [-S suffix] [word]\n")
+		} else {
+			r.errf("complete: usage: complete [-abcdfkv] [-pr] [-A action] [-W wordlist] [-F function] [-P prefix] [-S suffix] [name ...]\n")
+		}
+		return 2
+	}
+compOpts:
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		opts := args[0][1:]
+		args = args[1:]
+		if opts == "-" {
+			break
+		}
+	optChars:
+		for i, c := range opts {
+			for j, act := range compActions {
+				if act.flag != 0 && act.flag == byte(c) {
+					spec.actions[j] = true
+					continue optChars
+				}
+			}
+			if strings.ContainsRune(extra, c) {
+				flags += string(c)
+				continue
+			}
+			var dst *string
+			switch c {
+			case 'A', 'W', 'F', 'P', 'S':
+			default:
+				r.errf("%s: -%c: invalid option\n", builtin, c)
+				return spec, "", nil, usage()
+			}
+			val := opts[i+1:]
+			if val == "" {
+				if len(args) == 0 {
+					r.errf("%s: -%c: option requires an argument\n", builtin, c)
+					return spec, "", nil, usage()
+				}
+				val, args = args[0], args[1:]
+			}
+			switch c {
+			case 'A':
+				found := false
+				for j, act := range compActions {
+					if act.name == val {
+						spec.actions[j] = true
+						found = true
+					}
+				}
+				if !found {
+					r.errf("%s: %s: invalid action name\n", builtin, val)
+					return spec, "", nil, 2
+				}
+			case 'W':
+				dst = &spec.wordList
+			case 'F':
+				dst = &spec.funcName
+			case 'P':
+				dst = &spec.prefix
+			case 'S':
+				dst = &spec.suffix
+			}
+			if dst != nil {
+				*dst = val
+			}
+			continue compOpts
+		}
+	}
+	return spec, flags, args, 0
+}
+
+// compgen generates the completion candidates for a word, following a spec.
+func (r *Runner) compgen(ctx context.Context, pos syntax.Pos, spec compSpec, word string) []string {
+	var cands []string
+	add := func(name string) {
+		if strings.HasPrefix(name, word) {
+			cands = append(cands, name)
+		}
+	}
+	for i, act := range compActions {
+		if !spec.actions[i] {
+			continue
+		}
+		start := len(cands)
+		switch act.name {
+		case "alias":
+			for name := range r.alias {
+				add(name)
+			}
+		case "builtin":
+			for _, name := range builtinNames {
+				add(name)
+			}
+			for name := range r.builtins {
+				if !isBuiltin(name) {
+					add(name)
+				}
+			}
+		case "command":
+			for _, name := range r.commandNames(word) {
+				add(name)
+			}
+		case "directory", "file":
+			cands = append(cands, r.compFiles(word, act.name == "directory")...)
+		case "keyword":
+			for _, name := range keywords {
+				add(name)
+			}
+		case "variable":
+			r.eachVar(func(name string, vr expand.Variable) {
+				if vr.IsSet() || vr.ReadOnly {
+					add(name)
+				}
+			})
+		case "function":
+			for name := range r.Funcs {
+				add(name)
+			}
+		}
+		sort.Strings(cands[start:])
+	}
+	if spec.wordList != "" {
+		for _, field := range expand.ReadFields(r.ecfg, spec.wordList, -1, true) {
+			add(field)
+		}
+	}
+	if spec.funcName != "" {
+		r.delVar("COMPREPLY")
+		r.call(ctx, pos, []string{spec.funcName, "", word, ""})
+		cands = append(cands, r.lookupVar("COMPREPLY").List...)
+	}
+	for i, cand := range cands {
+		cands[i] = spec.prefix + cand + spec.suffix
+	}
+	return cands
+}
+
+// commandNames returns the sorted names of all the commands that could be run
+// starting with prefix, including aliases, functions, builtins, keywords, and
+// programs in $PATH.
+func (r *Runner) commandNames(prefix string) []string {
+	seen := make(map[string]bool)
+	for name := range r.alias {
+		seen[name] = true
+	}
+	for name := range r.Funcs {
+		seen[name] = true
+	}
+	for _, name := range builtinNames {
+		seen[name] = true
+	}
+	for name := range r.builtins {
+		seen[name] = true
+	}
+	for _, name := range keywords {
+		seen[name] = true
+	}
+	for _, dir := range splitList(r.envGet("PATH")) {
+		infos, _ := ioutil.ReadDir(r.absPath(dir))
+		for _, info := range infos {
+			name := info.Name()
+			if !strings.HasPrefix(name, prefix) || seen[name] {
+				continue
+			}
+			if _, err := checkStat(r.absPath(dir), name); err == nil {
+				seen[name] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compFiles returns the paths of the files starting with prefix, or only the
+// directories if dirsOnly is true.
+func (r *Runner) compFiles(prefix string, dirsOnly bool) []string {
+	dir, base := path.Split(prefix)
+	infos, _ := ioutil.ReadDir(r.absPath(dir))
+	var paths []string
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		if dirsOnly && !info.IsDir() {
+			// follow symlinks to directories
+			if info, err := os.Stat(filepath.Join(r.absPath(dir), name)); err != nil || !info.IsDir() {
+				continue
+			}
+		}
+		paths = append(paths, dir+name)
+	}
+	return paths
+}
+
+// singleQuote quotes a string so that the shell reads it back verbatim.
+func singleQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+type ulimitResource struct {
+	flag byte
+	name string
+	unit uint64 // bytes per unit in ulimit's input and output
+}
+
+// ulimitTable lists the resource limits supported by the "ulimit" builtin,
+// sorted alphabetically by flag.
+var ulimitTable = [...]ulimitResource{
+	{'c', "core file size", 1024},
+	{'f', "file size", 1024},
+	{'n', "open files", 1},
+	{'s', "stack size", 1024},
+	{'u', "max user processes", 1},
+}
+
+func ulimitByFlag(flag byte) *ulimitResource {
+	for i := range &ulimitTable {
+		if ulimitTable[i].flag == flag {
+			return &ulimitTable[i]
+		}
+	}
+	return nil
+}
+
 type getopts struct {
 	argidx  int
 	runeidx int
@@ -746,7 +2120,7 @@ func (g *getopts) Next(optstr string, args []string) (opt rune, optarg string, d
 	}
 
 	i := strings.IndexRune(optstr, opt)
-	if i < 0 {
+	if i < 0 || opt == ':' {
 		// invalid option
 		return '?', string(opt), false
 	}
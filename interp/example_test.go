@@ -86,3 +86,38 @@ func ExampleOpenHandler() {
 	// Output:
 	// foo
 }
+
+func ExampleTeeStdIO() {
+	src := "echo foo; x=$(echo bar); echo baz >&2; (echo $x)"
+	file, _ := syntax.NewParser().Parse(strings.NewReader(src), "")
+
+	var captured strings.Builder
+	runner, _ := interp.New(
+		interp.StdIO(nil, os.Stdout, os.Stdout),
+		interp.TeeStdIO(&captured, &captured),
+	)
+	runner.Run(context.TODO(), file)
+	fmt.Printf("captured: %q\n", captured.String())
+	// Output:
+	// foo
+	// baz
+	// bar
+	// captured: "foo\nbaz\nbar\n"
+}
+
+func ExampleRunner_ExpandWord() {
+	runner, _ := interp.New(
+		interp.Env(expand.ListEnviron("HOME=/home/me", "NAME=app")),
+	)
+	for _, value := range []string{"~/.config/$NAME", "$HOME/{a,b}.log"} {
+		fields, err := runner.ExpandWord(context.TODO(), value)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println(fields)
+	}
+	// Output:
+	// [/home/me/.config/app]
+	// [/home/me/a.log /home/me/b.log]
+}
@@ -47,6 +47,28 @@ type HandlerContext struct {
 	Stdout io.Writer
 	// Stderr is the interpreter's current standard error writer.
 	Stderr io.Writer
+
+	// Files holds the interpreter's file descriptors other than the
+	// standard ones, such as 3 after "exec 3>file", keyed by their number.
+	Files map[int]io.ReadWriteCloser
+
+	// hashPath, if not nil, looks up the program being executed in the
+	// interpreter's hash table.
+	hashPath func() string
+}
+
+// Path returns the absolute path to the program being executed, using and
+// updating the interpreter's hash table of remembered paths. It returns an
+// empty string if the program isn't found, or if it can't be remembered, such
+// as with a temporary $PATH like "PATH=dir cmd". It is always empty in open
+// handlers.
+//
+// The hash table is only updated by exec handlers which call Path.
+func (hc HandlerContext) Path() string {
+	if hc.hashPath == nil {
+		return ""
+	}
+	return hc.hashPath()
 }
 
 // ExecHandlerFunc is a handler which executes simple command. It is
@@ -57,9 +79,24 @@ type HandlerContext struct {
 // can be set with NewExitStatus. Any other error will halt an interpreter.
 type ExecHandlerFunc func(ctx context.Context, args []string) error
 
+// BuiltinHandlerFunc is a handler which runs a builtin registered via
+// Builtin or OverrideBuiltin, with args[0] being the builtin's name. Like
+// ExecHandlerFunc, the standard input, output, and error, as well as the
+// environment, are available via HandlerCtx.
+//
+// The returned value is the builtin's exit status.
+type BuiltinHandlerFunc func(ctx context.Context, args []string) int
+
 // DefaultExecHandler returns an ExecHandlerFunc used by default.
 // It finds binaries in PATH and executes them.
 // When context is cancelled, interrupt signal is sent to running processes.
+//
+// The file descriptors in HandlerContext.Files which are files, like those
+// opened by "exec 3>file", are passed on to the programs. Other streams, such
+// as a copy of a standard output which isn't a file, are closed in them. No
+// such file descriptors are passed on Windows. A standard output or error closed
+// via ">&-" is replaced by the null device, as programs are started with all
+// three standard streams.
 // KillTimeout is a duration to wait before sending kill signal.
 // A negative value means that a kill signal will be sent immediately.
 // On Windows, the kill signal is always sent immediately,
@@ -68,10 +105,14 @@ type ExecHandlerFunc func(ctx context.Context, args []string) error
 func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 	return func(ctx context.Context, args []string) error {
 		hc := HandlerCtx(ctx)
-		path, err := LookPath(hc.Env, args[0])
-		if err != nil {
-			fmt.Fprintln(hc.Stderr, err)
-			return NewExitStatus(127)
+		path := hc.Path()
+		if path == "" {
+			var err error
+			path, err = LookPath(hc.Env, args[0])
+			if err != nil {
+				fmt.Fprintln(hc.Stderr, err)
+				return NewExitStatus(127)
+			}
 		}
 		cmd := exec.Cmd{
 			Path:   path,
@@ -79,11 +120,13 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 			Env:    execEnv(hc.Env),
 			Dir:    hc.Dir,
 			Stdin:  hc.Stdin,
-			Stdout: hc.Stdout,
-			Stderr: hc.Stderr,
+			Stdout: execOutput(hc.Stdout),
+			Stderr: execOutput(hc.Stderr),
+
+			ExtraFiles: extraFiles(hc.Files),
 		}
 
-		err = cmd.Start()
+		err := cmd.Start()
 		if err == nil {
 			if done := ctx.Done(); done != nil {
 				go func() {
@@ -132,6 +175,39 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 	}
 }
 
+// extraFiles returns the files to pass to a program as the file descriptors
+// starting at 3, where nil entries are closed.
+// execOutput returns the writer to give a program as its standard output or
+// error. A nil writer makes os/exec use the null device.
+func execOutput(w io.Writer) io.Writer {
+	if _, ok := w.(closedWriter); ok {
+		return nil
+	}
+	return w
+}
+
+func extraFiles(files map[int]io.ReadWriteCloser) []*os.File {
+	if len(files) == 0 || runtime.GOOS == "windows" {
+		return nil
+	}
+	var extra []*os.File
+	for fd, f := range files {
+		if s, ok := f.(streamFd); ok {
+			// e.g. "3>&1"
+			f, _ = s.stream.(io.ReadWriteCloser)
+		}
+		file, ok := f.(*os.File)
+		if !ok || fd < 3 {
+			continue
+		}
+		for len(extra) <= fd-3 {
+			extra = append(extra, nil)
+		}
+		extra[fd-3] = file
+	}
+	return extra
+}
+
 func checkStat(dir, file string) (string, error) {
 	if !filepath.IsAbs(file) {
 		file = filepath.Join(dir, file)
@@ -289,3 +365,20 @@ func DefaultOpenHandler() OpenHandlerFunc {
 		return os.OpenFile(path, flag, perm)
 	}
 }
+
+// CommandEvent describes a simple command which was run, such as a builtin or
+// a program. It is passed to the hook set via CommandHook.
+type CommandEvent struct {
+	// Args holds the command's fields after expansion, including its name.
+	Args []string
+
+	// Builtin is true if the command was run as a builtin, instead of
+	// being passed to the ExecHandlerFunc.
+	Builtin bool
+
+	// Duration is how long the command took to run.
+	Duration time.Duration
+
+	// Exit is the command's exit status.
+	Exit int
+}
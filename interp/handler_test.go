@@ -9,8 +9,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -291,3 +294,178 @@ func TestKillSignal(t *testing.T) {
 		})
 	}
 }
+
+func TestCommandHook(t *testing.T) {
+	t.Parallel()
+	p := syntax.NewParser()
+	file := parse(t, p, "f() { echo foo; }; f bar; true | false; sleep 0.01; x=$(bogus)")
+	var mu sync.Mutex
+	var got []string
+	var slept time.Duration
+	hook := func(ev CommandEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, fmt.Sprintf("%s %t %d", strings.Join(ev.Args, " "), ev.Builtin, ev.Exit))
+		if ev.Args[0] == "sleep" {
+			slept = ev.Duration
+		}
+	}
+	r, err := New(StdIO(nil, ioutil.Discard, ioutil.Discard), CommandHook(hook))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := []string{
+		"bogus false 127",
+		"echo foo true 0",
+		"false true 1",
+		"sleep 0.01 false 0",
+		"true true 0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want:\n%q\ngot:\n%q", want, got)
+	}
+	if slept < 10*time.Millisecond {
+		t.Fatalf("sleep took %v, want at least 10ms", slept)
+	}
+}
+
+func TestCommandNotFoundHandler(t *testing.T) {
+	t.Parallel()
+	notFound := func(ctx context.Context, args []string) error {
+		fmt.Fprintf(HandlerCtx(ctx).Stdout, "not found: %q\n", args)
+		return NewExitStatus(3)
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"shouldnotexist a b; echo $?", "not found: [\"shouldnotexist\" \"a\" \"b\"]\n3\n"},
+		{"command shouldnotexist", "not found: [\"shouldnotexist\"]\nexit status 3"},
+		{"PATH=/ ls || echo $?", "not found: [\"ls\"]\n3\n"},
+		{"true; echo $?", "0\n"},
+		{"ls / >/dev/null; echo $?", "0\n"},
+		{"command_not_found_handle() { echo func: $1; }; shouldnotexist", "func: shouldnotexist\n"},
+		{"./shouldnotexist 2>/dev/null; echo $?", "127\n"},
+		{"exec shouldnotexist 2>/dev/null", "exit status 127"},
+	}
+	p := syntax.NewParser()
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			file := parse(t, p, tc.in)
+			var sb strings.Builder
+			r, err := New(StdIO(nil, &sb, &sb), CommandNotFoundHandler(notFound))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				fmt.Fprint(&sb, err)
+			}
+			if got := sb.String(); got != tc.want {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestExecHandlerPath(t *testing.T) {
+	t.Parallel()
+	ignorePath := func(ctx context.Context, args []string) error {
+		return nil
+	}
+	usePath := func(ctx context.Context, args []string) error {
+		fmt.Fprintln(HandlerCtx(ctx).Stdout, HandlerCtx(ctx).Path() != "")
+		return nil
+	}
+	tests := []struct {
+		handler ExecHandlerFunc
+		in      string
+		want    string
+	}{
+		// The hash table is only updated by handlers using the path.
+		{ignorePath, "ls; hash", "hash: hash table empty\n"},
+		{usePath, "ls; hash -t ls >/dev/null && echo hashed", "true\nhashed\n"},
+		{usePath, "PATH=$PATH ls; hash", "false\nhash: hash table empty\n"},
+		{usePath, "shouldnotexist", "false\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			file := parse(t, nil, tc.in)
+			var sb strings.Builder
+			r, err := New(StdIO(nil, &sb, &sb), ExecHandler(tc.handler))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				fmt.Fprint(&sb, err)
+			}
+			if got := sb.String(); got != tc.want {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBuiltinHandler(t *testing.T) {
+	t.Parallel()
+	logBuiltin := func(ctx context.Context, args []string) int {
+		hc := HandlerCtx(ctx)
+		if len(args) == 1 {
+			// with no arguments, log the standard input
+			data, _ := ioutil.ReadAll(hc.Stdin)
+			args = append(args, strings.TrimSuffix(string(data), "\n"))
+		}
+		prefix := hc.Env.Get("LOG_PREFIX").String()
+		fmt.Fprintf(hc.Stdout, "%s%s\n", prefix, strings.Join(args[1:], " "))
+		return len(args) - 2
+	}
+	echoBuiltin := func(ctx context.Context, args []string) int {
+		fmt.Fprintf(HandlerCtx(ctx).Stdout, "echo: %q\n", args[1:])
+		return 0
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"log foo", "foo\n"},
+		{"log foo bar; printf '%d\n' $?", "foo bar\n1\n"},
+		{"LOG_PREFIX='> ' log foo", "> foo\n"},
+		{"LOG_PREFIX='> '; log foo", "> foo\n"},
+		{"f() { local LOG_PREFIX=f:; log foo; }; f", "f:foo\n"},
+		{"printf 'foo\n' | log | sed s/o/0/g", "f00\n"},
+		{"log foo >/dev/null; x=$(log bar); log $x", "bar\n"},
+		{"log foo 2>/dev/null & wait", "foo\n"},
+		{"builtin log foo; command log bar", "foo\nbar\n"},
+		{"type log; command -v log", "log is a shell builtin\nlog\n"},
+		{"log() { printf 'func\n'; }; log foo", "func\n"},
+		{"echo foo bar", "echo: [\"foo\" \"bar\"]\n"},
+		{"compgen -b lo", "log\n"},
+		{"enable -n log; log foo 2>/dev/null || printf '%d\n' $?; enable -an | grep log", "127\nenable -n log\n"},
+	}
+	p := syntax.NewParser()
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			file := parse(t, p, tc.in)
+			var sb strings.Builder
+			r, err := New(StdIO(nil, &sb, &sb),
+				Builtin("log", logBuiltin),
+				OverrideBuiltin("echo", echoBuiltin),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				t.Fatal(err)
+			}
+			if got := sb.String(); got != tc.want {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+		})
+	}
+
+	_, err := New(Builtin("cd", logBuiltin))
+	if want := "cd is already a builtin"; err == nil || err.Error() != want {
+		t.Fatalf("want error %q, got %v", want, err)
+	}
+}
@@ -19,9 +19,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"golang.org/x/xerrors"
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
 )
@@ -224,12 +226,32 @@ var runTests = []runTest{
 	{"printf", "usage: printf format [arguments]\nexit status 2 #JUSTERR"},
 	{"break", "break is only useful in a loop #JUSTERR"},
 	{"continue", "continue is only useful in a loop #JUSTERR"},
-	{"cd a b", "usage: cd [dir]\nexit status 2 #JUSTERR"},
+	{"cd a b", "usage: cd [-L|-P] [dir]\nexit status 2 #JUSTERR"},
 	{"shift a", "usage: shift [n]\nexit status 2 #JUSTERR"},
 	{
 		"shouldnotexist",
 		"\"shouldnotexist\": executable file not found in $PATH\nexit status 127 #JUSTERR",
 	},
+	{
+		"command_not_found_handle() { echo \"nf: $*\"; x=1; return 3; }; shouldnotexist a b; echo $? x=$x",
+		"nf: shouldnotexist a b\n3 x=\n",
+	},
+	{
+		"command_not_found_handle() { exit 5; }; shouldnotexist; echo $?; command shouldnotexist; echo $?",
+		"5\n5\n",
+	},
+	{
+		"command_not_found_handle() { echo \"nf: $1\"; }; f() { shouldnotexist; }; f; PATH=/ ls",
+		"nf: shouldnotexist\nnf: ls\n",
+	},
+	{
+		"command_not_found_handle() { echo nf; }; ./shouldnotexist 2>/dev/null; echo $?",
+		"127\n",
+	},
+	{
+		"command_not_found_handle() { echo nf; }; exec shouldnotexist",
+		"\"shouldnotexist\": executable file not found in $PATH\nexit status 127 #JUSTERR",
+	},
 	{
 		"for i in 1; do continue a; done",
 		"usage: continue [n]\nexit status 2 #JUSTERR",
@@ -253,6 +275,9 @@ var runTests = []runTest{
 	{`echo -E '\t'`, "\\t\n"},
 	{"echo -x foo", "-x foo\n"},
 	{"echo -e -x -e foo", "-x -e foo\n"},
+	{`echo -e 'a\x41\e\u263a\0101\0'`, "aA\x1b\u263aA\x00\n"},
+	{`echo -e "\\'" '\"\?\q' '100%'`, `\' \"\?\q 100%` + "\n"},
+	{`echo -e 'a\cb' c; echo -n -e 'd\c'; echo e`, "ade\n"},
 
 	// printf
 	{"printf foo", "foo"},
@@ -280,6 +305,56 @@ var runTests = []runTest{
 	{"printf 'nofmt' 1 2 3", "nofmt"},
 	{"printf '%d_' 1 2 3", "1_2_3_"},
 	{"printf '%02d %02d\n' 1 2 3", "01 02\n03 00\n"},
+	{"printf '%s-%s\n' a b c", "a-b\nc-\n"},
+	{"printf '%s|%d|%c|%x|%f|%b|%q\n'", "|0|\x00|0|0.000000||''\n"},
+	{"printf '%s %d\n' a 1 b", "a 1\nb 0\n"},
+	{"printf 'x\n' a b", "x\n"},
+	{"printf -- '%s\n' a", "a\n"},
+	{"printf '[%3c|%-3c]' a", "[  a|\x00  ]"},
+	{"printf '%X %#x %#o %.3d %-+4d|' 255 10 8 7 3", "FF 0xa 010 007 +3  |"},
+	{"printf '%*s|%-*d|%.*s|' 4 a 3 5 2 xyz", "   a|5  |xy|"},
+	{"printf '%*d|%.*d|%*s|' -3 1 -1 2", "1  |2||"},
+	{"printf '%*s|' 2 a 3", " a|   |"},
+	{"printf '%*s\\n' 5 hi; printf '%.*f\\n' 2 3.14159", "   hi\n3.14\n"},
+	{"printf '%*.*f|%-*s|' 7 3 3.14159 -4 a", "  3.142|a   |"},
+	{"printf '%d %d %x %d' \"'a\" '\"b' \"'\" ' 12'", "97 98 0 12"},
+	{"printf '%.2f %e %g %g %G|' 1.005 12345 0.0001 1234567 1e20", "1.00 1.234500e+04 0.0001 1.23457e+06 1E+20|"},
+	{"printf '%.1f %f\n' 2 0x10 \"'a\"", "2.0 16.000000\n97.0 0.000000\n"},
+	{"printf '%.0f %.0f %.0f %.0f %.2f|' 2.5 3.5 -2.5 0.5 2.675", "2 4 -2 0 2.67|"},
+	{"printf '%f %.1f %g %e|' +1.5 0x1.8 0x1p-2 1e3", "1.500000 1.5 0.25 1.000000e+03|"},
+	{"printf '%f %e %G %F|' inf -Infinity nan -nan", "inf -inf NAN -NAN|"},
+	{"printf '[%5f] [%-5.2e] [%+g] [% f] [%05E] [%*f]' inf -inf inf nan inf -4 nan", "[  inf] [-inf ] [+inf] [ nan] [  INF] [nan ]"},
+	{"printf '%b|%5b|%.2b|' 'a\\tb' 'x\\ny' abc", "a\tb|  x\ny|ab|"},
+	{"printf '%b|' '\\0101\\101' '\\0' 'a\\'", "AA|\x00|a\\|"},
+	{"printf '%s %b %s\n' 'a\\c' 'b\\cd' e f", "a\\c b"},
+	{"printf 'a\\'; printf '\\0'", "a\\\x00"},
+	{"printf %.-1s a", "invalid format char: -\nexit status 1 #JUSTERR"},
+	{"printf %1*s a", "invalid format char: *\nexit status 1 #JUSTERR"},
+	{"printf '%2$s %1$s\n' a b", "b a\n #IGNORE"},
+	{"printf '%2$s %1$s|' a b c d e", "b a|d c| e| #IGNORE"},
+	{"printf '%1$s-%1$s-%s|' a b", "a-a-a|b-b-b| #IGNORE"},
+	{"printf '%3$s|%s|' a", "|a| #IGNORE"},
+	{"printf '%2$*1$d|%1$-*2$s|' 4 2", "   2|4 | #IGNORE"},
+	{"printf '%0$s' a", "invalid format argument position: 0\nexit status 1 #JUSTERR"},
+	{"printf '%*0$d' a", "invalid format argument position: 0\nexit status 1 #JUSTERR"},
+	{"printf '%-2$s' a", "invalid format char: $\nexit status 1 #JUSTERR"},
+	{"printf '%1$2$s' a", "invalid format char: $\nexit status 1 #JUSTERR"},
+	{"TZ=UTC printf '%(%Y-%m-%d %H:%M:%S)T' 0", "1970-01-01 00:00:00"},
+	{"TZ=UTC printf '%(%j %a %A %b %B %e)T' 86400", "002 Fri Friday Jan January  2"},
+	{"TZ=UTC printf '%(%c|%D|%F|%r|%T)T' 1000000000", "Sun Sep  9 01:46:40 2001|09/09/01|2001-09-09|01:46:40 AM|01:46:40"},
+	{"TZ=UTC printf '%(%u %w %U %W %V %G %s %%)T' 1000000000", "7 0 36 36 36 2001 1000000000 %"},
+	{"TZ=UTC printf '[%6(%Y)T|%-4(%m)T]' 0 0", "[  1970|01  ]"},
+	{"TZ=UTC printf '%()T|%(%X)T' 1000000000 0", "01:46:40|00:00:00"},
+	{"TZ=UTC printf '%(%Y)T\n' 0 86400000", "1970\n1972\n"},
+	{"[[ $(printf '%(%Y)T') -ge 2020 ]]", ""},
+	{"[[ $(printf '%(%s)T' -1) -ge $(printf '%(%s)T' -2) ]]", ""},
+	{"printf '%(%Y' 0", "invalid time format specification\nexit status 1 #JUSTERR"},
+	{"printf '%(%Y)T' foo", "invalid number: \"foo\"\nexit status 1 #JUSTERR"},
+	{"printf '[%q]' '' foo $'a\\nb' $'\\t'", `['']` + "[foo]" + `[$'a\nb']` + `[$'\t']`},
+	{"printf '%q\n' 'a b' \"it's\" '$x'", "a\\ b\nit\\'s\n\\$x\n"},
+	{"printf '%q\n' '~x' '#a' 'a~#' 'a=b:c' '{a,b}' '*?'", "\\~x\n\\#a\na~#\na=b:c\n\\{a\\,b\\}\n\\*\\?\n"},
+	{"printf '[%5q|%-5q]' a b", "[    a|b    ]"},
+	{`a=$'x\'y\x01 \n'; eval "b=$(printf %q "$a")"; [[ $a == "$b" ]]`, ""},
 
 	// words and quotes
 	{"echo  foo ", "foo\n"},
@@ -300,6 +375,11 @@ var runTests = []runTest{
 	{`count() { echo $#; }; a=(); count "${a[@]}"`, "0\n"},
 	{`count() { echo $#; }; a=(""); count "${a[@]}"`, "1\n"},
 	{`echo $1 $3; set -- a b c; echo $1 $3`, "\na c\n"},
+	{`f() { set -- x "y z"; echo $# "$2"; }; set -- a b c; f 1; echo $# $1`, "2 y z\n3 a\n"},
+	{`f() { set --; echo $#; }; f a b; set -- a; f; echo $#`, "0\n0\n1\n"},
+	{`set -- -x -- "-"; echo $# "$@"`, "3 -x -- -\n"},
+	{`set - a b; echo $# $1; set -; echo $# $2`, "2 a\n2 b\n"},
+	{`set -x; set - a; echo $1`, "+ set - a\na\n"},
 	{`[[ $0 == "bash" || $0 == "gosh" ]]`, ""},
 
 	// dollar quotes
@@ -315,6 +395,10 @@ var runTests = []runTest{
 	{`echo $'\x\xf\x09\xAB'`, "\\x\x0f\x09\xab\n"},
 	{`echo $'\u\uf\u09\uABCD\u00051234'`, "\\u\u000f\u0009\uabcd\u00051234\n"},
 	{`echo $'\U\Uf\U09\UABCD\U00051234'`, "\\U\u000f\u0009\uabcd\U00051234\n"},
+	{`echo $'\cA\ca\c?\c[\c'`, "\x01\x01\x7f\x1b\\c\n"},
+	{`echo $'a\0b' $'c\x00d'; printf '%s|%b|' $'e\0101' 'f\0101'`, "a c\ne\x081|fA|"},
+	{`printf '\cA|\c|%b|' '\cA' x; echo`, "\\cA|\\c|\n"},
+	{`printf '\'"'"'\"\?|%b' '\'"'"'\"\?'`, `'"?|\'\"\?`},
 
 	// escaped chars
 	{"echo a\\b", "ab\n"},
@@ -344,6 +428,12 @@ var runTests = []runTest{
 	{"foo=bar; $ENV_PROG | grep '^foo='", "exit status 1"},
 	{"foo=bar $ENV_PROG | grep '^foo='", "foo=bar\n"},
 	{"foo=a foo=b $ENV_PROG | grep '^foo='", "foo=b\n"},
+	{"a=1 b=$a $ENV_PROG | grep '^b='", "b=1\n"},
+	{"a=0; a=1 b=$a $ENV_PROG | grep '^b='; echo $a", "b=1\n0\n"},
+	{"a=x; a=$a$a a=$a-y $ENV_PROG | grep '^a='; echo $a", "a=xx-y\nx\n"},
+	{"a=1 b=$((a+1)) $ENV_PROG | grep '^b='", "b=2\n"},
+	{"a=1 b=2 true; echo ${a-unset} ${b-unset}", "unset unset\n"},
+	{"f() { echo $a $b; }; a=1 b=$a f; echo ${a-unset}", "1 1\nunset\n"},
 	{"$ENV_PROG | grep '^INTERP_GLOBAL='", "INTERP_GLOBAL=value\n"},
 	{"INTERP_GLOBAL=new; $ENV_PROG | grep '^INTERP_GLOBAL='", "INTERP_GLOBAL=new\n"},
 	{"INTERP_GLOBAL=; $ENV_PROG | grep '^INTERP_GLOBAL='", "INTERP_GLOBAL=\n"},
@@ -359,6 +449,9 @@ var runTests = []runTest{
 	{"for i in 1 2; do\necho $LINENO\necho $LINENO\ndone", "2\n3\n2\n3\n"},
 	{"[[ -n $$ && $$ -gt 0 ]]", ""},
 	{"[[ $$ -eq $PPID ]]", "exit status 1"},
+	{`[[ $EPOCHSECONDS =~ ^[0-9]+$ && $EPOCHREALTIME =~ ^[0-9]+\.[0-9]{6}$ ]]`, ""},
+	{"s=$EPOCHSECONDS; r=$EPOCHREALTIME; [[ ${r%.*} -ge $s && $EPOCHSECONDS -ge ${r%.*} ]]", ""},
+	{"a=$EPOCHREALTIME; b=$EPOCHREALTIME; [[ $a < $b || $a == $b ]]", ""},
 
 	// var manipulation
 	{"echo ${#a} ${#a[@]}", "0 0\n"},
@@ -374,6 +467,42 @@ var runTests = []runTest{
 		"a=b; echo ${!a}; b=c; echo ${!a}",
 		"\nc\n",
 	},
+	{
+		"a='b c'; echo ${!a}",
+		"invalid indirect expansion\nexit status 1 #JUSTERR",
+	},
+	{
+		"r=(b a) a=b b=c; echo ${!r[0]} ${!r[1]} ${!r}",
+		"c b c\n",
+	},
+	{
+		"a=(x y z) p='a[1]'; echo ${!p}; i=2 p='a[i]'; echo ${!p}",
+		"y\nz\n",
+	},
+	{
+		`a=("x  y" z) p='a[@]'; printf '<%s>' "${!p}"; echo`,
+		"<x  y><z>\n",
+	},
+	{
+		`declare -A m=([key]=v); p='m[key]'; echo ${!p}`,
+		"v\n",
+	},
+	{
+		"set -- one two; p=2; echo ${!p}; p='#'; echo ${!p}",
+		"two\n2\n",
+	},
+	{
+		"a=b b=cde; echo ${!a/d/D} ${!a:1:1} ${!a#c}",
+		"cDe d de\n",
+	},
+	{
+		`u=nosuch; echo "<${!u}>" "<${!u:-def}>"`,
+		"<> <def>\n",
+	},
+	{
+		"u=nosuch; set -u; echo ${!u}; echo after",
+		"nosuch: unbound variable\nexit status 1 #JUSTERR",
+	},
 	{
 		"a=foo; echo ${a:1}; echo ${a: -1}; echo ${a: -10}; echo ${a:5}",
 		"oo\no\n\n\n",
@@ -386,6 +515,26 @@ var runTests = []runTest{
 		"a=abc; echo ${a:1:1}",
 		"b\n",
 	},
+	{
+		"a=abcdef; echo ${a: -3:2} ${a:1:-2} ${a: -4:-1} ${a:(-2)}",
+		"de bcd cde ef\n",
+	},
+	{
+		`a=abc; echo "${a:1:-5}"`,
+		"-5: substring expression < 0\nexit status 1 #JUSTERR",
+	},
+	{
+		"a=(a b c d e); echo ${a[@]: -3:2}; echo ${a[@]:1}",
+		"c d\nb c d e\n",
+	},
+	{
+		`a=(a b c); echo "${a[@]:1:-1}"`,
+		"-1: substring expression < 0\nexit status 1 #JUSTERR",
+	},
+	{
+		"a=héllo; echo ${a:1:2} ${a: -2} ${a:1:-1}",
+		"él lo éll\n #IGNORE",
+	},
 	{
 		"a=foo; echo ${a/no/x} ${a/o/i} ${a//o/i} ${a/fo/}",
 		"foo fio fii o\n",
@@ -413,6 +562,15 @@ var runTests = []runTest{
 	{"a='abcx1y'; echo ${a//x[[:digit:]]y}", "abc\n"},
 	{`a=xyz; echo "${a/y/a  b}"`, "xa  bz\n"},
 	{"a='foo/bar'; echo ${a//o*a/}", "fr\n"},
+	{"a=xaxbx; echo ${a/#x/Y} ${a/%x/Y} ${a/#a/Y} ${a/%b/Y}", "Yaxbx xaxbY xaxbx xaxbx\n"},
+	{"a=xaxbx; echo ${a/#x*/Y} ${a/%x*/Y} ${a/%*x/Y} ${a/#*b/Y}", "Y Y Y Yx\n"},
+	{"a=xaxbx; echo ${a/#/Y} ${a/%/Y} ${a/#x} ${a/%x/}", "Yxaxbx xaxbxY axbx xaxb\n"},
+	{`a=xaxbx; echo ${a//#x/Y} ${a/"#"x/Y} ${a/\#x/Y} ${a/%"#"/Y}`, "xaxbx xaxbx xaxbx xaxbx\n"},
+	{"a='x#%'; echo ${a/%#%/Y} ${a/##/Y} ${a/#x#/Y}", "xY x#% Y%\n"},
+	{"a=(xa ax xx); echo ${a[@]/#x/Y} ${a[@]/%x/Y}", "Ya ax Yx xa aY xY\n"},
+	{"set -- xa ax; echo ${@/#x/Y} ${*/%x/Y}", "Ya ax xa aY\n"},
+	{`a=xa b=y; echo ${a/#?/\#} ${a/#x/$b} "${a/%a/"$b  $b"}" "${a/#x/\y}"`, "#a ya xy  y ya\n"},
+	{"a=x; echo ${a/} ${a//} ${a/#} ${a/%}", "x x x x\n"},
 	{
 		"echo ${a:-b}; echo $a; a=; echo ${a:-b}; a=c; echo ${a:-b}",
 		"b\n\nb\nc\n",
@@ -443,15 +601,35 @@ var runTests = []runTest{
 	},
 	{
 		"a=b; echo ${a:?err1}; a=; echo ${a:?err2}; unset a; echo ${a:?err3}",
-		"b\nerr2\nexit status 1 #JUSTERR",
+		"b\na: err2\nexit status 1 #JUSTERR",
 	},
 	{
 		"a=b; echo ${a?err1}; a=; echo ${a?err2}; unset a; echo ${a?err3}",
-		"b\n\nerr3\nexit status 1 #JUSTERR",
+		"b\n\na: err3\nexit status 1 #JUSTERR",
 	},
 	{
 		"echo ${a:?%s}",
-		"%s\nexit status 1 #JUSTERR",
+		"a: %s\nexit status 1 #JUSTERR",
+	},
+	{
+		"a=; echo ${a?}; echo ${a:?}; echo never",
+		"\na: parameter null or not set\nexit status 1 #JUSTERR",
+	},
+	{
+		"echo ${a?}",
+		"a: parameter not set\nexit status 1 #JUSTERR",
+	},
+	{
+		"f() { echo ${a:?m}; echo never; }; f; echo never",
+		"a: m\nexit status 1 #JUSTERR",
+	},
+	{
+		"arr=(x); echo ${arr[1]:?}",
+		"arr[1]: parameter null or not set\nexit status 1 #JUSTERR",
+	},
+	{
+		"(echo ${a:?m}; echo never); echo sub $?",
+		"a: m\nsub 1\n #IGNORE",
 	},
 	{
 		"x=aaabccc; echo ${x#*a}; echo ${x##*a}",
@@ -493,6 +671,18 @@ var runTests = []runTest{
 		"a=(àÉñ bAr); echo ${a[@]^}; echo ${a[*],,}",
 		"ÀÉñ BAr\nàéñ bar\n",
 	},
+	{
+		"a=abc; echo ${a^b} ${a^a} ${a^^[ac]} ${a^^a*}; b=ABC; echo ${b,B} ${b,,[AB]}",
+		"abc Abc AbC Abc\nABC abC\n",
+	},
+	{
+		`a=(ab cd); echo "${a[@]^c}"; set -- ab cd; echo ${*^^d}`,
+		"ab Cd\nab cD\n",
+	},
+	{
+		"name=world; echo ${name^}",
+		"World\n",
+	},
 	{
 		"INTERP_X_1=a INTERP_X_2=b; echo ${!INTERP_X_*}",
 		"INTERP_X_1 INTERP_X_2\n",
@@ -517,10 +707,38 @@ var runTests = []runTest{
 		`INTERP_X_2=b INTERP_X_1=a; set -- "${!INTERP_@}"; echo $#`,
 		"3\n",
 	},
+	{
+		`INTERP_X_1=a INTERP_X_2=b; unset INTERP_X_2; echo ${!INTERP_X_@}`,
+		"INTERP_X_1\n",
+	},
+	{
+		`INTERP_GLOBAL=x; echo ${!INTERP_G@}`,
+		"INTERP_GLOBAL\n",
+	},
+	{
+		`f() { local INTERP_X_3=c; echo ${!INTERP_X_*}; }; INTERP_X_1=a; f; echo ${!INTERP_X_*}`,
+		"INTERP_X_1 INTERP_X_3\nINTERP_X_1\n",
+	},
+	{
+		`INTERP_X_1=a INTERP_X_2=b; IFS=,; echo "${!INTERP_X_*}"; echo ${!INTERP_X_@}`,
+		"INTERP_X_1,INTERP_X_2\nINTERP_X_1 INTERP_X_2\n",
+	},
+	{
+		`printf '<%s>' "${!INTERP_NOMATCH_@}" "${!INTERP_NOMATCH_*}"`,
+		"<>",
+	},
 	{
 		`a='b  c'; eval "echo -n ${a} ${a@Q}"`,
 		`b c b  c`,
 	},
+	{
+		`a=''; b='it'"'"'s'; c=$'a\tb'; echo ${a@Q} ${b@Q} ${c@Q}`,
+		"'' 'it'\\''s' $'a\\tb'\n",
+	},
+	{
+		`a=(x 'y z'); b=$'\x01"'; echo "${a[@]@Q}" "${b@Q}"`,
+		"x 'y z' $'\\001\"'\n #IGNORE",
+	},
 	{
 		`a='"\n'; printf "%s %s" "${a}" "${a@E}"`,
 		"\"\\n \"\n",
@@ -585,8 +803,24 @@ var runTests = []runTest{
 		"while true; do while true; do break 2; done; done",
 		"",
 	},
+	{
+		"i=3; while (( i-- )); do echo $i; done; echo $i",
+		"2\n1\n0\n-1\n",
+	},
+	{
+		"i=0; while ((i < 2)) && true; do echo $((i++)); done; echo $?",
+		"0\n1\n0\n",
+	},
+	{
+		"set -e; i=1; while ((i--)); do echo $i; done; echo ok",
+		"0\nok\n",
+	},
 
 	// until
+	{
+		"i=0; until (( i >= 3 )); do echo $i; ((i++)); done",
+		"0\n1\n2\n",
+	},
 	{
 		"until true; do echo foo; done",
 		"",
@@ -721,6 +955,13 @@ var runTests = []runTest{
 	{`[[ 'ab\c' == *\\* ]]`, ""},
 	{`[[ foo/bar == foo* ]]`, ""},
 	{"[[ a == [ab ]]", "exit status 1"},
+	{"[[ foo == @(foo|bar) ]]", ""},
+	{"[[ foo == +(f|o) ]]", ""},
+	{"[[ foo == f?(x)o*(o) ]]", ""},
+	{"[[ foo == !(foo) ]]", "exit status 1"},
+	{"[[ foo.sh == !(*.go|*.c) ]]", ""},
+	{`[[ foo == "@(foo)" ]]`, "exit status 1"},
+	{`p='@(a|b)'; [[ b == $p ]]`, ""},
 	{`HOME='/*'; echo ~; echo "$HOME"`, "/*\n/*\n"},
 	{`test -d ~`, ""},
 	{`foo=~; test -d $foo`, ""},
@@ -787,6 +1028,65 @@ var runTests = []runTest{
 		`mkdir a; ln -s a b; [[ $(cd a && pwd) == "$(cd b && pwd)" ]]; echo $?`,
 		"1\n",
 	},
+	{
+		`mkdir a; ln -s a b; cd b; p=$(pwd -P); echo ${PWD##*/} ${p##*/}`,
+		"b a\n",
+	},
+	{
+		`mkdir a; ln -s a b; cd -P b; echo ${PWD##*/}; cd -P -L ../b; echo ${PWD##*/}`,
+		"a\nb\n",
+	},
+	{
+		`mkdir a; ln -s a b; cd -L -P -- b && echo ${PWD##*/}`,
+		"a\n",
+	},
+	{
+		`mkdir a; ln -s a b; set -o physical; cd b; echo ${PWD##*/}`,
+		"a\n",
+	},
+	{
+		`mkdir a; ln -s a b; set -P; cd b; echo ${PWD##*/}; cd -L ../b; echo ${PWD##*/}`,
+		"a\nb\n",
+	},
+	{
+		`mkdir -p x/y z; cd z; ln -s ../x/y l; cd ..; cd z/l; echo ${PWD##*/}; cd ..; echo ${PWD##*/}`,
+		"l\nz\n",
+	},
+	{
+		`mkdir -p x/y z; cd z; ln -s ../x/y l; cd ..; cd z/l; cd -P ..; echo ${PWD##*/}`,
+		"x\n",
+	},
+	{
+		`mkdir -p x/y z; cd z; ln -s ../x/y l; cd ..; set -o physical; cd z/l/..; echo ${PWD##*/}`,
+		"x\n",
+	},
+	{"cd -P noexist", "exit status 1 #JUSTERR"},
+	{
+		`mkdir -p a/sub b; top=$PWD; cd b; CDPATH=../a; cd sub >$top/out; read dir <$top/out; [[ $dir == "$PWD" ]] && echo ${PWD#$top/}`,
+		"a/sub\n",
+	},
+	{
+		`mkdir -p a/sub b; top=$PWD; CDPATH=$top/b:$top/a; cd b; cd sub >/dev/null; echo ${PWD#$top/}`,
+		"a/sub\n",
+	},
+	{
+		`mkdir -p a/sub sub; CDPATH=:a; cd sub; echo ${PWD#$OLDPWD/}`,
+		"sub\n",
+	},
+	{
+		`mkdir -p a/sub; CDPATH=a:; cd a; echo ${PWD#$OLDPWD/}`,
+		"a\n",
+	},
+	{
+		`mkdir sub; CDPATH=nonexistent; cd sub; echo ${PWD#$OLDPWD/}`,
+		"sub\n",
+	},
+	{
+		`mkdir -p a/sub; CDPATH=a; cd ./sub`,
+		"exit status 1 #JUSTERR",
+	},
+	{"pwd -x", "pwd: invalid option \"-x\"\nexit status 2 #JUSTERR"},
+	{"[[ $(pwd -- foo) == \"$PWD\" ]]", ""},
 
 	// dirs/pushd/popd
 	{"set -- $(dirs); echo $# ${#DIRSTACK[@]}", "1 1\n"},
@@ -865,6 +1165,34 @@ var runTests = []runTest{
 		"foo() { echo $1; }; foo a b",
 		"a\n",
 	},
+	{
+		"FUNCNEST=3; f() { echo in$1; f $(($1+1)); echo never; }; f 1; echo never",
+		"in1\nin2\nin3\nf: maximum function nesting level exceeded (3)\nexit status 1 #JUSTERR",
+	},
+	{
+		"FUNCNEST=2; f() { g; }; g() { echo g; }; f",
+		"g\n",
+	},
+	{
+		"x=outer; f() { local x=inner; set -- a; for i in 1; do return 3; done; }; set -- p; f; echo $? $x $1",
+		"3 outer p\n",
+	},
+	{
+		"x=outer; f() { local x=inner; set -e; false; }; (f; echo never); echo $? $x; (f) || echo $x",
+		"1 outer\nouter\n",
+	},
+	{
+		"FUNCNEST=2; f() { (f); echo sub $?; }; f; echo done",
+		"f: maximum function nesting level exceeded (2)\nsub 1\nsub 0\ndone\n #IGNORE",
+	},
+	{
+		"f() { f; }; f; echo never",
+		"f: maximum function nesting level exceeded (1000)\nexit status 1 #IGNORE",
+	},
+	{
+		"FUNCNEST=x; f() { f; }; f",
+		"f: maximum function nesting level exceeded (1000)\nexit status 1 #IGNORE",
+	},
 	{
 		"foo() { echo $1; bar c d; echo $2; }; bar() { echo $2; }; foo a b",
 		"a\nd\nb\n",
@@ -894,6 +1222,189 @@ var runTests = []runTest{
 		"a  1\nb  2\n",
 	},
 
+	// trap
+	{"trap", ""},
+	{"trap 'echo bye' EXIT; echo hi", "hi\nbye\n"},
+	{"trap 'echo bye $?' EXIT; exit 3", "bye 3\nexit status 3"},
+	{"trap 'exit 4' EXIT; true", "exit status 4"},
+	{"trap 'false' EXIT; true", ""},
+	{"trap 'echo bye' 0; trap - EXIT; echo hi", "hi\n"},
+	{"trap 'echo bye' exit; trap EXIT; echo hi", "hi\n"},
+	{"trap 'echo bye' EXIT; (exit 2); echo hi", "hi\nbye\n"},
+	{"(trap 'echo bye' EXIT; echo hi); echo after", "hi\nbye\nafter\n"},
+	{
+		"trap \"echo it's\" EXIT ERR; trap; trap -p ERR; trap - EXIT ERR",
+		"trap -- 'echo it'\\''s' EXIT\ntrap -- 'echo it'\\''s' ERR\ntrap -- 'echo it'\\''s' ERR\n",
+	},
+	{"trap '' ERR; trap -p", "trap -- '' ERR\n"},
+	{
+		"trap x nosuch",
+		"trap: nosuch: invalid signal specification\nexit status 1 #JUSTERR",
+	},
+	{
+		"trap -x",
+		"trap: -x: invalid option\ntrap: usage: trap [-lp] [[arg] signal_spec ...]\nexit status 2 #JUSTERR",
+	},
+	{
+		"trap 'echo t' TERM; trap 'echo i' 2; trap 'echo u' sigusr1; trap 'echo e' ERR; trap 'echo x' EXIT; trap -p; trap - EXIT ERR",
+		"trap -- 'echo x' EXIT\ntrap -- 'echo i' SIGINT\ntrap -- 'echo u' SIGUSR1\ntrap -- 'echo t' SIGTERM\ntrap -- 'echo e' ERR\n",
+	},
+	{
+		"trap 'echo t' SIGTERM; trap -p 15 int; trap - term; trap usr1; trap -p",
+		"trap -- 'echo t' SIGTERM\n",
+	},
+	{
+		"trap x SIGNOPE",
+		"trap: SIGNOPE: invalid signal specification\nexit status 1 #JUSTERR",
+	},
+	{
+		"trap x 99",
+		"trap: 99: invalid signal specification\nexit status 1 #JUSTERR",
+	},
+	{"trap -l | head -n 2", " 1) SIGHUP\t 2) SIGINT\t 3) SIGQUIT\t 4) SIGILL\t 5) SIGTRAP\n 6) SIGABRT\t 7) SIGBUS\t 8) SIGFPE\t 9) SIGKILL\t10) SIGUSR1\n"},
+	{"[[ $(trap -l) == $(kill -l) ]]", ""},
+	{"trap 'echo err $?' ERR; false; true; echo hi", "err 1\nhi\n"},
+	{"trap 'echo err' ERR; ! false; false || true; if false; then :; fi", ""},
+	{"trap 'echo err' ERR; trap '' ERR; false; echo hi", "hi\n"},
+	{"set -e; trap 'echo err $?' ERR; false; echo hi", "err 1\nexit status 1"},
+	{"trap 'echo err' ERR; f() { false; echo in; }; f", "in\n"},
+	{"trap 'echo err' ERR; f() { false; }; f", "err\nexit status 1"},
+	{"set -E; trap 'echo err' ERR; f() { false; echo in; }; f", "err\nin\n"},
+	{"trap 'echo err' ERR; (false; true)", ""},
+	{"set -o errtrace; trap 'echo err' ERR; (false; true)", "err\n"},
+	{"trap 'echo dbg' DEBUG; echo a; echo b", "dbg\na\ndbg\nb\n"},
+	{"trap 'echo dbg $?' DEBUG; false; true", "dbg 0\ndbg 1\n"},
+	{"trap 'echo dbg' DEBUG; f() { echo a; }; f", "dbg\na\n"},
+	{"set -T; trap 'echo dbg' DEBUG; f() { echo a; }; f", "dbg\ndbg\ndbg\na\n"},
+	{"trap 'echo dbg' DEBUG; (echo a)", "a\n"},
+	{"set -o functrace; trap 'echo dbg' DEBUG; (echo a)", "dbg\na\n"},
+	{"trap 'echo dbg' DEBUG; for i in 1 2; do continue; done", "dbg\ndbg\ndbg\ndbg\n"},
+	{"trap 'echo dbg' DEBUG; for ((i=0; i<1; i++)); do :; done", "dbg\ndbg\ndbg\ndbg\ndbg\n"},
+	{"trap 'echo dbg' DEBUG; case x in x) echo a;; esac", "dbg\ndbg\na\n"},
+	{"f() { trap 'echo err' ERR; }; f; false; echo after", "err\nafter\n"},
+
+	// trap inheritance in subshells
+	{"trap 'echo t' TERM; (trap -p); echo \"$(trap)\"", "trap -- 'echo t' SIGTERM\ntrap -- 'echo t' SIGTERM\n"},
+	{"trap 'echo t' TERM; trap | cat; (true; (trap -p TERM))", "trap -- 'echo t' SIGTERM\ntrap -- 'echo t' SIGTERM\n"},
+	{"trap 'echo t' TERM; (trap 'echo u' USR1; trap -p)", "trap -- 'echo u' SIGUSR1\n"},
+	{"trap 'echo t' TERM; (trap - TERM; trap -p; echo done)", "done\n"},
+	{"trap '' TERM; trap '' EXIT; (trap 'echo u' USR1; trap -p)", "trap -- '' EXIT\ntrap -- 'echo u' SIGUSR1\ntrap -- '' SIGTERM\n"},
+	{"trap 'echo bye' EXIT; saved=$(trap -p EXIT); trap - EXIT; eval \"$saved\"; echo hi", "hi\nbye\n"},
+	{"trap 'echo bye' EXIT; (echo a) | cat; x=$(echo b); echo $x", "a\nb\nbye\n"},
+	{"x=$(trap 'echo bye' EXIT; echo hi); echo \"[$x]\"", "[hi\nbye]\n"},
+	{"{ trap 'echo bye' EXIT; echo hi; } | cat; echo after", "hi\nbye\nafter\n"},
+	{"{ trap 'echo bye' EXIT; echo hi; } & wait; echo after", "hi\nbye\nafter\n"},
+	{"cat <(trap 'echo bye' EXIT; echo hi)", "hi\nbye\n"},
+
+	// control flow with traps and errexit
+	{
+		"set -e; for i in 1 2 3; do if [ $i = 2 ]; then continue; fi; echo $i; done; echo end",
+		"1\n3\nend\n",
+	},
+	{"set -e; for i in 1 2; do for j in a b; do break 2; done; done; echo $i$j", "1a\n"},
+	{"set -e; while true; do break; done; until false; do break; done; echo ok", "ok\n"},
+	{
+		"set -e; f() { for i in 1 2 3; do [ $i = 2 ] && return 3; echo $i; done; }; f || echo st=$?",
+		"1\nst=3\n",
+	},
+	{"set -e; f() { return 1; }; f || echo caught; f; echo notreached", "caught\nexit status 1"},
+	{"set -e; f() { while true; do exit 4; done; }; f; echo notreached", "exit status 4"},
+	{
+		"set -e; g() { return 1; }; f() { for i in 1 2; do g || continue; echo $i; done; echo end; }; f",
+		"end\n",
+	},
+	{"set -e; trap 'echo bye' EXIT; for i in 1 2; do false; done; echo no", "bye\nexit status 1"},
+	{"for i in 1 2 3; do trap 'break' ERR; false; echo $i; done; echo st=$?", "st=1\n"},
+	{"for i in 1 2; do trap 'continue' ERR; false; echo $i; done; echo st=$?", "st=1\n"},
+	{"trap 'echo err; exit 3' ERR; for i in 1 2; do false; done; echo no", "err\nexit status 3"},
+	{"set -E; trap 'echo err; trap - ERR; return 2' ERR; f() { false; echo no; }; f; echo st=$?", "err\nst=2\n"},
+	{"f() { trap 'trap - DEBUG; return 7' DEBUG; :; echo no; }; f; echo st=$?", "st=7\n"},
+
+	// BASH_COMMAND
+	{"echo $BASH_COMMAND", "echo $BASH_COMMAND\n"},
+	{`x=1 echo "$BASH_COMMAND"`, "x=1 echo \"$BASH_COMMAND\"\n"},
+	{
+		`echo $(echo $BASH_COMMAND) "$BASH_COMMAND"`,
+		"echo $BASH_COMMAND echo $(echo $BASH_COMMAND) \"$BASH_COMMAND\"\n",
+	},
+	{
+		`trap 'echo "dbg: $BASH_COMMAND"' DEBUG; echo a; trap - DEBUG`,
+		"dbg: echo a\na\ndbg: trap - DEBUG\n",
+	},
+	{
+		`trap 'echo "err: $BASH_COMMAND ($?)"' ERR; false foo`,
+		"err: false foo (1)\nexit status 1",
+	},
+	{`BASH_COMMAND=foo; echo "$BASH_COMMAND"`, "echo \"$BASH_COMMAND\"\n"},
+
+	// hash
+	{"hash", "hash: hash table empty\n"},
+	{"hash -r; hash", "hash: hash table empty\n"},
+	{"hash -p /a/foo foo; hash -t foo", "/a/foo\n"},
+	{
+		"hash -p /a/foo foo; hash -p /a/bar bar; hash -t foo bar",
+		"foo\t/a/foo\nbar\t/a/bar\n",
+	},
+	{
+		"hash -p /a/foo foo; hash -p /a/bar bar; hash",
+		"hits\tcommand\n   0\t/a/bar\n   0\t/a/foo\n #IGNORE",
+	},
+	{
+		"hash -p /a/foo foo; hash -l",
+		"builtin hash -p /a/foo foo\n",
+	},
+	{
+		"hash -p /a/foo foo; hash -d foo; hash",
+		"hash: hash table empty\n",
+	},
+	{
+		"hash -p /a/foo foo; hash -r; hash -t foo",
+		"hash: foo: not found\nexit status 1 #JUSTERR",
+	},
+	{
+		"hash -p /a/foo foo; PATH=$PATH; hash -t foo",
+		"hash: foo: not found\nexit status 1 #JUSTERR",
+	},
+	{
+		"hash -d foo",
+		"hash: foo: not found\nexit status 1 #JUSTERR",
+	},
+	{
+		"hash no_such_program_xyz",
+		"hash: no_such_program_xyz: not found\nexit status 1 #JUSTERR",
+	},
+	{
+		"hash -x",
+		"hash: -x: invalid option\nhash: usage: hash [-lr] [-p pathname] [-dt] [name ...]\nexit status 2 #JUSTERR",
+	},
+
+	// compgen and complete
+	{"compgen -W 'apple banana apricot' ap", "apple\napricot\n"},
+	{"compgen -W 'x y' z", "exit status 1"},
+	{"compgen -W 'a b' -P pre -S suf", "preasuf\nprebsuf\n"},
+	{"compgen", ""},
+	{"compgen -b ec; compgen -k el", "echo\nelif\nelse\n #IGNORE"},
+	{"f1() { :; }; f2() { :; }; compgen -A function f", "f1\nf2\n"},
+	{"foo_x=1; compgen -v foo_", "foo_x\n"},
+	{"mkdir dir; touch file; compgen -f; compgen -d", "dir\nfile\ndir\n #IGNORE"},
+	{"mkdir dir; touch dir/a dir/b; compgen -f -W 'dz' d; compgen -f dir/", "dir\ndz\ndir/a\ndir/b\n #IGNORE"},
+	{"compgen -c compge", "compgen\n"},
+	{"f() { COMPREPLY=(one two); }; compgen -F f x", "one\ntwo\n #IGNORE"},
+	{
+		"compgen -x",
+		"compgen: -x: invalid option\ncompgen: usage: compgen [-abcdfkv] [-A action] [-W wordlist] [-F function] [-P prefix] [-S suffix] [word]\nexit status 2 #JUSTERR",
+	},
+	{"compgen -A nosuch", "compgen: nosuch: invalid action name\nexit status 2 #JUSTERR"},
+	{"compgen -W", "compgen: -W: option requires an argument\ncompgen: usage: compgen [-abcdfkv] [-A action] [-W wordlist] [-F function] [-P prefix] [-S suffix] [word]\nexit status 2 #JUSTERR"},
+	{
+		"complete -F _f bar; complete -W 'a b' -f -d foo; complete -p",
+		"complete -F _f bar\ncomplete -d -f -W 'a b' foo\n #IGNORE",
+	},
+	{"complete -A function -c foo; complete -p foo", "complete -c -A function foo\n"},
+	{"complete -f foo; complete -r foo; complete -p foo", "complete: foo: no completion specification\nexit status 1 #JUSTERR"},
+	{"complete -f foo bar; complete -r; complete", ""},
+	{"complete -f foo; (complete -r foo); complete -p", "complete -f foo\n"},
+
 	// alias (note the input newlines)
 	{
 		"alias foo; alias foo=echo; alias foo; alias foo=; alias foo",
@@ -915,6 +1426,30 @@ var runTests = []runTest{
 		"shopt -s expand_aliases; alias foo='echo '\nfoo foo; foo bar",
 		"echo\nbar\n",
 	},
+	{
+		"shopt -s expand_aliases; alias a=b b='echo hi'\na there",
+		"hi there\n",
+	},
+	{
+		"shopt -s expand_aliases; alias a=b b=a\na 2>/dev/null; echo $?",
+		"127\n",
+	},
+	{
+		"shopt -s expand_aliases; alias a='b ' b=echo c=x\na c",
+		"x\n",
+	},
+	{
+		"shopt -s expand_aliases; alias a=b b='echo ' c=x\na c",
+		"c\n",
+	},
+	{
+		"shopt -s expand_aliases; alias e='echo ' q=''\ne q x",
+		"x\n",
+	},
+	{
+		"alias b=2 a=1; alias",
+		"alias a='1'\nalias b='2'\n",
+	},
 
 	// case
 	{
@@ -937,6 +1472,50 @@ var runTests = []runTest{
 		"case foo in '*') echo x ;; f*) echo y ;; esac",
 		"y\n",
 	},
+	{
+		"shopt -s extglob; case foo.go in !(*.go)) echo x ;; @(*.c|*.go)) echo y ;; esac",
+		"y\n #IGNORE",
+	},
+	{
+		"case foo in @(foo)) echo x ;; *) echo y ;; esac",
+		"y\n #IGNORE",
+	},
+	{
+		"case a in a) echo 1 ;& b) echo 2 ;;& a) echo 3 ;; *) echo 4 ;; esac",
+		"1\n2\n3\n",
+	},
+	{
+		"for n in 2 5 8; do case $n in [0-3]) echo low ;;& [4-6]) echo mid ;& [7-9]) echo high ;;& *) echo any ;; esac; done",
+		"low\nany\nmid\nhigh\nany\nhigh\nany\n",
+	},
+	{
+		"case x in a) echo a ;& b) echo b ;; esac; case a in a) echo a ;& esac",
+		"a\n",
+	},
+	{
+		"case a in a) ;;& b) echo b ;;& *) echo star ;;& c) echo c ;; esac",
+		"star\n",
+	},
+	{
+		"case a in a) false ;& b) ;; esac; echo $?; case a in a) false ;;& a) ;; esac; echo $?",
+		"0\n0\n",
+	},
+	{
+		"case a in a) false ;& b) echo $? ;; esac",
+		"1\n",
+	},
+	{
+		"for i in 1 2; do case $i in 1) echo one; continue ;& *) echo never ;; esac; echo after; done",
+		"one\nnever\nafter\n",
+	},
+	{
+		"for i in 1; do case a in a) break; echo no ;;& *) echo no ;; esac; done; echo ok",
+		"ok\n",
+	},
+	{
+		"for i in 1; do if true; then break; echo no; fi; done; for i in 1; do { continue; echo no; }; done; echo ok",
+		"ok\n",
+	},
 
 	// exec
 	{
@@ -970,6 +1549,13 @@ var runTests = []runTest{
 	{"echo 'return' >a; source a; return", "return: can only be done from a func or sourced script\nexit status 1 #JUSTERR"},
 	{"echo 'return 2' >a; source a", "exit status 2"},
 	{"echo 'echo foo; return; echo bar' >a; source a", "foo\n"},
+	{"return; echo $?", "return: can only be done from a func or sourced script\n1\n #IGNORE"},
+	{"f() { false; return; }; f; echo $?", "1\n"},
+	{"f() { return x; echo no; }; f; echo $?", "return: x: numeric argument required\n2\n #IGNORE"},
+	{"f() { (return 3; echo no); echo $?; }; f", "3\n"},
+	{"f() { (trap 'echo exit' EXIT; return 3); echo $?; }; f", "exit\n3\n"},
+	{"echo '(return 3); echo $?; return 4; echo no' >a; source a; echo $?", "3\n4\n"},
+	{"echo 'return' >a; f() { false; source a; }; f; echo $?", "1\n"},
 
 	// command
 	{"command", ""},
@@ -1019,6 +1605,22 @@ var runTests = []runTest{
 		"echo foo >f; echo $(<f; echo bar)",
 		"bar\n",
 	},
+	{
+		`f() { echo "[$*]"; }; echo "a$(f "b$(f c)")d"`,
+		"a[b[c]]d\n",
+	},
+	{
+		"f() { echo \"[$*]\"; }; echo \"a`f \\\"b\\`f c\\`\\\"`d\"",
+		"a[b[c]]d\n",
+	},
+	{
+		"echo `echo \\`echo \\\\\\`echo a  b\\\\\\`\\``",
+		"a b\n",
+	},
+	{
+		"x=y; echo `echo \\$x '\\$x' '\\\\' \\\\`; echo \"`echo '\\\"'`\"",
+		"y $x \\ \\\n\"\n",
+	},
 
 	// pipes
 	{
@@ -1068,48 +1670,152 @@ var runTests = []runTest{
 		"",
 	},
 	{
-		"echo foo >a; wc -c <a",
-		"4\n",
+		"echo foo >a; echo bar >|a; cat a",
+		"bar\n",
 	},
 	{
-		"echo foo >>a; echo bar &>>a; wc -c <a",
-		"8\n",
+		"set -C; echo foo >a; echo bar >a; echo $?; cat a",
+		"a: cannot overwrite existing file\n1\nfoo\n #IGNORE",
 	},
 	{
-		"{ echo a; echo b >&2; } &>/dev/null",
-		"",
+		"set -o noclobber; echo foo >a; echo bar &>a",
+		"a: cannot overwrite existing file\nexit status 1 #JUSTERR",
 	},
 	{
-		"sed 's/o/a/g' <<EOF\nfoo$foo\nEOF",
-		"faa\n",
+		"set -C; echo foo >a; echo bar >|a; echo baz >>a; echo new >b; cat a b",
+		"bar\nbaz\nnew\n",
 	},
 	{
-		"sed 's/o/a/g' <<'EOF'\nfoo$foo\nEOF",
-		"faa$faa\n",
+		"set -C; echo foo >/dev/null; set +C; echo bar >a; echo baz >a; cat a",
+		"baz\n",
 	},
 	{
-		"sed 's/o/a/g' <<EOF\n\tfoo\nEOF",
-		"\tfaa\n",
+		"exec 3>a; echo foo >&3; echo bar >&3; exec 3>&-; cat a",
+		"foo\nbar\n",
 	},
 	{
-		"sed 's/o/a/g' <<EOF\nfoo\nEOF",
-		"faa\n",
+		"echo foo 3>a >&3; cat a; echo bar >&3",
+		"foo\n3: bad file descriptor\nexit status 1 #JUSTERR",
 	},
 	{
-		"cat <<EOF\n~/foo\nEOF",
-		"~/foo\n",
+		"{ echo foo >&4; } 4>a; exec 3>b; echo bar >/dev/fd/3; cat a b",
+		"foo\nbar\n",
 	},
 	{
-		"sed 's/o/a/g' <<<foo$foo",
-		"faa\n",
+		"exec 3>&1; f() { echo foo >&3; }; f >/dev/null",
+		"foo\n",
 	},
 	{
-		"cat <<-EOF\n\tfoo\nEOF",
-		"foo\n",
+		"exec 3<<<foo; read -r line <&3; echo $line; cat 4<<EOF <&4\nbar\nEOF",
+		"foo\nbar\n",
 	},
 	{
-		"cat <<-EOF\n\tfoo\n\nEOF",
-		"foo\n\n",
+		"echo foo {fd}>a; echo $fd; echo bar >&$fd; exec {fd}>&-; cat a",
+		"foo\n10\nbar\n",
+	},
+	{
+		"exec {fd}<<<foo; cat <&$fd",
+		"foo\n",
+	},
+	{
+		"exec {fd}>&-",
+		"fd: ambiguous redirect\nexit status 1 #JUSTERR",
+	},
+	{
+		"exec 3>&1; exec >a; echo foo; exec 2>b; echo bar >&2; exec >&3; cat a b",
+		"foo\nbar\n",
+	},
+	{
+		"exec 3>&1; exec >&-; echo foo; exec >&3; echo bar",
+		"echo: write error: bad file descriptor\nbar\n",
+	},
+	{
+		"echo foo 2>&-; echo bar >&-; cat <&-; echo baz",
+		"foo\necho: write error: bad file descriptor\nbaz\n",
+	},
+	{
+		"echo foo >&-; echo $?; printf foo >&-; echo $?; echo foo 2>&-",
+		"echo: write error: bad file descriptor\n1\nprintf: write error: bad file descriptor\n1\nfoo\n",
+	},
+	{
+		`d=x; mkdir x; echo foo >"$d/f"; HOME=$PWD; echo bar >~/x/g; cat x/f x/g`,
+		"foo\nbar\n",
+	},
+	{
+		"echo foo >$(echo a); cat a",
+		"foo\n",
+	},
+	{
+		`x="a b"; echo foo >$x; echo $?; [[ -e a ]] || echo none`,
+		"$x: ambiguous redirect\n1\nnone\n #IGNORE",
+	},
+	{
+		"echo foo >$empty",
+		"$empty: ambiguous redirect\nexit status 1 #JUSTERR",
+	},
+	{
+		`set -f; x="a b"; echo foo >>$x`,
+		"$x: ambiguous redirect\nexit status 1 #JUSTERR",
+	},
+	{
+		"touch a1 a2; echo foo >a*; echo $?; echo bar >b*; cat b*",
+		"a*: ambiguous redirect\n1\nbar\n #IGNORE",
+	},
+	{
+		`x="1 2"; echo foo >&$x`,
+		"$x: ambiguous redirect\nexit status 1 #JUSTERR",
+	},
+	{
+		"set -u; echo foo >${undefined}; echo bar",
+		"undefined: unbound variable\nexit status 1 #JUSTERR",
+	},
+	{
+		"echo foo >a; wc -c <a",
+		"4\n",
+	},
+	{
+		"echo foo >>a; echo bar &>>a; wc -c <a",
+		"8\n",
+	},
+	{
+		"{ echo a; echo b >&2; } &>/dev/null",
+		"",
+	},
+	{
+		"&>a echo a | cat; echo b | &>>a cat; { echo c; echo d >&2; } &>>a | cat; cat a",
+		"a\nb\nc\nd\n",
+	},
+	{
+		"sed 's/o/a/g' <<EOF\nfoo$foo\nEOF",
+		"faa\n",
+	},
+	{
+		"sed 's/o/a/g' <<'EOF'\nfoo$foo\nEOF",
+		"faa$faa\n",
+	},
+	{
+		"sed 's/o/a/g' <<EOF\n\tfoo\nEOF",
+		"\tfaa\n",
+	},
+	{
+		"sed 's/o/a/g' <<EOF\nfoo\nEOF",
+		"faa\n",
+	},
+	{
+		"cat <<EOF\n~/foo\nEOF",
+		"~/foo\n",
+	},
+	{
+		"sed 's/o/a/g' <<<foo$foo",
+		"faa\n",
+	},
+	{
+		"cat <<-EOF\n\tfoo\nEOF",
+		"foo\n",
+	},
+	{
+		"cat <<-EOF\n\tfoo\n\nEOF",
+		"foo\n\n",
 	},
 	{
 		"cat <<EOF\nfoo\\\nbar\nEOF",
@@ -1140,6 +1846,16 @@ var runTests = []runTest{
 		"foo\n",
 	},
 
+	// special files
+	{"echo foo | cat </dev/stdin", "foo\n"},
+	{"echo foo | { read x </dev/fd/0; echo $x; }", "foo\n"},
+	{"echo foo >/dev/stdout | sed s/o/0/g", "f00\n"},
+	{"echo foo >/dev/fd/1 | sed s/o/0/g", "f00\n"},
+	{"{ echo foo >/dev/stderr; } 2>&1 | sed s/o/0/g", "f00\n"},
+	{"{ echo foo >/dev/fd/2; } 2>&1 | sed s/o/0/g", "f00\n"},
+	{"{ echo foo &>/dev/stdout; } | sed s/o/0/g", "f00\n"},
+	{"{ echo foo >>/dev/stdout; } | sed s/o/0/g", "f00\n"},
+
 	// background/wait
 	{"wait", ""},
 	{"{ true; } & wait", ""},
@@ -1157,6 +1873,68 @@ var runTests = []runTest{
 		"f() { echo 1; }; { sleep 0.01s; f; } & f() { echo 2; }; wait",
 		"1\n",
 	},
+	{
+		"sleep 0.03s & sleep 0.01s & sleep 0.02s & wait; echo $?",
+		"0\n",
+	},
+	{
+		"{ sleep 0.05s; echo 1; } & { sleep 0.01s; echo 2; } & wait; echo 3",
+		"2\n1\n3\n",
+	},
+	{"{ exit 3; } & { false; } & wait; echo $?", "0\n"},
+	{"true & wait; true & wait; wait", ""},
+
+	{`echo "[$!]"`, "[]\n"},
+	{"true & echo $!; true & echo $!; wait", "g1\ng2\n #IGNORE"},
+	{"{ exit 3; } & wait $!; echo $?", "3\n"},
+	{"{ exit 3; } & { exit 4; } & wait %1; echo $?; wait %2; echo $?", "3\n4\n"},
+	{"{ exit 3; } & { exit 4; } & wait %2 %1; echo $?", "3\n"},
+	{"{ sleep 0.01s; exit 5; } & wait %%; echo $?", "5\n"},
+	{"wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"wait 12345", "wait: pid 12345 is not a child of this shell\nexit status 127 #JUSTERR"},
+	{"wait abc", "wait: `abc': not a pid or valid job spec\nexit status 1 #JUSTERR"},
+	{"{ sleep 0.5s; echo bad; } & kill $!; wait $!; echo $?", "143\n"},
+	{"{ exit 3; } & sleep 0.05s; wait $!; echo $?", "3\n"},
+	{"{ exit 3; } & sleep 0.05s; wait $!; wait $!; echo $?", "3\n"},
+	{"{ exit 3; } & { exit 4; } & sleep 0.05s; wait %2 %1; echo $?", "3\n"},
+	{"{ exit 3; } & sleep 0.05s; wait; wait $!", "wait: pid g1 is not a child of this shell\nexit status 127 #JUSTERR"},
+	{"{ exit 3; } & sleep 0.05s; wait; wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"wait -n; echo $?", "127\n"},
+	{
+		"{ sleep 0.1s; exit 1; } & { sleep 0.05s; exit 2; } & { exit 3; } & for i in 1 2 3 4; do wait -n; echo $?; done",
+		"3\n2\n1\n127\n",
+	},
+	{"{ sleep 0.05s; exit 1; } & p=$!; { exit 2; } & wait -n $p; echo $?; wait $!; echo $?", "1\n2\n"},
+	{"{ exit 3; } & wait -n; wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"wait -n %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+
+	// disown
+	{"{ exit 4; } & disown; wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"{ exit 4; } & disown $!; wait $!", "wait: pid g1 is not a child of this shell\nexit status 127 #JUSTERR"},
+	{"{ exit 4; } & disown %1; disown %1", "disown: %1: no such job\nexit status 1 #JUSTERR"},
+	{"{ exit 4; } & disown -h %1; wait %1; echo $?", "4\n"},
+	{"true & true & disown -a; disown", "disown: current: no such job\nexit status 1 #JUSTERR"},
+	{"{ sleep 0.05s; echo bg; } & disown -a; wait; echo fg; sleep 0.1s", "fg\nbg\n"},
+	{"{ sleep 0.05s; } & disown -r; wait %1", "wait: %1: no such job\nexit status 127 #JUSTERR"},
+	{"disown", "disown: current: no such job\nexit status 1 #JUSTERR"},
+	{"disown 999", "disown: 999: no such job\nexit status 1 #JUSTERR"},
+	{"disown -x", "disown: -x: invalid option\ndisown: usage: disown [-h] [-ar] [jobspec ... | pid ...]\nexit status 2 #JUSTERR"},
+
+	// kill
+	{"kill", "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\nexit status 2 #JUSTERR"},
+	{"kill -l 9 15 137; kill -l KILL SIGTERM int", "KILL\nTERM\nKILL\n9\n15\n2\n"},
+	{"kill -l foo", "kill: foo: invalid signal specification\nexit status 1 #JUSTERR"},
+	{"kill -l | head -n 3", " 1) SIGHUP\t 2) SIGINT\t 3) SIGQUIT\t 4) SIGILL\t 5) SIGTRAP\n 6) SIGABRT\t 7) SIGBUS\t 8) SIGFPE\t 9) SIGKILL\t10) SIGUSR1\n11) SIGSEGV\t12) SIGUSR2\t13) SIGPIPE\t14) SIGALRM\t15) SIGTERM\n"},
+	{"kill %1", "kill: %1: no such job\nexit status 1 #JUSTERR"},
+	{"kill abc", "kill: abc: arguments must be process or job IDs\nexit status 1 #JUSTERR"},
+	{"kill -s FOO %1", "kill: FOO: invalid signal specification\nexit status 1 #JUSTERR"},
+	{"kill -s", "kill: -s: option requires an argument\nexit status 1 #JUSTERR"},
+	{"true & wait; kill %1", "kill: %1: no such job\nexit status 1 #JUSTERR"},
+	{"{ sleep 0.5s; echo bad; } & kill %1; wait; echo done", "done\n"},
+	{"{ sleep 0.5s; echo bad; } & kill -TERM %%; wait; echo done", "done\n"},
+	{"{ sleep 0.5s; echo bad; } & kill -s sigterm %+; wait; echo done", "done\n"},
+	{"{ sleep 0.5s; echo bad; } & true & kill -n 15 %-; wait; echo done", "done\n"},
+	{"{ sleep 0.05s; echo 1; } & kill -0 %1; wait; echo 2", "1\n2\n"},
 
 	// bash test
 	{
@@ -1331,6 +2109,38 @@ var runTests = []runTest{
 		"[[ a =~ [ ]]",
 		"exit status 2",
 	},
+	{
+		`[[ abc =~ (a)(x)?(b) ]]; echo ${#BASH_REMATCH[@]} "${BASH_REMATCH[@]}"`,
+		"4 ab a  b\n",
+	},
+	{
+		"[[ abc =~ (b) ]]; [[ abc =~ [ ]]; echo $? ${BASH_REMATCH[@]}; [[ abc =~ z ]]; echo $? ${#BASH_REMATCH[@]}",
+		"2 b b\n1 0\n",
+	},
+	{
+		"[[ abcd =~ a|abc ]]; echo ${BASH_REMATCH[0]}; [[ xyz =~ (x|xy)(z|yz) ]]; echo ${BASH_REMATCH[@]}",
+		"abc\nxyz x yz\n",
+	},
+	{
+		`re='^(f+)(o*)$'; [[ foo =~ $re ]] && echo "${BASH_REMATCH[@]}"`,
+		"foo f oo\n",
+	},
+	{
+		`r=a.c; [[ abc =~ $r ]] && echo unquoted; [[ abc =~ "$r" ]] || echo quoted`,
+		"unquoted\nquoted\n",
+	},
+	{
+		`[[ a.c =~ "a."c ]] && echo mixed; [[ abc =~ a\.c ]] || echo escaped; [[ "a b" =~ a\ b ]] && echo space`,
+		"mixed\nescaped\nspace\n",
+	},
+	{
+		`[[ a+ =~ 'a+' ]] && echo quoted; [[ aa =~ 'a+' ]] || echo literal; [[ 'x\y' =~ \\ ]] && echo backslash`,
+		"quoted\nliteral\nbackslash\n",
+	},
+	{
+		"[[ aXb =~ a[[:upper:]]b ]] && echo class; [[ '' =~ ^$ ]] && echo empty",
+		"class\nempty\n",
+	},
 	{
 		"[[ -e a ]] && echo x; >a; [[ -e a ]] && echo y",
 		"y\n",
@@ -1682,6 +2492,55 @@ var runTests = []runTest{
 		"set -o pipefail; set -M 2>/dev/null | false",
 		"exit status 1",
 	},
+	{"echo ${#PIPESTATUS[@]}", "0\n"},
+	{
+		"true | false | true; echo ${PIPESTATUS[@]}; false; echo ${PIPESTATUS[@]}",
+		"0 1 0\n1\n",
+	},
+	{
+		"false | true || echo x; echo ${PIPESTATUS[@]}; ! false | true; echo ${PIPESTATUS[@]} $?",
+		"1 0\n1 0 1\n",
+	},
+	{
+		"if false; then :; fi; echo ${PIPESTATUS[@]}; (exit 3) | (exit 4); echo ${PIPESTATUS[@]}",
+		"1\n3 4\n",
+	},
+	{
+		"false | { true | false; }; echo ${PIPESTATUS[@]}; f() { false | true; }; f; echo ${PIPESTATUS[@]}",
+		"1 1\n0\n",
+	},
+	{
+		"true | false; (echo ${PIPESTATUS[@]}); set -o pipefail; false | true |& (exit 3); echo ${PIPESTATUS[@]} $?",
+		"0 1\n1 0 3 3\n",
+	},
+	{
+		"echo foo | read v; echo \"v=$v\"; echo bar | { read v; echo \"in=$v\"; }; echo \"v=$v\"",
+		"v=\nin=bar\nv=\n",
+	},
+	{
+		"shopt -s lastpipe; echo foo | read v; echo $v; printf 'a\\nb\\n' | while read l; do n=$l; done; echo $n",
+		"foo\nb\n",
+	},
+	{
+		"shopt -s lastpipe; true | false | x=1; echo $? ${PIPESTATUS[@]} $x",
+		"0 0 1 0 1\n",
+	},
+	{
+		"shopt -s lastpipe; shopt -u lastpipe; echo foo | read v; echo \"v=$v\"",
+		"v=\n",
+	},
+	{
+		"f() { echo foo | return 3; echo $?; }; f; echo | exit 4; echo $?",
+		"3\n4\n",
+	},
+	{
+		"set -e; echo | { false; echo no; }; echo no",
+		"exit status 1",
+	},
+	{
+		"trap 'echo err' ERR; true | false; set -o pipefail; false | true; echo $?",
+		"err\nerr\n1\n",
+	},
 	{
 		"set -f; >a.x; echo *.x;",
 		"*.x\n",
@@ -1710,6 +2569,21 @@ var runTests = []runTest{
 		"echo $a; set -u; echo $a; echo extra",
 		"\na: unbound variable\nexit status 1 #JUSTERR",
 	},
+	{
+		"set -u; f() { echo f; }; f; cd .; echo after",
+		"f\nafter\n",
+	},
+	{"set -u; printf '%(%s)T\n' 0", "0\n"},
+	{"set -u; echo ${a:-x} ${a-y} ${a+z}; echo ${b:=w} $b", "x y\nw w\n"},
+	{"set -u; ((a = 3)); echo $((a + 1))", "4\n"},
+	{
+		"set -u; echo $((a + 1)); echo extra",
+		"a: unbound variable\nexit status 1 #JUSTERR",
+	},
+	{
+		"set -u; echo ${b[1]}; echo extra",
+		"b[1]: unbound variable\nexit status 1 #JUSTERR",
+	},
 	{"set -n; echo foo", ""},
 	{"set -n; [ wrong", ""},
 	{"set -n; set +n; echo foo", ""},
@@ -1719,18 +2593,43 @@ var runTests = []runTest{
 	},
 	{"set -o noexec; echo foo", ""},
 	{"set +o noexec; echo foo", "foo\n"},
+	{"set -e; set -o | grep -E '^(errexit|nounset) '", "errexit        \ton\nnounset        \toff\n"},
+	{"set -e; set +o | grep -E ' (errexit|nounset)$'", "set -o errexit\nset +o nounset\n"},
+	{
+		"set -u; saved=$(set +o); set +u -o pipefail; eval \"$saved\"; [[ -o nounset && ! -o pipefail ]] && echo restored",
+		"restored\n",
+	},
+	{"shopt -s globstar; shopt globstar nullglob", "globstar       \ton\nnullglob       \toff\n"},
 	{"set -e; set -o | grep -E 'errexit|noexec' | wc -l", "2\n"},
 	{"set -e; set -o | grep -E 'errexit|noexec' | grep 'on$' | wc -l", "1\n"},
 	{
 		"set -a; set +o",
 		`set -o allexport
 set +o errexit
+set +o errtrace
+set +o functrace
+set +o noclobber
 set +o noexec
 set +o noglob
 set +o nounset
+set +o physical
 set +o pipefail
+set +o xtrace
  #IGNORE`,
 	},
+	{"set -x; echo foo", "+ echo foo\nfoo\n"},
+	{"set -x; set +x; echo foo", "+ set +x\nfoo\n"},
+	{"set -o xtrace; echo on", "+ echo on\non\n"},
+	{
+		`set -x; a=1 b='x y'; c=1 true "a b" '' "it's"`,
+		"+ a=1\n+ b='x y'\n+ c=1\n+ true 'a b' '' 'it'\\''s'\n",
+	},
+	{"set -x; a=(x 'y z'); a[1]=q", "+ a=(x 'y z')\n+ a[1]=q\n"},
+	{"set -x; a=$(echo b); echo $a", "++ echo b\n+ a=b\n+ echo b\nb\n"},
+	{"set -x; for i in 'a b' c; do :; done", "+ for i in 'a b' c\n+ :\n+ for i in 'a b' c\n+ :\n"},
+	{"set -x; case 'a b' in *) ;; esac", "+ case 'a b' in\n"},
+	{`x=1; PS4='[$x] '; set -x; echo foo`, "[1] echo foo\nfoo\n"},
+	{`PS4=; set -x; echo foo`, "echo foo\nfoo\n"},
 
 	// unset
 	{
@@ -1759,7 +2658,7 @@ set +o pipefail
 	},
 	{
 		"readonly a=1; echo $a; unset a; echo $a",
-		"1\na: readonly variable\n1\n #IGNORE",
+		"1\nunset: a: cannot unset: readonly variable\n1\n #IGNORE",
 	},
 	{
 		"f() { local a=1; echo $a; unset a; echo $a; }; f",
@@ -1789,6 +2688,7 @@ set +o pipefail
 	{"shopt -u -o noexec; echo foo", "foo\n"},
 	{"shopt -u globstar; shopt globstar | grep 'off$' | wc -l", "1\n"},
 	{"shopt -s globstar; shopt globstar | grep 'off$' | wc -l", "0\n"},
+	{"shopt -s nullglob; shopt nullglob failglob | grep 'off$' | wc -l", "1\n"},
 
 	// IFS
 	{`echo -n "$IFS"`, " \t\n"},
@@ -1800,10 +2700,71 @@ set +o pipefail
 	{`a="  x y z"; IFS=; echo $a`, "  x y z\n"},
 	{`a=(x y z); IFS=; echo "${a[*]}"`, "xyz\n"},
 	{`a=(x y z); IFS=-; echo "${!a[@]}"`, "0 1 2\n"},
+	{`a=(x y z); IFS=-; echo "${!a[*]}"`, "0-1-2\n"},
 	{`set -- x y z; IFS=-; echo $*`, "x y z\n"},
 	{`set -- x y z; IFS=-; echo "$*"`, "x-y-z\n"},
 	{`set -- x y z; IFS=; echo $*`, "x y z\n"},
 	{`set -- x y z; IFS=; echo "$*"`, "xyz\n"},
+	{
+		`set -- a 'b c' ''; IFS=,; printf '<%s>' "$*"; echo; printf '<%s>' "$@"; echo`,
+		"<a,b c,>\n<a><b c><>\n",
+	},
+	{
+		`set -- 'a,b' c; IFS=,; printf '<%s>' $*; echo; printf '<%s>' $@; echo`,
+		"<a><b><c>\n<a><b><c>\n",
+	},
+	{
+		`set -- 'a b' c; IFS=; printf '<%s>' "$*" $* $@; echo`,
+		"<a bc><a b><c><a b><c>\n",
+	},
+	{
+		`set -- '' ''; IFS=; printf '<%s>' $*; echo; printf '<%s>' "$*" "$@"; echo`,
+		"<>\n<><><>\n",
+	},
+	{
+		`set -- a b; IFS=,; x=$*; y=$@; echo "$x" "$y" "pre$*post" "${*:2}"`,
+		"a,b a b prea,bpost b\n",
+	},
+	{
+		`set -- a b; IFS=,; printf '<%s>' "pre$@post"; echo`,
+		"<prea><bpost>\n",
+	},
+	{
+		`set --; IFS=,; printf '<%s>' "$*" "$@" $* $@ "pre$@post"; echo`,
+		"<><prepost>\n",
+	},
+	{
+		`set -- a 'b c'; IFS=,; x=("$*" "$@" $*); declare -p x`,
+		`declare -a x=([0]="a,b c" [1]="a" [2]="b c" [3]="a" [4]="b c")` + "\n",
+	},
+	{
+		`y='1 2'; x=([2]=a $y [0]=b); declare -p x`,
+		`declare -a x=([0]="b" [2]="a" [3]="1" [4]="2")` + "\n",
+	},
+	{
+		`x=(a "b c" 'd"e' $'f\tg\nh' '$i\j' ""); declare -p x`,
+		`declare -a x=([0]="a" [1]="b c" [2]="d\"e" [3]=$'f\tg\nh' [4]="\$i\\j" [5]="")` + "\n",
+	},
+	{
+		`x=$'a\nb'; declare -p x; declare -A m=(["a b"]=$'c\td'); declare -p m`,
+		`declare -- x=$'a\nb'` + "\n" + `declare -A m=(["a b"]=$'c\td' )` + "\n",
+	},
+	{
+		`declare -A m=([k]=1 [K_2]=2 ["a+b"]=3 ["a]b"]=4 ["-x"]=5 [$'\t']=6); declare -p m`,
+		`declare -A m=([$'\t']="6" ["-x"]="5" [K_2]="2" ["a+b"]="3" ["a]b"]="4" [k]="1" )` + "\n #IGNORE",
+	},
+	{
+		`x=(a "b c" $'d\ne' "f\"\$g" ""); s=$(declare -p x); unset x; eval "$s"; [[ $s == "$(declare -p x)" ]] && echo ${#x[@]} "${x[3]}"`,
+		"5 f\"$g\n",
+	},
+	{
+		`declare -A m=([k]=v ["a b"]=$'c\n' ["a+b"]="'q'" ["~"]=1); s=$(declare -p m); unset m; eval "$s"; [[ $s == "$(declare -p m)" ]] && echo ${#m[@]} ${m["a+b"]}`,
+		"4 'q'\n",
+	},
+	{
+		`declare -ir n=3; x=$'a b\n'; s=$(declare -p n x); unset x; eval "${s#*$'\n'}"; declare -p x`,
+		`declare -- x=$'a b\n'` + "\n",
+	},
 
 	// builtin
 	{"builtin", ""},
@@ -1824,6 +2785,17 @@ set +o pipefail
 	{"shopt -s expand_aliases; alias foo='bar baz'\ntype foo", "foo is aliased to `bar baz'\n"},
 	{"alias foo='bar baz'\ntype foo", "type: foo: not found\nexit status 1 #JUSTERR"},
 
+	// enable
+	{"enable -n echo; echo foo; type echo | grep -q -E ' is (hashed [(])?(/|[A-Z]:)' && echo external", "foo\nexternal\n"},
+	{"enable -n echo; enable echo; type echo", "echo is a shell builtin\n"},
+	{"enable -n echo true; enable -n", "enable -n echo\nenable -n true\n"},
+	{"enable -n test; enable -np; (enable test); enable -pn", "enable -n test\nenable -n test\n"},
+	{"enable -n echo; enable -a | grep -E ' (echo|eval)$'", "enable -n echo\nenable eval\n"},
+	{"enable -n eval; enable | grep -E ' (echo|eval)$'", "enable echo\n"},
+	{"enable -n shopt; (shopt 2>/dev/null) || echo $?", "127\n"},
+	{"enable foo", "enable: foo: not a shell builtin\nexit status 1 #JUSTERR"},
+	{"enable -n foo echo; enable -n", "enable: foo: not a shell builtin\nenable -n echo\n"},
+	{"enable -x", "enable: -x: invalid option\nenable: usage: enable [-a] [-np] [name ...]\nexit status 2 #JUSTERR"},
 	// eval
 	{"eval", ""},
 	{"eval ''", ""},
@@ -1839,6 +2811,10 @@ set +o pipefail
 	{`a=b eval 'x=y eval "echo \$a \$x"'`, "b y\n"},
 	{`a=b eval 'a=y eval "echo $a \$a"'`, "b y\n"},
 	{"a=b eval '(echo $a)'", "b\n"},
+	{
+		`FUNCNEST=4; e='echo e; eval "$e"'; eval "$e"`,
+		"e\ne\ne\ne\neval: maximum function nesting level exceeded (4)\nexit status 1 #IGNORE",
+	},
 
 	// source
 	{
@@ -1857,6 +2833,14 @@ set +o pipefail
 		"echo 'foo=bar' >a; source a; echo $foo",
 		"bar\n",
 	},
+	{
+		"echo 'echo a; . ./a' >a; FUNCNEST=3; . ./a",
+		"a\na\na\n.: maximum function nesting level exceeded (3)\nexit status 1 #IGNORE",
+	},
+	{
+		"echo 'f 1' >a; FUNCNEST=2; f() { source a; }; f",
+		"f: maximum function nesting level exceeded (2)\nexit status 1 #IGNORE",
+	},
 
 	// source with set and shift
 	{
@@ -1912,6 +2896,25 @@ set +o pipefail
 		"\na b c\na b c\n",
 	},
 
+	// caller
+	{"caller; echo $?; caller 0; echo $?", "1\n1\n"},
+	{
+		"f() { caller; caller 0; caller 1; echo $?; }\ng() { f; }\ng",
+		"2 NULL\n2 g NULL\n1\n #IGNORE",
+	},
+	{
+		"printf 'h() { caller 0; caller 1; echo $?; }\\nh\\n' >a; source a",
+		"2 source a\n1\n",
+	},
+	{
+		"f() { caller x; }; f",
+		"caller: x: invalid number\ncaller: usage: caller [expr]\nexit status 2 #JUSTERR",
+	},
+	{
+		"f() { caller -1; }; f",
+		"caller: -1: invalid option\ncaller: usage: caller [expr]\nexit status 2 #JUSTERR",
+	},
+
 	// indexed arrays
 	{
 		"a=foo; echo ${a[0]} ${a[@]} ${a[x]}; echo ${a[1]}",
@@ -1977,6 +2980,78 @@ set +o pipefail
 		`a=b; echo "${a[@]}"`,
 		"b\n",
 	},
+	{
+		`a=("x  y" "" z); printf '<%s>' "${a[@]}"; echo`,
+		"<x  y><><z>\n",
+	},
+	{
+		`a=("x  y" "" z); printf '<%s>' "${a[*]}"; echo`,
+		"<x  y  z>\n",
+	},
+	{
+		`a=("x  y" "" z); IFS=,; printf '<%s>' "${a[*]}"; echo`,
+		"<x  y,,z>\n",
+	},
+	{
+		`a=("x  y" "" z); IFS=; printf '<%s>' "${a[*]}"; echo`,
+		"<x  yz>\n",
+	},
+	{
+		`a=("x  y" "" z); IFS=,; x=${a[*]}; y=${a[@]}; echo "$x" "$y"`,
+		"x  y,,z x  y  z\n",
+	},
+	{
+		`a=("x  y" "" z); printf '<%s>' ${a[@]}; echo`,
+		"<x><y><z>\n",
+	},
+	{
+		`a=("a,b" c); IFS=,; printf '<%s>' ${a[*]}; echo`,
+		"<a><b><c>\n",
+	},
+	{
+		`count() { echo $#; }; a=(); count "${a[@]}" "${a[*]}"`,
+		"1\n",
+	},
+	{
+		`count() { echo $#; }; a=(); count "${a[@]}""${a[@]}"; count "${a[@]}"""`,
+		"0\n1\n",
+	},
+	{
+		`count() { echo $#; }; count "${u[@]}"; s=str; count "${s[@]}"`,
+		"0\n1\n",
+	},
+	{
+		`a=("x  y" "" z); printf '<%s>' "pre${a[@]}post"; echo`,
+		"<prex  y><><zpost>\n",
+	},
+	{
+		`a=(); printf '<%s>' "pre${a[@]}post"; echo`,
+		"<prepost>\n",
+	},
+	{
+		`a=(x y); printf '<%s>' "${a[@]}${a[@]}"; echo`,
+		"<x><yx><y>\n",
+	},
+	{
+		`a=("x  y" "" z); printf '<%s>' "${a[@]:1}"; echo`,
+		"<><z>\n",
+	},
+	{
+		`a=("x  y" "" z); printf '<%s>' "${a[@]:0:1}" "${a[*]:1}"; echo`,
+		"<x  y>< z>\n",
+	},
+	{
+		`set -- p1 "p 2" p3; printf '<%s>' "${@:2}" "${*:2}"; echo`,
+		"<p 2><p3><p 2 p3>\n",
+	},
+	{
+		`a=(xa ya); printf '<%s>' "${a[@]%a}" "${a[@]^^}" "${a[@]/a/b}"; echo ${a[@]}`,
+		"<x><y><XA><YA><xb><yb>xa ya\n",
+	},
+	{
+		`a=(); printf '<%s>' "${a[@]:-d f}"; b=(x y); printf '<%s>' "${b[@]:+alt}"; echo`,
+		"<d f><alt>\n",
+	},
 
 	// associative arrays
 	{
@@ -2028,6 +3103,11 @@ set +o pipefail
 	{"i=3; a=b; a[i]=x; echo ${a[@]}", "b x\n"},
 	{"i=3; declare a=(b); a[i]=x; echo ${!a[@]}", "0 3\n"},
 	{"i=3; declare -A a=(['x']=b); a[i]=x; for e in ${!a[@]}; do echo $e; done | sort", "i\nx\n"},
+	{
+		`declare -A m=(["a b"]=1 [c]=2); for k in "${!m[@]}"; do echo "<$k>=${m[$k]}"; done | sort`,
+		"<a b>=1\n<c>=2\n",
+	},
+	{`a=(); f() { echo $#; }; f "${!a[@]}"; f "${!a[*]}"; a=(x y); f "${!a[@]}"`, "0\n1\n2\n"},
 
 	// declare
 	{"declare -B foo", "declare: invalid option \"-B\"\nexit status 2 #JUSTERR"},
@@ -2108,6 +3188,50 @@ set +o pipefail
 		`export x=before; f() { local x; export x=after; $ENV_PROG | grep '^x='; }; f; echo $x`,
 		"x=after\nbefore\n",
 	},
+	{
+		"a=(x y); f() { local a=(b c); a+=(d); echo ${a[@]}; }; f; echo ${a[@]}",
+		"b c d\nx y\n",
+	},
+	{
+		"a=(x y); f() { local a; a+=(b); echo ${a[@]}; }; f; echo ${a[@]}",
+		"b\nx y\n",
+	},
+	{
+		"a=(x y); f() { local -a a; a[1]=b; echo ${a[@]}; }; f; echo ${a[@]}",
+		"b\nx y\n",
+	},
+	{
+		"declare -A m=([k]=x); f() { local -A m; m[q]=y; echo ${!m[@]}; }; f; echo ${!m[@]} ${m[k]}",
+		"q\nk x\n",
+	},
+	{
+		"f() { local -A m=([a]=1 [b]=2); m+=([c]=3); echo ${#m[@]} ${m[c]}; }; f; echo ${#m[@]}",
+		"3 3\n0\n",
+	},
+	{
+		"declare -A m=([a]=1); f() { m+=([b]=2); }; f; echo ${#m[@]} ${m[b]}",
+		"2 2\n",
+	},
+	{
+		"a=x; f() { local a=$a-in; echo $a; }; f",
+		"x-in\n",
+	},
+	{
+		"f() { local a=1; local a; echo $a; }; f",
+		"1\n",
+	},
+	{
+		"a=(x); f() { local a=(y); g; echo ${a[@]}; }; g() { a+=(z); }; f; echo ${a[@]}",
+		"y z\nx\n",
+	},
+	{
+		"a=x; f() { local a=y; g; echo $a; }; g() { local a=z; }; f; echo $a",
+		"y\nx\n",
+	},
+	{
+		"a=x; f() { local a; read a <<< in; echo $a; }; f; echo $a",
+		"in\nx\n",
+	},
 
 	// name references
 	{"declare -n foo=bar; bar=etc; [[ -R foo ]]", ""},
@@ -2181,27 +3305,197 @@ set +o pipefail
 		"readonly foo=bar; foo=etc",
 		"foo: readonly variable\nexit status 1 #JUSTERR",
 	},
-
-	// multiple var modes at once
 	{
-		"declare -r -x foo=bar; $ENV_PROG | grep '^foo='",
-		"foo=bar\n",
+		"readonly foo=bar; unset foo",
+		"unset: foo: cannot unset: readonly variable\nexit status 1 #JUSTERR",
 	},
 	{
-		"declare -r -x foo=bar; foo=x",
-		"foo: readonly variable\nexit status 1 #JUSTERR",
+		"readonly foo=bar; foo=etc true; echo $foo",
+		"foo: readonly variable\nbar\n #IGNORE",
 	},
-
-	// globbing
-	{"echo .", ".\n"},
-	{"echo ..", "..\n"},
-	{"echo ./.", "./.\n"},
 	{
-		">a.x >b.x >c.x; echo *.x; rm a.x b.x c.x",
-		"a.x b.x c.x\n",
+		"readonly foo=bar; : ${foo:=x} ${foo}",
+		"",
 	},
 	{
-		`>a.x; echo '*.x' "*.x"; rm a.x`,
+		"readonly foo=(x y); foo[1]=z",
+		"foo: readonly variable\nexit status 1 #JUSTERR",
+	},
+	{
+		"f() { local foo=x; }; readonly foo=bar; f",
+		"foo: readonly variable\nexit status 1 #JUSTERR",
+	},
+	{
+		"readonly x=out; f() { local x=in; echo $x; }; f; echo $x",
+		"x: readonly variable\nout\nout\n #IGNORE",
+	},
+	{
+		"x=out; f() { local -rx x=in; unset x 2>/dev/null || echo fail; declare -p x; $ENV_PROG | grep '^x='; }; f; x=new; echo $x",
+		"fail\ndeclare -rx x=\"in\"\nx=in\nnew\n",
+	},
+	{
+		"f() { local -ri n=2+3; declare -p n; }; f; echo ${n-unset}",
+		"declare -ir n=\"5\"\nunset\n",
+	},
+	{
+		"f() { local -r x=1; g; echo $x; }; g() { local x=2; x=3; echo $x; }; f",
+		"3\n1\n",
+	},
+	{
+		"f() { local -r x=1; local x=2; echo $x; }; f",
+		"x: readonly variable\n1\n #IGNORE",
+	},
+	{
+		`readonly foo=bar bar; readonly baz='a"$b'; readonly -p | grep -E ' (foo|bar|baz)'`,
+		"declare -r bar\ndeclare -r baz=\"a\\\"\\$b\"\ndeclare -r foo=\"bar\"\n",
+	},
+	{
+		`readonly foo=bar; readonly | grep ' foo'`,
+		"declare -r foo=\"bar\"\n",
+	},
+	{
+		`readonly a=(x y); declare -A m=([k]=v); readonly m; readonly -p a m`,
+		"declare -ar a=([0]=\"x\" [1]=\"y\")\ndeclare -Ar m=([k]=\"v\" )\n",
+	},
+	{
+		"readonly -p nosuch",
+		"readonly: nosuch: not found\nexit status 1 #JUSTERR",
+	},
+	{
+		"f() { echo f; }; readonly -f f; unset -f f; f",
+		"unset: f: cannot unset: readonly function\nf\n #IGNORE",
+	},
+	{
+		"f() { echo f; }; readonly -f f; f() { echo g; }",
+		"f: readonly function\nexit status 1 #JUSTERR",
+	},
+	{
+		"f() { echo f; }; g() { echo g; }; readonly -f f; readonly -f",
+		"f() { echo f; }\ndeclare -fr f\n #IGNORE",
+	},
+	{
+		"readonly -f nosuch",
+		"readonly: nosuch: not a function\nexit status 1 #JUSTERR",
+	},
+	{
+		"f() { echo f; }; declare -r -f f; (f() { echo g; })",
+		"f: readonly function\nexit status 1 #JUSTERR",
+	},
+
+	// multiple var modes at once
+	{
+		"declare -r -x foo=bar; $ENV_PROG | grep '^foo='",
+		"foo=bar\n",
+	},
+	{
+		"declare -r -x foo=bar; foo=x",
+		"foo: readonly variable\nexit status 1 #JUSTERR",
+	},
+	{
+		"declare -ix a=3+4 b=1; declare -p a b; $ENV_PROG | grep '^a='",
+		"declare -ix a=\"7\"\ndeclare -ix b=\"1\"\na=7\n",
+	},
+	{
+		"declare -rx a=1; declare -ai b=(1+1 2); declare -p a b",
+		"declare -rx a=\"1\"\ndeclare -ai b=([0]=\"2\" [1]=\"2\")\n",
+	},
+	{
+		"f() { local -ix l=5*2; declare -p l; $ENV_PROG | grep '^l='; }; f",
+		"declare -ix l=\"10\"\nl=10\n",
+	},
+	{
+		"x=-ix; declare $x y=2+2; declare -p y",
+		"declare -ix y=\"4\"\n",
+	},
+	{
+		"declare -ix a=1; declare +x a; declare -p a; $ENV_PROG | grep '^a='",
+		"declare -i a=\"1\"\nexit status 1",
+	},
+	{
+		"export a=1; export -n a; declare -p a; declare -x a; declare -p a",
+		"declare -- a=\"1\"\ndeclare -x a=\"1\"\n",
+	},
+	{
+		"declare -i a=2; declare +i a; a=3+3; declare +i b=1+1; declare -p a b",
+		"declare -- a=\"3+3\"\ndeclare -- b=\"1+1\"\n",
+	},
+	{
+		"INTERP_GLOBAL=x; declare +x INTERP_GLOBAL; $ENV_PROG | grep '^INTERP_GLOBAL='",
+		"exit status 1",
+	},
+	{
+		"declare -x a; declare -p a; $ENV_PROG | grep '^a=' || a=1; $ENV_PROG | grep '^a='",
+		"declare -x a\na=1\n",
+	},
+	{
+		"declare -ax a=(x y); declare -p a; $ENV_PROG | grep '^a='",
+		"declare -ax a=([0]=\"x\" [1]=\"y\")\nexit status 1",
+	},
+	{
+		"declare -r a=1; declare +r a; echo $?; declare +r b=1; echo $b",
+		"declare: a: readonly variable\n1\n1\n #IGNORE",
+	},
+
+	// integer variables
+	{
+		`declare -i n=3+4; echo $n; n="2 * n"; echo $n; n+=5; echo $n`,
+		"7\n14\n19\n",
+	},
+	{
+		"declare -i n; n=abc; echo $n; abc=5; n=abc; echo $n; n=; echo $n",
+		"0\n5\n0\n",
+	},
+	{
+		"declare -i n; read n <<< '6*7'; echo $n; for n in 1+1; do echo $n; done; ((n = 2 + 3)); echo $n",
+		"42\n2\n5\n",
+	},
+	{
+		"declare -i -a a=(1+1 2*3); a[3]=2+2; echo ${a[@]}; declare -i -A m=([x]=1+2); echo ${m[x]}",
+		"2 6 4\n3\n",
+	},
+	{
+		"f() { local -i q=9/3; echo $q; }; f; q=9/3; echo $q",
+		"3\n9/3\n",
+	},
+	{
+		"declare -i -r -x z=4+4; declare -p z; declare -i n=1; declare -p -i | grep ' n='",
+		"declare -irx z=\"8\"\ndeclare -i n=\"1\"\n",
+	},
+	{
+		"declare -r r=1; declare -x e=2 w; declare -ai ai=(3); declare -p | grep -E ' (r|e|w|ai)(=|$)'",
+		"declare -ai ai=([0]=\"3\")\ndeclare -x e=\"2\"\ndeclare -r r=\"1\"\ndeclare -x w\n",
+	},
+	{
+		"declare -r r=1; declare -x e=2; declare -ai ai=(3); declare -p -rx | grep -E ' (r|e|ai)='; declare -ai | grep -E ' (r|e|ai)='",
+		"declare -x e=\"2\"\ndeclare -r r=\"1\"\ndeclare -ai ai=([0]=\"3\")\n",
+	},
+	{
+		`f() { :; }; x="a b"; e=; n=$'a\nb'; arr=(1 "2 3"); declare -A m=([k]=v); declare -x w; declare | grep -E '^(x|e|n|w|arr|m)=|^f'`,
+		"arr=([0]=\"1\" [1]=\"2 3\")\ne=\nm=([k]=\"v\" )\nn=$'a\\nb'\nx='a b'\nf() { :; }\n #IGNORE",
+	},
+	{
+		"x=global; f() { local l=1 m; local -i i=2; typeset t=3; local; local -p; }; f; echo ${t-unset}",
+		"declare -i i=\"2\"\ndeclare -- l=\"1\"\ndeclare -- m\ndeclare -- t=\"3\"\ndeclare -i i=\"2\"\ndeclare -- l=\"1\"\ndeclare -- m\ndeclare -- t=\"3\"\nunset\n",
+	},
+	{
+		"declare -i n; n='3+'; echo after",
+		"3+: 1:2: + must be followed by an expression\nexit status 1 #JUSTERR",
+	},
+	{
+		"declare -i n; n='a b'; echo after",
+		"a b: 1:3: not a valid arithmetic operator: b\nexit status 1 #JUSTERR",
+	},
+
+	// globbing
+	{"echo .", ".\n"},
+	{"echo ..", "..\n"},
+	{"echo ./.", "./.\n"},
+	{
+		">a.x >b.x >c.x; echo *.x; rm a.x b.x c.x",
+		"a.x b.x c.x\n",
+	},
+	{
+		`>a.x; echo '*.x' "*.x"; rm a.x`,
 		"*.x *.x\n",
 	},
 	{
@@ -2216,6 +3510,14 @@ set +o pipefail
 		"echo *.x; echo foo *.y bar",
 		"*.x\nfoo *.y bar\n",
 	},
+	{
+		">a >1 >']' >-; echo [x[:digit:]] [![:alpha:]] []a] [a-]",
+		"1 - 1 ] ] a - a\n",
+	},
+	{
+		`for s in 1 a ']' '-'; do [[ $s == [!a-z] ]] && echo $s; case $s in [[:digit:]-]) echo c$s; esac; done`,
+		"1\nc1\n]\n-\nc-\n",
+	},
 	{
 		"mkdir a; >a/b.x; echo */*.x | sed 's@\\\\@/@g'; cd a; echo *.x",
 		"a/b.x\nb.x\n",
@@ -2232,6 +3534,26 @@ set +o pipefail
 		`mkdir d; >d/.hidden >d/a; set -- "$(echo d/*)" "$(echo d/.h*)"; echo ${#1} ${#2}; rm -r d`,
 		"3 9\n",
 	},
+	{
+		">a.c >a.o >b.o >.h; GLOBIGNORE='*.o'; echo *; echo *.o",
+		".h a.c\n*.o\n",
+	},
+	{
+		"mkdir d; >d/a.c >d/a.o >b.o; GLOBIGNORE='*.o:d/a.*'; echo * d/*; GLOBIGNORE=; echo *",
+		"d d/*\nb.o d\n",
+	},
+	{
+		">.a >.b.o; GLOBIGNORE=x; echo .*; unset GLOBIGNORE; echo *",
+		".a .b.o\n*\n",
+	},
+	{
+		">a.c >b.c; set -u; echo *.c",
+		"a.c b.c\n",
+	},
+	{
+		">a >1; echo [a-[:digit:]]; [[ a == [a-[:digit:]] ]] || echo nomatch",
+		"[a-[:digit:]]\nnomatch\n",
+	},
 	{
 		"mkdir -p a/b/c; echo a/** | sed 's@\\\\@/@g'",
 		"a/b\n",
@@ -2244,6 +3566,30 @@ set +o pipefail
 		"shopt -s globstar; mkdir -p a/b/c; echo **/c | sed 's@\\\\@/@g'",
 		"a/b/c\n",
 	},
+	{
+		"f() { echo $#; }; f *.nonexist; echo *.nonexist",
+		"1\n*.nonexist\n",
+	},
+	{
+		`shopt -s nullglob; f() { echo $#; }; f *.nonexist "*.nonexist" a[; >a.x; echo *.x *.y`,
+		"2\na.x\n",
+	},
+	{
+		"shopt -s nullglob; mkdir d; cd d; >a; ls *.nonexist",
+		"a\n",
+	},
+	{
+		"shopt -s failglob; echo *.nonexist; echo never",
+		"no match: *.nonexist\nexit status 1 #JUSTERR",
+	},
+	{
+		"shopt -s failglob; >a.x; echo *.x '*.y' [; (echo x*.y); echo $?",
+		"a.x *.y [\nno match: x*.y\n1\n #IGNORE",
+	},
+	{
+		"shopt -s nullglob failglob; for f in *.nonexist; do echo $f; done; echo never",
+		"no match: *.nonexist\nexit status 1 #JUSTERR",
+	},
 	{
 		"cat <<EOF\n{foo,bar}\nEOF",
 		"{foo,bar}\n",
@@ -2288,6 +3634,14 @@ set +o pipefail
 		"mkdir dir; >dir/x-f; ln -s dir sym; cd sym; test -f $PWD/x-*",
 		"",
 	},
+	{
+		">a.go >b.c >cc.go; shopt -s extglob; echo @(a|b).*; echo *(c).go",
+		"a.go b.c\ncc.go\n #IGNORE",
+	},
+	{
+		">a.go >b.c; echo @(a|b).*; shopt -s extglob; GLOBIGNORE='@(b).*'; echo *",
+		"@(a|b).*\na.go\n #IGNORE",
+	},
 
 	// brace expansion; more exhaustive tests in the syntax package
 	{"echo a}b", "a}b\n"},
@@ -2429,11 +3783,23 @@ set +o pipefail
 	},
 	{
 		"getopts abc opt -z",
-		"getopts: illegal option -- \"z\"\n #IGNORE",
+		"gosh: illegal option -- z\n #IGNORE",
 	},
 	{
 		"getopts a: opt -a",
-		"getopts: option requires an argument -- \"a\"\n #IGNORE",
+		"gosh: option requires an argument -- a\n #IGNORE",
+	},
+	{
+		"getopts abc opt -z 2>/dev/null; echo $? $opt ${OPTARG-unset}",
+		"0 ? unset\n",
+	},
+	{
+		"getopts a: opt -a 2>/dev/null; echo $? $opt ${OPTARG-unset}",
+		"0 ? unset\n",
+	},
+	{
+		"OPTERR=0; getopts a: opt -a; getopts a opt -z; echo $opt ${OPTARG-unset}",
+		"? unset\n",
 	},
 	{
 		"getopts :abc opt -z; echo $opt; echo $OPTARG",
@@ -2443,6 +3809,22 @@ set +o pipefail
 		"getopts :a: opt -a; echo $opt; echo $OPTARG",
 		":\na\n",
 	},
+	{
+		"getopts :a opt -:; echo $? $opt $OPTARG",
+		"0 ? :\n",
+	},
+	{
+		"getopts :a: opt -a foo; echo $opt $OPTARG; OPTIND=1; getopts :a opt -b; echo $opt $OPTARG",
+		"a foo\n? b\n",
+	},
+	{
+		"while getopts :ab: opt -a -x -b; do echo $opt ${OPTARG-unset}; done; echo $?",
+		"a unset\n? x\n: b\n0\n",
+	},
+	{
+		"while getopts ab: opt -a -x -b 2>/dev/null; do echo $opt ${OPTARG-unset}; done; echo $?",
+		"a unset\n? unset\n? unset\n0\n",
+	},
 	{
 		"getopts abc opt foo -a; echo $opt; echo $OPTIND",
 		"?\n1\n",
@@ -2478,6 +3860,7 @@ set +o pipefail
 }
 
 var runTestsUnix = []runTest{
+	{"[[ $(date +%s) -le $((EPOCHSECONDS + 1)) ]]", ""},
 	{"[[ -n $PPID && $PPID -gt 0 ]]", ""},
 	{
 		// no root user on windows
@@ -2505,6 +3888,10 @@ var runTestsUnix = []runTest{
 		"y\n",
 	},
 
+	{"exec 3>a; sh -c 'echo foo >&3'; exec 3>&-; cat a", "foo\n"},
+	{"sh -c true >&-; echo $?", "0\n"},
+	{"exec {fd}>a; sh -c \"echo foo >/dev/fd/$fd\"; exec {fd}>&-; cat a", "foo\n"},
+	{"exec 3>a 4>b; exec 3>&-; sh -c 'echo foo >&4; echo bar 2>/dev/null >&3'; cat a b", "foo\n"},
 	{"sh() { :; }; sh -c 'echo foo'", ""},
 	{"sh() { :; }; command sh -c 'echo foo'", "foo\n"},
 
@@ -2589,6 +3976,59 @@ var runTestsUnix = []runTest{
 		"b\n",
 	},
 
+	// coproc
+	{
+		"coproc { read l; echo got $l; read l; }; echo foo >&${COPROC[1]}; read x <&${COPROC[0]}; echo $x",
+		"got foo\n",
+	},
+	{
+		"coproc cat; echo foo >&${COPROC[1]}; read x <&${COPROC[0]}; echo $x",
+		"foo\n",
+	},
+	{
+		"coproc named { read l; echo got $l; read l; }; echo foo >&${named[1]}; read x <&${named[0]}; echo $x ${#named[@]}",
+		"got foo 2\n",
+	},
+	{
+		"coproc named { true; }; [[ -n $named_PID ]]",
+		"",
+	},
+	{
+		"coproc cat; echo foo >/dev/fd/${COPROC[1]}; read x </dev/fd/${COPROC[0]}; echo $x",
+		"foo\n",
+	},
+	{
+		"coproc X { true; }; wait $!; echo ${#X[@]} ${X_PID-unset}",
+		"0 unset\n",
+	},
+	{
+		"coproc X { true; }; fd=${X[0]}; wait $!; read x <&$fd",
+		"10: bad file descriptor\nexit status 1 #JUSTERR",
+	},
+	{
+		"echo foo >&9",
+		"9: bad file descriptor\nexit status 1 #JUSTERR",
+	},
+	{
+		"read x <&9",
+		"9: bad file descriptor\nexit status 1 #JUSTERR",
+	},
+
+	// ulimit; resource limits don't exist on windows
+	{"[[ $(ulimit -n) -gt 0 ]]", ""},
+	{"[[ $(ulimit -Hn) -ge $(ulimit -Sn) ]]", ""},
+	// Only lower the soft limit, as the test process couldn't raise the
+	// hard limit again.
+	{"old=$(ulimit -S -c); ulimit -S -c 0; ulimit -S -c; ulimit -S -c $old", "0\n"},
+	{"ulimit -a | grep -q 'open files'", ""},
+	// unlike Bash, the value applies to every resource given
+	{"old=$(ulimit -S -c); s=$(ulimit -S -s); ulimit -S -c -s $s; [[ $(ulimit -S -c) == $s ]] && echo ok; ulimit -S -c $old", "ok\n #IGNORE"},
+	{"ulimit -x", "ulimit: invalid option -x\nexit status 2 #JUSTERR"},
+	{"ulimit -c foo", "ulimit: invalid number: \"foo\"\nexit status 1 #JUSTERR"},
+	{"ulimit -S -c 18014398509481984", "ulimit: 18014398509481984: limit out of range\nexit status 1 #JUSTERR"},
+	{"ulimit -S -c 99999999999999999999", "ulimit: 99999999999999999999: limit out of range\nexit status 1 #JUSTERR"},
+	{"ulimit -c 0 1", "ulimit: too many arguments\nexit status 2 #JUSTERR"},
+
 	// process substitution; named pipes (fifos) are a TODO for windows
 	{
 		"sed 's/o/e/g' <(echo foo bar)",
@@ -3078,6 +4518,8 @@ func TestRunnerContext(t *testing.T) {
 		"sleep 1000",
 		"while true; do true; done & wait",
 		"sleep 1000 & wait",
+		"sleep 1000 & wait -n",
+		"sleep 1000 & sleep 1000 & sleep 1000 & wait",
 		"(while true; do true; done)",
 		"$(while true; do true; done)",
 		"while true; do true; done | while true; do true; done",
@@ -3258,27 +4700,216 @@ func TestRunnerDir(t *testing.T) {
 			t.Fatalf("\nwant regexp: %q\ngot: %q", want, got)
 		}
 	})
+	// Ensure that runners with different directories don't affect each
+	// other, nor the process's current directory.
+	t.Run("Independent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for _, name := range []string{"first", "second"} {
+			name := name
+			tempDir, err := ioutil.TempDir("", "interp-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tempDir)
+			if err := os.Mkdir(filepath.Join(tempDir, name), 0o777); err != nil {
+				t.Fatal(err)
+			}
+
+			var b bytes.Buffer
+			r, err := New(Dir(tempDir), StdIO(nil, &b, &b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := parse(t, nil, "echo *; cd *; echo foo >file; echo *; read x <file; echo $x")
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := r.Run(context.Background(), file); err != nil {
+					t.Error(err)
+				}
+				want := name + "\nfile\nfoo\n"
+				if got := b.String(); got != want {
+					t.Errorf("%s: want %q, got %q", name, want, got)
+				}
+				if want := filepath.Join(tempDir, name); r.Dir != want {
+					t.Errorf("%s: want Dir %q, got %q", name, want, r.Dir)
+				}
+			}()
+		}
+		wg.Wait()
+		if wd2, err := os.Getwd(); err != nil {
+			t.Fatal(err)
+		} else if wd2 != wd {
+			t.Fatalf("process directory changed from %q to %q", wd, wd2)
+		}
+	})
 }
 
 func TestRunnerIncremental(t *testing.T) {
 	t.Parallel()
-	file := parse(t, nil, "echo foo; false; echo bar; exit 0; echo baz")
-	want := "foo\nbar\n"
+	tests := []struct {
+		in, want string
+	}{
+		{"echo foo; false; echo bar; exit 0; echo baz", "foo\nbar\n"},
+		{"x=1; f() { echo f$x; }; false; echo $?; f; x=2; f", "1\nf1\nf2\n"},
+		{"mkdir d; cd d; pwd | sed 's@.*[/\\\\]@@'", "d\n"},
+		{"nope_cmd; echo $?; true >/; echo $?; echo after", "\"nope_cmd\": executable file not found in $PATH\n127\nopen /: is a directory\n1\nafter\n"},
+		{"trap 'echo bye' EXIT; set -u; echo $nope; echo never", "nope: unbound variable\nbye\n"},
+		{"trap 'echo bye $?' EXIT; echo foo; exit 3; echo never", "foo\nbye 3\n"},
+		{"trap 'echo bye' EXIT; f() { exit 2; }; f; echo never", "bye\n"},
+		{"trap 'echo bye' EXIT; echo foo", "foo\n"},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "interp-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := parse(t, nil, tc.in)
+			var b bytes.Buffer
+			r, _ := New(Dir(dir), StdIO(nil, &b, &b))
+			ctx := context.Background()
+			for _, stmt := range file.Stmts {
+				err := r.Run(ctx, stmt)
+				if _, ok := IsExitStatus(err); !ok && err != nil {
+					// Keep track of unexpected errors.
+					b.WriteString(err.Error())
+				}
+				if r.Exited() {
+					break
+				}
+			}
+			if got := b.String(); got != tc.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", tc.in, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerInteractive(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"echo ${a:?msg}; echo after $?", "a: msg\nafter 1\n"},
+		{"trap 'echo bye' EXIT; set -u; echo $nope; echo after", "nope: unbound variable\nafter\n"},
+		{"f() { echo ${a:?m}; echo never; }; f; echo after", "a: m\nafter\n"},
+		{"(echo ${a:?m}; echo never); echo sub $?", "a: m\nsub 1\n"},
+		{"echo foo; exit 2; echo never", "foo\n"},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			file := parse(t, nil, tc.in)
+			var b bytes.Buffer
+			r, _ := New(Interactive(true), StdIO(nil, &b, &b))
+			ctx := context.Background()
+			for _, stmt := range file.Stmts {
+				err := r.Run(ctx, stmt)
+				if _, ok := IsExitStatus(err); !ok && err != nil {
+					b.WriteString(err.Error())
+				}
+				if r.Exited() {
+					break
+				}
+			}
+			if got := b.String(); got != tc.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", tc.in, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerInteractiveCancel(t *testing.T) {
+	t.Parallel()
 	var b bytes.Buffer
-	r, _ := New(StdIO(nil, &b, &b))
-	ctx := context.Background()
-	for _, stmt := range file.Stmts {
-		err := r.Run(ctx, stmt)
-		if _, ok := IsExitStatus(err); !ok && err != nil {
-			// Keep track of unexpected errors.
-			b.WriteString(err.Error())
-		}
-		if r.Exited() {
-			break
+	r, _ := New(Interactive(true), StdIO(nil, &b, &b))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := r.Run(ctx, parse(t, nil, "while true; do :; done").Stmts[0])
+	if status, ok := IsExitStatus(err); !ok || status != 130 {
+		t.Fatalf("want exit status 130, got %v", err)
+	}
+	if got := r.ExitStatus(); got != 130 {
+		t.Fatalf("want ExitStatus 130, got %d", got)
+	}
+	if err := r.Run(context.Background(), parse(t, nil, "echo $?")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "130\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestRunnerStartTime(t *testing.T) {
+	t.Parallel()
+	var b1, b2 bytes.Buffer
+	r1, _ := New(StdIO(nil, &b1, &b1))
+	r2, _ := New(StdIO(nil, &b2, &b2))
+	r1.Reset()
+	r1.startTime = r1.startTime.Add(-time.Hour)
+	prog := parse(t, nil, "printf '%(%s)T\\n' -2; (printf '%(%s)T\\n' -2)")
+	for _, r := range []*Runner{r1, r2} {
+		if err := r.Run(context.Background(), prog); err != nil {
+			t.Fatal(err)
 		}
 	}
-	if got := b.String(); got != want {
-		t.Fatalf("\nwant: %q\ngot:  %q", want, got)
+	start := strconv.FormatInt(r1.startTime.Unix(), 10)
+	if got, want := b1.String(), start+"\n"+start+"\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	start = strconv.FormatInt(r2.startTime.Unix(), 10)
+	if got, want := b2.String(), start+"\n"+start+"\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestRunnerExitStatus(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in      string
+		exited  bool
+		status  uint8
+		ranTrap bool
+	}{
+		{"true", false, 0, false},
+		{"false", false, 1, false},
+		{"exit", true, 0, false},
+		{"false; exit", true, 1, false},
+		{"exit 3; echo never", true, 3, false},
+		{"exit 300", true, 44, false},
+		{"f() { exit 2; }; f", true, 2, false},
+		{"(exit 4)", false, 4, false},
+		{"trap 'echo bye' EXIT; false", false, 1, true},
+		{"trap 'echo bye' EXIT; exit 5", true, 5, true},
+		{"trap 'exit 6' EXIT; true", true, 6, true},
+		{"trap 'echo bye' EXIT; trap - EXIT; false", false, 1, false},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			file := parse(t, nil, tc.in)
+			r, _ := New()
+			err := r.Run(context.Background(), file)
+			if status, _ := IsExitStatus(err); status != tc.status {
+				t.Errorf("Run error %v does not match status %d", err, tc.status)
+			}
+			if got := r.Exited(); got != tc.exited {
+				t.Errorf("Exited got %t, want %t", got, tc.exited)
+			}
+			if got := r.ExitStatus(); got != tc.status {
+				t.Errorf("ExitStatus got %d, want %d", got, tc.status)
+			}
+			if got := r.RanExitTrap(); got != tc.ranTrap {
+				t.Errorf("RanExitTrap got %t, want %t", got, tc.ranTrap)
+			}
+			// $? in the next run matches ExitStatus.
+			var b bytes.Buffer
+			StdIO(nil, &b, &b)(r)
+			r.Run(context.Background(), parse(t, nil, "echo $?").Stmts[0])
+			if want := fmt.Sprintf("%d\n", tc.status); b.String() != want {
+				t.Errorf("$? in the next run got %q, want %q", b.String(), want)
+			}
+		})
 	}
 }
 
@@ -3344,6 +4975,77 @@ export GLOBAL=
 	}
 }
 
+func TestRunnerClone(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "interp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var out bytes.Buffer
+	r, _ := New(
+		Params("-f", "--", "first"),
+		Dir(dir),
+		StdIO(nil, &out, &out),
+		OutputLimit(100),
+		Builtin("greet", func(ctx context.Context, args []string) int {
+			hc := HandlerCtx(ctx)
+			fmt.Fprintf(hc.Stdout, "hello %s\n", args[1])
+			return 0
+		}),
+	)
+	// Change the state of the original, which clones must not see.
+	prog := parse(t, nil, "set +f -- second; cd /; foo=bar; f() { :; }; echo $(seq 100000)")
+	ctx := context.Background()
+	if err := r.Run(ctx, prog); err == nil {
+		t.Fatal("expected the output limit to be exceeded")
+	}
+
+	prog = parse(t, nil, `
+[[ $# -eq 1 && $1 == first ]] || exit 10
+[[ -o noglob ]] || exit 11
+[[ $PWD != / ]] || exit 12
+[[ -z $foo ]] || exit 13
+! declare -f f >/dev/null 2>&1 || exit 14
+greet "$1"
+`)
+	const n = 4
+	outs := make([]bytes.Buffer, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		r2 := r.Clone()
+		StdIO(nil, &outs[i], &outs[i])(r2)
+		go func() { errs <- r2.Run(ctx, prog) }()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range outs {
+		if got, want := outs[i].String(), "hello first\n"; got != want {
+			t.Fatalf("clone %d: want %q, got %q", i, want, got)
+		}
+	}
+}
+
+func BenchmarkNew(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := New(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClone(b *testing.B) {
+	b.ReportAllocs()
+	r, _ := New()
+	for i := 0; i < b.N; i++ {
+		r.Clone()
+	}
+}
+
 func TestRunnerManyResets(t *testing.T) {
 	t.Parallel()
 	r, _ := New()
@@ -3367,6 +5069,444 @@ func TestRunnerFilename(t *testing.T) {
 	}
 }
 
+func TestRunnerTeeStdIO(t *testing.T) {
+	t.Parallel()
+	file := parse(t, nil, `echo out; echo err >&2; x=$(echo subst); echo file >/dev/null; (echo sub) | cat; echo $x`)
+
+	var out, tee, teeErr bytes.Buffer
+	// TeeStdIO is kept regardless of whether StdIO comes before or after.
+	r, _ := New(TeeStdIO(&tee, &teeErr), StdIO(nil, &out, &out))
+	TeeStdIO(&tee, &teeErr)(r)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		r.Reset()
+		if err := r.Run(ctx, file); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := "out\nerr\nsub\nsubst\n"
+	if got := out.String(); got != want+want {
+		t.Fatalf("\nwant: %q\ngot:  %q", want+want, got)
+	}
+	want = "out\nsub\nsubst\n"
+	if got := tee.String(); got != want+want {
+		t.Fatalf("\nwant: %q\ngot:  %q", want+want, got)
+	}
+	want = "err\n"
+	if got := teeErr.String(); got != want+want {
+		t.Fatalf("\nwant: %q\ngot:  %q", want+want, got)
+	}
+}
+
+func TestRunnerLimits(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		opts    []RunnerOption
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			[]RunnerOption{OutputLimit(10)},
+			"echo foo; echo bar >&2",
+			"foo\nbar\n", "",
+		},
+		{
+			[]RunnerOption{OutputLimit(10)},
+			"echo foo; echo bar >&2; echo baz; echo never",
+			"foo\nbar\nba", "output limit of 10 bytes exceeded",
+		},
+		{
+			[]RunnerOption{OutputLimit(10)},
+			"while true; do echo foo; done",
+			"foo\nfoo\nfo", "output limit of 10 bytes exceeded",
+		},
+		{
+			[]RunnerOption{OutputLimit(10)},
+			"(while true; do echo foo; done) | cat",
+			"foo\nfoo\nfo", "output limit of 10 bytes exceeded",
+		},
+		{
+			[]RunnerOption{OutputLimit(10)},
+			"x=$(echo foo; echo foo; echo foo); echo done >/dev/null; echo ok",
+			"ok\n", "",
+		},
+		{
+			[]RunnerOption{OutputLimit(10), TimeLimit(time.Minute)},
+			"echo foo; exit 3",
+			"foo\n", "exit status 3",
+		},
+		{
+			[]RunnerOption{TimeLimit(50 * time.Millisecond)},
+			"echo foo; while true; do :; done; echo never",
+			"foo\n", "time limit of 50ms exceeded",
+		},
+		{
+			[]RunnerOption{TimeLimit(50 * time.Millisecond)},
+			"sleep 10 & wait",
+			"", "time limit of 50ms exceeded",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			file := parse(t, nil, tc.in)
+			var out bytes.Buffer
+			opts := append(tc.opts, StdIO(nil, &out, &out))
+			r, _ := New(opts...)
+			// Each call to Run gets its own limits.
+			for i := 0; i < 2; i++ {
+				out.Reset()
+				r.Reset()
+				err := r.Run(context.Background(), file)
+				if got := fmt.Sprint(err); tc.wantErr != "" && got != tc.wantErr {
+					t.Fatalf("want error %q, got: %v", tc.wantErr, err)
+				} else if tc.wantErr == "" && err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				var lerr *LimitError
+				if want := strings.Contains(tc.wantErr, "limit"); xerrors.As(err, &lerr) != want {
+					t.Fatalf("want LimitError to be %t, got: %#v", want, err)
+				}
+				if got := out.String(); got != tc.want {
+					t.Fatalf("\nwant: %q\ngot:  %q", tc.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunnerLimitsCancel(t *testing.T) {
+	t.Parallel()
+	// Cancelling the context isn't reported as exceeding a limit.
+	file := parse(t, nil, "while true; do :; done")
+	r, _ := New(TimeLimit(time.Minute))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Run(ctx, file); err != context.DeadlineExceeded {
+		t.Fatalf("want %v, got: %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRunnerDisableSubst(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		opts []RunnerOption
+		in   string
+		want string
+	}{
+		{
+			[]RunnerOption{DisableCmdSubst()},
+			"echo foo; echo $(echo bar); echo never",
+			"foo\ncommand substitution is disabled\nexit status 1",
+		},
+		{
+			[]RunnerOption{DisableCmdSubst()},
+			"a=`echo bar`; echo never",
+			"command substitution is disabled\nexit status 1",
+		},
+		{
+			[]RunnerOption{DisableCmdSubst()},
+			"echo foo >a; echo $(<a)",
+			"command substitution is disabled\nexit status 1",
+		},
+		{
+			[]RunnerOption{DisableCmdSubst()},
+			"a=foo; echo ${a} $((1 + 2)); (echo sub) | cat",
+			"foo 3\nsub\n",
+		},
+		{
+			[]RunnerOption{DisableCmdSubst()},
+			"(echo $(echo bar)); echo $?",
+			"command substitution is disabled\n1\n",
+		},
+		{
+			[]RunnerOption{DisableProcSubst()},
+			"echo $(echo foo); cat <(echo bar); echo never",
+			"foo\nprocess substitution is disabled\nexit status 1",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "interp-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file := parse(t, nil, tc.in)
+			var out bytes.Buffer
+			opts := append(tc.opts, StdIO(nil, &out, &out), Dir(dir))
+			r, _ := New(opts...)
+			if err := r.Run(context.Background(), file); err != nil {
+				out.WriteString(err.Error())
+			}
+			if got := out.String(); got != tc.want {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerMaxCallDepth(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		opts []RunnerOption
+		in   string
+		want string
+	}{
+		{
+			[]RunnerOption{MaxCallDepth(2)},
+			"f() { echo f; g; }; g() { echo g; h; }; h() { echo h; }; f",
+			"f\ng\nh: maximum function nesting level exceeded (2)\nexit status 1",
+		},
+		{
+			[]RunnerOption{MaxCallDepth(2)},
+			"f() { eval g; }; g() { echo g; }; f",
+			"g: maximum function nesting level exceeded (2)\nexit status 1",
+		},
+		{
+			[]RunnerOption{MaxCallDepth(2)},
+			"FUNCNEST=3; f() { g; }; g() { h; }; h() { echo h; }; f",
+			"h\n",
+		},
+		{
+			[]RunnerOption{MaxCallDepth(0)},
+			"f() { [[ $1 -lt 2000 ]] && f $(($1+1)) || echo $1; }; f 0",
+			"2000\n",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			file := parse(t, nil, tc.in)
+			var out bytes.Buffer
+			r, _ := New(append(tc.opts, StdIO(nil, &out, &out))...)
+			if err := r.Run(context.Background(), file); err != nil {
+				out.WriteString(err.Error())
+			}
+			if got := out.String(); got != tc.want {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerXTraceWriter(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in                string
+		stdout, stderr, x string
+	}{
+		{"echo foo", "foo\n", "", ""},
+		{"set -x; echo foo; echo bar >&2", "foo\n", "bar\n", "+ echo foo\n+ echo bar\n"},
+		{"set -x; x=$(echo foo) 2>/dev/null", "", "", "++ echo foo\n+ x=foo\n"},
+		{"p=dbg; PS4='$p> '; set -x; f() { echo >/dev/null; }; f 2>&1", "", "", "dbg> f\ndbg> echo\n"},
+		{"set -x; (echo a); echo $(echo b)", "a\nb\n", "", "+ echo a\n++ echo b\n+ echo b\n"},
+		{"set -x; set +x; echo foo", "foo\n", "", "+ set +x\n"},
+		{"set -x; declare a=1; let b=2", "", "", "+ declare a=1\n+ let b=2\n"},
+		{"set -x; [[ a == b ]]; (( 1 + 2 ))", "", "", "+ [[ a == b ]]\n+ ((  1 + 2  ))\n"},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			file := parse(t, nil, tc.in)
+			var stdout, stderr, xtrace bytes.Buffer
+			r, _ := New(
+				StdIO(nil, &stdout, &stderr),
+				XTraceWriter(&xtrace),
+				ExecHandler(testExecHandler),
+			)
+			if err := r.Run(context.Background(), file); err != nil {
+				t.Fatal(err)
+			}
+			if got := stdout.String(); got != tc.stdout {
+				t.Errorf("want stdout %q, got %q", tc.stdout, got)
+			}
+			if got := stderr.String(); got != tc.stderr {
+				t.Errorf("want stderr %q, got %q", tc.stderr, got)
+			}
+			if got := xtrace.String(); got != tc.x {
+				t.Errorf("want xtrace %q, got %q", tc.x, got)
+			}
+		})
+	}
+}
+
+func TestRunnerFuncRestore(t *testing.T) {
+	t.Parallel()
+	// Each function stops in a different way. The state of its caller must
+	// be restored in all cases, even if the shell exited.
+	funcs := []string{
+		"f() { local x=inner y=new; set -- a b; return 3; }",
+		"f() { local x=inner y=new; set -- a b; }",
+		"f() { local x=inner y=new; set -- a b; for i in 1; do return 2; done; }",
+		"f() { local x=inner y=new; set -- a b; set -e; false; echo never; }",
+		"f() { local x=inner y=new; set -- a b; echo ${nope?}; }",
+		"f() { local x=inner y=new; set -- a b; exit 4; }",
+		"f() { local x=inner y=new; set -- a b; g; }; g() { local x=g; exit 5; }",
+		"f() { local x=inner y=new; set -- a b; f; }",
+	}
+	const check = `echo "$x ${y-unset} $# $1"; caller 0 || echo nocaller; local z 2>/dev/null || echo nofunc`
+	for i, fn := range funcs {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			r, _ := New(StdIO(nil, ioutil.Discard, ioutil.Discard))
+			r.Run(context.Background(), parse(t, nil, "FUNCNEST=3; x=outer; set -- p1; "+fn+"; f"))
+			var out bytes.Buffer
+			StdIO(nil, &out, &out)(r)
+			if err := r.Run(context.Background(), parse(t, nil, check)); err != nil {
+				t.Fatal(err)
+			}
+			want := "outer unset 1 p1\nnocaller\nnofunc\n"
+			if got := out.String(); got != want {
+				t.Fatalf("after %q:\nwant: %q\ngot:  %q", fn, want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerExpandWord(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "interp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.conf", "b.conf", "c.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, _ := New(Env(expand.ListEnviron("HOME=/home/me", "IFS= ")), Dir(dir))
+	if err := r.Run(context.Background(), parse(t, nil, "v='x y'; set -- p1 p2")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr string
+	}{
+		{"", nil, ""},
+		{"  ", nil, ""},
+		{"foo", []string{"foo"}, ""},
+		{"~/foo", []string{"/home/me/foo"}, ""},
+		{"$HOME/foo", []string{"/home/me/foo"}, ""},
+		{"$v", []string{"x", "y"}, ""},
+		{`"$v"`, []string{"x y"}, ""},
+		{`"$@"`, []string{"p1", "p2"}, ""},
+		{"$((1 + 2))/{a,b}", []string{"3/a", "3/b"}, ""},
+		{"$(echo sub)", []string{"sub"}, ""},
+		{"*.conf", []string{"a.conf", "b.conf"}, ""},
+		{"'*.conf'", []string{"*.conf"}, ""},
+		{"$missing", nil, ""},
+		{"foo bar", nil, `"foo bar" is more than one word`},
+		{"foo; bar", nil, "1:4: ; is not a valid word"},
+		{`"foo`, nil, `1:1: reached EOF without closing quote "`},
+		{"${missing?unset}", nil, "missing: unset"},
+	}
+	for _, tc := range tests {
+		got, err := r.ExpandWord(context.Background(), tc.in)
+		gotErr := ""
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != tc.wantErr {
+			t.Errorf("ExpandWord(%q) error: want %q, got %q", tc.in, tc.wantErr, gotErr)
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tc.want) {
+			t.Errorf("ExpandWord(%q): want %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestRunnerTermSize(t *testing.T) {
+	t.Parallel()
+	cols, rows := 100, 40
+	size := func() (int, int) { return cols, rows }
+	tests := []struct {
+		opts []RunnerOption
+		in   string
+		want string
+	}{
+		{nil, "echo $COLUMNS $LINES", "80 24\n"},
+		{
+			[]RunnerOption{Env(expand.ListEnviron("COLUMNS=120", "LINES=50"))},
+			"echo $COLUMNS $LINES",
+			"120 50\n",
+		},
+		{[]RunnerOption{TermSize(size)}, "echo $COLUMNS $LINES", "100 40\n"},
+		{
+			[]RunnerOption{TermSize(size), Env(expand.ListEnviron("COLUMNS=120"))},
+			"echo $COLUMNS $LINES",
+			"100 40\n",
+		},
+		{
+			[]RunnerOption{TermSize(size)},
+			"COLUMNS=10; echo $COLUMNS $LINES; (echo $COLUMNS) | cat; LINES=5 printenv LINES",
+			"10 40\n10\n5\n",
+		},
+		{
+			[]RunnerOption{TermSize(func() (int, int) { return 0, 0 })},
+			"echo $COLUMNS $LINES",
+			"80 24\n",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			file := parse(t, nil, tc.in)
+			var out bytes.Buffer
+			opts := append(tc.opts, StdIO(nil, &out, &out))
+			r, _ := New(opts...)
+			if err := r.Run(context.Background(), file); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tc.want {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		spec    string
+		want    syscall.Signal
+		wantErr string
+	}{
+		{"TERM", syscall.SIGTERM, ""},
+		{"SIGTERM", syscall.SIGTERM, ""},
+		{"sigterm", syscall.SIGTERM, ""},
+		{"15", syscall.SIGTERM, ""},
+		{"kill", syscall.SIGKILL, ""},
+		{"0", 0, ""},
+		{"-1", 0, "-1: invalid signal specification"},
+		{"99", 0, "99: invalid signal specification"},
+		{"NOPE", 0, "NOPE: invalid signal specification"},
+		{"SIG", 0, "SIG: invalid signal specification"},
+	}
+	for _, tc := range tests {
+		got, err := ParseSignal(tc.spec)
+		if tc.wantErr != "" {
+			if fmt.Sprint(err) != tc.wantErr {
+				t.Errorf("ParseSignal(%q) want error %q, got: %v", tc.spec, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSignal(%q) unexpected error: %v", tc.spec, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseSignal(%q) = %d, want %d", tc.spec, got, tc.want)
+		}
+		if got == 0 {
+			continue
+		}
+		name := SignalName(got)
+		if back, err := ParseSignal(name); back != got {
+			t.Errorf("ParseSignal(SignalName(%d)) = %d, %v", got, back, err)
+		}
+	}
+}
+
 func TestRunnerEnvNoModify(t *testing.T) {
 	t.Parallel()
 	env := expand.ListEnviron("one=1", "two=2")
@@ -0,0 +1,53 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build aix darwin dragonfly freebsd linux netbsd openbsd
+
+package interp
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const rlimInfinity = unix.RLIM_INFINITY
+
+func rlimitResource(flag byte) int {
+	switch flag {
+	case 'c':
+		return unix.RLIMIT_CORE
+	case 'f':
+		return unix.RLIMIT_FSIZE
+	case 'n':
+		return unix.RLIMIT_NOFILE
+	case 's':
+		return unix.RLIMIT_STACK
+	case 'u':
+		return unix.RLIMIT_NPROC
+	}
+	panic(fmt.Sprintf("unknown ulimit flag: %c", flag))
+}
+
+// getRlimit returns the soft and hard limits of the resource given by a
+// "ulimit" flag. Note that resource limits apply to the entire process, and not
+// just to the interpreter.
+func getRlimit(flag byte) (soft, hard uint64, err error) {
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(rlimitResource(flag), &lim); err != nil {
+		return 0, 0, err
+	}
+	return uint64(lim.Cur), uint64(lim.Max), nil
+}
+
+// setRlimit sets the soft limit, the hard limit, or both, of the resource given
+// by a "ulimit" flag.
+func setRlimit(flag byte, value uint64, soft, hard bool) error {
+	resource := rlimitResource(flag)
+	var lim unix.Rlimit
+	if err := unix.Getrlimit(resource, &lim); err != nil {
+		return err
+	}
+	setRlimitValue(&lim, value, soft, hard)
+	return unix.Setrlimit(resource, &lim)
+}
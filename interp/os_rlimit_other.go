@@ -0,0 +1,21 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package interp
+
+import "fmt"
+
+const rlimInfinity = ^uint64(0)
+
+// getRlimit is not supported on platforms such as Windows, which lack resource
+// limits, or Solaris, which lacks some of the limits we support.
+func getRlimit(flag byte) (soft, hard uint64, err error) {
+	return 0, 0, fmt.Errorf("resource limits are unsupported on this platform")
+}
+
+// setRlimit is not supported on the same platforms as getRlimit.
+func setRlimit(flag byte, value uint64, soft, hard bool) error {
+	return fmt.Errorf("resource limits are unsupported on this platform")
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build dragonfly freebsd
+
+package interp
+
+import "golang.org/x/sys/unix"
+
+// setRlimitValue sets the soft limit, the hard limit, or both, which are
+// signed on these platforms.
+func setRlimitValue(lim *unix.Rlimit, value uint64, soft, hard bool) {
+	if soft {
+		lim.Cur = int64(value)
+	}
+	if hard {
+		lim.Max = int64(value)
+	}
+}
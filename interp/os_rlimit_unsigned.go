@@ -0,0 +1,18 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build aix darwin linux netbsd openbsd
+
+package interp
+
+import "golang.org/x/sys/unix"
+
+// setRlimitValue sets the soft limit, the hard limit, or both.
+func setRlimitValue(lim *unix.Rlimit, value uint64, soft, hard bool) {
+	if soft {
+		lim.Cur = value
+	}
+	if hard {
+		lim.Max = value
+	}
+}
@@ -53,3 +53,25 @@ func hasPermissionToDir(info os.FileInfo) bool {
 
 	return false
 }
+
+// signalNumber returns the signal with the given name, such as "SIGTERM", or
+// zero if there is no such signal.
+func signalNumber(name string) syscall.Signal {
+	return unix.SignalNum(name)
+}
+
+// signalName returns the name of a signal, such as "SIGTERM", or an empty
+// string if the signal is unknown.
+func signalName(sig syscall.Signal) string {
+	return unix.SignalName(sig)
+}
+
+// termSize returns the size of the terminal open as a file descriptor, in
+// columns and rows.
+func termSize(fd uintptr) (cols, rows int, err error) {
+	ws, err := unix.IoctlGetWinsize(int(fd), unix.TIOCGWINSZ)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(ws.Col), int(ws.Row), nil
+}
@@ -6,6 +6,7 @@ package interp
 import (
 	"fmt"
 	"os"
+	"syscall"
 )
 
 func mkfifo(path string, mode uint32) error {
@@ -16,3 +17,43 @@ func mkfifo(path string, mode uint32) error {
 func hasPermissionToDir(info os.FileInfo) bool {
 	return true
 }
+
+// termSize is not supported on Windows.
+func termSize(fd uintptr) (cols, rows int, err error) {
+	return 0, 0, fmt.Errorf("terminal sizes are unsupported on this platform")
+}
+
+// signalNames holds the POSIX signals that the kill builtin understands on
+// Windows, which has no signal table of its own.
+var signalNames = map[syscall.Signal]string{
+	1:  "SIGHUP",
+	2:  "SIGINT",
+	3:  "SIGQUIT",
+	4:  "SIGILL",
+	5:  "SIGTRAP",
+	6:  "SIGABRT",
+	7:  "SIGBUS",
+	8:  "SIGFPE",
+	9:  "SIGKILL",
+	11: "SIGSEGV",
+	13: "SIGPIPE",
+	14: "SIGALRM",
+	15: "SIGTERM",
+}
+
+// signalNumber returns the signal with the given name, such as "SIGTERM", or
+// zero if there is no such signal.
+func signalNumber(name string) syscall.Signal {
+	for sig, sigName := range signalNames {
+		if name == sigName {
+			return sig
+		}
+	}
+	return 0
+}
+
+// signalName returns the name of a signal, such as "SIGTERM", or an empty
+// string if the signal is unknown.
+func signalName(sig syscall.Signal) string {
+	return signalNames[sig]
+}
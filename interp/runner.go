@@ -12,10 +12,14 @@ import (
 	"math"
 	"math/rand"
 	"os"
-	"regexp"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"mvdan.cc/sh/v3/expand"
@@ -28,6 +32,9 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 	r.ecfg = &expand.Config{
 		Env: expandEnv{r},
 		CmdSubst: func(w io.Writer, cs *syntax.CmdSubst) error {
+			if r.noCmdSubst {
+				return fmt.Errorf("command substitution is disabled")
+			}
 			switch len(cs.Stmts) {
 			case 0: // nothing to do
 				return nil
@@ -46,10 +53,15 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 			}
 			r2 := r.Subshell()
 			r2.stdout = w
+			r2.substDepth++
 			r2.stmts(ctx, cs.Stmts)
+			r2.exitTrap(ctx)
 			return r2.err
 		},
 		ProcSubst: func(ps *syntax.ProcSubst) (string, error) {
+			if r.noProcSubst {
+				return "", fmt.Errorf("process substitution is disabled")
+			}
 			if runtime.GOOS == "windows" {
 				return "", fmt.Errorf("TODO: support process substitution on Windows")
 			}
@@ -99,6 +111,7 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 					}()
 				}
 				r2.stmts(ctx, ps.Stmts)
+				r2.exitTrap(ctx)
 			}()
 			return path, nil
 		},
@@ -129,22 +142,47 @@ func (r *Runner) updateExpandOpts() {
 		r.ecfg.ReadDir = ioutil.ReadDir
 	}
 	r.ecfg.GlobStar = r.opts[optGlobStar]
+	r.ecfg.ExtGlob = r.opts[optExtGlob]
+	r.ecfg.NullGlob = r.opts[optNullGlob]
+	r.ecfg.FailGlob = r.opts[optFailGlob]
+	r.ecfg.NoUnset = r.opts[optNoUnset]
 }
 
 func (r *Runner) expandErr(err error) {
 	if err != nil {
 		r.errf("%v\n", err)
-		r.exit = 1
-		r.exitShell = true
+		r.expandFatal()
 	}
 }
 
+// expandFatal stops the shell with exit status 1 after an expansion error. An
+// interactive shell only aborts the command being run, like Bash.
+func (r *Runner) expandFatal() {
+	r.exit = 1
+	r.exitShell = true
+	r.aborting = r.interactive
+}
+
 func (r *Runner) arithm(expr syntax.ArithmExpr) int {
 	n, err := expand.Arithm(r.ecfg, expr)
 	r.expandErr(err)
 	return n
 }
 
+// arithmString evaluates a string as an arithmetic expression, such as a value
+// assigned to an integer variable.
+func (r *Runner) arithmString(s string) int {
+	expr, err := syntax.NewParser().Arithmetic(strings.NewReader(s))
+	if err != nil {
+		r.expandErr(fmt.Errorf("%s: %v", s, err))
+		return 0
+	}
+	if expr == nil {
+		return 0
+	}
+	return r.arithm(expr)
+}
+
 func (r *Runner) fields(words ...*syntax.Word) []string {
 	strs, err := expand.Fields(r.ecfg, words...)
 	r.expandErr(err)
@@ -192,15 +230,30 @@ func (e expandEnv) Each(fn func(name string, vr expand.Variable) bool) {
 			return
 		}
 	}
+	for name, vr := range e.r.funcVars {
+		if !fn(name, vr) {
+			return
+		}
+	}
 }
 
 func (r *Runner) handlerCtx(ctx context.Context) context.Context {
+	return context.WithValue(ctx, handlerCtxKey{}, r.handlerContext())
+}
+
+func (r *Runner) handlerContext() HandlerContext {
 	hc := HandlerContext{
 		Dir:    r.Dir,
 		Stdin:  r.stdin,
 		Stdout: r.stdout,
 		Stderr: r.stderr,
 	}
+	if len(r.fds) > 0 {
+		hc.Files = make(map[int]io.ReadWriteCloser, len(r.fds))
+		for fd, f := range r.fds {
+			hc.Files[fd] = f
+		}
+	}
 	oenv := overlayEnviron{
 		parent: r.Env,
 		values: make(map[string]expand.Variable),
@@ -215,7 +268,7 @@ func (r *Runner) handlerCtx(ctx context.Context) context.Context {
 		oenv.Set(name, expand.Variable{Exported: true, Kind: expand.String, Str: value})
 	}
 	hc.Env = oenv
-	return context.WithValue(ctx, handlerCtxKey{}, hc)
+	return hc
 }
 
 func (r *Runner) setErr(err error) {
@@ -254,13 +307,17 @@ func (r *Runner) stmt(ctx context.Context, st *syntax.Stmt) {
 	if r.stop(ctx) {
 		return
 	}
+	if len(r.coprocs) > 0 {
+		r.reapCoprocs()
+	}
 	r.exit = 0
 	if st.Background {
 		r2 := r.Subshell()
 		st2 := *st
 		st2.Background = false
-		r.bgShells.Go(func() error {
-			return r2.Run(ctx, &st2)
+		r.background(ctx, func(ctx context.Context) error {
+			// Run a file, so that the subshell's EXIT trap runs.
+			return r2.Run(ctx, &syntax.File{Stmts: []*syntax.Stmt{&st2}})
 		})
 	} else {
 		r.stmtSync(ctx, st)
@@ -268,80 +325,442 @@ func (r *Runner) stmt(ctx context.Context, st *syntax.Stmt) {
 	r.lastExit = r.exit
 }
 
+// trap runs the command set via the trap builtin for a condition such as
+// "ERR", if there is one. Unless the command exits the shell, the exit status
+// is left untouched.
+func (r *Runner) trap(ctx context.Context, name string) {
+	cmd := r.traps[name]
+	if cmd == "" || r.handlingTrap {
+		return
+	}
+	file, err := syntax.NewParser().Parse(strings.NewReader(cmd), "")
+	if err != nil {
+		r.errf("%s trap: %v\n", strings.ToLower(name), err)
+		return
+	}
+	r.handlingTrap = true
+	oldExit, oldLastExit := r.exit, r.lastExit
+	r.stmts(ctx, file.Stmts)
+	if !r.exitShell {
+		r.exit, r.lastExit = oldExit, oldLastExit
+	}
+	r.handlingTrap = false
+}
+
+// trace prints a line to stderr for the xtrace option, prefixed by $PS4. The
+// first character of $PS4 is repeated for each nested command substitution.
+func (r *Runner) trace(line string) {
+	ps4 := "+ "
+	if vr := r.lookupVar("PS4"); vr.IsSet() {
+		ps4 = r.expandPS4(vr.String())
+	}
+	if ps4 != "" && r.substDepth > 0 {
+		ps4 = strings.Repeat(ps4[:1], r.substDepth) + ps4
+	}
+	if r.xtraceWriter != nil {
+		fmt.Fprintf(r.xtraceWriter, "%s%s\n", ps4, line)
+		return
+	}
+	r.errf("%s%s\n", ps4, line)
+}
+
+// expandPS4 performs parameter expansion on the value of $PS4, like bash does.
+func (r *Runner) expandPS4(ps4 string) string {
+	word, err := syntax.NewParser().Document(strings.NewReader(ps4))
+	if err != nil {
+		return ps4
+	}
+	oldOpts := r.opts
+	r.opts[optXTrace] = false // don't trace command substitutions
+	ps4 = r.document(word)
+	r.opts = oldOpts
+	return ps4
+}
+
+// traceAssign traces an assignment for the xtrace option.
+func (r *Runner) traceAssign(as *syntax.Assign, vr expand.Variable) {
+	if !r.opts[optXTrace] {
+		return
+	}
+	name := as.Name.Value
+	if as.Index != nil {
+		// print the index as part of $((index)), as it's not a word
+		index := printWords([]*syntax.Word{{Parts: []syntax.WordPart{
+			&syntax.ArithmExp{Left: as.Index.Pos(), X: as.Index},
+		}}})
+		name += "[" + index[len("$(("):len(index)-len("))")] + "]"
+	}
+	if as.Append {
+		name += "+"
+	}
+	switch {
+	case as.Array != nil:
+		var elems []string
+		for _, elem := range as.Array.Elems {
+			elems = append(elems, printWords([]*syntax.Word{elem.Value}))
+		}
+		r.trace(name + "=(" + strings.Join(elems, " ") + ")")
+	default:
+		r.trace(name + "=" + traceQuote(vr.String()))
+	}
+}
+
+// traceFields formats the fields of a command for the xtrace option.
+func traceFields(fields []string) string {
+	quoted := make([]string, len(fields))
+	for i, field := range fields {
+		quoted[i] = traceQuote(field)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// traceQuote single-quotes a field for the xtrace option, if it contains any
+// characters which the shell would treat specially.
+func traceQuote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n'\"\\|&;()<>*?[]$`!{}") ||
+		s[0] == '#' || s[0] == '~' {
+		return singleQuote(s)
+	}
+	return s
+}
+
+// printWords prints words as they appear in the source, separated by spaces.
+func printWords(words []*syntax.Word) string {
+	var buf bytes.Buffer
+	printer := syntax.NewPrinter()
+	for i, word := range words {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		printer.Print(&buf, word)
+	}
+	return buf.String()
+}
+
+// printCmd prints a command as it appears in the source, for the xtrace option.
+// Like Bash, arithmetic commands are padded with two spaces.
+func printCmd(cmd syntax.Command) string {
+	var buf bytes.Buffer
+	syntax.NewPrinter().Print(&buf, cmd)
+	s := buf.String()
+	if _, ok := cmd.(*syntax.ArithmCmd); ok {
+		s = "((  " + strings.TrimSuffix(strings.TrimPrefix(s, "(("), "))") + "  ))"
+	}
+	return s
+}
+
+// hideTrap removes a trap while running a function, unless the given option
+// makes functions inherit it. It returns the trap command to be given to
+// restoreTrap once the function returns.
+func (r *Runner) hideTrap(name string, inherit int) string {
+	if r.opts[inherit] {
+		return ""
+	}
+	cmd := r.traps[name]
+	delete(r.traps, name)
+	return cmd
+}
+
+// restoreTrap restores a trap removed by hideTrap, unless the function set a
+// new one.
+func (r *Runner) restoreTrap(name, cmd string) {
+	if cmd != "" && r.traps[name] == "" {
+		r.setTrap(name, cmd)
+	}
+}
+
+// exitTrap runs the EXIT trap, as the shell is about to exit.
+//
+// A subshell can also be ended by "return", such as with "(return 3)" in a
+// function, which only sets the subshell's exit status.
+func (r *Runner) exitTrap(ctx context.Context) {
+	if code, ok := r.err.(returnStatus); ok {
+		r.err = nil
+		r.exit = int(code)
+	}
+	if r.traps["EXIT"] == "" || r.err != nil {
+		return
+	}
+	oldExit, exiting := r.exit, r.exitShell
+	r.exitShell = false
+	r.lastExit = r.exit // for $? within the trap
+	r.trap(ctx, "EXIT")
+	r.ranExitTrap = true
+	if !r.exitShell {
+		r.exit = oldExit
+	}
+	// Reaching the end of a file doesn't count as exiting.
+	r.exitShell = r.exitShell || exiting
+}
+
+// background runs a function in a new goroutine, tracking it as a background
+// shell so that it can be waited for. The returned string is its process ID,
+// as used in $!. Since background shells aren't real processes, the IDs are
+// numbered separately with a "g" prefix, such as "g1".
+//
+// The function is given its own context, which is cancelled if the background
+// shell is killed. In that case, its exit status is 128 plus the signal
+// number, regardless of what the function returned.
+func (r *Runner) background(ctx context.Context, fn func(context.Context) error) string {
+	ctx, cancel := context.WithCancel(ctx)
+	bg := &bgProc{done: make(chan struct{}), cancel: cancel}
+	r.bgProcs = append(r.bgProcs, bg)
+	go func() {
+		bg.err = fn(ctx)
+		cancel()
+		bg.exit = 0
+		if sig := atomic.LoadInt32(&bg.signal); sig != 0 {
+			bg.exit = 128 + int(sig)
+			bg.err = NewExitStatus(uint8(bg.exit))
+		} else if status, ok := IsExitStatus(bg.err); ok {
+			bg.exit = int(status)
+		} else if bg.err != nil {
+			bg.exit = 1
+		}
+		close(bg.done)
+	}()
+	return fmt.Sprintf("g%d", len(r.bgProcs))
+}
+
+// coproc runs a coprocess, connecting its standard input and output to two new
+// file descriptors in the current shell. Their numbers are stored in the array
+// variable with the given name, along with the process ID in name_PID.
+//
+// When the coprocess finishes, the descriptor to write to its input is closed.
+// The descriptor to read its output is closed once it has been drained. Like in
+// Bash, the shell forgets about both descriptors and unsets the variables before
+// running its next command; see reapCoprocs.
+func (r *Runner) coproc(ctx context.Context, name string, st *syntax.Stmt) {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		r.setErr(err)
+		return
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		r.setErr(err)
+		return
+	}
+	r2 := r.Subshell()
+	r2.stdin = inR
+	r2.stdout = outW
+	readF := &eofCloser{outR}
+	readFd := r.newFd(readF)
+	writeFd := r.newFd(inW)
+	pid := r.background(ctx, func(ctx context.Context) error {
+		defer func() {
+			inR.Close()
+			outW.Close()
+			inW.Close()
+		}()
+		return r2.Run(ctx, &syntax.File{Stmts: []*syntax.Stmt{st}})
+	})
+	r.setVar(name, nil, expand.Variable{
+		Kind: expand.Indexed,
+		List: []string{strconv.Itoa(readFd), strconv.Itoa(writeFd)},
+	})
+	r.setVarString(name+"_PID", pid)
+	r.coprocs = append(r.coprocs, &coprocState{
+		name: name,
+		bg:   r.bgProcs[len(r.bgProcs)-1],
+		fds:  [2]int{readFd, writeFd},
+		fs:   [2]io.ReadWriteCloser{readF, inW},
+	})
+}
+
+// coprocState is a coprocess as started by the "coproc" keyword.
+type coprocState struct {
+	name string
+	bg   *bgProc
+	fds  [2]int
+	fs   [2]io.ReadWriteCloser
+}
+
+// reapCoprocs cleans up after the coprocesses which have finished, closing their
+// file descriptors and unsetting their variables. It's done between commands,
+// as the background shells can't safely modify the runner's state.
+func (r *Runner) reapCoprocs() {
+	alive := r.coprocs[:0]
+	for _, cp := range r.coprocs {
+		select {
+		case <-cp.bg.done:
+		default:
+			alive = append(alive, cp)
+			continue
+		}
+		for i, fd := range cp.fds {
+			// Leave the descriptor alone if it was replaced since.
+			if r.fds[fd] == cp.fs[i] {
+				cp.fs[i].Close()
+				delete(r.fds, fd)
+			}
+		}
+		r.delVar(cp.name)
+		r.delVar(cp.name + "_PID")
+	}
+	r.coprocs = alive
+}
+
+// eofCloser closes a file once reading from it reaches the end.
+type eofCloser struct {
+	*os.File
+}
+
+func (e *eofCloser) Read(p []byte) (int, error) {
+	n, err := e.File.Read(p)
+	if err == io.EOF {
+		e.File.Close()
+	}
+	return n, err
+}
+
+// newFd adds a file to the shell's file descriptors, returning its number.
+// Like in Bash, new file descriptors are numbered starting at 10.
+func (r *Runner) newFd(f io.ReadWriteCloser) int {
+	if r.fds == nil {
+		r.fds = make(map[int]io.ReadWriteCloser)
+	}
+	fd := 10
+	for r.fds[fd] != nil {
+		fd++
+	}
+	r.fds[fd] = f
+	return fd
+}
+
 func (r *Runner) stmtSync(ctx context.Context, st *syntax.Stmt) {
 	defer r.wgProcSubsts.Wait()
 	oldIn, oldOut, oldErr := r.stdin, r.stdout, r.stderr
+	var oldFds []savedFd
+	var closers []io.Closer
+	undoRedirs := func() {
+		for _, cls := range closers {
+			cls.Close()
+		}
+		r.stdin, r.stdout, r.stderr = oldIn, oldOut, oldErr
+		for i := len(oldFds) - 1; i >= 0; i-- {
+			r.setExtraFd(oldFds[i].fd, oldFds[i].f)
+		}
+	}
 	for _, rd := range st.Redirs {
+		if fd := redirFd(rd); fd > 2 {
+			oldFds = append(oldFds, savedFd{fd, r.fds[fd]})
+		}
 		cls, err := r.redir(ctx, rd)
+		if cls != nil {
+			closers = append(closers, cls)
+		}
 		if err != nil {
 			r.exit = 1
+			undoRedirs()
 			return
 		}
-		if cls != nil {
-			defer cls.Close()
-		}
 	}
 	if st.Cmd != nil {
 		r.cmd(ctx, st.Cmd)
 	}
+	switch st.Cmd.(type) {
+	case *syntax.CallExpr, *syntax.DeclClause, *syntax.LetClause,
+		*syntax.ArithmCmd, *syntax.TestClause, *syntax.Subshell:
+		// A pipeline of a single command; compound commands like
+		// "if" keep the status of the last pipeline they ran.
+		r.pipeStatus = []int{r.exit}
+	}
 	if st.Negated {
 		r.exit = oneIf(r.exit == 0)
-	} else if _, ok := st.Cmd.(*syntax.CallExpr); !ok {
-	} else if r.exit != 0 && !r.noErrExit && r.opts[optErrExit] {
-		// If the "errexit" option is set and a simple command failed,
-		// exit the shell. Exceptions:
+	} else if _, ok := st.Cmd.(*syntax.CallExpr); !ok && !isPipe(st) {
+	} else if r.exit != 0 && !r.noErrExit {
+		// If a simple command or a pipeline failed, run the ERR trap,
+		// and exit the shell if the "errexit" option is set.
+		// Exceptions:
 		//
 		//   conditions (if <cond>, while <cond>, etc)
 		//   part of && or || lists
 		//   preceded by !
-		r.exitShell = true
+		r.lastExit = r.exit // for $? within the trap
+		r.trap(ctx, "ERR")
+		if r.opts[optErrExit] {
+			r.exitShell = true
+		}
 	}
-	if !r.keepRedirs {
-		r.stdin, r.stdout, r.stderr = oldIn, oldOut, oldErr
+	if r.keepRedirs {
+		// "exec" made the redirections permanent, so only close the
+		// file descriptors which they replaced.
+		r.keepRedirs = false
+		for _, old := range oldFds {
+			if old.f != nil && r.fds[old.fd] != old.f {
+				old.f.Close()
+			}
+		}
+	} else if len(st.Redirs) > 0 {
+		undoRedirs()
 	}
 }
 
+// savedFd is a file descriptor replaced by a redirection, to be restored once
+// the command finishes.
+type savedFd struct {
+	fd int
+	f  io.ReadWriteCloser
+}
+
+// isPipe reports whether a statement is a pipeline of more than one command.
+func isPipe(st *syntax.Stmt) bool {
+	b, ok := st.Cmd.(*syntax.BinaryCmd)
+	return ok && (b.Op == syntax.Pipe || b.Op == syntax.PipeAll)
+}
+
 func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 	if r.stop(ctx) {
 		return
 	}
+	switch cm.(type) {
+	case *syntax.CallExpr, *syntax.DeclClause, *syntax.LetClause,
+		*syntax.ArithmCmd, *syntax.TestClause:
+		if !r.handlingTrap {
+			r.bashCommand = cm
+		}
+		r.trap(ctx, "DEBUG")
+	}
 	switch x := cm.(type) {
 	case *syntax.Block:
 		r.stmts(ctx, x.Stmts)
 	case *syntax.Subshell:
 		r2 := r.Subshell()
 		r2.stmts(ctx, x.Stmts)
+		r2.exitTrap(ctx)
 		r.exit = r2.exit
 		r.setErr(r2.err)
 	case *syntax.CallExpr:
-		// Use a new slice, to not modify the slice in the alias map.
-		var args []*syntax.Word
-		left := x.Args
-		for len(left) > 0 && r.opts[optExpandAliases] {
-			als, ok := r.alias[left[0].Lit()]
-			if !ok {
-				break
-			}
-			args = append(args, als.args...)
-			left = left[1:]
-			if !als.blank {
-				break
-			}
+		args := x.Args
+		if r.opts[optExpandAliases] {
+			args = r.expandAliases(args, make(map[string]bool))
 		}
-		args = append(args, left...)
 		fields := r.fields(args...)
 		if len(fields) == 0 {
 			for _, as := range x.Assigns {
-				vr := r.assignVal(as, "")
+				vr := r.assignVal(r.lookupVar(as.Name.Value), as, "")
+				r.traceAssign(as, vr)
 				r.setVar(as.Name.Value, as.Index, vr)
 			}
 			break
 		}
 		for _, as := range x.Assigns {
-			vr := r.assignVal(as, "")
+			vr := r.assignVal(r.lookupVar(as.Name.Value), as, "")
+			r.traceAssign(as, vr)
+			if r.lookupVar(as.Name.Value).ReadOnly {
+				// Like Bash, report the error but run the command.
+				r.errf("%s: readonly variable\n", as.Name.Value)
+				continue
+			}
 			// we know that inline vars must be strings
 			r.cmdVars[as.Name.Value] = vr.Str
 		}
+		if r.opts[optXTrace] {
+			r.trace(traceFields(fields))
+		}
 		r.call(ctx, x.Args[0].Pos(), fields)
 		// cmdVars can be nuked here, as they are never useful
 		// again once we nest into further levels of inline
@@ -372,17 +791,37 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			} else {
 				r2.stderr = r.stderr
 			}
-			r.stdin = pr
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go func() {
 				r2.stmt(ctx, x.X)
+				r2.exitTrap(ctx)
 				pw.Close()
 				wg.Done()
 			}()
-			r.stmt(ctx, x.Y)
+			if r.opts[optLastPipe] {
+				// Run the last command in the current shell, so
+				// that e.g. "echo foo | read var" sets var.
+				oldIn := r.stdin
+				r.stdin = pr
+				r.stmt(ctx, x.Y)
+				r.stdin = oldIn
+			} else {
+				r3 := r.Subshell()
+				r3.stdin = pr
+				r3.stmt(ctx, x.Y)
+				r3.exitTrap(ctx)
+				r.exit = r3.exit
+				r.setErr(r3.err)
+			}
 			pr.Close()
 			wg.Wait()
+			// "a | b | c" is parsed as "(a | b) | c".
+			left := []int{r2.exit}
+			if isPipe(x.X) {
+				left = r2.pipeStatus
+			}
+			r.pipeStatus = append(left, r.exit)
 			if r.opts[optPipeFail] && r2.exit != 0 && r.exit == 0 {
 				r.exit = r2.exit
 			}
@@ -424,52 +863,91 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				items = r.fields(y.Items...) // for i in ...; do ...
 			}
 			for _, field := range items {
+				if r.opts[optXTrace] {
+					r.trace("for " + name + " in " + printWords(y.Items))
+				}
+				r.trap(ctx, "DEBUG")
 				r.setVarString(name, field)
 				if r.loopStmtsBroken(ctx, x.Do) {
 					break
 				}
 			}
 		case *syntax.CStyleLoop:
+			r.trap(ctx, "DEBUG")
 			r.arithm(y.Init)
-			for r.arithm(y.Cond) != 0 {
+			for {
+				r.trap(ctx, "DEBUG")
+				if r.arithm(y.Cond) == 0 {
+					break
+				}
 				if r.exit != 0 || r.loopStmtsBroken(ctx, x.Do) {
 					break
 				}
+				r.trap(ctx, "DEBUG")
 				r.arithm(y.Post)
 			}
 		}
 	case *syntax.FuncDecl:
 		r.setFunc(x.Name.Value, x.Body)
 	case *syntax.ArithmCmd:
+		if r.opts[optXTrace] {
+			r.trace(printCmd(x))
+		}
 		r.exit = oneIf(r.arithm(x.X) == 0)
 	case *syntax.LetClause:
+		if r.opts[optXTrace] {
+			r.trace(printCmd(x))
+		}
 		var val int
 		for _, expr := range x.Exprs {
 			val = r.arithm(expr)
 		}
 		r.exit = oneIf(val == 0)
 	case *syntax.CaseClause:
+		if r.opts[optXTrace] {
+			r.trace("case " + printWords([]*syntax.Word{x.Word}) + " in")
+		}
+		r.trap(ctx, "DEBUG")
 		str := r.literal(x.Word)
-		for _, ci := range x.Items {
-			for _, word := range ci.Patterns {
-				pattern := r.pattern(word)
-				if match(pattern, str) {
-					r.stmts(ctx, ci.Stmts)
-					return
-				}
+		for i := 0; i < len(x.Items); i++ {
+			ci := x.Items[i]
+			if !r.caseMatch(ci, str) {
+				continue
+			}
+			r.exit = 0 // in case there are no statements
+			r.stmts(ctx, ci.Stmts)
+			// With ";&", also run the following items without
+			// matching them, for as long as they end with ";&".
+			for ci.Op == syntax.Fallthrough && i+1 < len(x.Items) && !r.loopJump() {
+				i++
+				ci = x.Items[i]
+				r.exit = 0
+				r.stmts(ctx, ci.Stmts)
+			}
+			// With ";;&" or ";|", keep matching the following items.
+			if (ci.Op != syntax.Resume && ci.Op != syntax.ResumeKorn) || r.loopJump() {
+				return
 			}
 		}
 	case *syntax.TestClause:
+		if r.opts[optXTrace] {
+			r.trace(printCmd(x))
+		}
 		if r.bashTest(ctx, x.X, false) == "" && r.exit == 0 {
 			// to preserve exit status code 2 for regex errors, etc
 			r.exit = 1
 		}
 	case *syntax.DeclClause:
+		if r.opts[optXTrace] {
+			r.trace(printCmd(x))
+		}
 		local, global := false, false
+		print, funcs, anyNames := false, false, false
+		optsDone := false
 		var modes []string
 		valType := ""
 		switch x.Variant.Value {
-		case "declare":
+		case "declare", "typeset":
 			// When used in a function, "declare" acts as "local"
 			// unless the "-g" option is used.
 			local = r.inFunc
@@ -490,27 +968,92 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		for _, as := range x.Args {
 			for _, as := range r.flattenAssign(as) {
 				name := as.Name.Value
-				if strings.HasPrefix(name, "-") {
-					switch name {
-					case "-x", "-r":
-						modes = append(modes, name)
-					case "-a", "-A", "-n":
-						valType = name
-					case "-g":
-						global = true
-					default:
-						r.errf("declare: invalid option %q\n", name)
-						r.exit = 2
-						return
+				if name == "--" && !optsDone && as.Value == nil {
+					optsDone = true
+					continue
+				}
+				if len(name) > 1 && (name[0] == '-' || name[0] == '+') && !optsDone {
+					// Options can be combined, like "-ix", and
+					// attributes are removed with '+', like "+x".
+					sign := name[:1]
+					for _, c := range name[1:] {
+						switch c {
+						case 'n':
+							if x.Variant.Value == "export" {
+								// "export -n" removes the export attribute
+								modes = append(modes, "+x")
+								break
+							}
+							fallthrough
+						case 'a', 'A':
+							if sign == "-" {
+								valType = "-" + string(c)
+							}
+						case 'x', 'r', 'i':
+							modes = append(modes, sign+string(c))
+						case 'g':
+							global = true
+						case 'p':
+							print = true
+						case 'f':
+							funcs = true
+						default:
+							r.errf("declare: invalid option %q\n", name)
+							r.exit = 2
+							return
+						}
 					}
 					continue
 				}
+				anyNames = true
+				if funcs {
+					r.declFunc(x.Variant.Value, name, modes)
+					continue
+				}
+				if print {
+					vr := r.lookupVar(name)
+					if !vr.IsSet() && !vr.ReadOnly && !vr.Exported && !vr.Integer {
+						r.errf("%s: %s: not found\n", x.Variant.Value, name)
+						r.exit = 1
+						continue
+					}
+					r.printVar(name, vr)
+					continue
+				}
 				if !syntax.ValidName(name) {
 					r.errf("declare: invalid name %q\n", name)
 					r.exit = 1
 					return
 				}
-				vr := r.assignVal(as, valType)
+				prev := r.lookupVar(name)
+				_, shadowed := r.funcShadowed[name]
+				// Like Bash, a read-only global variable can't be
+				// shadowed, but one local to a calling function can.
+				newLocal := local && !global && !shadowed && !(prev.ReadOnly && !prev.Local)
+				if newLocal {
+					// Like Bash, a new local variable only keeps
+					// the export attribute of what it shadows.
+					prev = expand.Variable{Exported: prev.Exported}
+				}
+				if hasMode(modes, "+r") && prev.ReadOnly {
+					r.errf("%s: %s: readonly variable\n", x.Variant.Value, name)
+					r.exit = 1
+					continue
+				}
+				// Like Bash, the integer attribute applies to the
+				// value being assigned by the same declaration.
+				for _, mode := range modes {
+					switch mode {
+					case "-i":
+						prev.Integer = true
+					case "+i":
+						prev.Integer = false
+					}
+				}
+				vr := r.assignVal(prev, as, valType)
+				if newLocal {
+					r.declareLocal(name)
+				}
 				if global {
 					vr.Local = false
 				} else if local {
@@ -520,8 +1063,14 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 					switch mode {
 					case "-x":
 						vr.Exported = true
+					case "+x":
+						vr.Exported = false
 					case "-r":
 						vr.ReadOnly = true
+					case "-i":
+						vr.Integer = true
+					case "+i":
+						vr.Integer = false
 					}
 				}
 				if as.Naked {
@@ -531,6 +1080,47 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 				}
 			}
 		}
+		if anyNames {
+			break
+		}
+		switch x.Variant.Value {
+		case "readonly", "export":
+			// Like "-p" when given no names.
+			print = true
+		}
+		switch {
+		case funcs:
+			r.printFuncs(modes)
+		case print || len(modes) > 0 || valType != "" || x.Variant.Value == "local":
+			r.eachVar(func(name string, vr expand.Variable) {
+				if local && !vr.Local {
+					return
+				}
+				if declFilter(modes, valType, vr) {
+					r.printVar(name, vr)
+				}
+			})
+		default:
+			// With no options at all, list the variables and their
+			// values, followed by the functions.
+			r.eachVar(func(name string, vr expand.Variable) {
+				if vr.IsSet() {
+					r.outf("%s=%s\n", name, declValue(vr, declQuote))
+				}
+			})
+			r.printFuncs(nil)
+		}
+	case *syntax.CoprocClause:
+		name := "COPROC"
+		if x.Name != nil {
+			name = r.literal(x.Name)
+		}
+		if !syntax.ValidName(name) {
+			r.errf("coproc: invalid name %q\n", name)
+			r.exit = 1
+			return
+		}
+		r.coproc(ctx, name, x.Stmt)
 	case *syntax.TimeClause:
 		start := time.Now()
 		if x.Stmt != nil {
@@ -552,6 +1142,101 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 	}
 }
 
+// declFunc applies a declaration like "readonly -f name" to a function, or
+// prints its definition if no attributes are being set.
+func (r *Runner) declFunc(variant, name string, modes []string) {
+	body := r.Funcs[name]
+	if body == nil {
+		r.errf("%s: %s: not a function\n", variant, name)
+		r.exit = 1
+		return
+	}
+	if !hasMode(modes, "-r") {
+		r.printFunc(name, body)
+		return
+	}
+	if r.readOnlyFuncs == nil {
+		r.readOnlyFuncs = make(map[string]bool)
+	}
+	r.readOnlyFuncs[name] = true
+}
+
+// printFuncs prints the definitions of all functions, sorted by name. If the
+// "-r" mode is given, only read-only functions are printed.
+func (r *Runner) printFuncs(modes []string) {
+	names := make([]string, 0, len(r.Funcs))
+	for name := range r.Funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		readOnly := r.readOnlyFuncs[name]
+		if hasMode(modes, "-r") && !readOnly {
+			continue
+		}
+		r.printFunc(name, r.Funcs[name])
+		if readOnly {
+			r.outf("declare -fr %s\n", name)
+		}
+	}
+}
+
+// declFilter reports whether a variable should be listed by a declaration
+// builtin like "declare -p" with no names. Like in Bash, "-a" and "-A" only
+// list arrays of that kind, while any of "-r", "-x", and "-i" may match.
+func declFilter(modes []string, valType string, vr expand.Variable) bool {
+	switch valType {
+	case "-a":
+		if vr.Kind != expand.Indexed {
+			return false
+		}
+	case "-A":
+		if vr.Kind != expand.Associative {
+			return false
+		}
+	case "-n":
+		if vr.Kind != expand.NameRef {
+			return false
+		}
+	}
+	any, matched := false, false
+	for _, mode := range modes {
+		var attr bool
+		switch mode {
+		case "-r":
+			attr = vr.ReadOnly
+		case "-x":
+			attr = vr.Exported
+		case "-i":
+			attr = vr.Integer
+		default:
+			continue
+		}
+		any = true
+		matched = matched || attr
+	}
+	return !any || matched
+}
+
+func hasMode(modes []string, mode string) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Runner) printFunc(name string, body *syntax.Stmt) {
+	var buf bytes.Buffer
+	syntax.NewPrinter().Print(&buf, &syntax.FuncDecl{
+		Name: &syntax.Lit{Value: name},
+		Body: body,
+	})
+	buf.WriteByte('\n')
+	r.out(buf.String())
+}
+
 func (r *Runner) flattenAssign(as *syntax.Assign) []*syntax.Assign {
 	// Convert "declare $x" into "declare value".
 	// Don't use syntax.Parser here, as we only want the basic
@@ -576,13 +1261,15 @@ func (r *Runner) flattenAssign(as *syntax.Assign) []*syntax.Assign {
 	return asgns
 }
 
-func match(pat, name string) bool {
-	expr, err := pattern.Regexp(pat, 0)
-	if err != nil {
-		return false
+// match reports whether name matches a pattern. Extended globs like "@(a|b)"
+// are only supported if extGlob is true.
+func match(pat, name string, extGlob bool) bool {
+	var mode pattern.Mode
+	if extGlob {
+		mode = pattern.ExtendedGlob
 	}
-	rx := regexp.MustCompile("^" + expr + "$")
-	return rx.MatchString(name)
+	ok, _ := pattern.Match(pat, name, mode)
+	return ok
 }
 
 func elapsedString(d time.Duration, posix bool) string {
@@ -597,9 +1284,28 @@ func elapsedString(d time.Duration, posix bool) string {
 func (r *Runner) stmts(ctx context.Context, stmts []*syntax.Stmt) {
 	for _, stmt := range stmts {
 		r.stmt(ctx, stmt)
+		if r.loopJump() {
+			break
+		}
 	}
 }
 
+// loopJump reports whether a break or continue is leaving the enclosing loops,
+// so that no more statements should run until the loop handles it.
+func (r *Runner) loopJump() bool {
+	return r.breakEnclosing > 0 || r.contnEnclosing > 0
+}
+
+// caseMatch reports whether any of the patterns of a case item match str.
+func (r *Runner) caseMatch(ci *syntax.CaseItem, str string) bool {
+	for _, word := range ci.Patterns {
+		if match(r.pattern(word), str, r.opts[optExtGlob]) {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *Runner) hdocReader(rd *syntax.Redirect) io.Reader {
 	if rd.Op != syntax.DashHdoc {
 		hdoc := r.document(rd.Hdoc)
@@ -634,61 +1340,292 @@ func (r *Runner) hdocReader(rd *syntax.Redirect) io.Reader {
 }
 
 func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, error) {
+	fd, name := redirFd(rd), ""
+	if rd.N != nil && fd < 0 {
+		name = strings.Trim(rd.N.Value, "{}") // "{name}>file"
+	}
 	if rd.Hdoc != nil {
-		r.stdin = r.hdocReader(rd)
-		return nil, nil
+		return nil, r.setFd(fd, name, "", dupStream(fd, r.hdocReader(rd)))
 	}
-	orig := &r.stdout
-	if rd.N != nil {
-		switch rd.N.Value {
-		case "1":
-		case "2":
-			orig = &r.stderr
-		}
+	if rd.Op == syntax.WordHdoc {
+		hdoc := strings.NewReader(r.literal(rd.Word) + "\n")
+		return nil, r.setFd(fd, name, "", dupStream(fd, hdoc))
+	}
+	arg, err := r.redirTarget(rd.Word)
+	if err != nil {
+		return nil, err
 	}
-	arg := r.literal(rd.Word)
 	switch rd.Op {
-	case syntax.WordHdoc:
-		r.stdin = strings.NewReader(arg + "\n")
-		return nil, nil
-	case syntax.DplOut:
-		switch arg {
-		case "1":
-			*orig = r.stdout
-		case "2":
-			*orig = r.stderr
+	case syntax.DplOut, syntax.DplIn:
+		if arg == "-" {
+			return nil, r.closeFd(fd, name)
 		}
-		return nil, nil
-	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut,
+		stream, ok := r.fdStream(arg)
+		if !ok {
+			r.errf("%s: bad file descriptor\n", arg)
+			return nil, fmt.Errorf("bad file descriptor")
+		}
+		return nil, r.setFd(fd, name, arg, dupStream(fd, stream))
+	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut, syntax.ClbOut,
 		syntax.RdrAll, syntax.AppAll:
 		// done further below
-	// case syntax.DplIn:
 	default:
 		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
 	}
+	if stream, ok := r.devStream(arg); ok {
+		// The stream belongs to the shell, so it mustn't be closed.
+		if rd.Op == syntax.RdrAll || rd.Op == syntax.AppAll {
+			if err := r.setFd(1, "", arg, stream); err != nil {
+				return nil, err
+			}
+		}
+		return nil, r.setFd(fd, name, arg, dupStream(fd, stream))
+	}
 	mode := os.O_RDONLY
 	switch rd.Op {
 	case syntax.AppOut, syntax.AppAll:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
-	case syntax.RdrOut, syntax.RdrAll:
+	case syntax.RdrOut, syntax.RdrAll, syntax.ClbOut:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	}
+	if r.opts[optNoClobber] && (rd.Op == syntax.RdrOut || rd.Op == syntax.RdrAll) {
+		// Like in Bash, only existing regular files are protected,
+		// so that redirecting to e.g. /dev/null still works.
+		info, err := r.stat(arg)
+		if err == nil && info.Mode().IsRegular() {
+			r.errf("%s: cannot overwrite existing file\n", arg)
+			return nil, fmt.Errorf("cannot overwrite existing file")
+		}
+		if err != nil {
+			mode |= os.O_EXCL
+		}
+	}
 	f, err := r.open(ctx, arg, mode, 0o644, true)
 	if err != nil {
 		return nil, err
 	}
+	if rd.Op == syntax.RdrAll || rd.Op == syntax.AppAll {
+		r.stdout = f
+	}
+	if err := r.setFd(fd, name, arg, f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if name != "" {
+		// Like in Bash, "{name}>file" leaves the file open.
+		return nil, nil
+	}
+	return f, nil
+}
+
+// redirFd returns the file descriptor which a redirection applies to, such as
+// 2 for "2>file" or 1 for ">file". It returns -1 for "{name}>file", which
+// allocates a new file descriptor.
+func redirFd(rd *syntax.Redirect) int {
+	if rd.N != nil {
+		n, err := strconv.Atoi(rd.N.Value)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
 	switch rd.Op {
-	case syntax.RdrIn:
-		r.stdin = f
-	case syntax.RdrOut, syntax.AppOut:
-		*orig = f
+	case syntax.RdrIn, syntax.DplIn, syntax.RdrInOut, syntax.Hdoc,
+		syntax.DashHdoc, syntax.WordHdoc:
+		return 0
 	case syntax.RdrAll, syntax.AppAll:
-		r.stdout = f
-		r.stderr = f
+		return 2 // and 1
+	}
+	return 1
+}
+
+// setFd makes file descriptor fd refer to a stream, such as an opened file or
+// one returned by fdStream. If fd is -1, a new file descriptor is allocated,
+// and its number is stored in the variable name.
+func (r *Runner) setFd(fd int, name, path string, stream interface{}) error {
+	switch fd {
+	case 0:
+		if stream == nil { // an empty stdin
+			r.stdin = nil
+			return nil
+		}
+		if rd, ok := stream.(io.Reader); ok {
+			r.stdin = rd
+			return nil
+		}
+	case 1, 2:
+		if w, ok := stream.(io.Writer); ok {
+			if fd == 1 {
+				r.stdout = w
+			} else {
+				r.stderr = w
+			}
+			return nil
+		}
 	default:
-		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
+		f, ok := stream.(io.ReadWriteCloser)
+		if !ok {
+			break
+		}
+		if fd < 0 {
+			r.setVarString(name, strconv.Itoa(r.newFd(f)))
+		} else {
+			r.setExtraFd(fd, f)
+		}
+		return nil
 	}
-	return f, nil
+	r.errf("%s: bad file descriptor\n", path)
+	return fmt.Errorf("bad file descriptor")
+}
+
+// setExtraFd sets or, if f is nil, removes a file descriptor other than the
+// standard ones.
+func (r *Runner) setExtraFd(fd int, f io.ReadWriteCloser) {
+	if f == nil {
+		delete(r.fds, fd)
+		return
+	}
+	if r.fds == nil {
+		r.fds = make(map[int]io.ReadWriteCloser)
+	}
+	r.fds[fd] = f
+}
+
+// closeFd closes a file descriptor, as in "3>&-" or "{name}>&-". Since the
+// redirection may be undone once the command finishes, a numbered file
+// descriptor is only removed. One allocated via "{name}>file" is closed for
+// good.
+//
+// The standard streams can't be missing, so closing standard input leaves it
+// empty, and closing standard output or error makes writes to them fail.
+func (r *Runner) closeFd(fd int, name string) error {
+	if name != "" {
+		vr := r.lookupVar(name)
+		if !vr.IsSet() {
+			r.errf("%s: ambiguous redirect\n", name)
+			return fmt.Errorf("ambiguous redirect")
+		}
+		n, err := strconv.Atoi(vr.String())
+		if f := r.fds[n]; err == nil && n > 2 && f != nil {
+			f.Close()
+			delete(r.fds, n)
+		}
+		return nil
+	}
+	switch fd {
+	case 0:
+		r.stdin = nil
+	case 1:
+		r.stdout = closedWriter{}
+	case 2:
+		r.stderr = closedWriter{}
+	default:
+		delete(r.fds, fd)
+	}
+	return nil
+}
+
+// closedWriter is a standard output or error stream which has been closed, so
+// that writing to it fails like writing to a closed file descriptor.
+type closedWriter struct{}
+
+func (closedWriter) Write(p []byte) (int, error) { return 0, syscall.EBADF }
+
+// dupStream prepares a stream which isn't owned by a redirection, such as one
+// returned by fdStream, to be used as file descriptor fd. Unlike the standard
+// streams, other file descriptors are closed when they are replaced or removed
+// for good, so the stream is wrapped to leave it open.
+func dupStream(fd int, stream interface{}) interface{} {
+	if fd >= 0 && fd <= 2 {
+		return stream
+	}
+	return streamFd{stream}
+}
+
+// streamFd is a file descriptor which refers to a stream used elsewhere, like
+// the copy of standard output made by "3>&1". Closing it does nothing.
+type streamFd struct {
+	stream interface{}
+}
+
+func (s streamFd) Read(p []byte) (int, error) {
+	if s.stream == nil { // an empty stdin
+		return 0, io.EOF
+	}
+	if rd, ok := s.stream.(io.Reader); ok {
+		return rd.Read(p)
+	}
+	return 0, fmt.Errorf("bad file descriptor")
+}
+
+func (s streamFd) Write(p []byte) (int, error) {
+	if w, ok := s.stream.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, fmt.Errorf("bad file descriptor")
+}
+
+func (s streamFd) Close() error { return nil }
+
+// devStream returns the stream which a special path such as /dev/stdout or
+// /dev/fd/N refers to. Like in Bash, these paths work even if the system
+// doesn't have such files, and they use the shell's streams, which might not
+// be files at all.
+func (r *Runner) devStream(path string) (interface{}, bool) {
+	switch path {
+	case "/dev/stdin":
+		return r.fdStream("0")
+	case "/dev/stdout":
+		return r.fdStream("1")
+	case "/dev/stderr":
+		return r.fdStream("2")
+	}
+	if strings.HasPrefix(path, "/dev/fd/") {
+		return r.fdStream(path[len("/dev/fd/"):])
+	}
+	return nil, false
+}
+
+// fdStream returns the stream behind the file descriptor with the given
+// number, as used in duplicating redirections like "<&N" or ">&N".
+func (r *Runner) fdStream(arg string) (interface{}, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, false
+	}
+	switch n {
+	case 0:
+		return r.stdin, true
+	case 1:
+		return r.stdout, true
+	case 2:
+		return r.stderr, true
+	}
+	if f := r.fds[n]; f != nil {
+		return f, true
+	}
+	return nil, false
+}
+
+// redirTarget expands the target word of a redirection such as ">word". Like
+// any other argument, it is subject to field splitting and globbing, but it
+// must result in exactly one field.
+func (r *Runner) redirTarget(word *syntax.Word) (string, error) {
+	fields, err := expand.Fields(r.ecfg, word)
+	if err != nil {
+		r.expandErr(err)
+		return "", err
+	}
+	if r.exitShell { // e.g. an unset variable with "set -u"
+		return "", fmt.Errorf("redirect target expansion failed")
+	}
+	if len(fields) != 1 {
+		var buf bytes.Buffer
+		syntax.NewPrinter().Print(&buf, word)
+		r.errf("%s: ambiguous redirect\n", buf.String())
+		return "", fmt.Errorf("ambiguous redirect")
+	}
+	return fields[0], nil
 }
 
 func (r *Runner) loopStmtsBroken(ctx context.Context, stmts []*syntax.Stmt) bool {
@@ -719,34 +1656,152 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 	}
 	name := args[0]
 	if body := r.Funcs[name]; body != nil {
-		// stack them to support nested func calls
-		oldParams := r.Params
-		r.Params = args[1:]
-		oldInFunc := r.inFunc
-		oldFuncVars := r.funcVars
-		r.funcVars = nil
-		r.inFunc = true
-
-		r.stmt(ctx, body)
+		if !r.enterCall(name) {
+			return
+		}
+		defer r.leaveCall()
+		r.callFunc(ctx, pos, name, args[1:], body)
+		return
+	}
+	builtin := r.isBuiltin(name)
+	var start time.Time
+	if r.commandHook != nil {
+		start = time.Now()
+	}
+	if builtin {
+		r.exit = r.builtinCode(ctx, pos, name, args[1:])
+	} else {
+		r.execOrNotFound(ctx, pos, args)
+	}
+	if r.commandHook != nil {
+		r.commandHook(CommandEvent{
+			Args:     args,
+			Builtin:  builtin,
+			Duration: time.Since(start),
+			Exit:     r.exit,
+		})
+	}
+}
 
+// callFunc runs the body of a function with the given parameters. The state
+// local to the call, such as its parameters and local variables, is restored
+// via defer. This way, it is undone however the function finishes, be it by
+// returning, reaching the end of its body, failing with errexit, an expansion
+// error, or exiting the shell.
+func (r *Runner) callFunc(ctx context.Context, pos syntax.Pos, name string, params []string, body *syntax.Stmt) {
+	// stack them to support nested func calls
+	oldParams := r.Params
+	oldInFunc := r.inFunc
+	oldShadowed := r.funcShadowed
+	r.Params = params
+	r.pushFrame(name, pos)
+	r.funcShadowed = nil
+	r.inFunc = true
+	debugTrap := r.hideTrap("DEBUG", optFuncTrace)
+	errTrap := r.hideTrap("ERR", optErrTrace)
+	defer func() {
 		r.Params = oldParams
-		r.funcVars = oldFuncVars
+		r.callStack = r.callStack[:len(r.callStack)-1]
+		r.restoreLocals()
+		r.funcShadowed = oldShadowed
 		r.inFunc = oldInFunc
-		if code, ok := r.err.(returnStatus); ok {
-			r.err = nil
-			r.exit = int(code)
-		}
+		r.restoreTrap("DEBUG", debugTrap)
+		r.restoreTrap("ERR", errTrap)
+	}()
+	if r.opts[optFuncTrace] {
+		r.trap(ctx, "DEBUG")
+	}
+
+	r.stmt(ctx, body)
+
+	if code, ok := r.err.(returnStatus); ok {
+		r.err = nil
+		r.exit = int(code)
+	}
+}
+
+// callFrame is an entry in the call stack, describing a call to a function
+// or the sourcing of a file.
+type callFrame struct {
+	name   string // the function name, or "source"
+	line   uint   // the line the call was made from
+	source string // the file the call was made from
+}
+
+// enterCall records that a function call, a sourced file, or an eval begins.
+// If that exceeds the nesting limit, it reports an error and stops the shell
+// instead, returning false.
+func (r *Runner) enterCall(name string) bool {
+	max := atoi(r.envGet("FUNCNEST"))
+	if max <= 0 {
+		max = r.maxCallDepth
+	}
+	if max > 0 && r.callDepth >= max {
+		r.errf("%s: maximum function nesting level exceeded (%d)\n", name, max)
+		r.exit = 1
+		r.exitShell = true
+		return false
+	}
+	r.callDepth++
+	return true
+}
+
+// leaveCall undoes enterCall.
+func (r *Runner) leaveCall() { r.callDepth-- }
+
+func (r *Runner) pushFrame(name string, pos syntax.Pos) {
+	r.callStack = append(r.callStack, callFrame{
+		name:   name,
+		line:   pos.Line(),
+		source: r.currentSource(),
+	})
+}
+
+// currentSource returns the name of the file being run, like $BASH_SOURCE.
+func (r *Runner) currentSource() string {
+	if r.sourceFile != "" {
+		return r.sourceFile
+	}
+	return r.filename
+}
+
+// execOrNotFound is like exec, but if the program isn't found in $PATH, it runs
+// the command_not_found_handle function or the handler set via
+// CommandNotFoundHandler instead, if any. Like in Bash, the exec builtin
+// doesn't do this.
+func (r *Runner) execOrNotFound(ctx context.Context, pos syntax.Pos, args []string) {
+	const name = "command_not_found_handle"
+	body := r.Funcs[name]
+	if (body == nil && r.notFoundHandler == nil) || !r.notFound(args[0]) {
+		r.exec(ctx, r.execHandler, args)
 		return
 	}
-	if isBuiltin(name) {
-		r.exit = r.builtinCode(ctx, pos, name, args[1:])
+	if body == nil {
+		r.exec(ctx, r.notFoundHandler, args)
 		return
 	}
-	r.exec(ctx, args)
+	r2 := r.Subshell()
+	if r2.enterCall(name) {
+		r2.callFunc(ctx, pos, name, args, body)
+		r2.leaveCall()
+	}
+	r2.exitTrap(ctx)
+	r.exit = r2.exit
+	r.setErr(r2.err)
 }
 
-func (r *Runner) exec(ctx context.Context, args []string) {
-	err := r.execHandler(r.handlerCtx(ctx), args)
+func (r *Runner) exec(ctx context.Context, handler ExecHandlerFunc, args []string) {
+	hc := r.handlerContext()
+	if _, ok := r.cmdVars["PATH"]; !ok {
+		path, looked := "", false
+		hc.hashPath = func() string {
+			if !looked {
+				path, looked = r.hashPath(args[0]), true
+			}
+			return path
+		}
+	}
+	err := handler(context.WithValue(ctx, handlerCtxKey{}, hc), args)
 	if status, ok := IsExitStatus(err); ok {
 		r.exit = int(status)
 		return
@@ -759,6 +1814,54 @@ func (r *Runner) exec(ctx context.Context, args []string) {
 	r.exit = 0
 }
 
+// notFound reports whether a program name isn't found in $PATH. Like in Bash,
+// names with slashes aren't searched for, so they are never "not found".
+func (r *Runner) notFound(name string) bool {
+	if hasPathSep(name) {
+		return false
+	}
+	_, err := LookPath(expandEnv{r}, name)
+	return err != nil
+}
+
+// hasPathSep reports whether a program name contains a path separator, meaning
+// that it's not looked up in $PATH.
+func hasPathSep(name string) bool {
+	chars := `/`
+	if runtime.GOOS == "windows" {
+		chars = `:\/`
+	}
+	return strings.ContainsAny(name, chars)
+}
+
+// hashPath returns the absolute path to a program, using and updating the hash
+// table of remembered paths. It returns an empty string if the program wasn't
+// found, or if its name contains a slash and thus $PATH isn't searched at all.
+func (r *Runner) hashPath(name string) string {
+	if hasPathSep(name) {
+		return ""
+	}
+	if entry, ok := r.hash[name]; ok {
+		// Like Bash's checkhash, as the program might have been
+		// removed since we last found it.
+		if _, err := os.Stat(entry.path); err == nil {
+			entry.hits++
+			r.hash[name] = entry
+			return entry.path
+		}
+		delete(r.hash, name)
+	}
+	path, err := LookPath(expandEnv{r}, name)
+	if err != nil || !filepath.IsAbs(path) {
+		return ""
+	}
+	if r.hash == nil {
+		r.hash = make(map[string]hashEntry)
+	}
+	r.hash[name] = hashEntry{path: path, hits: 1}
+	return path
+}
+
 func (r *Runner) open(ctx context.Context, path string, flags int, mode os.FileMode, print bool) (io.ReadWriteCloser, error) {
 	f, err := r.openHandler(r.handlerCtx(ctx), path, flags, mode)
 	// TODO: support wrapped PathError returned from openHandler.
@@ -35,11 +35,17 @@ func (r *Runner) bashTest(ctx context.Context, expr syntax.TestExpr, classic boo
 				}
 			} else { // [[
 				pattern := r.pattern(yw)
-				if match(pattern, str) == (x.Op != syntax.TsNoMatch) {
+				// Like Bash, as if extglob was enabled.
+				if match(pattern, str, true) == (x.Op != syntax.TsNoMatch) {
 					return "1"
 				}
 			}
 			return ""
+		case syntax.TsReMatch:
+			if r.reMatch(x.X.(*syntax.Word), x.Y.(*syntax.Word)) {
+				return "1"
+			}
+			return ""
 		}
 		if r.binTest(x.Op, r.bashTest(ctx, x.X, classic), r.bashTest(ctx, x.Y, classic)) {
 			return "1"
@@ -54,15 +60,30 @@ func (r *Runner) bashTest(ctx context.Context, expr syntax.TestExpr, classic boo
 	return ""
 }
 
+// reMatch implements [[ str =~ regex ]], setting $BASH_REMATCH to the match and
+// its parenthesized subexpressions. If the regular expression is invalid, the
+// exit status is 2 and $BASH_REMATCH is left untouched.
+func (r *Runner) reMatch(xw, yw *syntax.Word) bool {
+	str := r.literal(xw)
+	expr, err := expand.Regexp(r.ecfg, yw)
+	if err != nil {
+		r.expandErr(err)
+		return false
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		r.exit = 2
+		return false
+	}
+	// Like POSIX extended regular expressions, prefer the longest match.
+	re.Longest()
+	match := re.FindStringSubmatch(str)
+	r.setVar("BASH_REMATCH", nil, expand.Variable{Kind: expand.Indexed, List: match})
+	return match != nil
+}
+
 func (r *Runner) binTest(op syntax.BinTestOperator, x, y string) bool {
 	switch op {
-	case syntax.TsReMatch:
-		re, err := regexp.Compile(y)
-		if err != nil {
-			r.exit = 2
-			return false
-		}
-		return re.MatchString(x)
 	case syntax.TsNewer:
 		info1, err1 := r.stat(x)
 		info2, err2 := r.stat(y)
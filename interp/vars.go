@@ -4,10 +4,16 @@
 package interp
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
@@ -41,21 +47,22 @@ func (o overlayEnviron) Each(f func(name string, vr expand.Variable) bool) {
 func execEnv(env expand.Environ) []string {
 	list := make([]string, 0, 64)
 	env.Each(func(name string, vr expand.Variable) bool {
-		if !vr.IsSet() {
-			// If a variable is set globally but unset in the
-			// runner, we need to ensure it's not part of the final
-			// list. Seems like zeroing the element is enough.
-			// This is a linear search, but this scenario should be
-			// rare, and the number of variables shouldn't be large.
+		// Like in Bash, arrays and unset variables can have the
+		// export attribute, but they aren't exported.
+		if !vr.Exported || vr.Kind != expand.String {
+			// If a variable is exported globally but unset or no
+			// longer exported in the runner, we need to ensure it's
+			// not part of the final list. Seems like zeroing the
+			// element is enough. This is a linear search, but the
+			// number of variables shouldn't be large.
 			for i, kv := range list {
 				if strings.HasPrefix(kv, name+"=") {
 					list[i] = ""
 				}
 			}
+			return true
 		}
-		if vr.Exported {
-			list = append(list, name+"="+vr.String())
-		}
+		list = append(list, name+"="+vr.String())
 		return true
 	})
 	return list
@@ -75,10 +82,36 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.lastExit)
 	case "$":
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getpid())
+	case "!":
+		vr.Kind = expand.String
+		if n := len(r.bgProcs); n > 0 {
+			vr.Str = "g" + strconv.Itoa(n)
+		}
 	case "PPID":
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getppid())
+	case "START TIME":
+		vr.Kind, vr.Str = expand.String, strconv.FormatInt(r.startTime.Unix(), 10)
+	case "EPOCHSECONDS":
+		vr.Kind, vr.Str = expand.String, strconv.FormatInt(time.Now().Unix(), 10)
+	case "EPOCHREALTIME":
+		// Always with a '.' as the decimal point, regardless of locale.
+		now := time.Now()
+		vr.Kind = expand.String
+		vr.Str = fmt.Sprintf("%d.%06d", now.Unix(), now.Nanosecond()/1000)
+	case "BASH_COMMAND":
+		vr.Kind = expand.String
+		if r.bashCommand != nil {
+			var buf bytes.Buffer
+			syntax.NewPrinter().Print(&buf, r.bashCommand)
+			vr.Str = buf.String()
+		}
 	case "DIRSTACK":
 		vr.Kind, vr.List = expand.Indexed, r.dirStack
+	case "PIPESTATUS":
+		vr.Kind = expand.Indexed
+		for _, code := range r.pipeStatus {
+			vr.List = append(vr.List, strconv.Itoa(code))
+		}
 	case "0":
 		vr.Kind = expand.String
 		if r.filename != "" {
@@ -108,23 +141,51 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 	if vr, e := r.Vars[name]; e {
 		return vr
 	}
+	if name == "COLUMNS" || name == "LINES" {
+		cols, rows := r.terminalSize()
+		n := cols
+		if name == "LINES" {
+			n = rows
+		}
+		if n > 0 {
+			return expand.Variable{Kind: expand.String, Str: strconv.Itoa(n)}
+		}
+	}
 	if vr := r.Env.Get(name); vr.IsSet() {
 		return vr
 	}
+	switch name {
+	case "COLUMNS":
+		return expand.Variable{Kind: expand.String, Str: "80"}
+	case "LINES":
+		return expand.Variable{Kind: expand.String, Str: "24"}
+	}
 	if runtime.GOOS == "windows" {
 		upper := strings.ToUpper(name)
 		if vr := r.Env.Get(upper); vr.IsSet() {
 			return vr
 		}
 	}
-	if r.opts[optNoUnset] {
-		r.errf("%s: unbound variable\n", name)
-		r.exit = 1
-		r.exitShell = true
-	}
 	return expand.Variable{}
 }
 
+// terminalSize returns the size of the terminal in columns and rows, or zero if
+// it's unknown. See TermSize.
+func (r *Runner) terminalSize() (cols, rows int) {
+	if r.termSize != nil {
+		return r.termSize()
+	}
+	for _, f := range [...]interface{}{r.stdout, r.stderr, r.stdin} {
+		// Support Fd methods such as the one on *os.File.
+		if f, ok := f.(interface{ Fd() uintptr }); ok {
+			if cols, rows, err := termSize(f.Fd()); err == nil {
+				return cols, rows
+			}
+		}
+	}
+	return 0, 0
+}
+
 func (r *Runner) envGet(name string) string {
 	return r.lookupVar(name).String()
 }
@@ -136,6 +197,9 @@ func (r *Runner) delVar(name string) {
 		r.exit = 1
 		return
 	}
+	if name == "PATH" {
+		r.hash = nil
+	}
 	if vr.Local {
 		// don't overwrite a non-local var with the same name
 		r.funcVars[name] = expand.Variable{}
@@ -149,12 +213,11 @@ func (r *Runner) setVarString(name, value string) {
 }
 
 func (r *Runner) setVarInternal(name string, vr expand.Variable) {
-	if vr.Kind == expand.String {
-		if r.opts[optAllExport] {
-			vr.Exported = true
-		}
-	} else {
-		vr.Exported = false
+	if name == "PATH" {
+		r.hash = nil // the remembered paths may no longer be valid
+	}
+	if vr.Kind == expand.String && r.opts[optAllExport] {
+		vr.Exported = true
 	}
 	if vr.Local {
 		if r.funcVars == nil {
@@ -177,6 +240,16 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr expand.Variable
 		name = name2
 		cur = var2
 	}
+	if cur.Local {
+		// e.g. "read" on a local variable should not set a global one
+		vr.Local = true
+	}
+	if cur.Integer {
+		vr.Integer = true
+	}
+	if vr.Integer {
+		vr = r.evalInteger(vr)
+	}
 
 	if vr.Kind == expand.String && index == nil {
 		// When assigning a string to an array, fall back to the
@@ -229,7 +302,36 @@ func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr expand.Variable
 	r.setVarInternal(name, cur)
 }
 
+// evalInteger evaluates the values of a variable with the integer attribute as
+// arithmetic expressions. Unset array elements are left alone.
+func (r *Runner) evalInteger(vr expand.Variable) expand.Variable {
+	switch vr.Kind {
+	case expand.String:
+		vr.Str = strconv.Itoa(r.arithmString(vr.Str))
+	case expand.Indexed:
+		list := make([]string, len(vr.List))
+		for i, elem := range vr.List {
+			if elem != "" {
+				list[i] = strconv.Itoa(r.arithmString(elem))
+			}
+		}
+		vr.List = list
+	case expand.Associative:
+		m := make(map[string]string, len(vr.Map))
+		for k, v := range vr.Map {
+			m[k] = strconv.Itoa(r.arithmString(v))
+		}
+		vr.Map = m
+	}
+	return vr
+}
+
 func (r *Runner) setFunc(name string, body *syntax.Stmt) {
+	if r.readOnlyFuncs[name] {
+		r.errf("%s: readonly function\n", name)
+		r.exit = 1
+		return
+	}
 	if r.Funcs == nil {
 		r.Funcs = make(map[string]*syntax.Stmt, 4)
 	}
@@ -248,9 +350,21 @@ func stringIndex(index syntax.ArithmExpr) bool {
 	return false
 }
 
-func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
-	prev := r.lookupVar(as.Name.Value)
+// assignVal returns the variable resulting from an assignment, given the
+// variable's previous value. valType is the option which declared its type, if
+// any, such as "-A" for an associative array.
+func (r *Runner) assignVal(prev expand.Variable, as *syntax.Assign, valType string) expand.Variable {
 	if as.Naked {
+		if prev.IsSet() {
+			return prev
+		}
+		switch valType {
+		case "-a":
+			prev.Kind = expand.Indexed
+		case "-A":
+			prev.Kind = expand.Associative
+			prev.Map = make(map[string]string)
+		}
 		return prev
 	}
 	if as.Value != nil {
@@ -265,6 +379,11 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 		}
 		switch prev.Kind {
 		case expand.String:
+			if prev.Integer {
+				// e.g. "declare -i n=3; n+=4" adds the numbers
+				prev.Str = strconv.Itoa(atoi(prev.Str) + r.arithmString(s))
+				break
+			}
 			prev.Str += s
 		case expand.Indexed:
 			if len(prev.List) == 0 {
@@ -288,42 +407,50 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 	elems := as.Array.Elems
 	if valType == "" {
 		valType = "-a" // indexed
-		if len(elems) > 0 && stringIndex(elems[0].Index) {
+		if prev.Kind == expand.Associative && as.Append {
+			valType = "-A"
+		} else if len(elems) > 0 && stringIndex(elems[0].Index) {
 			valType = "-A" // associative
 		}
 	}
 	if valType == "-A" {
 		amap := make(map[string]string, len(elems))
+		if as.Append && prev.Kind == expand.Associative {
+			// copy the map, as it may be shared with a
+			// variable in an outer scope
+			for k, v := range prev.Map {
+				amap[k] = v
+			}
+		}
 		for _, elem := range elems {
 			k := r.literal(elem.Index.(*syntax.Word))
 			amap[k] = r.literal(elem.Value)
 		}
-		if !as.Append {
-			prev.Kind = expand.Associative
-			prev.Map = amap
-			return prev
-		}
-		// TODO
+		prev.Kind = expand.Associative
+		prev.Map = amap
 		return prev
 	}
-	maxIndex := len(elems) - 1
-	indexes := make([]int, len(elems))
-	for i, elem := range elems {
-		if elem.Index == nil {
-			indexes[i] = i
-			continue
+	// Elements without an index are split into fields, like the arguments
+	// to a command, and each field goes after the previous element.
+	var strs []string
+	next := 0
+	for _, elem := range elems {
+		var values []string
+		if elem.Index != nil {
+			next = r.arithm(elem.Index)
+			values = []string{r.literal(elem.Value)}
+		} else {
+			values = r.fields(elem.Value)
 		}
-		k := r.arithm(elem.Index)
-		indexes[i] = k
-		if k > maxIndex {
-			maxIndex = k
+		for _, value := range values {
+			for len(strs) <= next {
+				strs = append(strs, "")
+			}
+			strs[next] = value
+			next++
 		}
 	}
-	strs := make([]string, maxIndex+1)
-	for i, elem := range elems {
-		strs[indexes[i]] = r.literal(elem.Value)
-	}
-	if !as.Append {
+	if !as.Append || !prev.IsSet() {
 		prev.Kind = expand.Indexed
 		prev.List = strs
 		return prev
@@ -333,9 +460,187 @@ func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 		prev.Kind = expand.Indexed
 		prev.List = append([]string{prev.Str}, strs...)
 	case expand.Indexed:
-		prev.List = append(prev.List, strs...)
-	case expand.Associative:
-		// TODO
+		// don't append in place, as the backing array may be shared
+		// with a variable in an outer scope
+		prev.List = append(prev.List[:len(prev.List):len(prev.List)], strs...)
 	}
 	return prev
 }
+
+// declareLocal makes a variable local to the running function, shadowing any
+// variable with the same name until the function returns. Declaring the same
+// local variable again in the same function is a no-op.
+//
+// It reports whether the variable is new, in which case it starts off unset.
+func (r *Runner) declareLocal(name string) bool {
+	if _, ok := r.funcShadowed[name]; ok {
+		return false
+	}
+	if r.funcShadowed == nil {
+		r.funcShadowed = make(map[string]*expand.Variable)
+	}
+	var prev *expand.Variable
+	if vr, ok := r.funcVars[name]; ok {
+		prev = &vr
+	}
+	r.funcShadowed[name] = prev
+	if r.funcVars == nil {
+		r.funcVars = make(map[string]expand.Variable)
+	}
+	r.funcVars[name] = expand.Variable{Local: true}
+	return true
+}
+
+// restoreLocals discards the local variables of the function which is
+// returning, restoring the variables they shadowed.
+func (r *Runner) restoreLocals() {
+	for name, prev := range r.funcShadowed {
+		if prev == nil {
+			delete(r.funcVars, name)
+		} else {
+			r.funcVars[name] = *prev
+		}
+	}
+}
+
+// eachVar calls a function for each of the set variables, sorted by name.
+func (r *Runner) eachVar(fn func(name string, vr expand.Variable)) {
+	// expandEnv.Each visits the environment, then the global variables,
+	// then the function's local ones, so the later ones shadow the others.
+	all := make(map[string]expand.Variable)
+	expandEnv{r}.Each(func(name string, vr expand.Variable) bool {
+		all[name] = vr
+		return true
+	})
+	names := make([]string, 0, len(all))
+	for name, vr := range all {
+		// Include variables which were declared without a value, like
+		// "local x" or "declare -x x".
+		if vr.IsSet() || vr.ReadOnly || vr.Exported || vr.Integer || vr.Local {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn(name, all[name])
+	}
+}
+
+// printVar prints a variable in the form used by "declare -p", which can be
+// read back by the shell.
+func (r *Runner) printVar(name string, vr expand.Variable) {
+	flags := ""
+	switch vr.Kind {
+	case expand.Indexed:
+		flags += "a"
+	case expand.Associative:
+		flags += "A"
+	case expand.NameRef:
+		flags += "n"
+	}
+	if vr.Integer {
+		flags += "i"
+	}
+	if vr.ReadOnly {
+		flags += "r"
+	}
+	if vr.Exported {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "-"
+	}
+	r.outf("declare -%s %s", flags, name)
+	if vr.IsSet() {
+		r.outf("=%s", declValue(vr, dblQuote))
+	}
+	r.out("\n")
+}
+
+// declValue formats the value of a set variable as printed by "declare", such
+// as "foo" or ([0]="foo"). Strings are quoted via quote, while array elements
+// are always double-quoted.
+func declValue(vr expand.Variable, quote func(string) string) string {
+	var buf bytes.Buffer
+	switch vr.Kind {
+	case expand.String, expand.NameRef:
+		buf.WriteString(quote(vr.Str))
+	case expand.Indexed:
+		buf.WriteString("(")
+		first := true
+		for i, elem := range vr.List {
+			if elem == "" && i < len(vr.List)-1 {
+				// Unset, as arrays are sparse. The last element
+				// is kept so that the length is preserved.
+				continue
+			}
+			if !first {
+				buf.WriteByte(' ')
+			}
+			first = false
+			fmt.Fprintf(&buf, "[%d]=%s", i, dblQuote(elem))
+		}
+		buf.WriteByte(')')
+	case expand.Associative:
+		keys := make([]string, 0, len(vr.Map))
+		for k := range vr.Map {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("(")
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "[%s]=%s ", declKey(k), dblQuote(vr.Map[k]))
+		}
+		buf.WriteByte(')')
+	}
+	return buf.String()
+}
+
+// declQuote quotes a string as listed by "declare" with no options. Unlike
+// syntax.Quote, it leaves an empty string as-is, like Bash.
+func declQuote(s string) string {
+	if s == "" {
+		return ""
+	}
+	return syntax.Quote(s)
+}
+
+// declKey formats the key of an associative array as printed by "declare -p".
+// Keys made up of letters, digits, and underscores are left unquoted, like in
+// Bash. Any other key is quoted, as it could otherwise be read back as an
+// arithmetic expression, such as "a+b".
+func declKey(k string) string {
+	for _, r := range k {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '_':
+		default:
+			return dblQuote(k)
+		}
+	}
+	if k == "" {
+		return `""`
+	}
+	return k
+}
+
+// dblQuote quotes a string with double quotes, so that the shell reads it back
+// verbatim. Like in Bash, strings with non-printable characters such as
+// newlines are quoted with $'...' instead, so that they fit in a single line.
+func dblQuote(s string) string {
+	for _, r := range s {
+		if r == utf8.RuneError || !unicode.IsPrint(r) {
+			return syntax.Quote(s)
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"', '\\', '$', '`':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
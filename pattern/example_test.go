@@ -52,3 +52,18 @@ func ExampleQuoteMeta() {
 	// false
 	// true
 }
+
+func ExampleMatch() {
+	const mode = pattern.ExtendedGlob
+	for _, name := range []string{"main.go", "main.c", "README"} {
+		ok, err := pattern.Match("!(*.go|*.c)", name, mode)
+		if err != nil {
+			return
+		}
+		fmt.Println(name, ok)
+	}
+	// Output:
+	// main.go false
+	// main.c false
+	// README true
+}
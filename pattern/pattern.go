@@ -14,6 +14,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Mode can be used to supply a number of options to the package's functions.
@@ -21,9 +23,11 @@ import (
 type Mode uint
 
 const (
-	Shortest  Mode = 1 << iota // prefer the shortest match.
-	Filenames                  // "*" and "?" don't match slashes; only "**" does
-	Braces                     // support "{a,b}" and "{1..4}"
+	Shortest     Mode = 1 << iota // prefer the shortest match.
+	Filenames                     // "*" and "?" don't match slashes; only "**" does
+	Braces                        // support "{a,b}" and "{1..4}"
+	NoCase                        // match letters regardless of their case
+	ExtendedGlob                  // support "?(a|b)", "*(a)", "+(a)", "@(a)", and "!(a)"
 )
 
 var numRange = regexp.MustCompile(`^([+-]?\d+)\.\.([+-]?\d+)}`)
@@ -37,7 +41,17 @@ var numRange = regexp.MustCompile(`^([+-]?\d+)\.\.([+-]?\d+)}`)
 // Note that this function (and QuoteMeta) should not be directly used with file
 // paths if Windows is supported, as the path separator on that platform is the
 // same character as the escaping character for shell patterns.
+//
+// With ExtendedGlob, negated groups like "!(foo)" return an error, as they
+// cannot be expressed as a regular expression. Match supports them.
 func Regexp(pat string, mode Mode) (string, error) {
+	if mode&NoCase != 0 {
+		expr, err := Regexp(pat, mode&^NoCase)
+		if err != nil {
+			return "", err
+		}
+		return "(?i)" + expr, nil
+	}
 	any := false
 noopLoop:
 	for _, r := range pat {
@@ -57,6 +71,36 @@ noopLoop:
 	var buf bytes.Buffer
 writeLoop:
 	for i := 0; i < len(pat); i++ {
+		if mode&ExtendedGlob != 0 && isExtGlob(pat[i:]) {
+			op := pat[i]
+			if op == '!' {
+				return "", fmt.Errorf("!( cannot be translated to a regular expression")
+			}
+			alts, end := extGlobGroup(pat[i+1:])
+			if end < 0 {
+				return "", fmt.Errorf("%c( was not matched with a closing )", op)
+			}
+			buf.WriteString("(?:")
+			for j, alt := range alts {
+				if j > 0 {
+					buf.WriteByte('|')
+				}
+				expr, err := Regexp(alt, mode)
+				if err != nil {
+					return "", err
+				}
+				buf.WriteString(expr)
+			}
+			buf.WriteByte(')')
+			if op != '@' {
+				buf.WriteByte(op)
+				if mode&Shortest != 0 {
+					buf.WriteByte('?')
+				}
+			}
+			i += end + 1
+			continue
+		}
 		switch c := pat[i]; c {
 		case '*':
 			if mode&Filenames != 0 {
@@ -89,68 +133,23 @@ writeLoop:
 			}
 			buf.WriteString(regexp.QuoteMeta(string(pat[i])))
 		case '[':
-			name, err := charClass(pat[i:])
-			if err != nil {
-				return "", err
-			}
-			if name != "" {
-				buf.WriteString(name)
-				i += len(name) - 1
-				break
-			}
 			if mode&Filenames != 0 {
-				for _, c := range pat[i:] {
-					if c == ']' {
-						break
-					} else if c == '/' {
-						buf.WriteString("\\[")
-						continue writeLoop
-					}
-				}
-			}
-			buf.WriteByte(c)
-			if i++; i >= len(pat) {
-				return "", fmt.Errorf("[ was not matched with a closing ]")
-			}
-			switch c = pat[i]; c {
-			case '!', '^':
-				buf.WriteByte('^')
-				if i++; i >= len(pat) {
-					return "", fmt.Errorf("[ was not matched with a closing ]")
-				}
-			}
-			if c = pat[i]; c == ']' {
-				buf.WriteByte(']')
-				if i++; i >= len(pat) {
-					return "", fmt.Errorf("[ was not matched with a closing ]")
+				// A bracket expression can't match a slash.
+				end := bracketEnd(pat[i:])
+				if end < 0 {
+					end = len(pat) - i
 				}
-			}
-			rangeStart := byte(0)
-		loopBracket:
-			for ; i < len(pat); i++ {
-				c = pat[i]
-				buf.WriteByte(c)
-				switch c {
-				case '\\':
-					if i++; i < len(pat) {
-						buf.WriteByte(pat[i])
-					}
-					continue
-				case ']':
-					break loopBracket
-				}
-				if rangeStart != 0 && rangeStart > c {
-					return "", fmt.Errorf("invalid range: %c-%c", rangeStart, c)
-				}
-				if c == '-' {
-					rangeStart = pat[i-1]
-				} else {
-					rangeStart = 0
+				if strings.Contains(pat[i:i+end], "/") {
+					buf.WriteString("\\[")
+					break
 				}
 			}
-			if i >= len(pat) {
-				return "", fmt.Errorf("[ was not matched with a closing ]")
+			expr, size, err := bracket(pat[i:])
+			if err != nil {
+				return "", err
 			}
+			buf.WriteString(expr)
+			i += size - 1
 		case '{':
 			if mode&Braces == 0 {
 				buf.WriteString(regexp.QuoteMeta(string(c)))
@@ -222,26 +221,161 @@ writeLoop:
 	return buf.String(), nil
 }
 
-func charClass(s string) (string, error) {
-	if strings.HasPrefix(s, "[[.") || strings.HasPrefix(s, "[[=") {
-		return "", fmt.Errorf("collating features not available")
+// isExtGlob reports whether s starts with an extended glob operator, such as
+// "@(".
+func isExtGlob(s string) bool {
+	return len(s) > 1 && s[1] == '(' && strings.IndexByte("?*+@!", s[0]) >= 0
+}
+
+// extGlobGroup splits the contents of an extended glob group starting with
+// "(" into its alternatives, and returns the index of the closing ")". The
+// index is negative if the group isn't closed.
+func extGlobGroup(s string) (alts []string, end int) {
+	level := 0
+	start := 1
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			if j := bracketEnd(s[i:]); j > 0 {
+				i += j
+			}
+		case '(':
+			level++
+		case '|':
+			if level == 1 {
+				alts = append(alts, s[start:i])
+				start = i + 1
+			}
+		case ')':
+			if level--; level == 0 {
+				return append(alts, s[start:i]), i
+			}
+		}
+	}
+	return nil, -1
+}
+
+// bracket translates the bracket expression at the start of pat, such as
+// "[!a-z]" or "[[:digit:]_]", into a character class for a regular expression.
+// It also returns the length of the bracket expression.
+//
+// Like in Bash, "!" or "^" at the start negates the expression, a "]" right
+// after them or the opening "[" is a literal, as is a "-" at either end.
+func bracket(pat string) (expr string, size int, err error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	i := 1
+	if i < len(pat) && (pat[i] == '!' || pat[i] == '^') {
+		buf.WriteByte('^')
+		i++
+	}
+	if i < len(pat) && pat[i] == ']' {
+		buf.WriteByte(']')
+		i++
+	}
+	var rangeStart, last rune
+	for i < len(pat) {
+		r, w := utf8.DecodeRuneInString(pat[i:])
+		switch r {
+		case ']':
+			buf.WriteByte(']')
+			return buf.String(), i + 1, nil
+		case '\\':
+			if i+w >= len(pat) {
+				return "", 0, fmt.Errorf("[ was not matched with a closing ]")
+			}
+			i += w
+			r, w = utf8.DecodeRuneInString(pat[i:])
+			if r < utf8.RuneSelf && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				// Escaped punctuation like "\-" is always a literal.
+				buf.WriteByte('\\')
+			}
+			buf.WriteRune(r)
+		case '[':
+			if strings.HasPrefix(pat[i:], "[.") || strings.HasPrefix(pat[i:], "[=") {
+				return "", 0, fmt.Errorf("collating features not available")
+			}
+			name, err := charClass(pat[i:])
+			if err != nil {
+				return "", 0, err
+			}
+			if name != "" {
+				if rangeStart != 0 {
+					return "", 0, fmt.Errorf("invalid range: %c-[:%s:]", rangeStart, name)
+				}
+				class := pat[i : i+len(name)+4]
+				buf.WriteString(class)
+				i += len(class)
+				rangeStart, last = 0, 0
+				continue
+			}
+			if strings.HasPrefix(pat[i:], "[:") {
+				// Not a class, so don't let regexp see one.
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte('[')
+		default:
+			buf.WriteRune(r)
+		}
+		if rangeStart != 0 && rangeStart > r {
+			return "", 0, fmt.Errorf("invalid range: %c-%c", rangeStart, r)
+		}
+		if r == '-' && last != 0 && pat[i-1] != '\\' {
+			rangeStart = last
+		} else {
+			rangeStart = 0
+		}
+		last = r
+		i += w
+	}
+	return "", 0, fmt.Errorf("[ was not matched with a closing ]")
+}
+
+// bracketEnd returns the index of the "]" closing the bracket expression at
+// the start of s, or a negative index if there is none.
+func bracketEnd(s string) int {
+	i := 1
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		i++
 	}
-	if !strings.HasPrefix(s, "[[:") {
+	if i < len(s) && s[i] == ']' {
+		i++
+	}
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			if name, _ := charClass(s[i:]); name != "" {
+				i += len(name) + 3
+			}
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// charClass returns the name of the character class at the start of s, such as
+// "digit" for "[:digit:]". The name is empty if s doesn't start with a class.
+func charClass(s string) (string, error) {
+	if !strings.HasPrefix(s, "[:") {
 		return "", nil
 	}
-	name := s[3:]
-	end := strings.Index(name, ":]]")
+	end := strings.Index(s[2:], ":]")
 	if end < 0 {
-		return "", fmt.Errorf("[[: was not matched with a closing :]]")
+		return "", nil
 	}
-	name = name[:end]
+	name := s[2 : 2+end]
 	switch name {
 	case "alnum", "alpha", "ascii", "blank", "cntrl", "digit", "graph",
 		"lower", "print", "punct", "space", "upper", "word", "xdigit":
 	default:
 		return "", fmt.Errorf("invalid character class: %q", name)
 	}
-	return s[:len(name)+6], nil
+	return name, nil
 }
 
 // HasMeta returns whether a string contains any unescaped pattern
@@ -265,6 +399,10 @@ func HasMeta(pat string, mode Mode) bool {
 			if mode&Braces != 0 {
 				return true
 			}
+		case '+', '@', '!':
+			if mode&ExtendedGlob != 0 && isExtGlob(pat[i:]) {
+				return true
+			}
 		}
 	}
 	return false
@@ -283,7 +421,14 @@ loop:
 			if mode&Braces == 0 {
 				continue
 			}
-			fallthrough
+			any = true
+			break loop
+		case '(', ')', '|':
+			if mode&ExtendedGlob == 0 {
+				continue
+			}
+			any = true
+			break loop
 		case '*', '?', '[', '\\':
 			any = true
 			break loop
@@ -301,8 +446,114 @@ loop:
 			if mode&Braces != 0 {
 				buf.WriteByte('\\')
 			}
+		case '(', ')', '|':
+			if mode&ExtendedGlob != 0 {
+				buf.WriteByte('\\')
+			}
 		}
 		buf.WriteRune(r)
 	}
 	return buf.String()
 }
+
+// Match reports whether name matches the shell pattern pat in its entirety,
+// like the pattern in a case clause or on the right of == in [[. Unlike
+// filepath.Match, it follows the shell's pattern notation, including character
+// classes such as "[[:digit:]]" and, with ExtendedGlob, extended globs.
+//
+// Negated groups such as "!(foo)" are supported, as long as they aren't nested
+// inside other extended glob groups. The Shortest mode has no effect.
+func Match(pat, name string, mode Mode) (bool, error) {
+	match, err := compileMatch(pat, mode&^Shortest)
+	if err != nil {
+		return false, err
+	}
+	return match(name), nil
+}
+
+// compileMatch returns a function reporting whether a string matches pat in
+// its entirety. Patterns without negated groups are a single regular
+// expression; otherwise, a negated group can match any substring which doesn't
+// match its alternatives, so all the ways to split the string are tried.
+func compileMatch(pat string, mode Mode) (func(string) bool, error) {
+	start, end := -1, -1
+	if mode&ExtendedGlob != 0 {
+		start, end = negatedGroup(pat)
+	}
+	if start < 0 {
+		expr, err := Regexp(pat, mode)
+		if err != nil {
+			return nil, err
+		}
+		rx, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, err
+		}
+		return rx.MatchString, nil
+	}
+	prefix, err := compileMatch(pat[:start], mode)
+	if err != nil {
+		return nil, err
+	}
+	negated, err := compileMatch("@"+pat[start+1:end+1], mode)
+	if err != nil {
+		return nil, err
+	}
+	suffix, err := compileMatch(pat[end+1:], mode)
+	if err != nil {
+		return nil, err
+	}
+	return func(name string) bool {
+		for i := 0; i <= len(name); i++ {
+			if i < len(name) && !utf8.RuneStart(name[i]) {
+				continue
+			}
+			if !prefix(name[:i]) {
+				continue
+			}
+			for j := i; j <= len(name); j++ {
+				if j < len(name) && !utf8.RuneStart(name[j]) {
+					continue
+				}
+				part := name[i:j]
+				if mode&Filenames != 0 && strings.Contains(part, "/") {
+					break
+				}
+				if !negated(part) && suffix(name[j:]) {
+					return true
+				}
+			}
+		}
+		return false
+	}, nil
+}
+
+// negatedGroup returns the indexes of the "!" and ")" delimiting the first
+// negated group in pat, skipping any nested inside other extended glob groups.
+// The indexes are negative if there is no such group.
+func negatedGroup(pat string) (start, end int) {
+	for i := 0; i < len(pat); i++ {
+		switch pat[i] {
+		case '\\':
+			i++
+			continue
+		case '[':
+			if j := bracketEnd(pat[i:]); j > 0 {
+				i += j
+			}
+			continue
+		}
+		if !isExtGlob(pat[i:]) {
+			continue
+		}
+		_, j := extGlobGroup(pat[i+1:])
+		if j < 0 {
+			break
+		}
+		if pat[i] == '!' {
+			return i, i + 1 + j
+		}
+		i += j + 1
+	}
+	return -1, -1
+}
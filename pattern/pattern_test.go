@@ -82,6 +82,31 @@ var translateTests = []struct {
 	{pat: `[[:wrong:]]`, wantErr: true},
 	{pat: `[[=x=]]`, wantErr: true},
 	{pat: `[[.x.]]`, wantErr: true},
+	{pat: `[[:digit:]a]`, want: `[[:digit:]a]`},
+	{pat: `[_[:alpha:][:digit:]]`, want: `[_[:alpha:][:digit:]]`},
+	{pat: `[![:space:]]`, want: `[^[:space:]]`},
+	{pat: `[[:digit:]-a]`, want: `[[:digit:]-a]`},
+	{pat: `[a-[:digit:]]`, wantErr: true},
+	{pat: `[a\-z]`, want: `[a\-z]`},
+	{pat: `[\a]`, want: `[a]`},
+	{pat: `[[:]`, want: `[\[:]`},
+	{pat: `[é-ü]`, want: `[é-ü]`},
+	{pat: `[ü-é]`, wantErr: true},
+	{pat: `[[:digit:]]`, mode: Filenames, want: `[[:digit:]]`},
+	{pat: `foo`, mode: NoCase, want: `(?i)foo`},
+	{pat: `[a-c]*`, mode: NoCase, want: `(?i)[a-c].*`},
+	{pat: `@(a|b)`, want: `@\(a\|b\)`},
+	{pat: `@(a|b)`, mode: ExtendedGlob, want: `(?:a|b)`},
+	{pat: `?(a)`, mode: ExtendedGlob, want: `(?:a)?`},
+	{pat: `*(a)`, mode: ExtendedGlob, want: `(?:a)*`},
+	{pat: `*(a)`, mode: ExtendedGlob | Shortest, want: `(?:a)*?`},
+	{pat: `+(a*|b?)`, mode: ExtendedGlob, want: `(?:a.*|b.)+`},
+	{pat: `x@(a|+(b|c))`, mode: ExtendedGlob, want: `x(?:a|(?:b|c)+)`},
+	{pat: `@(a|\))`, mode: ExtendedGlob, want: `(?:a|\))`},
+	{pat: `@([|)])`, mode: ExtendedGlob, want: `(?:[|)])`},
+	{pat: `@([[:alpha:]])`, mode: ExtendedGlob, want: `(?:[[:alpha:]])`},
+	{pat: `@(a`, mode: ExtendedGlob, wantErr: true},
+	{pat: `!(a)`, mode: ExtendedGlob, wantErr: true},
 }
 
 func TestRegexp(t *testing.T) {
@@ -121,6 +146,10 @@ var metaTests = []struct {
 	{`\[`, 0, false, `\\\[`},
 	{`{`, 0, false, `{`},
 	{`{`, Braces, true, `\{`},
+	{`@(a)`, 0, false, `@(a)`},
+	{`@(a|b)`, ExtendedGlob, true, `@\(a\|b\)`},
+	{`!(a)`, ExtendedGlob, true, `!\(a\)`},
+	{`a!b`, ExtendedGlob, false, `a!b`},
 }
 
 func TestMeta(t *testing.T) {
@@ -136,3 +165,72 @@ func TestMeta(t *testing.T) {
 		}
 	}
 }
+
+var matchTests = []struct {
+	pat     string
+	mode    Mode
+	name    string
+	want    bool
+	wantErr bool
+}{
+	{pat: ``, name: ``, want: true},
+	{pat: `foo`, name: `foo`, want: true},
+	{pat: `foo`, name: `foobar`, want: false},
+	{pat: `f*`, name: `foobar`, want: true},
+	{pat: `f*`, mode: Shortest, name: `foobar`, want: true},
+	{pat: `*`, mode: Filenames, name: `a/b`, want: false},
+	{pat: `[[:digit:]]?`, name: `1a`, want: true},
+	{pat: `[`, wantErr: true},
+	{pat: `[[:digit:]]`, name: `5`, want: true},
+	{pat: `[[:digit:]]`, name: `a`, want: false},
+	{pat: `[!a-z]`, name: `b`, want: false},
+	{pat: `[!a-z]`, name: `B`, want: true},
+	{pat: `[^a-z]`, name: `-`, want: true},
+	{pat: `[]a]`, name: `]`, want: true},
+	{pat: `[]a]`, name: `a`, want: true},
+	{pat: `[]a]`, name: `b`, want: false},
+	{pat: `[!]a]`, name: `]`, want: false},
+	{pat: `[a-]`, name: `-`, want: true},
+	{pat: `[-a]`, name: `-`, want: true},
+	{pat: `[a\-z]`, name: `m`, want: false},
+	{pat: `[x[:digit:]]`, name: `7`, want: true},
+	{pat: `[![:alpha:]_]`, name: `_`, want: false},
+	{pat: `[![:alpha:]_]`, name: `%`, want: true},
+	{pat: `FOO`, name: `foo`, want: false},
+	{pat: `FOO`, mode: NoCase, name: `foo`, want: true},
+	{pat: `[A-C]x`, mode: NoCase, name: `bX`, want: true},
+	{pat: `@(foo|bar)`, name: `foo`, want: false},
+	{pat: `@(foo|bar)`, mode: ExtendedGlob, name: `bar`, want: true},
+	{pat: `+(ab)`, mode: ExtendedGlob, name: `ababab`, want: true},
+	{pat: `x?(a)y`, mode: ExtendedGlob, name: `xaay`, want: false},
+	{pat: `!(foo)`, mode: ExtendedGlob, name: `foo`, want: false},
+	{pat: `!(foo)`, mode: ExtendedGlob, name: `fooo`, want: true},
+	{pat: `!(foo)`, mode: ExtendedGlob, name: ``, want: true},
+	{pat: `a!(b)c`, mode: ExtendedGlob, name: `abc`, want: false},
+	{pat: `a!(b)c`, mode: ExtendedGlob, name: `abbc`, want: true},
+	{pat: `!(*.go|*.c)`, mode: ExtendedGlob, name: `main.c`, want: false},
+	{pat: `!(*.go|*.c)`, mode: ExtendedGlob, name: `main.sh`, want: true},
+	{pat: `!(a)!(b)`, mode: ExtendedGlob, name: `ab`, want: true},
+	{pat: `!(a)`, mode: ExtendedGlob | Filenames, name: `b/c`, want: false},
+	{pat: `!(foo)`, mode: ExtendedGlob | NoCase, name: `FOO`, want: false},
+	{pat: `!(é)`, mode: ExtendedGlob, name: `é`, want: false},
+	{pat: `@(a|!(b))`, mode: ExtendedGlob, wantErr: true},
+	{pat: `!(a`, mode: ExtendedGlob, wantErr: true},
+}
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+	for _, tc := range matchTests {
+		got, gotErr := Match(tc.pat, tc.name, tc.mode)
+		if tc.wantErr && gotErr == nil {
+			t.Errorf("Match(%q, %q, %b) did not error", tc.pat, tc.name, tc.mode)
+		}
+		if !tc.wantErr && gotErr != nil {
+			t.Errorf("Match(%q, %q, %b) errored with %q", tc.pat, tc.name, tc.mode, gotErr)
+		}
+		if got != tc.want {
+			t.Errorf("Match(%q, %q, %b) got %t, wanted %t",
+				tc.pat, tc.name, tc.mode, got, tc.want)
+		}
+	}
+}
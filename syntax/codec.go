@@ -0,0 +1,1231 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// codecVersion is written at the start of the encoding, so that Decode can
+// reject input written by an incompatible version of Encode.
+const codecVersion = 1
+
+// The tags which precede the nodes held by interfaces such as Command or
+// WordPart. Their values are part of the encoding, so they must only be
+// appended to.
+const (
+	tagNil = iota
+	tagCallExpr
+	tagIfClause
+	tagWhileClause
+	tagForClause
+	tagCaseClause
+	tagBlock
+	tagSubshell
+	tagBinaryCmd
+	tagFuncDecl
+	tagArithmCmd
+	tagTestClause
+	tagDeclClause
+	tagLetClause
+	tagTimeClause
+	tagCoprocClause
+	tagWordIter
+	tagCStyleLoop
+	tagLit
+	tagSglQuoted
+	tagDblQuoted
+	tagParamExp
+	tagCmdSubst
+	tagArithmExp
+	tagProcSubst
+	tagExtGlob
+	tagBraceExp
+	tagBinaryArithm
+	tagUnaryArithm
+	tagParenArithm
+	tagWord
+	tagBinaryTest
+	tagUnaryTest
+	tagParenTest
+)
+
+var errCodecTrunc = errors.New("invalid or truncated encoding")
+
+// Encode writes a compact binary encoding of a syntax tree to w, which Decode
+// can turn back into an identical tree, positions and comments included. This
+// is useful to cache parsed programs, as decoding is faster than parsing.
+//
+// The encoding is not stable; it is only meant to be decoded by the same
+// version of this package.
+func Encode(w io.Writer, f *File) error {
+	e := encoder{}
+	e.uint(codecVersion)
+	e.file(f)
+	_, err := w.Write(e.buf)
+	return err
+}
+
+// Decode reads a syntax tree written by Encode.
+func Decode(r io.Reader) (*File, error) {
+	// Read the input as a string, so that decoded strings can share it.
+	var sb strings.Builder
+	if _, err := io.Copy(&sb, r); err != nil {
+		return nil, err
+	}
+	d := decoder{data: sb.String()}
+	if v := d.uint(); d.err == nil && v != codecVersion {
+		return nil, fmt.Errorf("unsupported encoding version %d", v)
+	}
+	f := d.file()
+	if d.err == nil && d.left() > 0 {
+		d.err = fmt.Errorf("%d bytes of trailing data", d.left())
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return f, nil
+}
+
+// encoder appends the encoding of nodes to a buffer. Non-nil pointers are
+// preceded by a one, and nil ones are a single zero. Slices are preceded by
+// their length plus one, so that a nil slice is kept apart from an empty one.
+type encoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) uint(n uint64) {
+	if n < 0x80 {
+		e.buf = append(e.buf, byte(n))
+		return
+	}
+	i := binary.PutUvarint(e.scratch[:], n)
+	e.buf = append(e.buf, e.scratch[:i]...)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// present encodes whether a pointer is non-nil, and returns that.
+func (e *encoder) present(ok bool) bool {
+	e.bool(ok)
+	return ok
+}
+
+// sliceLen encodes the length of a slice, and reports whether it is non-nil.
+func (e *encoder) sliceLen(n int, isNil bool) bool {
+	if isNil {
+		e.uint(0)
+		return false
+	}
+	e.uint(uint64(n) + 1)
+	return true
+}
+
+func (e *encoder) str(s string) {
+	e.uint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) pos(p Pos) {
+	e.uint(uint64(p.offs))
+	e.uint(uint64(p.line))
+	e.uint(uint64(p.col))
+}
+
+func (e *encoder) file(f *File) {
+	if !e.present(f != nil) {
+		return
+	}
+	e.str(f.Name)
+	e.stmts(f.Stmts)
+	e.comments(f.Last)
+}
+
+func (e *encoder) comments(cs []Comment) {
+	if e.sliceLen(len(cs), cs == nil) {
+		for _, c := range cs {
+			e.pos(c.Hash)
+			e.str(c.Text)
+		}
+	}
+}
+
+func (e *encoder) stmts(stmts []*Stmt) {
+	if e.sliceLen(len(stmts), stmts == nil) {
+		for _, s := range stmts {
+			e.stmt(s)
+		}
+	}
+}
+
+func (e *encoder) stmt(s *Stmt) {
+	if !e.present(s != nil) {
+		return
+	}
+	e.comments(s.Comments)
+	e.command(s.Cmd)
+	e.pos(s.Position)
+	e.pos(s.Semicolon)
+	e.bool(s.Negated)
+	e.bool(s.Background)
+	e.bool(s.Coprocess)
+	if e.sliceLen(len(s.Redirs), s.Redirs == nil) {
+		for _, r := range s.Redirs {
+			e.redirect(r)
+		}
+	}
+}
+
+func (e *encoder) redirect(r *Redirect) {
+	if !e.present(r != nil) {
+		return
+	}
+	e.pos(r.OpPos)
+	e.uint(uint64(r.Op))
+	e.lit(r.N)
+	e.word(r.Word)
+	e.word(r.Hdoc)
+}
+
+func (e *encoder) assigns(as []*Assign) {
+	if !e.sliceLen(len(as), as == nil) {
+		return
+	}
+	for _, a := range as {
+		if !e.present(a != nil) {
+			continue
+		}
+		e.bool(a.Append)
+		e.bool(a.Naked)
+		e.lit(a.Name)
+		e.arithm(a.Index)
+		e.word(a.Value)
+		e.arrayExpr(a.Array)
+	}
+}
+
+func (e *encoder) arrayExpr(a *ArrayExpr) {
+	if !e.present(a != nil) {
+		return
+	}
+	e.pos(a.Lparen)
+	e.pos(a.Rparen)
+	if e.sliceLen(len(a.Elems), a.Elems == nil) {
+		for _, elem := range a.Elems {
+			if !e.present(elem != nil) {
+				continue
+			}
+			e.arithm(elem.Index)
+			e.word(elem.Value)
+			e.comments(elem.Comments)
+		}
+	}
+	e.comments(a.Last)
+}
+
+func (e *encoder) command(cmd Command) {
+	switch x := cmd.(type) {
+	case nil:
+		e.uint(tagNil)
+	case *CallExpr:
+		e.uint(tagCallExpr)
+		e.assigns(x.Assigns)
+		e.words(x.Args)
+	case *IfClause:
+		e.uint(tagIfClause)
+		e.ifClause(x)
+	case *WhileClause:
+		e.uint(tagWhileClause)
+		e.pos(x.WhilePos)
+		e.pos(x.DoPos)
+		e.pos(x.DonePos)
+		e.bool(x.Until)
+		e.stmts(x.Cond)
+		e.comments(x.CondLast)
+		e.stmts(x.Do)
+		e.comments(x.DoLast)
+	case *ForClause:
+		e.uint(tagForClause)
+		e.pos(x.ForPos)
+		e.pos(x.DoPos)
+		e.pos(x.DonePos)
+		e.bool(x.Select)
+		e.bool(x.Braces)
+		e.loop(x.Loop)
+		e.stmts(x.Do)
+		e.comments(x.DoLast)
+	case *CaseClause:
+		e.uint(tagCaseClause)
+		e.pos(x.Case)
+		e.pos(x.In)
+		e.pos(x.Esac)
+		e.bool(x.Braces)
+		e.word(x.Word)
+		if e.sliceLen(len(x.Items), x.Items == nil) {
+			for _, ci := range x.Items {
+				if !e.present(ci != nil) {
+					continue
+				}
+				e.uint(uint64(ci.Op))
+				e.pos(ci.OpPos)
+				e.comments(ci.Comments)
+				e.words(ci.Patterns)
+				e.stmts(ci.Stmts)
+				e.comments(ci.Last)
+			}
+		}
+		e.comments(x.Last)
+	case *Block:
+		e.uint(tagBlock)
+		e.pos(x.Lbrace)
+		e.pos(x.Rbrace)
+		e.stmts(x.Stmts)
+		e.comments(x.Last)
+	case *Subshell:
+		e.uint(tagSubshell)
+		e.pos(x.Lparen)
+		e.pos(x.Rparen)
+		e.stmts(x.Stmts)
+		e.comments(x.Last)
+	case *BinaryCmd:
+		e.uint(tagBinaryCmd)
+		e.pos(x.OpPos)
+		e.uint(uint64(x.Op))
+		e.stmt(x.X)
+		e.stmt(x.Y)
+	case *FuncDecl:
+		e.uint(tagFuncDecl)
+		e.pos(x.Position)
+		e.bool(x.RsrvWord)
+		e.lit(x.Name)
+		e.stmt(x.Body)
+	case *ArithmCmd:
+		e.uint(tagArithmCmd)
+		e.pos(x.Left)
+		e.pos(x.Right)
+		e.bool(x.Unsigned)
+		e.arithm(x.X)
+	case *TestClause:
+		e.uint(tagTestClause)
+		e.pos(x.Left)
+		e.pos(x.Right)
+		e.test(x.X)
+	case *DeclClause:
+		e.uint(tagDeclClause)
+		e.lit(x.Variant)
+		e.assigns(x.Args)
+	case *LetClause:
+		e.uint(tagLetClause)
+		e.pos(x.Let)
+		if e.sliceLen(len(x.Exprs), x.Exprs == nil) {
+			for _, expr := range x.Exprs {
+				e.arithm(expr)
+			}
+		}
+	case *TimeClause:
+		e.uint(tagTimeClause)
+		e.pos(x.Time)
+		e.bool(x.PosixFormat)
+		e.stmt(x.Stmt)
+	case *CoprocClause:
+		e.uint(tagCoprocClause)
+		e.pos(x.Coproc)
+		e.word(x.Name)
+		e.stmt(x.Stmt)
+	default:
+		panic(fmt.Sprintf("unexpected command node: %T", x))
+	}
+}
+
+func (e *encoder) ifClause(x *IfClause) {
+	if !e.present(x != nil) {
+		return
+	}
+	e.pos(x.Position)
+	e.pos(x.ThenPos)
+	e.pos(x.FiPos)
+	e.stmts(x.Cond)
+	e.comments(x.CondLast)
+	e.stmts(x.Then)
+	e.comments(x.ThenLast)
+	e.ifClause(x.Else)
+	e.comments(x.Last)
+}
+
+func (e *encoder) loop(loop Loop) {
+	switch x := loop.(type) {
+	case nil:
+		e.uint(tagNil)
+	case *WordIter:
+		e.uint(tagWordIter)
+		e.lit(x.Name)
+		e.pos(x.InPos)
+		e.words(x.Items)
+	case *CStyleLoop:
+		e.uint(tagCStyleLoop)
+		e.pos(x.Lparen)
+		e.pos(x.Rparen)
+		e.arithm(x.Init)
+		e.arithm(x.Cond)
+		e.arithm(x.Post)
+	default:
+		panic(fmt.Sprintf("unexpected loop node: %T", x))
+	}
+}
+
+func (e *encoder) lit(l *Lit) {
+	if !e.present(l != nil) {
+		return
+	}
+	e.pos(l.ValuePos)
+	e.pos(l.ValueEnd)
+	e.str(l.Value)
+}
+
+func (e *encoder) words(ws []*Word) {
+	if e.sliceLen(len(ws), ws == nil) {
+		for _, w := range ws {
+			e.word(w)
+		}
+	}
+}
+
+func (e *encoder) word(w *Word) {
+	if e.present(w != nil) {
+		e.wordParts(w.Parts)
+	}
+}
+
+func (e *encoder) wordParts(parts []WordPart) {
+	if e.sliceLen(len(parts), parts == nil) {
+		for _, part := range parts {
+			e.wordPart(part)
+		}
+	}
+}
+
+func (e *encoder) wordPart(part WordPart) {
+	switch x := part.(type) {
+	case nil:
+		e.uint(tagNil)
+	case *Lit:
+		e.uint(tagLit)
+		e.lit(x)
+	case *SglQuoted:
+		e.uint(tagSglQuoted)
+		e.pos(x.Left)
+		e.pos(x.Right)
+		e.bool(x.Dollar)
+		e.str(x.Value)
+	case *DblQuoted:
+		e.uint(tagDblQuoted)
+		e.pos(x.Left)
+		e.pos(x.Right)
+		e.bool(x.Dollar)
+		e.wordParts(x.Parts)
+	case *ParamExp:
+		e.uint(tagParamExp)
+		e.paramExp(x)
+	case *CmdSubst:
+		e.uint(tagCmdSubst)
+		e.pos(x.Left)
+		e.pos(x.Right)
+		e.stmts(x.Stmts)
+		e.comments(x.Last)
+		e.bool(x.Backquotes)
+		e.bool(x.TempFile)
+		e.bool(x.ReplyVar)
+	case *ArithmExp:
+		e.uint(tagArithmExp)
+		e.pos(x.Left)
+		e.pos(x.Right)
+		e.bool(x.Bracket)
+		e.bool(x.Unsigned)
+		e.arithm(x.X)
+	case *ProcSubst:
+		e.uint(tagProcSubst)
+		e.pos(x.OpPos)
+		e.pos(x.Rparen)
+		e.uint(uint64(x.Op))
+		e.stmts(x.Stmts)
+		e.comments(x.Last)
+	case *ExtGlob:
+		e.uint(tagExtGlob)
+		e.pos(x.OpPos)
+		e.uint(uint64(x.Op))
+		e.lit(x.Pattern)
+	case *BraceExp:
+		e.uint(tagBraceExp)
+		e.bool(x.Sequence)
+		e.words(x.Elems)
+	default:
+		panic(fmt.Sprintf("unexpected word part node: %T", x))
+	}
+}
+
+func (e *encoder) paramExp(x *ParamExp) {
+	e.pos(x.Dollar)
+	e.pos(x.Rbrace)
+	e.bool(x.Short)
+	e.bool(x.Excl)
+	e.bool(x.Length)
+	e.bool(x.Width)
+	e.lit(x.Param)
+	e.arithm(x.Index)
+	if e.present(x.Slice != nil) {
+		e.arithm(x.Slice.Offset)
+		e.arithm(x.Slice.Length)
+	}
+	if e.present(x.Repl != nil) {
+		e.bool(x.Repl.All)
+		e.word(x.Repl.Orig)
+		e.word(x.Repl.With)
+	}
+	e.uint(uint64(x.Names))
+	if e.present(x.Exp != nil) {
+		e.uint(uint64(x.Exp.Op))
+		e.word(x.Exp.Word)
+	}
+}
+
+func (e *encoder) arithm(expr ArithmExpr) {
+	switch x := expr.(type) {
+	case nil:
+		e.uint(tagNil)
+	case *BinaryArithm:
+		e.uint(tagBinaryArithm)
+		e.pos(x.OpPos)
+		e.uint(uint64(x.Op))
+		e.arithm(x.X)
+		e.arithm(x.Y)
+	case *UnaryArithm:
+		e.uint(tagUnaryArithm)
+		e.pos(x.OpPos)
+		e.uint(uint64(x.Op))
+		e.bool(x.Post)
+		e.arithm(x.X)
+	case *ParenArithm:
+		e.uint(tagParenArithm)
+		e.pos(x.Lparen)
+		e.pos(x.Rparen)
+		e.arithm(x.X)
+	case *Word:
+		e.uint(tagWord)
+		e.wordParts(x.Parts)
+	default:
+		panic(fmt.Sprintf("unexpected arithmetic node: %T", x))
+	}
+}
+
+func (e *encoder) test(expr TestExpr) {
+	switch x := expr.(type) {
+	case nil:
+		e.uint(tagNil)
+	case *BinaryTest:
+		e.uint(tagBinaryTest)
+		e.pos(x.OpPos)
+		e.uint(uint64(x.Op))
+		e.test(x.X)
+		e.test(x.Y)
+	case *UnaryTest:
+		e.uint(tagUnaryTest)
+		e.pos(x.OpPos)
+		e.uint(uint64(x.Op))
+		e.test(x.X)
+	case *ParenTest:
+		e.uint(tagParenTest)
+		e.pos(x.Lparen)
+		e.pos(x.Rparen)
+		e.test(x.X)
+	case *Word:
+		e.uint(tagWord)
+		e.wordParts(x.Parts)
+	default:
+		panic(fmt.Sprintf("unexpected test node: %T", x))
+	}
+}
+
+// decoder reads the encoding written by encoder. Once it finds an error, it
+// stops consuming input and only returns zero values.
+//
+// It keeps an offset into its input rather than slicing it, as the decoder
+// lives on the heap and updating a string there is slower.
+type decoder struct {
+	data string
+	off  int
+	err  error
+
+	// Like the parser, allocate the most common nodes in batches.
+	litBatch    []Lit
+	wordBatch   []Word
+	stmtBatch   []Stmt
+	callBatch   []CallExpr
+	stListBatch []*Stmt
+	wordsBatch  []*Word
+	wpsBatch    []WordPart
+}
+
+// batchLen returns how many nodes to allocate at once, up to max. It is limited
+// by the remaining input, since each node takes up a few bytes.
+func (d *decoder) batchLen(max int) int {
+	if n := d.left()/32 + 1; n < max {
+		return n
+	}
+	return max
+}
+
+func (d *decoder) newLit() *Lit {
+	if len(d.litBatch) == 0 {
+		d.litBatch = make([]Lit, d.batchLen(128))
+	}
+	l := &d.litBatch[0]
+	d.litBatch = d.litBatch[1:]
+	return l
+}
+
+func (d *decoder) newWord() *Word {
+	if len(d.wordBatch) == 0 {
+		d.wordBatch = make([]Word, d.batchLen(64))
+	}
+	w := &d.wordBatch[0]
+	d.wordBatch = d.wordBatch[1:]
+	return w
+}
+
+func (d *decoder) newStmt() *Stmt {
+	if len(d.stmtBatch) == 0 {
+		d.stmtBatch = make([]Stmt, d.batchLen(64))
+	}
+	s := &d.stmtBatch[0]
+	d.stmtBatch = d.stmtBatch[1:]
+	return s
+}
+
+func (d *decoder) newCall() *CallExpr {
+	if len(d.callBatch) == 0 {
+		d.callBatch = make([]CallExpr, d.batchLen(32))
+	}
+	ce := &d.callBatch[0]
+	d.callBatch = d.callBatch[1:]
+	return ce
+}
+
+// The list funcs below return non-nil slices of length n, taking them from a
+// batch when n is small enough.
+
+func (d *decoder) stList(n int) []*Stmt {
+	if n == 0 || n > 8 {
+		return make([]*Stmt, n)
+	}
+	if len(d.stListBatch) < n {
+		d.stListBatch = make([]*Stmt, d.batchLen(256)+n)
+	}
+	stmts := d.stListBatch[:n:n]
+	d.stListBatch = d.stListBatch[n:]
+	return stmts
+}
+
+func (d *decoder) wordList(n int) []*Word {
+	if n == 0 || n > 8 {
+		return make([]*Word, n)
+	}
+	if len(d.wordsBatch) < n {
+		d.wordsBatch = make([]*Word, d.batchLen(256)+n)
+	}
+	ws := d.wordsBatch[:n:n]
+	d.wordsBatch = d.wordsBatch[n:]
+	return ws
+}
+
+func (d *decoder) wps(n int) []WordPart {
+	if n == 0 || n > 8 {
+		return make([]WordPart, n)
+	}
+	if len(d.wpsBatch) < n {
+		d.wpsBatch = make([]WordPart, d.batchLen(256)+n)
+	}
+	parts := d.wpsBatch[:n:n]
+	d.wpsBatch = d.wpsBatch[n:]
+	return parts
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.off = len(d.data)
+}
+
+// left returns the number of bytes which remain to be decoded.
+func (d *decoder) left() int { return len(d.data) - d.off }
+
+func (d *decoder) uint() uint64 {
+	if d.off < len(d.data) && d.data[d.off] < 0x80 {
+		n := d.data[d.off]
+		d.off++
+		return uint64(n)
+	}
+	var n uint64
+	for shift := uint(0); d.off < len(d.data) && shift < 64; shift += 7 {
+		b := d.data[d.off]
+		d.off++
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n
+		}
+	}
+	d.fail(errCodecTrunc)
+	return 0
+}
+
+func (d *decoder) bool() bool { return d.uint() != 0 }
+
+// sliceLen decodes the length of a slice, and reports whether it is non-nil.
+// Since each element takes up at least a byte, the length can't be larger than
+// the remaining input.
+func (d *decoder) sliceLen() (int, bool) {
+	n := d.uint()
+	if n == 0 {
+		return 0, false
+	}
+	if n-1 > uint64(d.left()) {
+		d.fail(errCodecTrunc)
+		return 0, false
+	}
+	return int(n - 1), true
+}
+
+func (d *decoder) str() string {
+	n := d.uint()
+	if n > uint64(d.left()) {
+		d.fail(errCodecTrunc)
+		return ""
+	}
+	s := d.data[d.off : d.off+int(n)]
+	d.off += int(n)
+	return s
+}
+
+func (d *decoder) pos() Pos {
+	return Pos{
+		offs: uint32(d.uint()),
+		line: uint16(d.uint()),
+		col:  uint16(d.uint()),
+	}
+}
+
+func (d *decoder) file() *File {
+	if !d.bool() {
+		return nil
+	}
+	return &File{
+		Name:  d.str(),
+		Stmts: d.stmts(),
+		Last:  d.comments(),
+	}
+}
+
+func (d *decoder) comments() []Comment {
+	n, ok := d.sliceLen()
+	if !ok {
+		return nil
+	}
+	cs := make([]Comment, n)
+	for i := range cs {
+		cs[i].Hash = d.pos()
+		cs[i].Text = d.str()
+	}
+	return cs
+}
+
+func (d *decoder) stmts() []*Stmt {
+	n, ok := d.sliceLen()
+	if !ok {
+		return nil
+	}
+	stmts := d.stList(n)
+	for i := range stmts {
+		stmts[i] = d.stmt()
+	}
+	return stmts
+}
+
+func (d *decoder) stmt() *Stmt {
+	if !d.bool() {
+		return nil
+	}
+	s := d.newStmt()
+	s.Comments = d.comments()
+	s.Cmd = d.command()
+	s.Position = d.pos()
+	s.Semicolon = d.pos()
+	s.Negated = d.bool()
+	s.Background = d.bool()
+	s.Coprocess = d.bool()
+	if n, ok := d.sliceLen(); ok {
+		s.Redirs = make([]*Redirect, n)
+		for i := range s.Redirs {
+			s.Redirs[i] = d.redirect()
+		}
+	}
+	return s
+}
+
+func (d *decoder) redirect() *Redirect {
+	if !d.bool() {
+		return nil
+	}
+	return &Redirect{
+		OpPos: d.pos(),
+		Op:    RedirOperator(d.uint()),
+		N:     d.lit(),
+		Word:  d.word(),
+		Hdoc:  d.word(),
+	}
+}
+
+func (d *decoder) assigns() []*Assign {
+	n, ok := d.sliceLen()
+	if !ok {
+		return nil
+	}
+	as := make([]*Assign, n)
+	for i := range as {
+		if !d.bool() {
+			continue
+		}
+		as[i] = &Assign{
+			Append: d.bool(),
+			Naked:  d.bool(),
+			Name:   d.lit(),
+			Index:  d.arithm(),
+			Value:  d.word(),
+			Array:  d.arrayExpr(),
+		}
+	}
+	return as
+}
+
+func (d *decoder) arrayExpr() *ArrayExpr {
+	if !d.bool() {
+		return nil
+	}
+	a := &ArrayExpr{
+		Lparen: d.pos(),
+		Rparen: d.pos(),
+	}
+	if n, ok := d.sliceLen(); ok {
+		a.Elems = make([]*ArrayElem, n)
+		for i := range a.Elems {
+			if !d.bool() {
+				continue
+			}
+			a.Elems[i] = &ArrayElem{
+				Index:    d.arithm(),
+				Value:    d.word(),
+				Comments: d.comments(),
+			}
+		}
+	}
+	a.Last = d.comments()
+	return a
+}
+
+func (d *decoder) command() Command {
+	switch tag := d.uint(); tag {
+	case tagNil:
+		return nil
+	case tagCallExpr:
+		ce := d.newCall()
+		ce.Assigns = d.assigns()
+		ce.Args = d.words()
+		return ce
+	case tagIfClause:
+		if x := d.ifClause(); x != nil {
+			return x
+		}
+	case tagWhileClause:
+		return &WhileClause{
+			WhilePos: d.pos(),
+			DoPos:    d.pos(),
+			DonePos:  d.pos(),
+			Until:    d.bool(),
+			Cond:     d.stmts(),
+			CondLast: d.comments(),
+			Do:       d.stmts(),
+			DoLast:   d.comments(),
+		}
+	case tagForClause:
+		return &ForClause{
+			ForPos:  d.pos(),
+			DoPos:   d.pos(),
+			DonePos: d.pos(),
+			Select:  d.bool(),
+			Braces:  d.bool(),
+			Loop:    d.loop(),
+			Do:      d.stmts(),
+			DoLast:  d.comments(),
+		}
+	case tagCaseClause:
+		x := &CaseClause{
+			Case:   d.pos(),
+			In:     d.pos(),
+			Esac:   d.pos(),
+			Braces: d.bool(),
+			Word:   d.word(),
+		}
+		if n, ok := d.sliceLen(); ok {
+			x.Items = make([]*CaseItem, n)
+			for i := range x.Items {
+				if !d.bool() {
+					continue
+				}
+				x.Items[i] = &CaseItem{
+					Op:       CaseOperator(d.uint()),
+					OpPos:    d.pos(),
+					Comments: d.comments(),
+					Patterns: d.words(),
+					Stmts:    d.stmts(),
+					Last:     d.comments(),
+				}
+			}
+		}
+		x.Last = d.comments()
+		return x
+	case tagBlock:
+		return &Block{
+			Lbrace: d.pos(),
+			Rbrace: d.pos(),
+			Stmts:  d.stmts(),
+			Last:   d.comments(),
+		}
+	case tagSubshell:
+		return &Subshell{
+			Lparen: d.pos(),
+			Rparen: d.pos(),
+			Stmts:  d.stmts(),
+			Last:   d.comments(),
+		}
+	case tagBinaryCmd:
+		return &BinaryCmd{
+			OpPos: d.pos(),
+			Op:    BinCmdOperator(d.uint()),
+			X:     d.stmt(),
+			Y:     d.stmt(),
+		}
+	case tagFuncDecl:
+		return &FuncDecl{
+			Position: d.pos(),
+			RsrvWord: d.bool(),
+			Name:     d.lit(),
+			Body:     d.stmt(),
+		}
+	case tagArithmCmd:
+		return &ArithmCmd{
+			Left:     d.pos(),
+			Right:    d.pos(),
+			Unsigned: d.bool(),
+			X:        d.arithm(),
+		}
+	case tagTestClause:
+		return &TestClause{
+			Left:  d.pos(),
+			Right: d.pos(),
+			X:     d.test(),
+		}
+	case tagDeclClause:
+		return &DeclClause{
+			Variant: d.lit(),
+			Args:    d.assigns(),
+		}
+	case tagLetClause:
+		x := &LetClause{Let: d.pos()}
+		if n, ok := d.sliceLen(); ok {
+			x.Exprs = make([]ArithmExpr, n)
+			for i := range x.Exprs {
+				x.Exprs[i] = d.arithm()
+			}
+		}
+		return x
+	case tagTimeClause:
+		return &TimeClause{
+			Time:        d.pos(),
+			PosixFormat: d.bool(),
+			Stmt:        d.stmt(),
+		}
+	case tagCoprocClause:
+		return &CoprocClause{
+			Coproc: d.pos(),
+			Name:   d.word(),
+			Stmt:   d.stmt(),
+		}
+	default:
+		d.fail(fmt.Errorf("invalid command tag %d", tag))
+	}
+	return nil
+}
+
+func (d *decoder) ifClause() *IfClause {
+	if !d.bool() {
+		return nil
+	}
+	return &IfClause{
+		Position: d.pos(),
+		ThenPos:  d.pos(),
+		FiPos:    d.pos(),
+		Cond:     d.stmts(),
+		CondLast: d.comments(),
+		Then:     d.stmts(),
+		ThenLast: d.comments(),
+		Else:     d.ifClause(),
+		Last:     d.comments(),
+	}
+}
+
+func (d *decoder) loop() Loop {
+	switch tag := d.uint(); tag {
+	case tagNil:
+		return nil
+	case tagWordIter:
+		return &WordIter{
+			Name:  d.lit(),
+			InPos: d.pos(),
+			Items: d.words(),
+		}
+	case tagCStyleLoop:
+		return &CStyleLoop{
+			Lparen: d.pos(),
+			Rparen: d.pos(),
+			Init:   d.arithm(),
+			Cond:   d.arithm(),
+			Post:   d.arithm(),
+		}
+	default:
+		d.fail(fmt.Errorf("invalid loop tag %d", tag))
+	}
+	return nil
+}
+
+func (d *decoder) lit() *Lit {
+	if !d.bool() {
+		return nil
+	}
+	l := d.newLit()
+	l.ValuePos = d.pos()
+	l.ValueEnd = d.pos()
+	l.Value = d.str()
+	return l
+}
+
+func (d *decoder) words() []*Word {
+	n, ok := d.sliceLen()
+	if !ok {
+		return nil
+	}
+	ws := d.wordList(n)
+	for i := range ws {
+		ws[i] = d.word()
+	}
+	return ws
+}
+
+func (d *decoder) word() *Word {
+	if !d.bool() {
+		return nil
+	}
+	w := d.newWord()
+	w.Parts = d.wordParts()
+	return w
+}
+
+func (d *decoder) wordParts() []WordPart {
+	n, ok := d.sliceLen()
+	if !ok {
+		return nil
+	}
+	parts := d.wps(n)
+	for i := range parts {
+		parts[i] = d.wordPart()
+	}
+	return parts
+}
+
+func (d *decoder) wordPart() WordPart {
+	switch tag := d.uint(); tag {
+	case tagNil:
+		return nil
+	case tagLit:
+		if x := d.lit(); x != nil {
+			return x
+		}
+	case tagSglQuoted:
+		return &SglQuoted{
+			Left:   d.pos(),
+			Right:  d.pos(),
+			Dollar: d.bool(),
+			Value:  d.str(),
+		}
+	case tagDblQuoted:
+		return &DblQuoted{
+			Left:   d.pos(),
+			Right:  d.pos(),
+			Dollar: d.bool(),
+			Parts:  d.wordParts(),
+		}
+	case tagParamExp:
+		return d.paramExp()
+	case tagCmdSubst:
+		return &CmdSubst{
+			Left:       d.pos(),
+			Right:      d.pos(),
+			Stmts:      d.stmts(),
+			Last:       d.comments(),
+			Backquotes: d.bool(),
+			TempFile:   d.bool(),
+			ReplyVar:   d.bool(),
+		}
+	case tagArithmExp:
+		return &ArithmExp{
+			Left:     d.pos(),
+			Right:    d.pos(),
+			Bracket:  d.bool(),
+			Unsigned: d.bool(),
+			X:        d.arithm(),
+		}
+	case tagProcSubst:
+		return &ProcSubst{
+			OpPos:  d.pos(),
+			Rparen: d.pos(),
+			Op:     ProcOperator(d.uint()),
+			Stmts:  d.stmts(),
+			Last:   d.comments(),
+		}
+	case tagExtGlob:
+		return &ExtGlob{
+			OpPos:   d.pos(),
+			Op:      GlobOperator(d.uint()),
+			Pattern: d.lit(),
+		}
+	case tagBraceExp:
+		return &BraceExp{
+			Sequence: d.bool(),
+			Elems:    d.words(),
+		}
+	default:
+		d.fail(fmt.Errorf("invalid word part tag %d", tag))
+	}
+	return nil
+}
+
+func (d *decoder) paramExp() *ParamExp {
+	x := &ParamExp{
+		Dollar: d.pos(),
+		Rbrace: d.pos(),
+		Short:  d.bool(),
+		Excl:   d.bool(),
+		Length: d.bool(),
+		Width:  d.bool(),
+		Param:  d.lit(),
+		Index:  d.arithm(),
+	}
+	if d.bool() {
+		x.Slice = &Slice{
+			Offset: d.arithm(),
+			Length: d.arithm(),
+		}
+	}
+	if d.bool() {
+		x.Repl = &Replace{
+			All:  d.bool(),
+			Orig: d.word(),
+			With: d.word(),
+		}
+	}
+	x.Names = ParNamesOperator(d.uint())
+	if d.bool() {
+		x.Exp = &Expansion{
+			Op:   ParExpOperator(d.uint()),
+			Word: d.word(),
+		}
+	}
+	return x
+}
+
+func (d *decoder) arithm() ArithmExpr {
+	switch tag := d.uint(); tag {
+	case tagNil:
+		return nil
+	case tagBinaryArithm:
+		return &BinaryArithm{
+			OpPos: d.pos(),
+			Op:    BinAritOperator(d.uint()),
+			X:     d.arithm(),
+			Y:     d.arithm(),
+		}
+	case tagUnaryArithm:
+		return &UnaryArithm{
+			OpPos: d.pos(),
+			Op:    UnAritOperator(d.uint()),
+			Post:  d.bool(),
+			X:     d.arithm(),
+		}
+	case tagParenArithm:
+		return &ParenArithm{
+			Lparen: d.pos(),
+			Rparen: d.pos(),
+			X:      d.arithm(),
+		}
+	case tagWord:
+		w := d.newWord()
+		w.Parts = d.wordParts()
+		return w
+	default:
+		d.fail(fmt.Errorf("invalid arithmetic tag %d", tag))
+	}
+	return nil
+}
+
+func (d *decoder) test() TestExpr {
+	switch tag := d.uint(); tag {
+	case tagNil:
+		return nil
+	case tagBinaryTest:
+		return &BinaryTest{
+			OpPos: d.pos(),
+			Op:    BinTestOperator(d.uint()),
+			X:     d.test(),
+			Y:     d.test(),
+		}
+	case tagUnaryTest:
+		return &UnaryTest{
+			OpPos: d.pos(),
+			Op:    UnTestOperator(d.uint()),
+			X:     d.test(),
+		}
+	case tagParenTest:
+		return &ParenTest{
+			Lparen: d.pos(),
+			Rparen: d.pos(),
+			X:      d.test(),
+		}
+	case tagWord:
+		w := d.newWord()
+		w.Parts = d.wordParts()
+		return w
+	default:
+		d.fail(fmt.Errorf("invalid test tag %d", tag))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kr/pretty"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	t.Parallel()
+	for i, c := range append(fileTests, fileTestsNoPrint...) {
+		lang := LangBash
+		switch {
+		case c.Bash != nil:
+		case c.Posix != nil:
+			lang = LangPOSIX
+		case c.MirBSDKorn != nil:
+			lang = LangMirBSDKorn
+		default:
+			continue
+		}
+		p := NewParser(KeepComments(true), Variant(lang))
+		for j, in := range c.Strs {
+			t.Run(fmt.Sprintf("%03d-%d", i, j), func(t *testing.T) {
+				want, err := p.Parse(strings.NewReader(in), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var buf bytes.Buffer
+				if err := Encode(&buf, want); err != nil {
+					t.Fatal(err)
+				}
+				got, err := Decode(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("syntax tree mismatch in %q\ndiff:\n%s", in,
+						strings.Join(pretty.Diff(want, got), "\n"))
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeDecodeBraces(t *testing.T) {
+	t.Parallel()
+	want, err := NewParser().Parse(strings.NewReader("echo a{b,c{1..3}}d"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !SplitBraces(want.Stmts[0].Cmd.(*CallExpr).Args[1]) {
+		t.Fatal("expected a brace expansion")
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("syntax tree mismatch\ndiff:\n%s",
+			strings.Join(pretty.Diff(want, got), "\n"))
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	t.Parallel()
+	f, err := NewParser().Parse(strings.NewReader("foo | bar $(baz)"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"Empty", nil, "invalid or truncated encoding"},
+		{"Version", append([]byte{99}, data[1:]...), "unsupported encoding version 99"},
+		{"Truncated", data[:len(data)-1], "invalid or truncated encoding"},
+		{"Trailing", append(data[:len(data):len(data)], 0), "1 bytes of trailing data"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Decode(bytes.NewReader(tc.data))
+			if err == nil || err.Error() != tc.want {
+				t.Fatalf("want error %q, got: %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	f, err := NewParser(KeepComments(true)).Parse(strings.NewReader(benchmarkSrc), "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := Encode(&buf, f); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	in := bytes.NewReader(data)
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(in); err != nil {
+			b.Fatal(err)
+		}
+		in.Reset(data)
+	}
+}
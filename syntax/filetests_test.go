@@ -1666,6 +1666,46 @@ var fileTests = []testCase{
 			word(cmdSubst(litStmt("x"))),
 		))),
 	},
+	{
+		Strs: []string{
+			`$(echo \\ '$x' '\' "\"")`,
+			"`echo \\\\\\\\ '\\$x' '\\\\' \"\\\"\"`",
+		},
+		common: cmdSubst(stmt(call(
+			litWord("echo"),
+			litWord(`\\`),
+			word(sglQuoted(`$x`)),
+			word(sglQuoted(`\`)),
+			word(dblQuoted(lit(`\"`))),
+		))),
+	},
+	{
+		Strs: []string{
+			`"a$(f "b$(g)")c"`,
+			"\"a`f \\\"b\\`g\\`\\\"`c\"",
+		},
+		common: dblQuoted(
+			lit("a"),
+			cmdSubst(stmt(call(
+				litWord("f"),
+				word(dblQuoted(lit("b"), cmdSubst(litStmt("g")))),
+			))),
+			lit("c"),
+		),
+	},
+	{
+		Strs: []string{
+			"$(echo $(echo $(x)))",
+			"`echo \\`echo \\\\\\`x\\\\\\`\\``",
+		},
+		common: cmdSubst(stmt(call(
+			litWord("echo"),
+			word(cmdSubst(stmt(call(
+				litWord("echo"),
+				word(cmdSubst(litStmt("x"))),
+			)))),
+		))),
+	},
 	{
 		Strs: []string{
 			"$($(foo bar))",
@@ -4289,6 +4329,8 @@ func fullProg(v interface{}) *File {
 	return nil
 }
 
+var bquoteEscaper = strings.NewReplacer(`\`, `\\`, "$", `\$`, "`", "\\`")
+
 func clearPosRecurse(tb testing.TB, src string, v interface{}) {
 	zeroPos := Pos{}
 	checkSrc := func(pos Pos, strs ...string) {
@@ -4376,6 +4418,9 @@ func clearPosRecurse(tb testing.TB, src string, v interface{}) {
 				// ended by semicolon
 			case endOff > 0 && src[endOff-1] == '&':
 				// ended by & or |&
+			case strings.HasPrefix(strings.TrimLeft(src[endOff:], "\\"), "`"):
+				// ended by an escaped backquote; see
+				// TestBquoteEscapedEnd
 			default:
 				tb.Fatalf("Unexpected Stmt.End() %d %q in %q",
 					endOff, end, src)
@@ -4537,7 +4582,8 @@ func clearPosRecurse(tb testing.TB, src string, v interface{}) {
 		if x.Dollar {
 			valuePos = posAddCol(valuePos, 1)
 		}
-		checkSrc(valuePos, x.Value)
+		// within backquotes, the source escapes the value once more
+		checkSrc(valuePos, x.Value, bquoteEscaper.Replace(x.Value))
 		if x.Dollar {
 			setPos(&x.Left, "$'")
 		} else {
@@ -55,6 +55,58 @@ func bquoteEscaped(b byte) bool {
 	return false
 }
 
+// unescapeBquotes works out the backslashes starting at p.bsp within open
+// backquotes. Each level of backquotes unescapes the input once before it's
+// parsed, so "\\\\" and "\\\$" become "\\" and "$" inside one level.
+//
+// Only the backslashes left after unescaping are left in the input, to be read
+// by rune as usual. The number of levels which escaped the character after
+// them is kept in p.bquoteEsc, to tell which level a backquote belongs to.
+func (p *Parser) unescapeBquotes() {
+	end := p.bsp
+	for {
+		if end == len(p.bs) {
+			// we need more bytes to know what follows the backslashes
+			start := end - p.bsp
+			p.fill()
+			end = start
+			if end == len(p.bs) {
+				break
+			}
+		}
+		if p.bs[end] != '\\' {
+			break
+		}
+		end++
+	}
+	var c byte
+	if end < len(p.bs) {
+		c = p.bs[end]
+	}
+	n, esc := end-p.bsp, 0
+	for i := 0; i < p.openBquotes; i++ {
+		if n%2 == 0 {
+			n /= 2
+			if c == '`' {
+				// an unescaped backquote at this level; when
+				// ending the innermost one, keep any backslash
+				// before it from escaping it
+				n += n % 2
+				break
+			}
+			continue
+		}
+		n /= 2
+		if !bquoteEscaped(c) && (c != '"' || !p.dblQuotedBquotes[i]) {
+			n++ // e.g. "\\a" is left as is
+		}
+		esc = i + 1
+	}
+	p.bsp = end - n
+	p.bquoteSlashes = n
+	p.bquoteEsc = esc
+}
+
 const escNewl rune = utf8.RuneSelf + 1
 
 func (p *Parser) rune() rune {
@@ -65,25 +117,28 @@ func (p *Parser) rune() rune {
 		p.npos.col = 0
 	}
 	p.npos.col += p.w
-	bquotes := 0
 retry:
 	if p.bsp < len(p.bs) {
 		if b := p.bs[p.bsp]; b < utf8.RuneSelf {
 			p.bsp++
 			if b == '\\' {
+				if p.bquoteSlashes > 0 {
+					p.bquoteSlashes--
+				} else if p.openBquotes > 0 {
+					p.bsp--
+					p.unescapeBquotes()
+					goto retry
+				}
 				if p.r != '\\' && p.peekByte('\n') {
 					p.bsp++
 					p.w, p.r = 1, escNewl
 					return escNewl
 				}
-				if p.openBquotes > 0 && bquotes < p.openBquotes &&
-					p.bsp < len(p.bs) && bquoteEscaped(p.bs[p.bsp]) {
-					bquotes++
-					goto retry
+			} else {
+				if b == '`' {
+					p.lastBquoteEsc = p.bquoteEsc
 				}
-			}
-			if b == '`' {
-				p.lastBquoteEsc = bquotes
+				p.bquoteEsc = 0
 			}
 			if p.litBs != nil {
 				p.litBs = append(p.litBs, b)
@@ -121,14 +176,21 @@ retry:
 // fill reads more bytes from the input src into readBuf. Any bytes that
 // had not yet been used at the end of the buffer are slid into the
 // beginning of the buffer.
+//
+// If those bytes already fill the buffer, such as a long run of backslashes
+// within backquotes, a larger buffer is used instead.
 func (p *Parser) fill() {
 	p.offs += p.bsp
 	left := len(p.bs) - p.bsp
-	copy(p.readBuf[:left], p.readBuf[p.bsp:])
+	buf := p.readBuf[:]
+	if left >= len(buf) {
+		buf = make([]byte, 2*left)
+	}
+	copy(buf[:left], p.bs[p.bsp:])
 readAgain:
 	n, err := 0, p.readErr
 	if err == nil {
-		n, err = p.src.Read(p.readBuf[left:])
+		n, err = p.src.Read(buf[left:])
 		p.readErr = err
 	}
 	if n == 0 {
@@ -140,12 +202,12 @@ readAgain:
 			p.err = err
 		}
 		if left > 0 {
-			p.bs = p.readBuf[:left]
+			p.bs = buf[:left]
 		} else {
 			p.bs = nil
 		}
 	} else {
-		p.bs = p.readBuf[:left+n]
+		p.bs = buf[:left+n]
 	}
 	p.bsp = 0
 }
@@ -193,6 +255,75 @@ func (p *Parser) nextKeepSpaces() {
 }
 
 func (p *Parser) next() {
+	if p.tokenFn == nil {
+		p.lex()
+		return
+	}
+	p.flushTok()
+	p.lex()
+	if p.tok != _EOF && p.tok != _Newl {
+		p.reportTok()
+	}
+}
+
+// reportTok reports the current token to tokenFn. Literal words are held back
+// until the parser moves on to the next token, as it might find them to be
+// reserved words first.
+func (p *Parser) reportTok() {
+	kind, val := TokenOperator, p.tok.String()
+	switch p.tok {
+	case _Lit, _LitWord, _LitRedir:
+		kind, val = TokenLiteral, p.val
+		switch p.quote {
+		case paramExpName:
+			kind = TokenParam
+		case dblQuotes, hdocBody, hdocBodyTabs:
+			kind = TokenString
+		}
+	case sglQuote, dblQuote, dollSglQuote, dollDblQuote:
+		kind = TokenString
+	}
+	if p.tok == _LitWord && kind == TokenLiteral {
+		p.heldTok = heldToken{kind, val, p.pos}
+		p.heldSet = true
+		return
+	}
+	p.tokenFn(kind, val, p.pos)
+}
+
+type heldToken struct {
+	kind TokenKind
+	val  string
+	pos  Pos
+}
+
+// keyword marks the current token as a keyword, if it was held back by
+// reportTok.
+func (p *Parser) keyword() {
+	if p.heldSet && p.heldTok.pos == p.pos {
+		p.heldTok.kind = TokenKeyword
+	}
+}
+
+// flushTok reports the token held back by reportTok, if any.
+func (p *Parser) flushTok() {
+	if p.heldSet {
+		p.heldSet = false
+		p.tokenFn(p.heldTok.kind, p.heldTok.val, p.heldTok.pos)
+	}
+}
+
+// lexTok reports a token which the parser lexed by itself, such as the
+// contents of a single-quoted string.
+func (p *Parser) lexTok(kind TokenKind, val string, pos Pos) {
+	if p.tokenFn != nil && val != "" {
+		p.flushTok()
+		p.tokenFn(kind, val, pos)
+	}
+}
+
+// lex advances the lexer to the next token, like next, without reporting it.
+func (p *Parser) lex() {
 	if p.r == utf8.RuneSelf {
 		p.tok = _EOF
 		return
@@ -258,15 +389,20 @@ skipSpace:
 				}
 				r = p.rune()
 			}
-			if p.keepComments {
-				*p.curComs = append(*p.curComs, Comment{
-					Hash: p.pos,
-					Text: p.endLit(),
-				})
+			keep := p.keepComments || p.lossless
+			if keep || p.tokenFn != nil {
+				text := p.endLit()
+				p.lexTok(TokenComment, "#"+text, p.pos)
+				if keep {
+					*p.curComs = append(*p.curComs, Comment{
+						Hash: p.pos,
+						Text: text,
+					})
+				}
 			} else {
 				p.litBs = nil
 			}
-			p.next()
+			p.lex()
 		case '[', '=':
 			if p.quote == arrayElems {
 				p.tok = p.paramToken(r)
@@ -340,11 +476,6 @@ func (p *Parser) peekByte(b byte) bool {
 func (p *Parser) regToken(r rune) token {
 	switch r {
 	case '\'':
-		if p.openBquotes > 0 {
-			// bury openBquotes
-			p.buriedBquotes = p.openBquotes
-			p.openBquotes = 0
-		}
 		p.rune()
 		return sglQuote
 	case '"':
@@ -988,6 +1119,7 @@ func (p *Parser) quotedHdocWord() *Word {
 			if val == "" {
 				return nil
 			}
+			p.lexTok(TokenString, val, pos)
 			return p.word(p.wps(p.lit(pos, val)))
 		}
 	}
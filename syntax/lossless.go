@@ -0,0 +1,270 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// losslessFile is what a parser using Lossless remembers about a file, so that
+// a printer using PrintExact can tell which of its nodes were modified.
+type losslessFile struct {
+	src   []byte
+	nodes map[Node]nodeSnap
+}
+
+// nodeSnap is the original state of a node.
+type nodeSnap struct {
+	// sig is the node's shallow signature; see shallowSig.
+	sig string
+
+	// start and end are the byte offsets of the source which the node
+	// spans, including its comments and the comments of its descendants.
+	start, end uint
+
+	// noPrint means that the node can't be printed on its own, as the
+	// printer would give it a different meaning out of its context. For
+	// example, a literal within double quotes.
+	noPrint bool
+
+	// trailing means that the node is a statement followed by a comment on
+	// the same line.
+	trailing bool
+}
+
+func newLosslessFile(f *File, src []byte) *losslessFile {
+	lf := &losslessFile{src: src, nodes: make(map[Node]nodeSnap)}
+	lf.record(f, false)
+	return lf
+}
+
+// record stores the snapshots of a node and its descendants, returning the
+// node's span.
+func (lf *losslessFile) record(node Node, noPrint bool) (start, end uint) {
+	sig, children, comments := shallowSig(node)
+	snap := nodeSnap{sig: sig, noPrint: noPrint}
+	first := true
+	extend := func(start, end uint) {
+		if first || start < snap.start {
+			snap.start = start
+		}
+		if first || end > snap.end {
+			snap.end = end
+		}
+		first = false
+	}
+	extendPos := func(pos, end Pos) {
+		if pos.IsValid() && end.IsValid() {
+			extend(pos.Offset(), end.Offset())
+		}
+	}
+	if _, ok := node.(*File); !ok {
+		extendPos(node.Pos(), node.End())
+	}
+	if s, ok := node.(*Stmt); ok {
+		for _, c := range s.Comments {
+			if !s.End().After(c.Pos()) {
+				snap.trailing = true
+			}
+		}
+	}
+	for _, c := range comments {
+		extendPos(c.Pos(), c.End())
+	}
+	for _, child := range children {
+		childNoPrint := false
+		switch x := node.(type) {
+		case *DblQuoted:
+			_, childNoPrint = child.(*Lit)
+		case *ExtGlob:
+			childNoPrint = true
+		case *Redirect:
+			childNoPrint = child == Node(x.Hdoc)
+		case *Word:
+			if noPrint {
+				// the parts of a heredoc body
+				_, childNoPrint = child.(*Lit)
+			}
+		}
+		extend(lf.record(child, childNoPrint))
+	}
+	lf.nodes[node] = snap
+	return snap.start, snap.end
+}
+
+var (
+	posType     = reflect.TypeOf(Pos{})
+	commentType = reflect.TypeOf(Comment{})
+	nodeType    = reflect.TypeOf((*Node)(nil)).Elem()
+)
+
+// shallowSig returns a signature of the fields of a node, where its child
+// nodes are only represented by their pointers. The children are returned too,
+// as well as the comments, which are treated as fields. Two signatures of the
+// same node are equal if and only if the node itself wasn't modified, even if
+// its children were.
+func shallowSig(node Node) (sig string, children []Node, comments []Comment) {
+	var sb strings.Builder
+	sigValue(&sb, reflect.ValueOf(node).Elem(), &children, &comments)
+	return sb.String(), children, comments
+}
+
+func sigValue(sb *strings.Builder, v reflect.Value, children *[]Node, comments *[]Comment) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			sb.WriteString("nil;")
+			return
+		}
+		sigValue(sb, v.Elem(), children, comments)
+	case reflect.Ptr:
+		if v.IsNil() {
+			sb.WriteString("nil;")
+			return
+		}
+		if v.Type().Implements(nodeType) {
+			sb.WriteString(strconv.FormatUint(uint64(v.Pointer()), 16))
+			sb.WriteByte(';')
+			*children = append(*children, v.Interface().(Node))
+			return
+		}
+		// Not a node, such as *Expansion; its fields belong to the node.
+		sigValue(sb, v.Elem(), children, comments)
+	case reflect.Struct:
+		t := v.Type()
+		if t == commentType {
+			*comments = append(*comments, v.Interface().(Comment))
+		}
+		sb.WriteByte('{')
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" && t != posType {
+				continue // such as File.lossless
+			}
+			sigValue(sb, v.Field(i), children, comments)
+		}
+		sb.WriteByte('}')
+	case reflect.Slice:
+		sb.WriteString(strconv.Itoa(v.Len()))
+		sb.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			sigValue(sb, v.Index(i), children, comments)
+		}
+		sb.WriteByte(']')
+	case reflect.String:
+		sb.WriteString(strconv.Quote(v.String()))
+	case reflect.Bool:
+		sb.WriteString(strconv.FormatBool(v.Bool()))
+		sb.WriteByte(';')
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sb.WriteString(strconv.FormatInt(v.Int(), 10))
+		sb.WriteByte(';')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		sb.WriteString(strconv.FormatUint(v.Uint(), 10))
+		sb.WriteByte(';')
+	default:
+		panic(fmt.Sprintf("unexpected field kind in a node: %s", v.Kind()))
+	}
+}
+
+// exactEdit replaces a span of the original source with a node printed anew.
+type exactEdit struct {
+	start, end uint
+	node       Node
+	semicolon  bool
+}
+
+// edits collects the edits needed to print node, reporting whether node must be
+// printed anew by its parent instead.
+func (lf *losslessFile) edits(node Node, edits *[]exactEdit) (reprint bool) {
+	snap, ok := lf.nodes[node]
+	if !ok {
+		return true // a new node
+	}
+	sig, children, _ := shallowSig(node)
+	if sig == snap.sig {
+		before := len(*edits)
+		for _, child := range children {
+			if lf.edits(child, edits) {
+				reprint = true
+			}
+		}
+		if !reprint {
+			return false
+		}
+		// Drop the edits within this node, as it's printed anew.
+		*edits = (*edits)[:before]
+	}
+	if snap.noPrint || !exactPrintable(node) || hasHeredoc(node) {
+		return true
+	}
+	edit := exactEdit{start: snap.start, end: snap.end, node: node}
+	if s, ok := node.(*Stmt); ok {
+		// The printer omits a statement's semicolon, which may be
+		// followed by another statement on the same line.
+		edit.semicolon = s.Semicolon.IsValid() && !s.Background &&
+			!s.Coprocess && !snap.trailing
+	}
+	*edits = append(*edits, edit)
+	return false
+}
+
+// exactPrintable reports whether a node can be printed on its own.
+func exactPrintable(node Node) bool {
+	switch node.(type) {
+	case *Stmt, *Word, *Redirect, Command, WordPart:
+		return true
+	}
+	return false
+}
+
+// hasHeredoc reports whether a node contains any heredocs, as their bodies are
+// printed after the end of the node.
+func hasHeredoc(node Node) bool {
+	found := false
+	Walk(node, func(node Node) bool {
+		if r, ok := node.(*Redirect); ok && r.Hdoc != nil {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// printExact prints a file parsed with Lossless, keeping the original source for
+// the nodes which weren't modified.
+func (p *Printer) printExact(w io.Writer, f *File, lf *losslessFile) error {
+	p.exact = false
+	defer func() { p.exact = true }()
+
+	var edits []exactEdit
+	if lf.edits(f, &edits) {
+		return p.Print(w, f)
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var buf bytes.Buffer
+	last := uint(0)
+	for _, edit := range edits {
+		if edit.start < last || edit.end > uint(len(lf.src)) {
+			// Overlapping edits; print the entire file instead.
+			return p.Print(w, f)
+		}
+		buf.Write(lf.src[last:edit.start])
+		if err := p.Print(&buf, edit.node); err != nil {
+			return err
+		}
+		if edit.semicolon {
+			buf.WriteByte(';')
+		}
+		last = edit.end
+	}
+	buf.Write(lf.src[last:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPrintExactUnmodified(t *testing.T) {
+	t.Parallel()
+	extra := []string{
+		"",
+		"\n\n",
+		"#!/bin/sh\n\n  foo   bar # baz\n\n\n",
+		"foo;bar  ;  baz&\n",
+		"if  true ;then\n\t  echo\t\"a  b\"\nfi",
+		"cat <<EOF   ;  echo  x\n\tbody  $foo\nEOF\n",
+		"a=( 1   2 # c\n  3 )\n",
+		"foo \\\n   bar",
+	}
+	printer := NewPrinter(PrintExact(true))
+	check := func(t *testing.T, p *Parser, in string) {
+		t.Helper()
+		f, err := p.Parse(strings.NewReader(in), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sb strings.Builder
+		if err := printer.Print(&sb, f); err != nil {
+			t.Fatal(err)
+		}
+		if got := sb.String(); got != in {
+			t.Fatalf("output mismatch:\nwant: %q\ngot:  %q", in, got)
+		}
+	}
+	for i, in := range extra {
+		t.Run(fmt.Sprintf("extra-%02d", i), func(t *testing.T) {
+			check(t, NewParser(Lossless(true)), in)
+		})
+	}
+	for i, c := range fileTests {
+		lang := LangBash
+		switch {
+		case c.Bash != nil:
+		case c.Posix != nil:
+			lang = LangPOSIX
+		case c.MirBSDKorn != nil:
+			lang = LangMirBSDKorn
+		default:
+			continue
+		}
+		p := NewParser(Lossless(true), Variant(lang))
+		for j, in := range c.Strs {
+			t.Run(fmt.Sprintf("%03d-%d", i, j), func(t *testing.T) {
+				check(t, p, in)
+			})
+		}
+	}
+}
+
+func TestPrintExactModified(t *testing.T) {
+	t.Parallel()
+	lit := func(f *File, i int) *Lit {
+		return f.Stmts[i].Cmd.(*CallExpr).Args[1].Parts[0].(*Lit)
+	}
+	tests := []struct {
+		in     string
+		modify func(f *File)
+		want   string
+	}{
+		{
+			"foo   bar  # c\n\nbaz\t\tqux\n",
+			func(f *File) { lit(f, 1).Value = "new" },
+			"foo   bar  # c\n\nbaz\t\tnew\n",
+		},
+		{
+			"foo   bar ;  baz  qux",
+			func(f *File) { f.Stmts[0].Cmd.(*CallExpr).Args[1] = &Word{Parts: []WordPart{&Lit{Value: "x"}}} },
+			"foo x ;  baz  qux",
+		},
+		{
+			"foo   bar ;  baz  qux",
+			func(f *File) {
+				ce := f.Stmts[0].Cmd.(*CallExpr)
+				ce.Args = append(ce.Args, &Word{Parts: []WordPart{&Lit{Value: "x"}}})
+			},
+			"foo bar x ;  baz  qux",
+		},
+		{
+			"if  true ;then\n\t  echo\t\"a  b\"  c\nfi # end\n",
+			func(f *File) {
+				ic := f.Stmts[0].Cmd.(*IfClause)
+				dq := ic.Then[0].Cmd.(*CallExpr).Args[1].Parts[0].(*DblQuoted)
+				dq.Parts[0].(*Lit).Value = "x  y"
+			},
+			"if  true ;then\n\t  echo\t\"x  y\"  c\nfi # end\n",
+		},
+		{
+			"foo  &&   bar # c\nbaz",
+			func(f *File) { f.Stmts[0].Cmd.(*BinaryCmd).Op = OrStmt },
+			"foo || bar # c\nbaz",
+		},
+		{
+			"# lead\nfoo  x;  bar",
+			func(f *File) { f.Stmts[0].Negated = true },
+			"# lead\n! foo x;  bar",
+		},
+		{
+			"foo  x\nbar  y",
+			func(f *File) { f.Stmts = f.Stmts[:1] },
+			"foo x\n",
+		},
+		{
+			"cat <<EOF;  foo  x\nbody\nEOF\n",
+			func(f *File) { f.Stmts[1].Cmd.(*CallExpr).Args[1].Parts[0].(*Lit).Value = "y" },
+			"cat <<EOF;  foo  y\nbody\nEOF\n",
+		},
+		{
+			"cat <<EOF;  foo  x\nbody\nEOF\n",
+			func(f *File) { f.Stmts[0].Redirs[0].Hdoc.Parts[0].(*Lit).Value = "new\n" },
+			"cat <<EOF\nnew\nEOF\nfoo x\n",
+		},
+	}
+	parser := NewParser(Lossless(true))
+	printer := NewPrinter(PrintExact(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.modify(f)
+			var sb strings.Builder
+			if err := printer.Print(&sb, f); err != nil {
+				t.Fatal(err)
+			}
+			if got := sb.String(); got != tc.want {
+				t.Fatalf("output mismatch:\nwant: %q\ngot:  %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPrintExactNotLossless(t *testing.T) {
+	t.Parallel()
+	in := "foo   bar\n"
+	f, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if err := NewPrinter(PrintExact(true)).Print(&sb, f); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sb.String(), "foo bar\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
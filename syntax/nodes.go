@@ -5,6 +5,7 @@ package syntax
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 )
 
@@ -19,12 +20,30 @@ type Node interface {
 	End() Pos
 }
 
+// NodeType returns the name of a node's type without its package, such as
+// "CallExpr" for a *CallExpr. It returns an empty string for a nil node.
+//
+// The name is the same as the "Type" field in the JSON output of shfmt, so it
+// can be used to tell nodes apart in both.
+func NodeType(node Node) string {
+	if node == nil {
+		return ""
+	}
+	typ := reflect.TypeOf(node)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ.Name()
+}
+
 // File represents a shell source file.
 type File struct {
 	Name string
 
 	Stmts []*Stmt
 	Last  []Comment
+
+	lossless *losslessFile // set when parsed with Lossless
 }
 
 func (f *File) Pos() Pos { return stmtsPos(f.Stmts, f.Last) }
@@ -118,6 +137,13 @@ func (c *Comment) End() Pos { return posAddCol(c.Hash, 1+len(c.Text)) }
 // Stmt represents a statement, also known as a "complete command". It is
 // compromised of a command and other components that may come before or after
 // it.
+//
+// When comments are kept, a statement's Comments are those on the lines
+// between the previous statement, or the start of its block, and the statement
+// itself, followed by a comment on the same line as the statement's end, if
+// any. This means that a doc comment above a function ends up attached to its
+// FuncDecl statement. Comments following the last statement of a block are
+// attached to the block instead, such as in File.Last or Block.Last.
 type Stmt struct {
 	Comments   []Comment
 	Cmd        Command
@@ -245,6 +271,15 @@ func (r *Redirect) End() Pos {
 	return r.Word.End()
 }
 
+// String returns the redirection as printed by a Printer with the default
+// options, such as "2>file", "{fd}>&-", or "<<EOF" followed by the body of the
+// here-document.
+func (r *Redirect) String() string {
+	var sb strings.Builder
+	NewPrinter().Print(&sb, r)
+	return sb.String()
+}
+
 // CallExpr represents a command execution or function call, otherwise known as
 // a "simple command".
 //
@@ -415,7 +450,8 @@ func (w *Word) End() Pos { return w.Parts[len(w.Parts)-1].End() }
 // which can appear in some edge cases, are handled properly.
 //
 // For example, the word "foo" will return "foo", but the word "foo${bar}" will
-// return "".
+// return "". Quoted words like 'foo' are not literals, and backslashes in
+// literals are kept as written, so foo\ bar will return "foo\ bar".
 func (w *Word) Lit() string {
 	// In the usual case, we'll have either a single part that's a literal,
 	// or one of the parts being a non-literal. Using strings.Join instead
@@ -456,6 +492,10 @@ func (*BraceExp) wordPartNode()  {}
 // Note that a parsed string literal may not appear as-is in the original source
 // code, as it is possible to split literals by escaping newlines. The splitting
 // is lost, but the end position is not.
+//
+// The value of a parsed literal is its source, including any backslashes. When
+// printing a literal built by hand whose value would not be read back as a
+// single literal word, such as "a b", the printer quotes it.
 type Lit struct {
 	ValuePos, ValueEnd Pos
 	Value              string
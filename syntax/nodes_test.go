@@ -71,3 +71,79 @@ func TestWeirdOperatorString(t *testing.T) {
 		t.Fatalf("token.String() mismatch: want %s, got %s", want, got)
 	}
 }
+
+func TestRedirectString(t *testing.T) {
+	t.Parallel()
+	in := "foo >a 2>>b {fd}>&- 3<'c d' <<EOF\nbar\nEOF"
+	f, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, rd := range f.Stmts[0].Redirs {
+		got = append(got, rd.String())
+	}
+	want := []string{">a", "2>>b", "{fd}>&-", "3<'c d'", "<<EOF\nbar\nEOF"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Redirect.String() mismatch: want %q, got %q", want, got)
+	}
+}
+
+func TestNodeType(t *testing.T) {
+	t.Parallel()
+	in := "foo=bar echo $((1 + 2)) >f; [[ -n x ]]"
+	f, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	Walk(f, func(node Node) bool {
+		if node != nil {
+			got = append(got, NodeType(node))
+		}
+		return true
+	})
+	want := []string{
+		"File", "Stmt", "CallExpr", "Assign", "Lit", "Word", "Lit",
+		"Word", "Lit", "Word", "ArithmExp", "BinaryArithm", "Word", "Lit",
+		"Word", "Lit", "Redirect", "Word", "Lit", "Stmt", "TestClause",
+		"UnaryTest", "Word", "Lit",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("NodeType() mismatch:\nwant %q\ngot  %q", want, got)
+	}
+	if got := NodeType(nil); got != "" {
+		t.Fatalf("NodeType(nil) mismatch: want \"\", got %q", got)
+	}
+}
+
+func TestWordLit(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"foo", "foo"},
+		{"foo-bar.baz", "foo-bar.baz"},
+		{`foo\ bar`, `foo\ bar`},
+		{"foo$bar", ""},
+		{"${foo}bar", ""},
+		{"'foo'", ""},
+		{`foo"bar"`, ""},
+		{"foo$(bar)", ""},
+		{"*.go", "*.go"},
+	}
+	for _, tc := range tests {
+		w, err := ParseWord(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Lit(); got != tc.want {
+			t.Errorf("Lit of %q: want %q, got %q", tc.in, tc.want, got)
+		}
+	}
+	// Words built by hand may have many literal parts.
+	w := &Word{Parts: []WordPart{&Lit{Value: "foo"}, &Lit{Value: "bar"}}}
+	if got, want := w.Lit(), "foobar"; got != want {
+		t.Errorf("Lit of split word: want %q, got %q", want, got)
+	}
+}
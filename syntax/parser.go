@@ -18,23 +18,44 @@ import (
 type ParserOption func(*Parser)
 
 // KeepComments makes the parser parse comments and attach them to
-// nodes, as opposed to discarding them.
+// nodes, as opposed to discarding them. See Stmt for how comments are
+// attached.
 func KeepComments(enabled bool) ParserOption {
 	return func(p *Parser) { p.keepComments = enabled }
 }
 
+// Lossless makes the parser remember the source of each file it parses, as well
+// as the original state of its nodes. A Printer using PrintExact can then
+// reproduce the file byte for byte, except for the nodes which were modified.
+//
+// This implies KeepComments. Parsing becomes slower and uses more memory, and
+// only Parser.Parse is affected. Encode does not keep this information.
+func Lossless(enabled bool) ParserOption {
+	return func(p *Parser) { p.lossless = enabled }
+}
+
 type LangVariant int
 
 const (
 	LangBash LangVariant = iota
 	LangPOSIX
 	LangMirBSDKorn
+
+	// LangAuto picks the variant from the shebang at the start of a
+	// program, such as "#!/bin/sh" for LangPOSIX, when using Parse or
+	// Stmts. Otherwise, and if no known shell is found, LangBash is used.
+	LangAuto
 )
 
 // Variant changes the shell language variant that the parser will
 // accept.
 func Variant(l LangVariant) ParserOption {
-	return func(p *Parser) { p.lang = l }
+	return func(p *Parser) {
+		p.variant, p.lang = l, l
+		if l == LangAuto {
+			p.lang = LangBash
+		}
+	}
 }
 
 func (l LangVariant) String() string {
@@ -45,10 +66,67 @@ func (l LangVariant) String() string {
 		return "posix"
 	case LangMirBSDKorn:
 		return "mksh"
+	case LangAuto:
+		return "auto"
 	}
 	return "unknown shell language variant"
 }
 
+// shebangLang returns the language variant for a shebang line without its
+// leading "#", such as "!/usr/bin/env bash". It reports false if the line
+// isn't a shebang, or if it's for an unknown shell.
+func shebangLang(line []byte) (LangVariant, bool) {
+	if len(line) == 0 || line[0] != '!' {
+		return 0, false
+	}
+	fields := strings.Fields(string(line[1:]))
+	if len(fields) == 0 {
+		return 0, false
+	}
+	name := fields[0][strings.LastIndexByte(fields[0], '/')+1:]
+	if name == "env" {
+		name = ""
+		for _, field := range fields[1:] {
+			if !strings.HasPrefix(field, "-") {
+				name = field
+				break
+			}
+		}
+	}
+	switch name {
+	case "sh":
+		return LangPOSIX, true
+	case "bash":
+		return LangBash, true
+	case "mksh":
+		return LangMirBSDKorn, true
+	}
+	return 0, false
+}
+
+// detectLang sets the language variant from the shebang at the start of the
+// input when using LangAuto. It must be called right after reading the first
+// rune.
+func (p *Parser) detectLang() {
+	if p.variant != LangAuto || p.r != '#' {
+		return
+	}
+	for {
+		line := p.bs[p.bsp:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+		} else if p.readErr == nil && len(p.bs) < bufSize {
+			// the first line hasn't been fully read yet
+			p.fill()
+			continue
+		}
+		if lang, ok := shebangLang(line); ok {
+			p.lang = lang
+		}
+		return
+	}
+}
+
 // StopAt configures the lexer to stop at an arbitrary word, treating it
 // as if it were the end of the input. It can contain any characters
 // except whitespace, and cannot be over four bytes in size.
@@ -72,6 +150,51 @@ func StopAt(word string) ParserOption {
 	return func(p *Parser) { p.stopAt = []byte(word) }
 }
 
+// TokenKind describes the broad kind of a token, as reported by the parser
+// when using the Tokens option.
+type TokenKind int
+
+const (
+	TokenLiteral  TokenKind = iota // unquoted literals, like foo or -n
+	TokenString                    // quotes and quoted literals, like " or 'foo'
+	TokenKeyword                   // reserved words, like if or done
+	TokenOperator                  // operators, like &&, > or ${
+	TokenParam                     // parameter names, like foo in $foo
+	TokenComment                   // comments, including the leading #
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenLiteral:
+		return "literal"
+	case TokenString:
+		return "string"
+	case TokenKeyword:
+		return "keyword"
+	case TokenOperator:
+		return "operator"
+	case TokenParam:
+		return "param"
+	case TokenComment:
+		return "comment"
+	}
+	return "unknown token kind"
+}
+
+// Tokens makes the parser call a function for each token it lexes, in the
+// order in which they appear in the input. This includes the tokens within
+// quotes and expansions, as well as comments even if KeepComments is not used.
+//
+// The function is given the kind of the token, its source text, and its
+// position. Whitespace and newlines are not reported.
+//
+// This can be useful to implement tools such as syntax highlighters, as
+// reserved words are only reported as keywords where the parser treats them as
+// such. For example, in "if echo if; then fi", only the first "if" is a keyword.
+func Tokens(fn func(kind TokenKind, val string, pos Pos)) ParserOption {
+	return func(p *Parser) { p.tokenFn = fn }
+}
+
 // NewParser allocates a new Parser and applies any number of options.
 func NewParser(options ...ParserOption) *Parser {
 	p := &Parser{}
@@ -90,8 +213,13 @@ func NewParser(options ...ParserOption) *Parser {
 func (p *Parser) Parse(r io.Reader, name string) (*File, error) {
 	p.reset()
 	p.f = &File{Name: name}
+	var src bytes.Buffer
+	if p.lossless {
+		r = io.TeeReader(r, &src)
+	}
 	p.src = r
 	p.rune()
+	p.detectLang()
 	p.next()
 	p.f.Stmts, p.f.Last = p.stmtList()
 	if p.err == nil {
@@ -99,6 +227,9 @@ func (p *Parser) Parse(r io.Reader, name string) (*File, error) {
 		// trigger it
 		p.doHeredocs()
 	}
+	if p.lossless && p.err == nil {
+		p.f.lossless = newLosslessFile(p.f, src.Bytes())
+	}
 	return p.f, p.err
 }
 
@@ -110,8 +241,10 @@ func (p *Parser) Stmts(r io.Reader, fn func(*Stmt) bool) error {
 	p.f = &File{}
 	p.src = r
 	p.rune()
+	p.detectLang()
 	p.next()
 	p.stmts(fn)
+	p.flushTok()
 	if p.err == nil {
 		// EOF immediately after heredoc word so no newline to
 		// trigger it
@@ -158,8 +291,9 @@ func (w *wrappedReader) Read(p []byte) (n int, err error) {
 // called with said statements.
 //
 // If a line ending in an incomplete statement is parsed, the function will be
-// called with any fully parsed statents, and Parser.Incomplete will return
-// true.
+// called with any fully parsed statements, and Parser.Incomplete will return
+// true. This includes lines ending in an escaped newline, a pending heredoc,
+// or an unclosed quote or compound command.
 //
 // One can imagine a simple interactive shell implementation as follows:
 //
@@ -224,6 +358,7 @@ func (p *Parser) Words(r io.Reader, fn func(*Word) bool) error {
 			return p.err
 		}
 		if !fn(w) {
+			p.flushTok()
 			return nil
 		}
 	}
@@ -259,9 +394,47 @@ func (p *Parser) Arithmetic(r io.Reader) (ArithmExpr, error) {
 	p.quote = arithmExpr
 	p.next()
 	expr := p.arithmExpr(false)
+	switch {
+	case p.err != nil, p.tok == _EOF:
+	case p.tok == _Lit, p.tok == _LitWord:
+		p.curErr("not a valid arithmetic operator: %s", p.val)
+	default:
+		p.curErr("not a valid arithmetic operator: %v", p.tok)
+	}
 	return expr, p.err
 }
 
+// ParseWord parses s as a single shell word, such as a configuration value
+// which may contain quotes and expansions. It uses the Bash language variant,
+// like NewParser does by default.
+//
+// Blanks and newlines around the word are skipped. An error is returned if s
+// contains no word, or if any input follows the word, as in "foo bar".
+func ParseWord(s string) (*Word, error) {
+	p := NewParser()
+	p.reset()
+	p.f = &File{}
+	p.src = strings.NewReader(s)
+	p.rune()
+	p.next()
+	p.got(_Newl)
+	w := p.getWord()
+	p.got(_Newl)
+	switch {
+	case p.err != nil:
+	case w == nil && p.tok == _EOF:
+		p.posErr(p.npos, "expected a word")
+	case w == nil:
+		p.curErr("%s is not a valid word", p.tok)
+	case p.tok == _EOF:
+	case p.tok == _Lit, p.tok == _LitWord:
+		p.curErr("unexpected input after word: %s", p.val)
+	default:
+		p.curErr("unexpected input after word: %v", p.tok)
+	}
+	return w, p.err
+}
+
 // Parser holds the internal state of the parsing mechanism of a
 // program.
 type Parser struct {
@@ -289,10 +462,18 @@ type Parser struct {
 	eqlOffs int        // position of '=' in val (a literal)
 
 	keepComments bool
+	lossless     bool
+	variant      LangVariant // as set via Variant, which may be LangAuto
 	lang         LangVariant
 
 	stopAt []byte
 
+	tokenFn func(TokenKind, string, Pos)
+	// heldTok is a literal word which was lexed but not reported to tokenFn
+	// yet, as the parser might still find it to be a reserved word.
+	heldTok heldToken
+	heldSet bool
+
 	forbidNested bool
 
 	// list of pending heredoc bodies
@@ -309,12 +490,17 @@ type Parser struct {
 	openStmts int
 	// openBquotes is how many levels of backquotes are open at the moment.
 	openBquotes int
+	// dblQuotedBquotes records whether each open level of backquotes
+	// started within double quotes, where \" is also unescaped.
+	dblQuotedBquotes []bool
 
 	// lastBquoteEsc is how many times the last backquote token was escaped
 	lastBquoteEsc int
-	// buriedBquotes is like openBquotes, but saved for when the parser
-	// comes out of single quotes
-	buriedBquotes int
+	// bquoteSlashes is how many of the next backslashes have already been
+	// unescaped for the open backquotes, and bquoteEsc is how many times
+	// the character after them was escaped.
+	bquoteSlashes int
+	bquoteEsc     int
 
 	rxOpenParens int
 	rxFirstPart  bool
@@ -361,8 +547,13 @@ func (p *Parser) reset() {
 	p.openStmts = 0
 	p.heredocs, p.buriedHdocs = p.heredocs[:0], 0
 	p.parsingDoc = false
-	p.openBquotes, p.buriedBquotes = 0, 0
+	p.openBquotes, p.dblQuotedBquotes = 0, p.dblQuotedBquotes[:0]
+	p.bquoteSlashes, p.bquoteEsc = 0, 0
 	p.accComs, p.curComs = nil, &p.accComs
+	p.heldSet = false
+	if p.variant == LangAuto {
+		p.lang = LangBash
+	}
 }
 
 func (p *Parser) getPos() Pos {
@@ -585,6 +776,7 @@ func (p *Parser) got(tok token) bool {
 func (p *Parser) gotRsrv(val string) (Pos, bool) {
 	pos := p.pos
 	if p.tok == _LitWord && p.val == val {
+		p.keyword()
 		p.next()
 		return pos, true
 	}
@@ -675,6 +867,7 @@ func (p *Parser) errPass(err error) {
 		p.r = utf8.RuneSelf
 		p.w = 1
 		p.tok = _EOF
+		p.flushTok()
 	}
 }
 
@@ -982,6 +1175,7 @@ func (p *Parser) wordPart() WordPart {
 		p.ensureNoNested()
 		pe := &ParamExp{Dollar: p.pos, Short: true}
 		p.pos = posAddCol(p.pos, 1)
+		p.lexTok(TokenParam, p.val, p.pos)
 		pe.Param = p.getLit()
 		if pe.Param != nil && pe.Param.Value == "" {
 			l := p.lit(pe.Dollar, "$")
@@ -1012,10 +1206,14 @@ func (p *Parser) wordPart() WordPart {
 			case '\'':
 				sq.Right = p.getPos()
 				sq.Value = p.endLit()
-
-				// restore openBquotes
-				p.openBquotes = p.buriedBquotes
-				p.buriedBquotes = 0
+				if p.tokenFn != nil {
+					left := posAddCol(sq.Left, 1)
+					if sq.Dollar {
+						left = posAddCol(left, 1)
+					}
+					p.lexTok(TokenString, sq.Value, left)
+					p.lexTok(TokenString, "'", sq.Right)
+				}
 
 				p.rune()
 				p.next()
@@ -1040,6 +1238,7 @@ func (p *Parser) wordPart() WordPart {
 		}
 		p.ensureNoNested()
 		cs := &CmdSubst{Left: p.pos, Backquotes: true}
+		p.dblQuotedBquotes = append(p.dblQuotedBquotes, p.quote == dblQuotes)
 		old := p.preNested(subCmdBckquo)
 		p.openBquotes++
 
@@ -1056,6 +1255,7 @@ func (p *Parser) wordPart() WordPart {
 		}
 		p.postNested(old)
 		p.openBquotes--
+		p.dblQuotedBquotes = p.dblQuotedBquotes[:p.openBquotes]
 		cs.Right = p.pos
 
 		// Like above, the lexer didn't call p.rune for us.
@@ -1085,6 +1285,10 @@ func (p *Parser) wordPart() WordPart {
 			}
 		}
 		eg.Pattern = p.lit(posAddCol(eg.OpPos, 2), p.endLit())
+		p.lexTok(TokenLiteral, eg.Pattern.Value, eg.Pattern.ValuePos)
+		if lparens == 0 {
+			p.lexTok(TokenOperator, ")", p.getPos())
+		}
 		p.rune()
 		p.next()
 		if lparens != 0 {
@@ -1126,6 +1330,7 @@ func (p *Parser) paramExp() *ParamExp {
 	if p.r == '#' {
 		p.tok = hash
 		p.pos = p.getPos()
+		p.lexTok(TokenOperator, "#", p.pos)
 		p.rune()
 	} else {
 		p.next()
@@ -1379,6 +1584,7 @@ func (p *Parser) getAssign(needEqual bool) *Assign {
 	} else { // foo[x]=bar
 		as.Name = p.lit(p.pos, p.val)
 		// hasValidIdent already checks p.r is '['
+		p.lexTok(TokenOperator, "[", as.Name.ValueEnd)
 		p.rune()
 		p.pos = posAddCol(p.pos, 1)
 		as.Index = p.eitherIndex()
@@ -1762,6 +1968,7 @@ func (p *Parser) arithmExpCmd(s *Stmt) {
 
 func (p *Parser) block(s *Stmt) {
 	b := &Block{Lbrace: p.pos}
+	p.keyword()
 	p.next()
 	b.Stmts, b.Last = p.stmtList("}")
 	pos, ok := p.gotRsrv("}")
@@ -1774,6 +1981,7 @@ func (p *Parser) block(s *Stmt) {
 
 func (p *Parser) ifClause(s *Stmt) {
 	rootIf := &IfClause{Position: p.pos}
+	p.keyword()
 	p.next()
 	rootIf.Cond, rootIf.CondLast = p.followStmts("if", rootIf.Position, "then")
 	rootIf.ThenPos = p.followRsrv(rootIf.Position, "if <cond>", "then")
@@ -1783,6 +1991,7 @@ func (p *Parser) ifClause(s *Stmt) {
 		elf := &IfClause{Position: p.pos}
 		curIf.Last = p.accComs
 		p.accComs = nil
+		p.keyword()
 		p.next()
 		elf.Cond, elf.CondLast = p.followStmts("elif", elf.Position, "then")
 		elf.ThenPos = p.followRsrv(elf.Position, "elif <cond>", "then")
@@ -1816,6 +2025,7 @@ func (p *Parser) whileClause(s *Stmt, until bool) {
 		rsrv = "until"
 		rsrvCond = "until <cond>"
 	}
+	p.keyword()
 	p.next()
 	wc.Cond, wc.CondLast = p.followStmts(rsrv, wc.WhilePos, "do")
 	wc.DoPos = p.followRsrv(wc.WhilePos, rsrvCond, "do")
@@ -1826,6 +2036,7 @@ func (p *Parser) whileClause(s *Stmt, until bool) {
 
 func (p *Parser) forClause(s *Stmt) {
 	fc := &ForClause{ForPos: p.pos}
+	p.keyword()
 	p.next()
 	fc.Loop = p.loop(fc.ForPos)
 
@@ -1904,6 +2115,7 @@ func (p *Parser) wordIter(ftok string, fpos Pos) *WordIter {
 
 func (p *Parser) selectClause(s *Stmt) {
 	fc := &ForClause{ForPos: p.pos, Select: true}
+	p.keyword()
 	p.next()
 	fc.Loop = p.wordIter("select", fc.ForPos)
 	fc.DoPos = p.followRsrv(fc.ForPos, "select foo [in words]", "do")
@@ -1914,6 +2126,7 @@ func (p *Parser) selectClause(s *Stmt) {
 
 func (p *Parser) caseClause(s *Stmt) {
 	cc := &CaseClause{Case: p.pos}
+	p.keyword()
 	p.next()
 	cc.Word = p.getWord()
 	if cc.Word == nil {
@@ -1993,6 +2206,7 @@ func (p *Parser) caseItems(stop string) (items []*CaseItem) {
 func (p *Parser) testClause(s *Stmt) {
 	tc := &TestClause{Left: p.pos}
 	old := p.preNested(testExpr)
+	p.keyword()
 	p.next()
 	if _, ok := p.gotRsrv("]]"); ok || p.tok == _EOF {
 		p.posErr(tc.Left, "test clause requires at least one expression")
@@ -2171,9 +2385,11 @@ func isBashCompoundCommand(tok token, val string) bool {
 
 func (p *Parser) timeClause(s *Stmt) {
 	tc := &TimeClause{Time: p.pos}
+	p.keyword()
 	p.next()
-	if _, ok := p.gotRsrv("-p"); ok {
+	if p.tok == _LitWord && p.val == "-p" {
 		tc.PosixFormat = true
+		p.next()
 	}
 	tc.Stmt = p.gotStmtPipe(p.stmt(p.pos), false)
 	s.Cmd = tc
@@ -2181,6 +2397,7 @@ func (p *Parser) timeClause(s *Stmt) {
 
 func (p *Parser) coprocClause(s *Stmt) {
 	cc := &CoprocClause{Coproc: p.pos}
+	p.keyword()
 	if p.next(); isBashCompoundCommand(p.tok, p.val) {
 		// has no name
 		cc.Stmt = p.gotStmtPipe(p.stmt(p.pos), false)
@@ -2228,6 +2445,7 @@ func (p *Parser) letClause(s *Stmt) {
 
 func (p *Parser) bashFuncDecl(s *Stmt) {
 	fpos := p.pos
+	p.keyword()
 	if p.next(); p.tok != _LitWord {
 		p.followErr(fpos, "function", "a name")
 	}
@@ -345,6 +345,7 @@ func (p *Parser) arithmEnd(ltok token, lpos Pos, old saveState) Pos {
 	if !p.peekArithmEnd() {
 		p.arithmMatchingErr(lpos, ltok, dblRightParen)
 	}
+	p.lexTok(TokenOperator, ")", p.getPos())
 	p.rune()
 	p.postNested(old)
 	pos := p.pos
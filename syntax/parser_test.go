@@ -14,6 +14,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/kr/pretty"
 )
@@ -31,6 +32,45 @@ func TestKeepComments(t *testing.T) {
 	singleParse(NewParser(KeepComments(true)), in, want)(t)
 }
 
+func TestKeepCommentsFunc(t *testing.T) {
+	t.Parallel()
+	in := "# foo does things.\n# More.\nfoo() {\n\tbar # inner\n\t# last\n} # after\n"
+	want := &File{
+		Stmts: []*Stmt{{
+			Comments: []Comment{
+				{Text: " foo does things."},
+				{Text: " More."},
+				{Text: " after"},
+			},
+			Cmd: &FuncDecl{
+				Name: lit("foo"),
+				Body: stmt(&Block{
+					Stmts: []*Stmt{{
+						Comments: []Comment{{Text: " inner"}},
+						Cmd:      litCall("bar"),
+					}},
+					Last: []Comment{{Text: " last"}},
+				}),
+			},
+		}},
+		Last: []Comment{},
+	}
+	p := NewParser(KeepComments(true))
+	singleParse(p, in, want)(t)
+
+	f, err := p.Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := NewPrinter().Print(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != in {
+		t.Fatalf("comments not printed back:\nwant: %q\ngot:  %q", in, got)
+	}
+}
+
 func TestParseBash(t *testing.T) {
 	t.Parallel()
 	p := NewParser()
@@ -294,23 +334,26 @@ func singleParse(p *Parser, in string, want *File) func(t *testing.T) {
 	}
 }
 
+// benchmarkSrc is a program with a bit of everything, used in benchmarks.
+var benchmarkSrc = "" +
+	strings.Repeat("\n\n\t\t        \n", 10) +
+	"# " + strings.Repeat("foo bar ", 10) + "\n" +
+	strings.Repeat("longlit_", 10) + "\n" +
+	"'" + strings.Repeat("foo bar ", 10) + "'\n" +
+	`"` + strings.Repeat("foo bar ", 10) + `"` + "\n" +
+	strings.Repeat("aa bb cc dd; ", 6) +
+	"a() { (b); { c; }; }; $(d; `e`)\n" +
+	"foo=bar; a=b; c=d$foo${bar}e $simple ${complex:-default}\n" +
+	"if a; then while b; do for c in d e; do f; done; done; fi\n" +
+	"a | b && c || d | e && g || f\n" +
+	"foo >a <b <<<c 2>&1 <<EOF\n" +
+	strings.Repeat("somewhat long heredoc line\n", 10) +
+	"EOF" +
+	""
+
 func BenchmarkParse(b *testing.B) {
 	b.ReportAllocs()
-	src := "" +
-		strings.Repeat("\n\n\t\t        \n", 10) +
-		"# " + strings.Repeat("foo bar ", 10) + "\n" +
-		strings.Repeat("longlit_", 10) + "\n" +
-		"'" + strings.Repeat("foo bar ", 10) + "'\n" +
-		`"` + strings.Repeat("foo bar ", 10) + `"` + "\n" +
-		strings.Repeat("aa bb cc dd; ", 6) +
-		"a() { (b); { c; }; }; $(d; `e`)\n" +
-		"foo=bar; a=b; c=d$foo${bar}e $simple ${complex:-default}\n" +
-		"if a; then while b; do for c in d e; do f; done; done; fi\n" +
-		"a | b && c || d | e && g || f\n" +
-		"foo >a <b <<<c 2>&1 <<EOF\n" +
-		strings.Repeat("somewhat long heredoc line\n", 10) +
-		"EOF" +
-		""
+	src := benchmarkSrc
 	p := NewParser(KeepComments(true))
 	in := strings.NewReader(src)
 	for i := 0; i < b.N; i++ {
@@ -1905,6 +1948,39 @@ func TestReadErr(t *testing.T) {
 	}
 }
 
+func TestBquoteBackslashes(t *testing.T) {
+	t.Parallel()
+	// A run of backslashes longer than the read buffer, which must be
+	// read in full to unescape it.
+	in := "echo `echo " + strings.Repeat(`\\`, bufSize*2) + "`"
+	f, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := f.Stmts[0].Cmd.(*CallExpr).Args[1].Parts[0].(*CmdSubst)
+	got := cs.Stmts[0].Cmd.(*CallExpr).Args[1].Lit()
+	if want := strings.Repeat(`\\`, bufSize); got != want {
+		t.Fatalf("want %d backslashes, got %d", len(want), len(got))
+	}
+}
+
+func TestBquoteEscapedEnd(t *testing.T) {
+	t.Parallel()
+	// The middle statement is ended by an escaped backquote, so the
+	// source at its end is a backslash.
+	in := "`echo \\`echo \\\\\\`x\\\\\\`\\``"
+	f, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer := f.Stmts[0].Cmd.(*CallExpr).Args[0].Parts[0].(*CmdSubst)
+	middle := outer.Stmts[0].Cmd.(*CallExpr).Args[1].Parts[0].(*CmdSubst)
+	got := in[middle.Stmts[0].End().Offset():]
+	if want := "\\``"; got != want {
+		t.Fatalf("want the statement to end before %q, got %q", want, got)
+	}
+}
+
 type strictStringReader struct {
 	*strings.Reader
 	gaveEOF bool
@@ -2109,6 +2185,70 @@ func TestParseDocumentError(t *testing.T) {
 	}
 }
 
+var parseWordTests = []struct {
+	in   string
+	want []WordPart
+}{
+	{
+		"foo",
+		[]WordPart{lit("foo")},
+	},
+	{
+		" foo=$bar\n",
+		[]WordPart{
+			lit("foo="),
+			litParamExp("bar"),
+		},
+	},
+	{
+		`'a b'"$c"d`,
+		[]WordPart{
+			sglQuoted("a b"),
+			dblQuoted(litParamExp("c")),
+			lit("d"),
+		},
+	},
+}
+
+func TestParseWord(t *testing.T) {
+	t.Parallel()
+	for i, tc := range parseWordTests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			got, err := ParseWord(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clearPosRecurse(t, "", got)
+			want := &Word{Parts: tc.want}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("syntax tree mismatch in %q\ndiff:\n%s", tc.in,
+					strings.Join(pretty.Diff(want, got), "\n"))
+			}
+		})
+	}
+}
+
+func TestParseWordError(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"", "1:1: expected a word"},
+		{")", "1:1: ) is not a valid word"},
+		{"foo bar", "1:5: unexpected input after word: bar"},
+		{"foo;", "1:4: unexpected input after word: ;"},
+		{"foo >bar", "1:5: unexpected input after word: >"},
+		{"foo$(", "1:4: reached EOF without matching ( with )"},
+	}
+	for _, tc := range tests {
+		_, err := ParseWord(tc.in)
+		got := fmt.Sprintf("%v", err)
+		if got != tc.want {
+			t.Fatalf("Expected %q as an error, but got %q", tc.want, got)
+		}
+	}
+}
+
 var arithmeticTests = []struct {
 	in   string
 	want ArithmExpr
@@ -2195,13 +2335,20 @@ func TestParseArithmetic(t *testing.T) {
 
 func TestParseArithmeticError(t *testing.T) {
 	t.Parallel()
-	in := "3 +"
+	tests := []struct {
+		in, want string
+	}{
+		{"3 +", "1:3: + must be followed by an expression"},
+		{"a b", "1:3: not a valid arithmetic operator: b"},
+		{"a ; b", "1:3: not a valid arithmetic operator: ;"},
+	}
 	p := NewParser()
-	_, err := p.Arithmetic(strings.NewReader(in))
-	want := "1:3: + must be followed by an expression"
-	got := fmt.Sprintf("%v", err)
-	if got != want {
-		t.Fatalf("Expected %q as an error, but got %q", want, got)
+	for _, tc := range tests {
+		_, err := p.Arithmetic(strings.NewReader(tc.in))
+		got := fmt.Sprintf("%v", err)
+		if got != tc.want {
+			t.Fatalf("Expected %q as an error, but got %q", tc.want, got)
+		}
 	}
 }
 
@@ -2257,6 +2404,124 @@ func TestParseStmtsStopAt(t *testing.T) {
 	}
 }
 
+var tokensTests = []struct {
+	in   string
+	want []string
+}{
+	{"foo bar", []string{"literal foo 1:1", "literal bar 1:5"}},
+	{
+		"if echo if; then :; fi # c",
+		[]string{
+			"keyword if 1:1", "literal echo 1:4", "literal if 1:9",
+			"operator ; 1:11", "keyword then 1:13", "literal : 1:18",
+			"operator ; 1:19", "keyword fi 1:21", "comment # c 1:24",
+		},
+	},
+	{
+		`echo "a $b" 'c' ${d:-e}`,
+		[]string{
+			"literal echo 1:1", `string " 1:6`, "string a  1:7",
+			"operator $ 1:9", "param b 1:10", `string " 1:11`,
+			"string ' 1:13", "string c 1:14", "string ' 1:15",
+			"operator ${ 1:17", "param d 1:19", "operator :- 1:20",
+			"literal e 1:22", "operator } 1:23",
+		},
+	},
+	{
+		"for i in a; do (( i++ )); done",
+		[]string{
+			"keyword for 1:1", "literal i 1:5", "keyword in 1:7",
+			"literal a 1:10", "operator ; 1:11", "keyword do 1:13",
+			"operator (( 1:16", "literal i 1:19", "operator ++ 1:20",
+			"operator ) 1:23", "operator ) 1:24", "operator ; 1:25",
+			"keyword done 1:27",
+		},
+	},
+	{
+		"cat <<EOF\nx $y\nEOF",
+		[]string{
+			"literal cat 1:1", "operator << 1:5", "literal EOF 1:7",
+			"string x  2:1", "operator $ 2:3", "param y 2:4",
+			"string \n 2:5",
+		},
+	},
+	{
+		"[[ -n @(a|b) ]] && ! { `ls`; }",
+		[]string{
+			"keyword [[ 1:1", "literal -n 1:4", "operator @( 1:7",
+			"literal a|b 1:9", "operator ) 1:12", "keyword ]] 1:14",
+			"operator && 1:17", "keyword ! 1:20", "keyword { 1:22",
+			"operator ` 1:24", "literal ls 1:25", "operator ` 1:27",
+			"operator ; 1:28", "keyword } 1:30",
+		},
+	},
+}
+
+func TestTokens(t *testing.T) {
+	t.Parallel()
+	for i, tc := range tokensTests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			var got []string
+			p := NewParser(Tokens(func(kind TokenKind, val string, pos Pos) {
+				got = append(got, fmt.Sprintf("%s %s %s", kind, val, pos))
+			}))
+			if _, err := p.Parse(strings.NewReader(tc.in), ""); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("tokens mismatch in %q\nwant: %q\ngot:  %q",
+					tc.in, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLangAuto(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		variant LangVariant
+		in      string
+		wantErr bool
+	}{
+		{"NoShebang", LangAuto, "foo=(bar)", false},
+		{"Comment", LangAuto, "# comment\nfoo=(bar)", false},
+		{"Sh", LangAuto, "#!/bin/sh\nfoo=(bar)", true},
+		{"ShSpace", LangAuto, "#! /bin/sh -e\nfoo=(bar)", true},
+		{"Bash", LangAuto, "#!/bin/bash\nfoo=(bar)", false},
+		{"EnvSh", LangAuto, "#!/usr/bin/env sh\nfoo=(bar)", true},
+		{"EnvFlags", LangAuto, "#!/usr/bin/env -S sh -e\nfoo=(bar)", true},
+		{"EnvBash", LangAuto, "#!/usr/bin/env bash\nfoo=(bar)", false},
+		{"Mksh", LangAuto, "#!/bin/mksh\necho ${|foo;}", false},
+		{"BashMksh", LangAuto, "#!/bin/bash\necho ${|foo;}", true},
+		{"Unknown", LangAuto, "#!/bin/zsh\nfoo=(bar)", false},
+		{"Explicit", LangPOSIX, "#!/bin/bash\nfoo=(bar)", true},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			p := NewParser(Variant(tc.variant))
+			for _, r := range []io.Reader{
+				strings.NewReader(tc.in),
+				iotest.OneByteReader(strings.NewReader(tc.in)),
+			} {
+				_, err := p.Parse(r, "")
+				if tc.wantErr && err == nil {
+					t.Fatalf("Parse(%q) did not error", tc.in)
+				}
+				if !tc.wantErr && err != nil {
+					t.Fatalf("Parse(%q) errored: %v", tc.in, err)
+				}
+			}
+			// The variant must be detected anew for each program.
+			if _, err := p.Parse(strings.NewReader("foo=(bar)"), ""); err != nil && tc.variant == LangAuto {
+				t.Fatalf("Parse without a shebang errored: %v", err)
+			}
+		})
+	}
+}
+
 func TestValidName(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
@@ -2282,6 +2547,96 @@ func TestValidName(t *testing.T) {
 	}
 }
 
+var interactiveTests = []struct {
+	lines []string
+	want  []string
+}{
+	{
+		[]string{"foo\n"},
+		[]string{"1"},
+	},
+	{
+		[]string{"foo; bar\n"},
+		[]string{"2"},
+	},
+	{
+		[]string{"\n", "foo\n"},
+		[]string{"0", "1"},
+	},
+	{
+		[]string{"foo \\\n", "bar\n"},
+		[]string{"0 >", "1"},
+	},
+	{
+		[]string{"echo 'a\n", "b'\n"},
+		[]string{"0 >", "1"},
+	},
+	{
+		[]string{"foo &&\n", "bar\n"},
+		[]string{"0 >", "1"},
+	},
+	{
+		[]string{"foo |\n", "bar\n"},
+		[]string{"0 >", "1"},
+	},
+	{
+		[]string{"if foo; then\n", "bar\n", "fi\n"},
+		[]string{"0 >", "0 >", "1"},
+	},
+	{
+		[]string{"f() {\n", "bar\n", "}\n", "f\n"},
+		[]string{"0 >", "0 >", "1", "1"},
+	},
+	{
+		[]string{"echo $(\n", "foo)\n"},
+		[]string{"0 >", "1"},
+	},
+	{
+		[]string{"cat <<EOF\n", "body\n", "EOF\n"},
+		[]string{"0 >", "0 >", "1"},
+	},
+	{
+		[]string{"cat <<EOF; foo\n", "body\n", "EOF\n", "bar\n"},
+		[]string{"1 >", "1 >", "2", "1"},
+	},
+}
+
+func TestInteractive(t *testing.T) {
+	t.Parallel()
+	for i, tc := range interactiveTests {
+		tc := tc
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			t.Parallel()
+			// Feed the input one line at a time, like a terminal
+			// would, so that the parser blocks waiting for more.
+			pr, pw := io.Pipe()
+			go func() {
+				for _, line := range tc.lines {
+					io.WriteString(pw, line)
+				}
+				pw.Close()
+			}()
+			p := NewParser()
+			var got []string
+			err := p.Interactive(pr, func(stmts []*Stmt) bool {
+				call := fmt.Sprint(len(stmts))
+				if p.Incomplete() {
+					call += " >"
+				}
+				got = append(got, call)
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("callbacks mismatch in %q\nwant: %q\ngot:  %q",
+					tc.lines, tc.want, got)
+			}
+		})
+	}
+}
+
 func TestIsIncomplete(t *testing.T) {
 	t.Parallel()
 
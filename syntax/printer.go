@@ -82,6 +82,19 @@ func FunctionNextLine(enabled bool) PrinterOption {
 	return func(p *Printer) { p.funcNextLine = enabled }
 }
 
+// PrintExact will print files parsed with Lossless exactly as they were in the
+// original source, byte for byte. Only the nodes which were modified or added
+// since are printed anew, following the other printer options.
+//
+// When a modification can't be printed on its own, such as a literal within
+// double quotes, the closest parent node which can be is printed anew instead.
+// Modifications involving heredocs, or to the list of statements of a file,
+// make the entire file be printed anew. Nodes other than files, and files not
+// parsed with Lossless, are printed as usual.
+func PrintExact(enabled bool) PrinterOption {
+	return func(p *Printer) { p.exact = enabled }
+}
+
 // NewPrinter allocates a new Printer and applies any number of options.
 func NewPrinter(opts ...PrinterOption) *Printer {
 	p := &Printer{
@@ -97,10 +110,13 @@ func NewPrinter(opts ...PrinterOption) *Printer {
 // Print "pretty-prints" the given syntax tree node to the given writer. Writes
 // to w are buffered.
 //
-// The node types supported at the moment are *File, *Stmt, *Word, any Command
-// node, and any WordPart node. A trailing newline will only be printed when a
-// *File is used.
+// The node types supported at the moment are *File, *Stmt, *Word, *Redirect,
+// any Command node, and any WordPart node. A trailing newline will only be
+// printed when a *File is used.
 func (p *Printer) Print(w io.Writer, node Node) error {
+	if f, ok := node.(*File); ok && p.exact && f.lossless != nil {
+		return p.printExact(w, f, f.lossless)
+	}
 	p.reset()
 
 	// TODO: consider adding a raw mode to skip the tab writer, much like in
@@ -132,7 +148,10 @@ func (p *Printer) Print(w io.Writer, node Node) error {
 		p.word(x)
 	case WordPart:
 		p.line = x.Pos().Line()
-		p.wordPart(x, nil)
+		p.wordParts([]WordPart{x}, false)
+	case *Redirect:
+		p.line = x.Pos().Line()
+		p.redirect(x)
 	default:
 		return fmt.Errorf("unsupported node type: %T", x)
 	}
@@ -209,6 +228,7 @@ type Printer struct {
 	keepPadding    bool
 	minify         bool
 	funcNextLine   bool
+	exact          bool
 
 	wantSpace   bool
 	wantNewline bool
@@ -547,11 +567,47 @@ func (p *Printer) wordParts(wps []WordPart, quoted bool) {
 				p.bslashNewl()
 			}
 		}
-		p.wordPart(wp, next)
+		if lit, ok := wp.(*Lit); ok && !quoted && litNeedsQuotes(lit.Value, i == 0) {
+			p.writeLit(Quote(lit.Value))
+		} else {
+			p.wordPart(wp, next)
+		}
 		p.line = wp.End().Line()
 	}
 }
 
+// litNeedsQuotes reports whether an unquoted literal would not be parsed back
+// as the same literal if printed as-is, such as "a b" or "$foo". This can only
+// happen with nodes built by hand, since the parser keeps the source of each
+// literal, including any backslashes.
+func litNeedsQuotes(s string, wordStart bool) bool {
+	if wordStart && strings.HasPrefix(s, "#") {
+		return true // a comment
+	}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case ' ', '\t', '\n', ';', '&', '|', '(', ')', '<', '>', '\'', '"', '`':
+			return true
+		case '$':
+			if i+1 < len(s) && paramStart(s[i+1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// paramStart reports whether a byte following '$' starts an expansion.
+func paramStart(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("_{(['\"#?*@!$-", b) >= 0
+}
+
 func (p *Printer) wordPart(wp, next WordPart) {
 	switch x := wp.(type) {
 	case *Lit:
@@ -691,18 +747,18 @@ func (p *Printer) paramExp(pe *ParamExp) {
 		}
 		p.WriteByte('/')
 		if pe.Repl.Orig != nil {
-			p.word(pe.Repl.Orig)
+			p.rawWord(pe.Repl.Orig)
 		}
 		p.WriteByte('/')
 		if pe.Repl.With != nil {
-			p.word(pe.Repl.With)
+			p.rawWord(pe.Repl.With)
 		}
 	case pe.Names != 0:
 		p.writeLit(pe.Names.String())
 	case pe.Exp != nil:
 		p.WriteString(pe.Exp.Op.String())
 		if pe.Exp.Word != nil {
-			p.word(pe.Exp.Word)
+			p.rawWord(pe.Exp.Word)
 		}
 	}
 	p.WriteByte('}')
@@ -781,6 +837,12 @@ func (p *Printer) testExpr(expr TestExpr) {
 		p.space()
 		p.WriteString(x.Op.String())
 		p.space()
+		if w, ok := x.Y.(*Word); ok && x.Op == TsReMatch {
+			// Quoting a regular expression like "a|b" would
+			// change its meaning.
+			p.rawWord(w)
+			break
+		}
 		p.testExpr(x.Y)
 	case *UnaryTest:
 		p.WriteString(x.Op.String())
@@ -798,6 +860,13 @@ func (p *Printer) word(w *Word) {
 	p.wantSpace = true
 }
 
+// rawWord is like word, but it never quotes literals, as the word is in a
+// context where blanks and operators don't split words, like "${foo:-a b}".
+func (p *Printer) rawWord(w *Word) {
+	p.wordParts(w.Parts, true)
+	p.wantSpace = true
+}
+
 func (p *Printer) unquotedWord(w *Word) {
 	for _, wp := range w.Parts {
 		switch x := wp.(type) {
@@ -908,19 +977,7 @@ func (p *Printer) stmt(s *Stmt) {
 		if p.wantSpace {
 			p.spacePad(r.Pos())
 		}
-		if r.N != nil {
-			p.writeLit(r.N.Value)
-		}
-		p.WriteString(r.Op.String())
-		if p.spaceRedirects && (r.Op != DplIn && r.Op != DplOut) {
-			p.space()
-		} else {
-			p.wantSpace = true
-		}
-		p.word(r.Word)
-		if r.Op == Hdoc || r.Op == DashHdoc {
-			p.pendingHdocs = append(p.pendingHdocs, r)
-		}
+		p.redirect(r)
 	}
 	p.wroteSemi = true
 	switch {
@@ -946,6 +1003,24 @@ func (p *Printer) stmt(s *Stmt) {
 	p.decLevel()
 }
 
+// redirect prints a redirection, such as "2>file" or "{fd}>&-". The body of a
+// here-document is printed later, once the line is finished.
+func (p *Printer) redirect(r *Redirect) {
+	if r.N != nil {
+		p.writeLit(r.N.Value)
+	}
+	p.WriteString(r.Op.String())
+	if p.spaceRedirects && (r.Op != DplIn && r.Op != DplOut) {
+		p.space()
+	} else {
+		p.wantSpace = true
+	}
+	p.word(r.Word)
+	if r.Op == Hdoc || r.Op == DashHdoc {
+		p.pendingHdocs = append(p.pendingHdocs, r)
+	}
+}
+
 func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 	p.spacePad(cmd.Pos())
 	switch x := cmd.(type) {
@@ -963,16 +1038,7 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 			if p.wantSpace {
 				p.spacePad(r.Pos())
 			}
-			if r.N != nil {
-				p.writeLit(r.N.Value)
-			}
-			p.WriteString(r.Op.String())
-			if p.spaceRedirects && (r.Op != DplIn && r.Op != DplOut) {
-				p.space()
-			} else {
-				p.wantSpace = true
-			}
-			p.word(r.Word)
+			p.redirect(r)
 			startRedirs++
 		}
 		p.wordJoin(x.Args[1:])
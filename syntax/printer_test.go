@@ -87,6 +87,8 @@ var printTests = []printCase{
 	samePrint("foo >&2 <f bar"),
 	samePrint("foo >&2 bar <f"),
 	{"foo >&2 bar <f bar2", "foo >&2 bar bar2 <f"},
+	samePrint("foo &>f | bar &>>g"),
+	{"&>f foo | &>>g bar", "foo &>f | bar &>>g"},
 	{"foo <<EOF bar\nl1\nEOF", "foo bar <<EOF\nl1\nEOF"},
 	samePrint("foo <<\\\\\\\\EOF\nbar\n\\\\EOF"),
 	samePrint("foo <<\"\\EOF\"\nbar\n\\EOF"),
@@ -373,6 +375,7 @@ var printTests = []printCase{
 	samePrint("case $i in\n#bef\n1) ;; #inl\nesac"),
 	samePrint("case $i in\n1) ;; #inl1\n2) ;; #inl2\nesac"),
 	samePrint("case $i in\n#bef\n1) #inl\n\tfoo\n\t;;\nesac"),
+	samePrint("case $i in\n1)\n\tfoo\n\t;&\n2)\n\tbar\n\t;;&\n*) baz ;;\nesac"),
 	samePrint("case $i in\n1) #inl\n\t;;\nesac"),
 	samePrint("case $i in\n1) a \\\n\tb ;;\nesac"),
 	samePrint("case $i in\n1 | 2 | \\\n\t3 | 4) a b ;;\nesac"),
@@ -1030,6 +1033,45 @@ func TestPrintNodeTypes(t *testing.T) {
 			in:   sglQuoted("foo"),
 			want: "'foo'",
 		},
+		{
+			in:   litCall("echo", "a b", "it's", "$foo", "a;b", "#x", "x#", "$", "a$/", "*.go", `a\ b`),
+			want: `echo 'a b' 'it'\''s' '$foo' 'a;b' '#x' x# $ a$/ *.go a\ b`,
+		},
+		{
+			in:   lit("a b"),
+			want: "'a b'",
+		},
+		{
+			in:   word(lit("a b"), dblQuoted(lit("c d"))),
+			want: `'a b'"c d"`,
+		},
+		{
+			in:   litWord("line\nbreak"),
+			want: "$'line\\nbreak'",
+		},
+		{
+			in: word(&ParamExp{Param: lit("x"), Exp: &Expansion{
+				Op:   DefaultUnset,
+				Word: litWord("a b"),
+			}}),
+			want: "${x-a b}",
+		},
+		{
+			in: &TestClause{X: &BinaryTest{
+				Op: TsReMatch,
+				X:  litWord("x"),
+				Y:  litWord("a|b c"),
+			}},
+			want: "[[ x =~ a|b c ]]",
+		},
+		{
+			in:   &Redirect{Op: RdrOut, N: lit("2"), Word: litWord("f")},
+			want: "2>f",
+		},
+		{
+			in:   &Redirect{Op: DplOut, N: lit("{fd}"), Word: litWord("-")},
+			want: "{fd}>&-",
+		},
 		{
 			in:      &Comment{},
 			wantErr: true,
@@ -0,0 +1,91 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Quote returns a quoted version of s which the shell reads back as a single
+// word with the exact value s, such as for the "${var@Q}" expansion.
+//
+// Like in Bash, the empty string is quoted as a pair of single quotes, strings
+// containing non-printable characters like newlines are quoted with $'...' and
+// escape sequences, and strings using any other characters which the shell
+// would interpret are single-quoted. Strings which are safe as-is are left
+// unquoted.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for i, r := range s {
+		switch {
+		case r == utf8.RuneError, !unicode.IsPrint(r):
+			return ansiQuote(s)
+		case quoteSafe(r):
+		case (r == '~' || r == '#') && i > 0:
+		default:
+			safe = false
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// quoteSafe reports whether a printable character never needs quoting.
+func quoteSafe(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	case r >= utf8.RuneSelf:
+		return true
+	}
+	return strings.ContainsRune("%+-./:=@_", r)
+}
+
+// ansiQuote quotes a string with $'...', escaping any non-printable
+// characters and invalid UTF-8 bytes.
+func ansiQuote(s string) string {
+	var sb strings.Builder
+	sb.WriteString("$'")
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		switch {
+		case r == '\'' || r == '\\':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r == '\a':
+			sb.WriteString(`\a`)
+		case r == '\b':
+			sb.WriteString(`\b`)
+		case r == '\x1b':
+			sb.WriteString(`\E`)
+		case r == '\f':
+			sb.WriteString(`\f`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r == '\v':
+			sb.WriteString(`\v`)
+		case r == utf8.RuneError || !unicode.IsPrint(r):
+			for i := 0; i < size; i++ {
+				fmt.Fprintf(&sb, `\%03o`, s[i])
+			}
+		default:
+			sb.WriteString(s[:size])
+		}
+		s = s[size:]
+	}
+	sb.WriteByte('\'')
+	return sb.String()
+}
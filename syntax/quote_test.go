@@ -0,0 +1,68 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"strings"
+	"testing"
+)
+
+var quoteTests = []struct {
+	in, want string
+}{
+	{"", `''`},
+	{"foo", `foo`},
+	{"a-b.c/d:e=f@g%h+_", `a-b.c/d:e=f@g%h+_`},
+	{"世界", `世界`},
+	{"a~#", `a~#`},
+	{"~a", `'~a'`},
+	{"#a", `'#a'`},
+	{"a b", `'a b'`},
+	{"a\tb", `$'a\tb'`},
+	{"$foo", `'$foo'`},
+	{`a"b`, `'a"b'`},
+	{"it's", `'it'\''s'`},
+	{`a\b`, `'a\b'`},
+	{"*?[]{},;&|<>()!`^", "'*?[]{},;&|<>()!`^'"},
+	{"a\nb", `$'a\nb'`},
+	{"\a\b\x1b\f\r\v", `$'\a\b\E\f\r\v'`},
+	{"'\\\n", `$'\'\\\n'`},
+	{"\x01\x7f", `$'\001\177'`},
+	{"a b\n", `$'a b\n'`},
+	{"\xff", `$'\377'`},
+	{"é\xc3", `$'é\303'`},
+}
+
+func TestQuote(t *testing.T) {
+	t.Parallel()
+	p := NewParser()
+	for _, tc := range quoteTests {
+		got := Quote(tc.in)
+		if got != tc.want {
+			t.Errorf("Quote(%q) got %q, want %q", tc.in, got, tc.want)
+			continue
+		}
+		// The result must be a single word with no expansions.
+		var words []*Word
+		err := p.Words(strings.NewReader(got), func(w *Word) bool {
+			words = append(words, w)
+			return true
+		})
+		if err != nil {
+			t.Errorf("Quote(%q) gave %q, which fails to parse: %v", tc.in, got, err)
+			continue
+		}
+		if len(words) != 1 {
+			t.Errorf("Quote(%q) gave %q, which is %d words", tc.in, got, len(words))
+			continue
+		}
+		for _, part := range words[0].Parts {
+			switch part.(type) {
+			case *Lit, *SglQuoted:
+			default:
+				t.Errorf("Quote(%q) gave %q, which has a %T", tc.in, got, part)
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2020, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// operatorFamilies lists every exported operator, grouped by type. Each
+// operator's String method must give its exact lexeme, and no two operators of
+// the same type may share one, so that an operator can be found from its
+// lexeme given the node it appears in.
+var operatorFamilies = map[string][]fmt.Stringer{
+	"RedirOperator": {
+		RdrOut, AppOut, RdrIn, RdrInOut, DplIn, DplOut, ClbOut,
+		Hdoc, DashHdoc, WordHdoc, RdrAll, AppAll,
+	},
+	"ProcOperator": {CmdIn, CmdOut},
+	"GlobOperator": {
+		GlobZeroOrOne, GlobZeroOrMore, GlobOneOrMore, GlobOne, GlobExcept,
+	},
+	"BinCmdOperator":   {AndStmt, OrStmt, Pipe, PipeAll},
+	"CaseOperator":     {Break, Fallthrough, Resume, ResumeKorn},
+	"ParNamesOperator": {NamesPrefix, NamesPrefixWords},
+	"ParExpOperator": {
+		AlternateUnset, AlternateUnsetOrNull, DefaultUnset,
+		DefaultUnsetOrNull, ErrorUnset, ErrorUnsetOrNull, AssignUnset,
+		AssignUnsetOrNull, RemSmallSuffix, RemLargeSuffix, RemSmallPrefix,
+		RemLargePrefix, UpperFirst, UpperAll, LowerFirst, LowerAll,
+		OtherParamOps,
+	},
+	"UnAritOperator": {Not, BitNegation, Inc, Dec, Plus, Minus},
+	"BinAritOperator": {
+		Add, Sub, Mul, Quo, Rem, Pow, Eql, Gtr, Lss, Neq, Leq, Geq,
+		And, Or, Xor, Shr, Shl, AndArit, OrArit, Comma, TernQuest,
+		TernColon, Assgn, AddAssgn, SubAssgn, MulAssgn, QuoAssgn,
+		RemAssgn, AndAssgn, OrAssgn, XorAssgn, ShlAssgn, ShrAssgn,
+	},
+	"UnTestOperator": {
+		TsExists, TsRegFile, TsDirect, TsCharSp, TsBlckSp, TsNmPipe,
+		TsSocket, TsSmbLink, TsSticky, TsGIDSet, TsUIDSet, TsGrpOwn,
+		TsUsrOwn, TsModif, TsRead, TsWrite, TsExec, TsNoEmpty, TsFdTerm,
+		TsEmpStr, TsNempStr, TsOptSet, TsVarSet, TsRefVar, TsNot,
+	},
+	"BinTestOperator": {
+		TsReMatch, TsNewer, TsOlder, TsDevIno, TsEql, TsNeq, TsLeq,
+		TsGeq, TsLss, TsGtr, AndTest, OrTest, TsMatchShort, TsMatch,
+		TsNoMatch, TsBefore, TsAfter,
+	},
+}
+
+func TestOperatorStrings(t *testing.T) {
+	t.Parallel()
+	for name, ops := range operatorFamilies {
+		byLexeme := make(map[string]fmt.Stringer, len(ops))
+		for _, op := range ops {
+			lexeme := op.String()
+			if lexeme == "" || strings.HasPrefix(lexeme, "token(") {
+				t.Errorf("%s %#v has no lexeme: %q", name, op, lexeme)
+				continue
+			}
+			if prev, ok := byLexeme[lexeme]; ok {
+				t.Errorf("%s %#v and %#v share the lexeme %q",
+					name, prev, op, lexeme)
+				continue
+			}
+			byLexeme[lexeme] = op
+		}
+		for _, op := range ops {
+			if got := byLexeme[op.String()]; got != op {
+				t.Errorf("%s %q parsed back as %#v, want %#v",
+					name, op.String(), got, op)
+			}
+		}
+	}
+}
+
+func TestTokenStrings(t *testing.T) {
+	t.Parallel()
+	// Every token after the literal kinds stands for a fixed lexeme,
+	// which must be unique so that the lexer and printer agree on it.
+	seen := make(map[string]token)
+	for tok := sglQuote; tok <= globExcl; tok++ {
+		lexeme := tok.String()
+		if lexeme == "" || strings.HasPrefix(lexeme, "token(") {
+			t.Errorf("token %d has no lexeme: %q", tok, lexeme)
+			continue
+		}
+		if prev, ok := seen[lexeme]; ok {
+			t.Errorf("tokens %d and %d share the lexeme %q", prev, tok, lexeme)
+			continue
+		}
+		seen[lexeme] = tok
+	}
+	if got := (globExcl + 1).String(); !strings.HasPrefix(got, "token(") {
+		t.Errorf("token list is out of sync with token_string.go: %q", got)
+	}
+}
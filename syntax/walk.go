@@ -227,6 +227,36 @@ func Walk(node Node, f func(Node) bool) {
 	f(nil)
 }
 
+// Walk is a shortcut for Walk(f, fn), traversing the entire file.
+func (f *File) Walk(fn func(Node) bool) {
+	Walk(f, fn)
+}
+
+// Commands calls fn for each simple command in the file which runs a program,
+// builtin, or function, in the order they appear in the source. Commands nested
+// anywhere within the file are included, such as those inside compound
+// commands, function bodies, and command or process substitutions. Use the
+// command's Pos and End methods to find where it is.
+//
+// Calls which consist of variable assignments alone are skipped, since they
+// invoke no command. Declaration builtins like declare and export, and the let
+// builtin, have their own nodes and are skipped too.
+//
+// If fn returns false, the traversal stops.
+func (f *File) Commands(fn func(*CallExpr) bool) {
+	stop := false
+	Walk(f, func(node Node) bool {
+		if stop {
+			return false
+		}
+		if ce, ok := node.(*CallExpr); ok && len(ce.Args) > 0 && !fn(ce) {
+			stop = true
+			return false
+		}
+		return true
+	})
+}
+
 // DebugPrint prints the provided syntax tree, spanning multiple lines and with
 // indentation. Can be useful to investigate the content of a syntax tree.
 func DebugPrint(w io.Writer, node Node) error {
@@ -295,10 +325,16 @@ func (p *debugPrinter) print(x reflect.Value) {
 		p.printf("%s {", t)
 		p.level++
 		p.newline()
+		var fields []int
 		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" { // skip unexported fields
+				fields = append(fields, i)
+			}
+		}
+		for j, i := range fields {
 			p.printf("%s: ", t.Field(i).Name)
 			p.print(x.Field(i))
-			if i == x.NumField()-1 {
+			if j == len(fields)-1 {
 				p.level--
 			}
 			p.newline()
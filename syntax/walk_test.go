@@ -122,3 +122,58 @@ func TestWalkUnexpectedType(t *testing.T) {
 		return true
 	})
 }
+
+var fileCommandsTests = []struct {
+	in   string
+	want []string
+}{
+	{"", nil},
+	{"a=b", nil},
+	{"foo; a=b bar x", []string{"1:1 foo", "1:6 a=b bar x"}},
+	{"if foo; then bar; fi", []string{"1:4 foo", "1:14 bar"}},
+	{"f() { foo | bar; }\nwhile baz; do :; done", []string{
+		"1:7 foo", "1:13 bar", "2:7 baz", "2:15 :",
+	}},
+	{"echo $(foo) <(bar)", []string{"1:1 echo $(foo) <(bar)", "1:8 foo", "1:15 bar"}},
+	{"declare a=$(foo); let x++", []string{"1:13 foo"}},
+}
+
+func TestFileCommands(t *testing.T) {
+	t.Parallel()
+	parser := NewParser()
+	printer := NewPrinter()
+	for i, tc := range fileCommandsTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			f.Commands(func(ce *CallExpr) bool {
+				var sb strings.Builder
+				if err := printer.Print(&sb, ce); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fmt.Sprintf("%s %s", ce.Pos(), sb.String()))
+				return true
+			})
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Commands mismatch:\nwant: %q\ngot:  %q", tc.want, got)
+			}
+		})
+	}
+	t.Run("Stop", func(t *testing.T) {
+		f, err := parser.Parse(strings.NewReader("foo; { bar; baz; }"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		f.Commands(func(ce *CallExpr) bool {
+			got = append(got, ce.Args[0].Lit())
+			return len(got) < 2
+		})
+		if want := []string{"foo", "bar"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Commands mismatch:\nwant: %q\ngot:  %q", want, got)
+		}
+	})
+}